@@ -0,0 +1,117 @@
+package main
+
+import (
+        "errors"
+        "testing"
+        "time"
+
+        "github.com/gorilla/websocket"
+)
+
+func TestEnqueueSkipsChunksForLaggingClient(t *testing.T) {
+        am := newTestManager(t)
+        session := &ClientSession{}
+        session.writer = &clientWriter{session: session, queue: make(chan outboundMessage, 4)}
+        chunk := Message{Type: "command_output_chunk"}
+        status := Message{Type: "agent_status"}
+
+        am.enqueueLocked(nil, session, chunk, nil)
+        am.enqueueLocked(nil, session, chunk, nil)
+        for i := 0; i < 10; i++ {
+                am.enqueueLocked(nil, session, chunk, nil)
+        }
+        if got := len(session.writer.queue); got != 2 {
+                t.Fatalf("queued %d messages, want 2 chunks", got)
+        }
+        if got := am.broadcastStats.droppedChunks.Load(); got != 10 {
+                t.Errorf("dropped %d chunks, want 10", got)
+        }
+
+        am.enqueueLocked(nil, session, status, nil)
+        am.enqueueLocked(nil, session, status, nil)
+        if got := len(session.writer.queue); got != 4 {
+                t.Errorf("queued %d messages, want the status updates let through", got)
+        }
+        if session.writer.dropped.Load() || am.broadcastStats.dropped.Load() != 0 {
+                t.Error("client dropped for output chunks")
+        }
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClientWriterRetriesTransientErrors(t *testing.T) {
+        for _, tc := range []struct {
+                name     string
+                failures int
+                err      error
+                attempts int
+                ok       bool
+        }{
+                {"recovers", 2, timeoutError{}, 3, true},
+                {"gives up", 10, timeoutError{}, wsWriteRetries + 1, false},
+                {"fatal", 10, errors.New("broken pipe"), 1, false},
+        } {
+                t.Run(tc.name, func(t *testing.T) {
+                        attempts := 0
+                        w := &clientWriter{write: func([]byte) error {
+                                attempts++
+                                if attempts <= tc.failures {
+                                        return tc.err
+                                }
+                                return nil
+                        }}
+                        err := w.writeWithRetry([]byte("{}"))
+                        if (err == nil) != tc.ok || attempts != tc.attempts {
+                                t.Errorf("err = %v after %d attempts, want ok=%v after %d", err, attempts, tc.ok, tc.attempts)
+                        }
+                })
+        }
+}
+
+func TestDetachWaitsForWriterDrain(t *testing.T) {
+        am := newTestManager(t, "WS_RECONNECT_GRACE_MS", "10000")
+        conn := &websocket.Conn{}
+        session := &ClientSession{Token: "t"}
+        writing, release := make(chan struct{}), make(chan struct{})
+        session.writer = &clientWriter{session: session, queue: make(chan outboundMessage, 4), done: make(chan struct{})}
+        session.writer.write = func([]byte) error {
+                close(writing)
+                <-release
+                return nil
+        }
+        am.clients[conn] = session
+        go am.runClientWriter(session.writer)
+
+        for _, msgType := range []string{"first", "second", "third"} {
+                am.enqueueLocked(conn, session, Message{Type: msgType}, nil)
+        }
+        <-writing
+
+        detached := make(chan struct{})
+        go func() {
+                am.detachClient(conn)
+                close(detached)
+        }()
+        time.Sleep(50 * time.Millisecond)
+        am.clientLock.RLock()
+        _, resumable := am.detached["t"]
+        am.clientLock.RUnlock()
+        if resumable {
+                t.Fatal("session resumable while its writer was still draining")
+        }
+
+        close(release)
+        <-detached
+        missed := session.takeMissed()
+        if len(missed) != 2 || missed[0].Type != "second" || missed[1].Type != "third" {
+                t.Errorf("missed = %+v, want second and third in order", missed)
+        }
+        if _, ok := am.detached["t"]; !ok {
+                t.Error("session not kept for reconnect")
+        }
+}
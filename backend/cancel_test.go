@@ -0,0 +1,48 @@
+package main
+
+import (
+        "errors"
+        "testing"
+        "time"
+)
+
+func TestCancelAfterExitIsNotCounted(t *testing.T) {
+        am := newDispatchManager(t)
+        run := am.trackCommand(1, 7, "echo done", func() {})
+        am.markExited(run)
+
+        if _, err := am.CancelCommand(0, 7); !errors.Is(err, errNoRunningCommand) {
+                t.Errorf("CancelCommand after exit = %v, want errNoRunningCommand", err)
+        }
+        if am.takeCancellation(7) {
+                t.Error("item marked cancelled after its process had exited")
+        }
+}
+
+func TestCancelStopsPreCheck(t *testing.T) {
+        am := newTestManager(t, "PRECHECK_TIMEOUT_MS", "30000")
+        id := newTestAgent(t, am, AgentSpec{})
+        am.queueLock.Lock()
+        am.lastIndex = 1
+        am.queue = append(am.queue, QueueItem{Index: 1, Command: "RUN echo main", Status: "pending", PreCheck: "sleep 30"})
+        am.queueLock.Unlock()
+        am.StartAgentLoop(id)
+
+        deadline := time.Now().Add(5 * time.Second)
+        for {
+                if _, err := am.CancelCommand(0, 1); err == nil {
+                        break
+                }
+                if time.Now().After(deadline) {
+                        t.Fatal("pre-check never showed up as running")
+                }
+                time.Sleep(20 * time.Millisecond)
+        }
+
+        for status := ""; status != "cancelled"; time.Sleep(20 * time.Millisecond) {
+                if time.Now().After(deadline) {
+                        t.Fatalf("item status %q, want cancelled", status)
+                }
+                status = am.GetQueueList()[0].Status
+        }
+}
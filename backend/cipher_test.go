@@ -0,0 +1,31 @@
+package main
+
+import (
+        "strings"
+        "testing"
+)
+
+func TestOutputCipherRoundTrip(t *testing.T) {
+        c, err := newOutputCipher(strings.Repeat("ab", 32))
+        if err != nil {
+                t.Fatal(err)
+        }
+        sealed, err := c.Seal("secret output")
+        if err != nil {
+                t.Fatal(err)
+        }
+        if !strings.HasPrefix(sealed, encryptedPrefix) || strings.Contains(sealed, "secret") {
+                t.Errorf("sealed = %q", sealed)
+        }
+        if got := c.Open(sealed); got != "secret output" {
+                t.Errorf("Open = %q", got)
+        }
+
+        var none *outputCipher
+        if plain, err := none.Seal("plain"); err != nil || plain != "plain" {
+                t.Errorf("nil cipher Seal = %q, %v", plain, err)
+        }
+        if got := none.Open(sealed); !strings.Contains(got, "OUTPUT_ENCRYPTION_KEY") {
+                t.Errorf("nil cipher Open = %q", got)
+        }
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+        "os"
+        "path/filepath"
+        "slices"
+        "testing"
+)
+
+func TestReloadConfigKeepsRuntimeSafeMode(t *testing.T) {
+        path := filepath.Join(t.TempDir(), "policy.json")
+        os.WriteFile(path, []byte(`{"denylist": []}`), 0o644)
+        am := newTestManager(t, "SAFE_MODE", "", "COMMAND_POLICY_FILE", path, "COMMAND_DENYLIST", "", "COMMAND_ALLOWLIST", "")
+        am.SetSafeMode(true)
+
+        os.WriteFile(path, []byte(`{"denylist": ["^reboot$"]}`), 0o644)
+        if reload := am.ReloadConfig(); len(reload.Applied) == 0 {
+                t.Fatal("reload applied nothing")
+        }
+        if !am.safeMode.Load() {
+                t.Error("reload reverted safe mode set at runtime")
+        }
+}
+
+func TestReloadConfigRereadsPolicyFile(t *testing.T) {
+        path := filepath.Join(t.TempDir(), "policy.json")
+        os.WriteFile(path, []byte(`{"denylist": []}`), 0o644)
+        am := newTestManager(t, "COMMAND_POLICY_FILE", path, "COMMAND_DENYLIST", "", "COMMAND_ALLOWLIST", "")
+        if reason := am.config().commandPolicy.blocks("reboot"); reason != "" {
+                t.Fatalf("blocked before the policy changed: %s", reason)
+        }
+
+        os.WriteFile(path, []byte(`{"denylist": ["^reboot$"]}`), 0o644)
+        reload := am.ReloadConfig()
+        if reason := am.config().commandPolicy.blocks("reboot"); reason == "" {
+                t.Error("policy file change not picked up")
+        }
+        if !slices.Contains(reload.Applied, "COMMAND_POLICY_FILE") {
+                t.Errorf("applied = %v, want COMMAND_POLICY_FILE", reload.Applied)
+        }
+
+        if reload := am.ReloadConfig(); len(reload.Applied) != 0 {
+                t.Errorf("unchanged reload applied %v", reload.Applied)
+        }
+}
+
+func TestConfigTableSource(t *testing.T) {
+        am := newTestManager(t, "MAX_COMMAND_LENGTH", "100", "BACKEND_PORT", "", "ADMIN_TOKEN", "secret")
+        fake := useFakeDB(t, am)
+        t.Cleanup(func() {
+                am.reloadLock.Lock()
+                am.restoreShadowedEnv()
+                am.reloadLock.Unlock()
+        })
+        source := func(key string) string {
+                for _, setting := range am.EffectiveConfig() {
+                        if setting.Key == key {
+                                return setting.Source
+                        }
+                }
+                return ""
+        }
+
+        fake.config["MAX_COMMAND_LENGTH"] = "50"
+        fake.config["BACKEND_PORT"] = "9999"
+        fake.config["ADMIN_TOKEN"] = "from-db"
+        reload := am.ReloadConfig()
+        if !slices.Contains(reload.Applied, "MAX_COMMAND_LENGTH") || am.config().maxCommandLength != 50 {
+                t.Fatalf("applied %v, limit %d; want the config table's 50", reload.Applied, am.config().maxCommandLength)
+        }
+        if got := source("MAX_COMMAND_LENGTH"); got != "db" {
+                t.Errorf("MAX_COMMAND_LENGTH source = %q, want db", got)
+        }
+        if os.Getenv("BACKEND_PORT") != "" || os.Getenv("ADMIN_TOKEN") != "secret" {
+                t.Error("config table overrode a restart-only setting or a secret")
+        }
+
+        delete(fake.config, "MAX_COMMAND_LENGTH")
+        am.ReloadConfig()
+        if am.config().maxCommandLength != 100 || source("MAX_COMMAND_LENGTH") != "env" {
+                t.Errorf("after the row was deleted: limit %d from %s, want 100 from env",
+                        am.config().maxCommandLength, source("MAX_COMMAND_LENGTH"))
+        }
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+        "slices"
+        "testing"
+)
+
+// newDispatchManager returns a manager whose agent loops do not run, so
+// tests can claim queue items themselves.
+func newDispatchManager(t *testing.T, env ...string) *AgentManager {
+        t.Helper()
+        am := newTestManager(t, env...)
+        am.running.Store(false)
+        return am
+}
+
+func TestFIFOAgentWaitsForRunningHead(t *testing.T) {
+        am := newDispatchManager(t)
+        id := newTestAgent(t, am, AgentSpec{FIFO: true, MaxConcurrent: 2})
+        am.queue = []QueueItem{
+                {Index: 1, Command: "RUN echo 1", Status: "pending", PinnedAgent: id, Priority: 0},
+                {Index: 2, Command: "RUN echo 2", Status: "pending", PinnedAgent: id, Priority: 10},
+        }
+
+        if item := am.claimNextQueueItem(id); item == nil || item.Index != 1 {
+                t.Fatalf("first claim = %+v, want item 1", item)
+        }
+        if item := am.claimNextQueueItem(id); item != nil {
+                t.Fatalf("claimed item %d while the FIFO head was still running", item.Index)
+        }
+        am.finishQueueItem(1, "completed", "")
+        if item := am.claimNextQueueItem(id); item == nil || item.Index != 2 {
+                t.Fatalf("claim after the head finished = %+v, want item 2", item)
+        }
+}
+
+// diamondQueue returns a queue where 2 and 3 depend on 1 and 4 on both.
+func diamondQueue() []QueueItem {
+        return []QueueItem{
+                {Index: 1, Command: "RUN echo a", Status: "pending"},
+                {Index: 2, Command: "RUN echo b", Status: "pending", DependsOn: []int{1}},
+                {Index: 3, Command: "RUN echo c", Status: "pending", DependsOn: []int{1}},
+                {Index: 4, Command: "RUN echo d", Status: "pending", DependsOn: []int{2, 3}},
+        }
+}
+
+func queueStatuses(am *AgentManager) []string {
+        var statuses []string
+        for _, item := range am.GetQueueList() {
+                statuses = append(statuses, item.Status)
+        }
+        return statuses
+}
+
+func TestSkipBlockedDiamond(t *testing.T) {
+        for _, tc := range []struct {
+                name   string
+                set    map[int]string
+                expect []string
+        }{
+                {"root failed", map[int]string{1: "failed"}, []string{"failed", "skipped", "skipped", "skipped"}},
+                {"root interrupted", map[int]string{1: "interrupted"}, []string{"interrupted", "skipped", "skipped", "skipped"}},
+                {"one branch failed", map[int]string{1: "completed", 2: "failed"}, []string{"completed", "failed", "pending", "skipped"}},
+                {"one branch cancelled, other running", map[int]string{1: "completed", 2: "running", 3: "cancelled"}, []string{"completed", "running", "cancelled", "skipped"}},
+                {"root disabled", map[int]string{1: "disabled"}, []string{"disabled", "pending", "pending", "pending"}},
+                {"both branches done", map[int]string{1: "completed", 2: "completed", 3: "completed"}, []string{"completed", "completed", "completed", "pending"}},
+        } {
+                t.Run(tc.name, func(t *testing.T) {
+                        am := newDispatchManager(t)
+                        am.queue = diamondQueue()
+                        for i := range am.queue {
+                                if status, ok := tc.set[am.queue[i].Index]; ok {
+                                        am.queue[i].Status = status
+                                }
+                        }
+                        am.queueLock.Lock()
+                        am.skipBlockedLocked(am.queuePositionsLocked())
+                        am.queueLock.Unlock()
+                        if got := queueStatuses(am); !slices.Equal(got, tc.expect) {
+                                t.Errorf("statuses = %v, want %v", got, tc.expect)
+                        }
+                })
+        }
+}
+
+func TestDiamondDispatchOrder(t *testing.T) {
+        am := newDispatchManager(t)
+        id := newTestAgent(t, am, AgentSpec{MaxConcurrent: 4})
+        am.queue = diamondQueue()
+
+        claim := func() int {
+                if item := am.claimNextQueueItem(id); item != nil {
+                        return item.Index
+                }
+                return 0
+        }
+        if got := claim(); got != 1 {
+                t.Fatalf("first claim = %d, want 1", got)
+        }
+        if got := claim(); got != 0 {
+                t.Fatalf("claimed %d before the root finished", got)
+        }
+        am.finishQueueItem(1, "completed", "")
+        first, second := claim(), claim()
+        if first+second != 5 {
+                t.Fatalf("claimed %d and %d, want the two branches", first, second)
+        }
+        if got := claim(); got != 0 {
+                t.Fatalf("claimed %d before both branches finished", got)
+        }
+        am.finishQueueItem(2, "completed", "")
+        if got := claim(); got != 0 {
+                t.Fatalf("claimed %d with one branch still running", got)
+        }
+        am.finishQueueItem(3, "completed", "")
+        if got := claim(); got != 4 {
+                t.Fatalf("claim after both branches = %d, want 4", got)
+        }
+}
+
+func TestRetryBudgetCountsEarlierRetries(t *testing.T) {
+        am := newDispatchManager(t)
+        am.queue = []QueueItem{
+                {Index: 1, Command: "RUN a", Status: "pending", BatchID: "b", RetryCount: 2},
+                {Index: 2, Command: "RUN b", Status: "pending", BatchID: "b", FailoverCount: 1, TimeoutRetries: 1},
+        }
+        budget, err := am.SetBatchRetryBudget("b", 5)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if budget.Used != 4 || budget.Remaining != 1 {
+                t.Errorf("budget = %+v, want 4 used and 1 remaining", budget)
+        }
+}
+
+func TestDependenciesOutsideTheQueue(t *testing.T) {
+        am := newDispatchManager(t)
+        fake := useFakeDB(t, am)
+        fake.statuses[5] = "completed"
+        fake.statuses[6] = "failed"
+        am.queue = []QueueItem{
+                {ID: 10, Index: 1, Command: "RUN echo a", Status: "pending", DependsOn: []int{5}},
+                {ID: 11, Index: 2, Command: "RUN echo b", Status: "pending", DependsOn: []int{6}},
+                {ID: 12, Index: 3, Command: "RUN echo c", Status: "pending", DependsOn: []int{7}},
+        }
+
+        am.queueLock.Lock()
+        positions := am.queuePositionsLocked()
+        am.skipBlockedLocked(positions)
+        met := am.dependenciesMetLocked(&am.queue[0], positions)
+        am.queueLock.Unlock()
+        if !met {
+                t.Error("dependency completed in the database counted as unmet")
+        }
+        if got := queueStatuses(am); !slices.Equal(got, []string{"pending", "skipped", "skipped"}) {
+                t.Errorf("statuses = %v, want the failed and missing dependencies skipped", got)
+        }
+        if out := am.queue[2].Output; out != "dependency 7 not found" {
+                t.Errorf("output = %q", out)
+        }
+
+        result := am.AddToQueue(map[string]string{"1": "RUN echo d", "2": "RUN echo e"}, map[string]queueEntry{
+                "1": {DependsOn: []int{5}},
+                "2": {DependsOn: []int{8}},
+        })
+        if len(result.Added) != 1 || !slices.Equal(result.Failed, []int{2}) {
+                t.Errorf("result = %+v, want the database dependency accepted and the unknown one rejected", result)
+        }
+}
+
+func TestMissingDependencyIsNotMetWithoutDatabase(t *testing.T) {
+        am := newDispatchManager(t)
+        id := newTestAgent(t, am, AgentSpec{})
+        am.queue = []QueueItem{{Index: 2, Command: "RUN echo b", Status: "pending", DependsOn: []int{1}}}
+
+        if item := am.claimNextQueueItem(id); item != nil {
+                t.Fatalf("claimed %d although its dependency is gone", item.Index)
+        }
+        if status := am.queue[0].Status; status != "skipped" {
+                t.Errorf("status = %q, want skipped", status)
+        }
+}
+
+func TestGetNextBatchOrder(t *testing.T) {
+        am := newDispatchManager(t)
+        // Slice order differs from enqueue order, as after a reload or retry.
+        am.queue = []QueueItem{
+                {Index: 4, Command: "RUN low late", Status: "pending", Priority: 0},
+                {Index: 5, Command: "RUN high late", Status: "pending", Priority: 10},
+                {Index: 1, Command: "RUN low early", Status: "pending", Priority: 0},
+                {Index: 3, Command: "RUN mid", Status: "pending", Priority: 5},
+                {Index: 2, Command: "RUN high early", Status: "pending", Priority: 10},
+                {Index: 6, Command: "RUN negative", Status: "pending", Priority: -1},
+        }
+
+        var order []int
+        for _, size := range []int{2, 3, 5} {
+                for _, item := range am.GetNextBatch(size) {
+                        order = append(order, item.Index)
+                }
+        }
+        if want := []int{2, 5, 3, 1, 4, 6}; !slices.Equal(order, want) {
+                t.Errorf("dequeued %v, want %v", order, want)
+        }
+}
+
+func TestGetNextBatchOrderByID(t *testing.T) {
+        am := newDispatchManager(t)
+        // With persistence, row ids rather than indexes give enqueue order.
+        am.queue = []QueueItem{
+                {ID: 30, Index: 1, Command: "RUN c", Status: "pending", Priority: 1},
+                {ID: 10, Index: 3, Command: "RUN a", Status: "pending", Priority: 1},
+                {ID: 20, Index: 2, Command: "RUN b", Status: "pending", Priority: 1},
+        }
+
+        var order []int
+        for _, item := range am.GetNextBatch(3) {
+                order = append(order, item.ID)
+        }
+        if want := []int{10, 20, 30}; !slices.Equal(order, want) {
+                t.Errorf("dequeued ids %v, want %v", order, want)
+        }
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+        "context"
+        "database/sql"
+        "database/sql/driver"
+        "io"
+        "strings"
+        "sync"
+        "testing"
+)
+
+// fakeQueueDB is a database/sql driver for the statements tests care about:
+// queue status lookups answer from statuses, queue inserts hand out ids or
+// fail with insertErr, and the config table reads back config. Every other
+// statement succeeds without effect.
+type fakeQueueDB struct {
+        mu        sync.Mutex
+        statuses  map[int]string
+        insertErr error
+        nextID    int
+        config    map[string]string
+}
+
+// useFakeDB connects am to a fresh fakeQueueDB with persistence on.
+func useFakeDB(t *testing.T, am *AgentManager) *fakeQueueDB {
+        t.Helper()
+        fake := &fakeQueueDB{statuses: make(map[int]string), nextID: 100, config: make(map[string]string)}
+        db := sql.OpenDB(fake)
+        t.Cleanup(func() {
+                am.hotPool.Store(nil)
+                db.Close()
+        })
+        am.hotPool.Store(db)
+        am.stateLoaded.Store(true)
+        return fake
+}
+
+func (f *fakeQueueDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeQueueDB) Driver() driver.Driver                        { return f }
+func (f *fakeQueueDB) Open(string) (driver.Conn, error)             { return fakeConn{f}, nil }
+
+func (f *fakeQueueDB) query(query string, args []driver.Value) (driver.Rows, error) {
+        f.mu.Lock()
+        defer f.mu.Unlock()
+        switch {
+        case strings.Contains(query, "SELECT status FROM queue"):
+                status, ok := f.statuses[int(args[0].(int64))]
+                if !ok {
+                        return &fakeRows{}, nil
+                }
+                return &fakeRows{rows: [][]driver.Value{{status}}}, nil
+        case strings.Contains(query, "INSERT INTO queue"):
+                if f.insertErr != nil {
+                        return nil, f.insertErr
+                }
+                f.nextID++
+                return &fakeRows{rows: [][]driver.Value{{int64(f.nextID)}}}, nil
+        case strings.Contains(query, "FROM config"):
+                rows := &fakeRows{columns: 2}
+                for key, value := range f.config {
+                        rows.rows = append(rows.rows, []driver.Value{key, value})
+                }
+                return rows, nil
+        }
+        return &fakeRows{}, nil
+}
+
+type fakeConn struct{ db *fakeQueueDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+        db    *fakeQueueDB
+        query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+        return driver.RowsAffected(1), nil
+}
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+        return s.db.query(s.query, args)
+}
+
+// fakeRows returns rows in order; columns is only needed when there may be
+// none to count them from.
+type fakeRows struct {
+        rows    [][]driver.Value
+        columns int
+}
+
+func (r *fakeRows) Columns() []string {
+        n := r.columns
+        if len(r.rows) > 0 {
+                n = len(r.rows[0])
+        }
+        columns := make([]string, n)
+        for i := range columns {
+                columns[i] = "c"
+        }
+        return columns
+}
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+        if len(r.rows) == 0 {
+                return io.EOF
+        }
+        copy(dest, r.rows[0])
+        r.rows = r.rows[1:]
+        return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+        "reflect"
+        "testing"
+)
+
+func TestSaveGroupKeepsAgentOverrides(t *testing.T) {
+        am := newTestManager(t)
+        if _, err := am.SaveGroup(AgentGroup{
+                Name:       "build",
+                Labels:     []string{"linux"},
+                Env:        map[string]string{"GOOS": "linux", "CC": "gcc"},
+                WorkingDir: "/srv/build",
+                Weight:     1,
+        }, false); err != nil {
+                t.Fatal(err)
+        }
+        newTestAgent(t, am, AgentSpec{Name: "inherits", Group: "build"})
+        newTestAgent(t, am, AgentSpec{
+                Name:       "overrides",
+                Group:      "build",
+                Labels:     []string{"gpu"},
+                Env:        map[string]string{"CC": "clang", "EXTRA": "1"},
+                WorkingDir: "/home/ci",
+                Weight:     5,
+        })
+
+        updated, err := am.SaveGroup(AgentGroup{
+                Name:            "build",
+                Labels:          []string{"linux", "amd64"},
+                Env:             map[string]string{"GOOS": "linux", "CC": "gcc-13", "CGO_ENABLED": "0"},
+                WorkingDir:      "/srv/build2",
+                Weight:          2,
+                AllowedCommands: []string{"make"},
+        }, true)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if updated != 2 {
+                t.Fatalf("updated %d agents, want 2", updated)
+        }
+
+        inherits := am.findAgentByName("inherits")
+        if want := []string{"linux", "amd64"}; !reflect.DeepEqual(inherits.Labels, want) {
+                t.Errorf("inherited labels = %v, want %v", inherits.Labels, want)
+        }
+        if want := map[string]string{"GOOS": "linux", "CC": "gcc-13", "CGO_ENABLED": "0"}; !reflect.DeepEqual(inherits.Env, want) {
+                t.Errorf("inherited env = %v, want %v", inherits.Env, want)
+        }
+        if inherits.WorkingDir != "/srv/build2" || inherits.Weight != 2 {
+                t.Errorf("inherited working dir, weight = %q, %d", inherits.WorkingDir, inherits.Weight)
+        }
+
+        overrides := am.findAgentByName("overrides")
+        if want := []string{"gpu"}; !reflect.DeepEqual(overrides.Labels, want) {
+                t.Errorf("overridden labels = %v, want %v", overrides.Labels, want)
+        }
+        if want := map[string]string{"GOOS": "linux", "CC": "clang", "EXTRA": "1", "CGO_ENABLED": "0"}; !reflect.DeepEqual(overrides.Env, want) {
+                t.Errorf("overridden env = %v, want %v", overrides.Env, want)
+        }
+        if overrides.WorkingDir != "/home/ci" || overrides.Weight != 5 {
+                t.Errorf("overridden working dir, weight = %q, %d", overrides.WorkingDir, overrides.Weight)
+        }
+        if want := []string{"make"}; !reflect.DeepEqual(overrides.AllowedCommands, want) {
+                t.Errorf("allowed commands = %v, want %v", overrides.AllowedCommands, want)
+        }
+}
+
+func TestDeleteGroupRacingAddAgent(t *testing.T) {
+        for range 50 {
+                am := newTestManager(t)
+                if _, err := am.SaveGroup(AgentGroup{Name: "workers"}, false); err != nil {
+                        t.Fatal(err)
+                }
+                added := make(chan *Agent)
+                go func() { added <- am.AddAgentWithSpec(AgentSpec{Name: "w", Group: "workers"}) }()
+                err := am.DeleteGroup("workers")
+                <-added
+
+                if _, exists := am.GetGroup("workers"); err == nil && exists {
+                        t.Fatal("DeleteGroup succeeded but the group is still there")
+                }
+                if err == nil {
+                        for _, agent := range am.GetAgents() {
+                                if agent.Group == "workers" {
+                                        t.Fatalf("agent %d belongs to deleted group", agent.ID)
+                                }
+                        }
+                }
+        }
+}
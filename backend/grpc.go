@@ -0,0 +1,349 @@
+//go:build grpc
+
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "log"
+        "net"
+        "os"
+        "slices"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+
+        "ai-backend/axshellpb"
+
+        "google.golang.org/grpc"
+        "google.golang.org/grpc/codes"
+        "google.golang.org/grpc/metadata"
+        "google.golang.org/grpc/status"
+        "google.golang.org/protobuf/types/known/structpb"
+)
+
+// The gRPC API (axshellpb/axshell.proto) is only compiled with -tags grpc
+// and only served when GRPC_PORT is set:
+//
+//      GRPC_PORT=9090 go run -tags grpc .
+//
+// It takes the same BACKEND_API_KEY as the REST API, as "authorization:
+// Bearer <key>" metadata.
+
+func init() {
+        extraServers = append(extraServers, startGRPCServer)
+}
+
+// grpcEventBuffer is how many events a StreamEvents call may fall behind
+// before it starts missing them.
+const grpcEventBuffer = 256
+
+func startGRPCServer() func() {
+        port := os.Getenv("GRPC_PORT")
+        if port == "" {
+                return func() {}
+        }
+
+        listener, err := net.Listen("tcp", ":"+port)
+        if err != nil {
+                log.Fatalf("gRPC server cannot listen on port %s: %v", port, err)
+        }
+        server := grpc.NewServer(
+                grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+                        if err := grpcAuthorize(ctx); err != nil {
+                                return nil, err
+                        }
+                        return handler(ctx, req)
+                }),
+                grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+                        if err := grpcAuthorize(stream.Context()); err != nil {
+                                return err
+                        }
+                        return handler(srv, stream)
+                }),
+        )
+        axshellpb.RegisterAxShellServer(server, &grpcServer{am: manager})
+
+        go func() {
+                if err := server.Serve(listener); err != nil {
+                        log.Printf("gRPC server stopped: %v", err)
+                }
+        }()
+        log.Printf("gRPC endpoint: localhost:%s", port)
+
+        // Event streams only end when their client goes away, so a graceful
+        // stop would wait for them forever.
+        return server.Stop
+}
+
+func grpcAuthorize(ctx context.Context) error {
+        key := apiKey()
+        if key == "" {
+                return nil
+        }
+        md, _ := metadata.FromIncomingContext(ctx)
+        for _, value := range md.Get("authorization") {
+                if given, ok := strings.CutPrefix(value, "Bearer "); ok && validAPIKey(given, key) {
+                        return nil
+                }
+        }
+        return status.Error(codes.Unauthenticated, "missing or invalid API key")
+}
+
+// grpcServer implements the AxShell service on top of the same
+// AgentManager methods the REST and WebSocket handlers use.
+type grpcServer struct {
+        axshellpb.UnimplementedAxShellServer
+        am *AgentManager
+}
+
+func (s *grpcServer) ListAgents(ctx context.Context, req *axshellpb.ListAgentsRequest) (*axshellpb.ListAgentsResponse, error) {
+        agents := s.am.GetAgents()
+        sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+
+        resp := &axshellpb.ListAgentsResponse{}
+        for _, agent := range agents {
+                resp.Agents = append(resp.Agents, agentToProto(agent))
+        }
+        return resp, nil
+}
+
+func (s *grpcServer) AddAgent(ctx context.Context, req *axshellpb.AddAgentRequest) (*axshellpb.Agent, error) {
+        if req.Name == "" {
+                return nil, status.Error(codes.InvalidArgument, "name is required")
+        }
+        if _, ok := s.am.GetGroup(req.Group); req.Group != "" && !ok {
+                return nil, status.Errorf(codes.InvalidArgument, "unknown agent group %q", req.Group)
+        }
+        if err := checkEnv(req.Env); err != nil {
+                return nil, status.Error(codes.InvalidArgument, err.Error())
+        }
+
+        agent := s.am.AddAgentWithSpec(AgentSpec{
+                Name:          req.Name,
+                Labels:        req.Labels,
+                WorkingDir:    req.WorkingDir,
+                Env:           req.Env,
+                Weight:        int(req.Weight),
+                Group:         req.Group,
+                FIFO:          req.Fifo,
+                MaxConcurrent: int(req.MaxConcurrent),
+        })
+        if agent == nil {
+                return nil, status.Error(codes.ResourceExhausted, "max agents reached")
+        }
+        s.am.StartAgentLoop(agent.ID)
+        return agentToProto(agent), nil
+}
+
+func (s *grpcServer) RemoveAgent(ctx context.Context, req *axshellpb.RemoveAgentRequest) (*axshellpb.RemoveAgentResponse, error) {
+        if !s.am.RemoveAgent(int(req.Id)) {
+                return nil, status.Errorf(codes.NotFound, "agent %d not found", req.Id)
+        }
+        return &axshellpb.RemoveAgentResponse{}, nil
+}
+
+func (s *grpcServer) Enqueue(ctx context.Context, req *axshellpb.EnqueueRequest) (*axshellpb.EnqueueResponse, error) {
+        if len(req.Entries) == 0 {
+                return nil, status.Error(codes.InvalidArgument, "entries must not be empty")
+        }
+
+        commands := make(map[string]string, len(req.Entries))
+        entries := make(map[string]queueEntry, len(req.Entries))
+        for i, e := range req.Entries {
+                key := strconv.Itoa(i + 1)
+                if err := checkEnv(e.Env); err != nil {
+                        return nil, status.Errorf(codes.InvalidArgument, "entry %s: %v", key, err)
+                }
+                schedule := map[string]any{}
+                if e.RunAt != "" {
+                        schedule["run_at"] = e.RunAt
+                }
+                if e.DelayMs != 0 {
+                        schedule["delay_ms"] = float64(e.DelayMs)
+                }
+                runAt, err := parseSchedule(schedule)
+                if err != nil {
+                        return nil, status.Errorf(codes.InvalidArgument, "entry %s: %v", key, err)
+                }
+                entry := queueEntry{Env: e.Env, WorkingDir: e.WorkingDir, RunAt: runAt}
+                if e.MaxRetries != nil {
+                        if *e.MaxRetries < 0 {
+                                return nil, status.Errorf(codes.InvalidArgument, "entry %s has a negative max_retries", key)
+                        }
+                        retries := int(*e.MaxRetries)
+                        entry.MaxRetries = &retries
+                }
+                commands[key] = e.Command
+                entries[key] = entry
+        }
+
+        result := s.am.AddToQueue(commands, entries)
+        resp := &axshellpb.EnqueueResponse{
+                Status:  result.Status,
+                BatchId: result.BatchID,
+        }
+        for i := range result.Added {
+                resp.Added = append(resp.Added, queueItemToProto(&result.Added[i]))
+        }
+        for _, key := range result.Failed {
+                resp.Failed = append(resp.Failed, int64(key))
+        }
+        if len(result.Errors) > 0 {
+                resp.Errors = make(map[int64]string, len(result.Errors))
+                for key, msg := range result.Errors {
+                        resp.Errors[int64(key)] = msg
+                }
+        }
+        return resp, nil
+}
+
+func (s *grpcServer) ListQueue(ctx context.Context, req *axshellpb.ListQueueRequest) (*axshellpb.ListQueueResponse, error) {
+        s.am.queueLock.RLock()
+        defer s.am.queueLock.RUnlock()
+
+        resp := &axshellpb.ListQueueResponse{}
+        for i := range s.am.queue {
+                resp.Items = append(resp.Items, queueItemToProto(&s.am.queue[i]))
+        }
+        return resp, nil
+}
+
+func (s *grpcServer) RemoveQueueItem(ctx context.Context, req *axshellpb.RemoveQueueItemRequest) (*axshellpb.RemoveQueueItemResponse, error) {
+        if !s.am.RemoveQueueItem(int(req.Id)) {
+                return nil, status.Errorf(codes.NotFound, "queue item %d not found", req.Id)
+        }
+        return &axshellpb.RemoveQueueItemResponse{}, nil
+}
+
+func (s *grpcServer) StreamEvents(req *axshellpb.StreamEventsRequest, stream axshellpb.AxShell_StreamEventsServer) error {
+        events, unsubscribe := s.am.Subscribe(grpcEventBuffer)
+        defer unsubscribe()
+
+        for {
+                select {
+                case <-stream.Context().Done():
+                        return nil
+                case event := <-events:
+                        if len(req.Types) > 0 && !slices.Contains(req.Types, event.Type) {
+                                continue
+                        }
+                        err := stream.Send(&axshellpb.Event{
+                                Type:        event.Type,
+                                PayloadJson: string(event.Payload),
+                                Timestamp:   event.Timestamp,
+                        })
+                        if err != nil {
+                                return err
+                        }
+                }
+        }
+}
+
+func (s *grpcServer) GetLogs(ctx context.Context, req *axshellpb.GetLogsRequest) (*axshellpb.GetLogsResponse, error) {
+        limit := int(req.Limit)
+        if limit <= 0 {
+                limit = 50
+        }
+
+        if req.Search != "" && !s.am.outputSearchable() {
+                grpc.SetHeader(ctx, metadata.Pairs("x-search-excludes", "output"))
+        }
+        resp := &axshellpb.GetLogsResponse{}
+        for _, entry := range s.am.GetLogs(limit, int(req.AgentId), req.Level, req.Search) {
+                resp.Entries = append(resp.Entries, &axshellpb.LogEntry{
+                        Id:         int64(entry.ID),
+                        AgentId:    int64(entry.AgentID),
+                        Level:      entry.Level,
+                        Message:    entry.Message,
+                        Command:    entry.Command,
+                        Output:     entry.Output,
+                        ExitCode:   int64(entry.ExitCode),
+                        DurationMs: entry.Duration,
+                        Timestamp:  entry.Timestamp,
+                        GitCommit:  entry.GitCommit,
+                        QueueId:    int64(entry.QueueID),
+                })
+        }
+        return resp, nil
+}
+
+func (s *grpcServer) GetMetrics(ctx context.Context, req *axshellpb.GetMetricsRequest) (*axshellpb.GetMetricsResponse, error) {
+        resources, err := toStruct(s.am.GetResourceUsage())
+        if err != nil {
+                return nil, status.Error(codes.Internal, err.Error())
+        }
+        stats, err := toStruct(s.am.GetStats())
+        if err != nil {
+                return nil, status.Error(codes.Internal, err.Error())
+        }
+        return &axshellpb.GetMetricsResponse{Resources: resources, Stats: stats}, nil
+}
+
+// toStruct converts v to a protobuf Struct by way of its JSON encoding, so
+// nested values come out as they do on the REST API.
+func toStruct(v any) (*structpb.Struct, error) {
+        data, err := json.Marshal(v)
+        if err != nil {
+                return nil, err
+        }
+        var fields map[string]any
+        if err := json.Unmarshal(data, &fields); err != nil {
+                return nil, err
+        }
+        return structpb.NewStruct(fields)
+}
+
+func agentToProto(agent *Agent) *axshellpb.Agent {
+        return &axshellpb.Agent{
+                Id:             int64(agent.ID),
+                Name:           agent.Name,
+                Status:         agent.Status,
+                CurrentTask:    agent.CurrentTask,
+                StartTime:      agent.StartTime.Format(time.RFC3339),
+                LastExecute:    agent.LastExecute.Format(time.RFC3339),
+                MemoryUsage:    agent.MemoryUsage,
+                CpuUsage:       agent.CPUUsage,
+                NetworkUsage:   agent.NetworkUsage,
+                TasksDone:      int64(agent.TasksDone),
+                TasksFailed:    int64(agent.TasksFailed),
+                Reserved:       agent.Reserved,
+                Draining:       agent.Draining,
+                Paused:         agent.Paused,
+                Labels:         agent.Labels,
+                WorkingDir:     agent.WorkingDir,
+                Env:            agent.Env,
+                Weight:         int64(agent.Weight),
+                Group:          agent.Group,
+                Fifo:           agent.FIFO,
+                MaxConcurrent:  int64(clampConcurrency(agent.MaxConcurrent)),
+                ActiveCommands: int64(agent.ActiveCommands),
+        }
+}
+
+func queueItemToProto(item *QueueItem) *axshellpb.QueueItem {
+        return &axshellpb.QueueItem{
+                Id:         int64(item.ID),
+                Index:      int64(item.Index),
+                Command:    item.Command,
+                Status:     item.Status,
+                Output:     item.Output,
+                AgentId:    int64(item.AgentID),
+                Priority:   int64(item.Priority),
+                BatchId:    item.BatchID,
+                CreatedAt:  item.CreatedAt,
+                MaxRetries: int64(item.MaxRetries),
+                RetryCount: int64(item.RetryCount),
+                Env:        item.Env,
+                WorkingDir: item.WorkingDir,
+                RunAt:      formatRunAt(item.RunAt),
+        }
+}
+
+func formatRunAt(t time.Time) string {
+        if t.IsZero() {
+                return ""
+        }
+        return t.Format(time.RFC3339)
+}
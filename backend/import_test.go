@@ -0,0 +1,69 @@
+package main
+
+import (
+        "slices"
+        "testing"
+)
+
+func TestExportImportRemapsDependencies(t *testing.T) {
+        am := newDispatchManager(t)
+        am.queue = []QueueItem{
+                {Index: 1, Command: "RUN echo 1", Status: "completed"},
+                {Index: 2, Command: "RUN echo 2", Status: "pending", DependsOn: []int{1}},
+                {Index: 3, Command: "RUN echo 3", Status: "pending", DependsOn: []int{2}},
+        }
+        am.lastIndex = 3
+
+        export := am.ExportQueue(false)
+        if len(export.Items) != 2 || len(export.Items[0].DependsOn) != 0 {
+                t.Fatalf("export = %+v, want items 2 and 3 without the completed dependency", export.Items)
+        }
+        if _, err := am.ImportQueue(export.Items); err != nil {
+                t.Fatal(err)
+        }
+        imported := am.queue[3:]
+        if len(imported) != 2 || !slices.Equal(imported[1].DependsOn, []int{imported[0].Index}) {
+                t.Errorf("imported = %+v, want the second to depend on the first", imported)
+        }
+}
+
+func TestImportRejectsOutsideDependencies(t *testing.T) {
+        am := newDispatchManager(t)
+        am.queue = []QueueItem{{Index: 1, Command: "RUN echo local", Status: "pending"}}
+        am.lastIndex = 1
+
+        _, err := am.ImportQueue([]QueueItem{{Index: 7, Command: "RUN echo imported", DependsOn: []int{1}}})
+        if err == nil {
+                t.Fatal("import bound a dependency to a local item")
+        }
+        if len(am.queue) != 1 {
+                t.Errorf("failed import changed the queue: %+v", am.queue)
+        }
+}
+
+func TestExportImportKeepsStatuses(t *testing.T) {
+        source := newDispatchManager(t)
+        statuses := []string{"pending", "disabled", "quarantined", "running", "interrupted", "failed", "skipped", "expired", "cancelled", "completed"}
+        for i, status := range statuses {
+                source.queue = append(source.queue, QueueItem{Index: i + 1, Command: "RUN echo " + status, Status: status})
+        }
+        source.lastIndex = len(statuses)
+
+        target := newDispatchManager(t)
+        if _, err := target.ImportQueue(source.ExportQueue(true).Items); err != nil {
+                t.Fatal(err)
+        }
+        want := []string{"pending", "disabled", "pending", "interrupted", "interrupted", "failed", "skipped", "expired", "cancelled", "completed"}
+        if got := queueStatuses(target); !slices.Equal(got, want) {
+                t.Errorf("statuses after round trip = %v, want %v", got, want)
+        }
+
+        id := newTestAgent(t, target, AgentSpec{MaxConcurrent: 10})
+        var claimed []string
+        for item := target.claimNextQueueItem(id); item != nil; item = target.claimNextQueueItem(id) {
+                claimed = append(claimed, item.Command)
+        }
+        if !slices.Equal(claimed, []string{"RUN echo pending", "RUN echo quarantined"}) {
+                t.Errorf("claimed %v, want only the items still waiting to run", claimed)
+        }
+}
@@ -0,0 +1,157 @@
+//go:build loadtest
+
+package main
+
+import (
+        "encoding/json"
+        "errors"
+        "fmt"
+        "net/http"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// The load test harness is only compiled with -tags loadtest so production
+// builds never expose it:
+//
+//      go run -tags loadtest .
+
+func init() {
+        adminRoutes["/admin/loadtest"] = handleLoadTest
+}
+
+type LoadTestRequest struct {
+        Agents   int    `json:"agents"`
+        Items    int    `json:"items"`
+        Command  string `json:"command"`
+        Duration int    `json:"duration"` // seconds to wait for the items to finish
+}
+
+// loadTestCommand maps the NOOP and SLEEP <ms> pseudo-commands onto cheap
+// shell commands; anything else is used as given.
+func loadTestCommand(command string) string {
+        fields := strings.Fields(command)
+        switch {
+        case len(fields) == 0, fields[0] == "NOOP":
+                return "RUN true"
+        case fields[0] == "SLEEP" && len(fields) == 2:
+                ms, err := strconv.Atoi(fields[1])
+                if err != nil {
+                        return command
+                }
+                return fmt.Sprintf("RUN sleep %.3f", float64(ms)/1000)
+        }
+        return command
+}
+
+// RunLoadTest spins up synthetic agents, enqueues the items as one batch and
+// waits for them, then removes the agents and reports throughput and
+// enqueue-to-completion latency. An item is finished once it reaches any
+// terminal status or is quarantined; statuses counts them by status.
+func (am *AgentManager) RunLoadTest(req LoadTestRequest) map[string]interface{} {
+        command := loadTestCommand(req.Command)
+        deadline := time.Duration(req.Duration) * time.Second
+
+        var agentIDs []int
+        for i := 0; i < req.Agents; i++ {
+                agent := am.AddAgent(fmt.Sprintf("loadtest-%d", i+1))
+                if agent == nil {
+                        break
+                }
+                agentIDs = append(agentIDs, agent.ID)
+                am.StartAgentLoop(agent.ID)
+        }
+        defer func() {
+                for _, id := range agentIDs {
+                        am.RemoveAgent(id)
+                }
+        }()
+
+        commands := make(map[string]string, req.Items)
+        for i := 1; i <= req.Items; i++ {
+                commands[strconv.Itoa(i)] = command
+        }
+
+        start := time.Now()
+        added := am.AddToQueue(commands, nil)
+
+        finished := make(map[int]time.Duration)
+        statuses := make(map[string]int)
+        for len(finished) < len(added.Added) && time.Since(start) < deadline {
+                for i := range added.Added {
+                        key := queueKey(&added.Added[i])
+                        if _, seen := finished[key]; seen {
+                                continue
+                        }
+                        // Falls back to the queue table for items compacted
+                        // out of memory; without persistence only finished
+                        // items are compacted, so a missing one is done too.
+                        result, err := am.GetQueueItemResult(key)
+                        switch {
+                        case errors.Is(err, errQueueItemNotFound):
+                                result.Status = "unknown"
+                        case err != nil:
+                                continue
+                        case !result.Done && result.Status != "quarantined":
+                                continue
+                        }
+                        finished[key] = time.Since(start)
+                        statuses[result.Status]++
+                }
+                if len(finished) < len(added.Added) {
+                        time.Sleep(20 * time.Millisecond)
+                }
+        }
+        elapsed := time.Since(start)
+
+        latencies := make([]time.Duration, 0, len(finished))
+        for _, d := range finished {
+                latencies = append(latencies, d)
+        }
+        sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+        percentile := func(q float64) int64 {
+                if len(latencies) == 0 {
+                        return 0
+                }
+                return latencies[int(q*float64(len(latencies)-1))].Milliseconds()
+        }
+
+        return map[string]interface{}{
+                "batch_id":       added.BatchID,
+                "agents":         len(agentIDs),
+                "items":          len(added.Added),
+                "completed":      statuses["completed"],
+                "failed":         statuses["failed"],
+                "statuses":       statuses,
+                "timed_out":      len(added.Added) - len(finished),
+                "elapsed_ms":     elapsed.Milliseconds(),
+                "throughput_ips": float64(len(finished)) / elapsed.Seconds(),
+                "latency_p50_ms": percentile(0.5),
+                "latency_p90_ms": percentile(0.9),
+                "latency_p99_ms": percentile(0.99),
+                "latency_max_ms": percentile(1),
+        }
+}
+
+func handleLoadTest(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        req := LoadTestRequest{Agents: 2, Items: 100, Command: "NOOP", Duration: 60}
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid request body")
+                return
+        }
+        if req.Agents <= 0 || req.Items <= 0 || req.Duration <= 0 {
+                writeError(w, r, http.StatusBadRequest, "agents, items and duration must be positive")
+                return
+        }
+
+        json.NewEncoder(w).Encode(manager.RunLoadTest(req))
+}
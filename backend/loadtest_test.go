@@ -0,0 +1,75 @@
+//go:build loadtest
+
+package main
+
+import (
+        "testing"
+        "time"
+)
+
+func TestLoadTestCommand(t *testing.T) {
+        for command, want := range map[string]string{
+                "":           "RUN true",
+                "NOOP":       "RUN true",
+                "SLEEP 250":  "RUN sleep 0.250",
+                "SLEEP x":    "SLEEP x",
+                "SLEEP":      "SLEEP",
+                "RUN echo 1": "RUN echo 1",
+        } {
+                if got := loadTestCommand(command); got != want {
+                        t.Errorf("loadTestCommand(%q) = %q, want %q", command, got, want)
+                }
+        }
+}
+
+func TestRunLoadTest(t *testing.T) {
+        am := newTestManager(t)
+        report := am.RunLoadTest(LoadTestRequest{Agents: 2, Items: 6, Command: "NOOP", Duration: 20})
+        if report["completed"] != 6 || report["timed_out"] != 0 {
+                t.Errorf("report = %v, want all 6 completed", report)
+        }
+        if len(am.GetAgents()) != 0 {
+                t.Error("load test agents left behind")
+        }
+}
+
+func TestRunLoadTestCountsEveryTerminalStatus(t *testing.T) {
+        // The agent loops do not run, so the test settles the items itself.
+        am := newDispatchManager(t, "QUEUE_KEEP_TERMINAL", "0")
+        done := make(chan map[string]interface{})
+        go func() {
+                done <- am.RunLoadTest(LoadTestRequest{Agents: 1, Items: 5, Command: "NOOP", Duration: 30})
+        }()
+
+        deadline := time.Now().Add(5 * time.Second)
+        for len(am.GetQueueList()) < 5 {
+                if time.Now().After(deadline) {
+                        t.Fatal("items never enqueued")
+                }
+                time.Sleep(10 * time.Millisecond)
+        }
+        for i, status := range []string{"skipped", "cancelled", "expired", "quarantined", "completed"} {
+                am.finishQueueItem(queueKey(&am.GetQueueList()[i]), status, "")
+        }
+        // Drops the finished items from memory, quarantined aside.
+        am.compactQueue()
+
+        select {
+        case report := <-done:
+                if report["timed_out"] != 0 {
+                        t.Errorf("report = %v, want no item timed out", report)
+                }
+                // Items seen before compaction report their status, the
+                // rest are only known to be gone.
+                statuses := report["statuses"].(map[string]int)
+                total := 0
+                for _, n := range statuses {
+                        total += n
+                }
+                if total != 5 || statuses["quarantined"] != 1 {
+                        t.Errorf("statuses = %v, want 5 items, 1 of them quarantined", statuses)
+                }
+        case <-time.After(10 * time.Second):
+                t.Fatal("load test waited for items that had already finished")
+        }
+}
@@ -1,26 +1,57 @@
 package main
 
 import (
+        "bytes"
+        "cmp"
+        "context"
+        "crypto/aes"
+        "crypto/cipher"
+        "crypto/rand"
+        "crypto/sha256"
+        "crypto/subtle"
         "database/sql"
+        "encoding/base64"
+        "encoding/hex"
         "encoding/json"
+        "errors"
         "fmt"
+        "io"
         "log"
+        "maps"
+        "math"
+        mrand "math/rand/v2"
+        "net"
         "net/http"
+        "net/url"
         "os"
         "os/exec"
+        "os/signal"
+        "path/filepath"
+        "regexp"
         "runtime"
+        "slices"
+        "sort"
+        "strconv"
         "strings"
         "sync"
+        "sync/atomic"
+        "syscall"
         "time"
 
         "github.com/gorilla/websocket"
         "github.com/joho/godotenv"
         _ "github.com/lib/pq"
+        "github.com/prometheus/client_golang/prometheus"
+        "github.com/prometheus/client_golang/prometheus/collectors"
+        "github.com/prometheus/client_golang/prometheus/promhttp"
+        psnet "github.com/shirou/gopsutil/v4/net"
+        "github.com/shirou/gopsutil/v4/process"
+        "gopkg.in/yaml.v3"
 )
 
 var upgrader = websocket.Upgrader{
         CheckOrigin: func(r *http.Request) bool {
-                return true
+                return manager.config().originAllowed(r.Header.Get("Origin"))
         },
 }
 
@@ -36,9 +67,96 @@ type Agent struct {
         NetworkUsage float64   `json:"network_usage"`
         TasksDone    int       `json:"tasks_done"`
         TasksFailed  int       `json:"tasks_failed"`
+        Reserved     bool      `json:"reserved"`
+
+        // Draining agents finish their current command and take no new
+        // work, ahead of being removed. Drained is set once that is done.
+        Draining bool `json:"draining,omitempty"`
+        Drained  bool `json:"drained,omitempty"`
+
+        // Paused agents finish their current command and take no new queue
+        // items until resumed; their status reads "paused" while idle.
+        Paused bool `json:"paused,omitempty"`
+
+        Labels     []string          `json:"labels,omitempty"`
+        WorkingDir string            `json:"working_dir,omitempty"`
+        Env        map[string]string `json:"env,omitempty"`
+        Bootstrap  string            `json:"bootstrap,omitempty"`
+
+        // Weight biases dispatch: an agent of weight 3 takes three items for
+        // every one taken by an agent of weight 1. Zero counts as 1.
+        Weight int `json:"weight"`
+
+        // Group names the AgentGroup the agent was created from. Its
+        // AllowedCommands, when set, restrict what the agent will run.
+        Group           string   `json:"group,omitempty"`
+        AllowedCommands []string `json:"allowed_commands,omitempty"`
+
+        // FIFO makes the agent run the items pinned to it strictly in the
+        // order they were enqueued, whatever their priority.
+        FIFO bool `json:"fifo,omitempty"`
+
+        // MaxConcurrent is how many queue items the agent runs at once; zero
+        // counts as 1. ActiveCommands is how many it is running right now.
+        MaxConcurrent  int `json:"max_concurrent"`
+        ActiveCommands int `json:"active_commands"`
+
+        // cpuTime is the CPU time of every command the agent finished;
+        // cpuSampled is its value at the last resource sample.
+        cpuTime    time.Duration
+        cpuSampled time.Duration
+}
+
+// AgentGroup is a named template of agent settings. Agents created with the
+// group start from it, and editing the group rewrites its members.
+type AgentGroup struct {
+        Name            string            `json:"name" yaml:"name"`
+        Labels          []string          `json:"labels,omitempty" yaml:"labels"`
+        Env             map[string]string `json:"env,omitempty" yaml:"env"`
+        WorkingDir      string            `json:"working_dir,omitempty" yaml:"working_dir"`
+        Weight          int               `json:"weight,omitempty" yaml:"weight"`
+        AllowedCommands []string          `json:"allowed_commands,omitempty" yaml:"allowed_commands"`
+}
+
+// AgentSpec describes an agent declared in the AGENTS_CONFIG file.
+type AgentSpec struct {
+        Name       string            `json:"name" yaml:"name"`
+        Labels     []string          `json:"labels" yaml:"labels"`
+        WorkingDir string            `json:"working_dir" yaml:"working_dir"`
+        Env        map[string]string `json:"env" yaml:"env"`
+        Bootstrap  string            `json:"bootstrap" yaml:"bootstrap"`
+        Weight     int               `json:"weight" yaml:"weight"`
+        Group      string            `json:"group" yaml:"group"`
+        FIFO       bool              `json:"fifo" yaml:"fifo"`
+
+        MaxConcurrent int `json:"max_concurrent" yaml:"max_concurrent"`
+
+        // StartupOrder and DependsOn sequence agents created together: an
+        // agent bootstraps once every agent with a lower StartupOrder has
+        // finished bootstrapping, and only if every agent it depends on (by
+        // name) did so successfully.
+        StartupOrder int      `json:"startup_order" yaml:"startup_order"`
+        DependsOn    []string `json:"depends_on" yaml:"depends_on"`
+}
+
+type AgentsConfig struct {
+        Agents []AgentSpec `json:"agents" yaml:"agents"`
+}
+
+// AgentLease grants exclusive use of an agent. While it is held the agent
+// takes no work from the shared queue and only runs commands that present
+// the lease token.
+type AgentLease struct {
+        Token     string    `json:"token"`
+        AgentID   int       `json:"agent_id"`
+        ExpiresAt time.Time `json:"expires_at"`
 }
 
 type QueueItem struct {
+        // ID is the row id and what every endpoint addresses an item by;
+        // without persistence it is 0 and Index stands in for it. Index is
+        // a sequence number that is never reused, kept for ordering and for
+        // older clients.
         ID        int    `json:"id"`
         Index     int    `json:"index"`
         Command   string `json:"command"`
@@ -48,8 +166,159 @@ type QueueItem struct {
         Priority  int    `json:"priority"`
         BatchID   string `json:"batch_id"`
         CreatedAt string `json:"created_at"`
+
+        SuccessPattern   string `json:"success_pattern,omitempty"`
+        FailurePattern   string `json:"failure_pattern,omitempty"`
+        KillOnMatch      bool   `json:"kill_on_match,omitempty"`
+        PatternTimeoutMs int    `json:"pattern_timeout_ms,omitempty"`
+
+        // TimeoutMs kills the command once it has run this long; zero falls
+        // back to DEFAULT_COMMAND_TIMEOUT_MS.
+        TimeoutMs int `json:"timeout_ms,omitempty"`
+
+        // PreCheck runs before Command; unless it exits 0 the item is marked
+        // "skipped" with the check's output and Command never runs.
+        PreCheck string `json:"pre_check,omitempty"`
+
+        // OnTimeout picks what happens when the item times out: "kill" (the
+        // default) fails it, "cleanup:<command>" runs command on the agent
+        // and then fails it, and "retry" puts it straight back to pending,
+        // at most maxTimeoutRetries times. TimeoutRetries counts those.
+        OnTimeout      string `json:"on_timeout,omitempty"`
+        TimeoutRetries int    `json:"timeout_retries,omitempty"`
+
+        // PinnedAgent restricts the item to one agent; zero lets any agent
+        // take it.
+        PinnedAgent int `json:"pinned_agent,omitempty"`
+
+        // MaxRetries is how often a failed run is retried, with exponential
+        // backoff, before the item fails for good. RetryCount counts those
+        // retries and RetryAt holds the item back until its backoff is over.
+        MaxRetries int       `json:"max_retries,omitempty"`
+        RetryCount int       `json:"retry_count,omitempty"`
+        RetryAt    time.Time `json:"-"`
+
+        // RunAt schedules the item: it stays pending until then, however
+        // many agents are free. Zero runs it as soon as possible.
+        RunAt time.Time `json:"run_at,omitzero"`
+
+        // FailoverCount is how often the item went back to pending because
+        // its agent was removed while running it.
+        FailoverCount int `json:"failover_count,omitempty"`
+
+        // Started is set once the item is first dispatched and stays set if
+        // it goes back to pending (retry, failover or shutdown), so
+        // PENDING_TTL only expires items that never ran.
+        Started bool `json:"started,omitempty"`
+
+        // FanOut turns the item into one run of Command per value, with
+        // {{param}} replaced by the shell-quoted value. The runs go in
+        // parallel and the item succeeds when at least FanOutQuorum of them
+        // do (all of them when zero).
+        FanOut       []string `json:"fan_out,omitempty"`
+        FanOutQuorum int      `json:"fan_out_quorum,omitempty"`
+
+        // StaggerMs spaces out the starts of items in the same batch: one is
+        // dispatched at most every StaggerMs, while earlier ones keep running.
+        StaggerMs int `json:"stagger_ms,omitempty"`
+
+        // Cacheable items may reuse a recent successful result of the same
+        // command; CacheTTLMs falls back to RESULT_CACHE_TTL when zero.
+        Cacheable  bool `json:"cacheable,omitempty"`
+        CacheTTLMs int  `json:"cache_ttl_ms,omitempty"`
+
+        // DependsOn lists items (by id, or by index without persistence) that
+        // must complete before this one is dispatched. Items no longer in the
+        // queue are looked up in the database; if one ends any other way, or
+        // does not exist, this item is skipped.
+        DependsOn []int `json:"depends_on,omitempty"`
+
+        // Env is merged over the agent's environment for this item only and
+        // WorkingDir replaces the agent's working directory; the directory
+        // has to exist when the item is enqueued and again when it runs.
+        Env        map[string]string `json:"env,omitempty"`
+        WorkingDir string            `json:"working_dir,omitempty"`
+
+        // Operator notes; never consulted during execution.
+        Annotations string `json:"annotations,omitempty"`
+        AnnotatedBy string `json:"annotated_by,omitempty"`
+        AnnotatedAt string `json:"annotated_at,omitempty"`
+
+        // ExpeditedAt is when an operator moved the item to the front of
+        // the queue with POST /queue/{id}/expedite.
+        ExpeditedAt string `json:"expedited_at,omitempty"`
+
+        // EnqueuedAt is CreatedAt at full precision for the queue wait
+        // histogram; items loaded from the database fall back to CreatedAt.
+        EnqueuedAt time.Time `json:"-"`
+
+        // Position (1-based rank among pending items in dispatch order) and
+        // EstimatedStart are computed per response and never stored.
+        Position       int    `json:"position,omitempty"`
+        EstimatedStart string `json:"estimated_start,omitempty"`
+
+        // EffectivePriority is the priority dispatch actually uses once
+        // inherited from waiting dependents; computed per response.
+        EffectivePriority int `json:"effective_priority,omitempty"`
+}
+
+// execOptions builds the execution options an agent uses for this item;
+// cacheTTL applies to cacheable items that do not set their own.
+func (item *QueueItem) execOptions(cacheTTL time.Duration) ExecOptions {
+        if !item.Cacheable {
+                cacheTTL = 0
+        } else if item.CacheTTLMs > 0 {
+                cacheTTL = time.Duration(item.CacheTTLMs) * time.Millisecond
+        }
+
+        return ExecOptions{
+                QueueID:        item.ID,
+                QueueIndex:     item.Index,
+                BatchID:        item.BatchID,
+                WorkingDir:     item.WorkingDir,
+                Env:            item.Env,
+                SuccessPattern: item.SuccessPattern,
+                FailurePattern: item.FailurePattern,
+                KillOnMatch:    item.KillOnMatch,
+                PatternTimeout: time.Duration(item.PatternTimeoutMs) * time.Millisecond,
+                Timeout:        time.Duration(item.TimeoutMs) * time.Millisecond,
+                CacheTTL:       cacheTTL,
+                OnTimeout:      item.OnTimeout,
+        }
+}
+
+// maxTimeoutRetries bounds how often an item with OnTimeout "retry" is
+// rerun before its timeout is final.
+const maxTimeoutRetries = 3
+
+// checkOnTimeout validates an OnTimeout spec.
+func checkOnTimeout(spec string) error {
+        switch {
+        case spec == "", spec == "kill", spec == "retry":
+                return nil
+        case strings.HasPrefix(spec, "cleanup:"):
+                if strings.TrimSpace(strings.TrimPrefix(spec, "cleanup:")) == "" {
+                        return errors.New("on_timeout cleanup needs a command")
+                }
+                return nil
+        }
+        return fmt.Errorf("unknown on_timeout %q (want kill, cleanup:<command> or retry)", spec)
+}
+
+// timedOut reports whether a result ended because the command ran out of
+// time rather than failing on its own.
+func timedOut(result CommandResult) bool {
+        return result.ErrorCode == "PATTERN_TIMEOUT" || result.ErrorCode == "COMMAND_TIMEOUT"
 }
 
+// timeoutExitCode is what timeout(1) exits with, reported for commands
+// killed at their deadline.
+const timeoutExitCode = 124
+
+// cancelledExitCode is what a shell reports for a job stopped by Ctrl-C,
+// reported for commands stopped with cancel_command.
+const cancelledExitCode = 130
+
 type CommandResult struct {
         AgentID   int    `json:"agent_id"`
         Command   string `json:"command"`
@@ -58,6 +327,23 @@ type CommandResult struct {
         ExitCode  int    `json:"exit_code"`
         Duration  int64  `json:"duration_ms"`
         Timestamp string `json:"timestamp"`
+        RawOutput string `json:"raw_output,omitempty"`
+        ErrorCode string `json:"error_code,omitempty"`
+
+        CommandHash      string `json:"command_hash,omitempty"`
+        ChangedSinceLast *bool  `json:"changed_since_last,omitempty"`
+        OutputDiff       string `json:"output_diff,omitempty"`
+
+        // GitCommit is HEAD of the repository holding the working directory,
+        // when there is one.
+        GitCommit string `json:"git_commit,omitempty"`
+
+        // Cached marks a result served from the result cache; Duration and
+        // Output are those of the original run.
+        Cached bool `json:"cached,omitempty"`
+
+        // BatchID is the batch of the queue item the command ran for.
+        BatchID string `json:"batch_id,omitempty"`
 }
 
 type LogEntry struct {
@@ -70,1191 +356,12113 @@ type LogEntry struct {
         ExitCode  int    `json:"exit_code"`
         Duration  int64  `json:"duration_ms"`
         Timestamp string `json:"timestamp"`
+        GitCommit string `json:"git_commit,omitempty"`
+
+        // QueueID links the entry of a queue item's run back to the item.
+        QueueID int `json:"queue_id,omitempty"`
 }
 
 type ResourceMetric struct {
-        ID          int     `json:"id"`
-        CPUPercent  float64 `json:"cpu_percent"`
-        MemoryMB    float64 `json:"memory_mb"`
-        MemoryPerc  float64 `json:"memory_percent"`
-        Goroutines  int     `json:"goroutines"`
-        NumGC       uint32  `json:"num_gc"`
-        AllocMB     float64 `json:"alloc_mb"`
-        SysMB       float64 `json:"sys_mb"`
-        AgentCount  int     `json:"agent_count"`
-        QueueCount  int     `json:"queue_count"`
-        Timestamp   string  `json:"timestamp"`
+        ID         int     `json:"id"`
+        CPUPercent float64 `json:"cpu_percent"`
+        MemoryMB   float64 `json:"memory_mb"`
+        MemoryPerc float64 `json:"memory_percent"`
+        Goroutines int     `json:"goroutines"`
+        NumGC      uint32  `json:"num_gc"`
+        AllocMB    float64 `json:"alloc_mb"`
+        SysMB      float64 `json:"sys_mb"`
+        AgentCount int     `json:"agent_count"`
+        QueueCount int     `json:"queue_count"`
+        Timestamp  string  `json:"timestamp"`
 }
 
-type Message struct {
-        Type    string      `json:"type"`
-        Payload interface{} `json:"payload"`
+// AgentMetric is one agent's resource fields at a MonitorResources tick,
+// linked to the resource_metrics row written in the same tick.
+type AgentMetric struct {
+        MetricID     int     `json:"metric_id"`
+        AgentID      int     `json:"agent_id"`
+        AgentName    string  `json:"agent_name"`
+        Status       string  `json:"status"`
+        MemoryUsage  float64 `json:"memory_usage"`
+        CPUUsage     float64 `json:"cpu_usage"`
+        NetworkUsage float64 `json:"network_usage"`
+        TasksDone    int     `json:"tasks_done"`
+        TasksFailed  int     `json:"tasks_failed"`
+        Timestamp    string  `json:"timestamp"`
 }
 
-type ChatMessage struct {
-        Mode    string `json:"mode"`
-        Content string `json:"content"`
-        User    string `json:"user"`
+type ExecOptions struct {
+        QueueID     int
+        QueueIndex  int
+        BatchID     string
+        PostProcess []string
+        WorkingDir  string
+
+        // Env is set on top of the agent's environment; on a clash the
+        // command's value wins.
+        Env map[string]string
+
+        // Isolate runs the command in a fresh temp directory, removed once
+        // it exits, when no working directory is given.
+        Isolate bool
+
+        // SuccessPattern and FailurePattern end the command as soon as an
+        // output line matches, regardless of its exit code.
+        SuccessPattern string
+        FailurePattern string
+        KillOnMatch    bool
+        PatternTimeout time.Duration
+
+        // Timeout kills the command's process group after this long; zero
+        // means DEFAULT_COMMAND_TIMEOUT_MS. A command left running after a
+        // success match is no longer bound by it.
+        Timeout time.Duration
+
+        // Context, when set, bounds the command's lifetime; interactive
+        // commands use it to die with the connection that started them.
+        Context context.Context
+
+        // DispatchedAt is when a queue item was claimed for this run and
+        // TraceID an optional caller-supplied trace to join; both only feed
+        // the execution span.
+        DispatchedAt time.Time
+        TraceID      string
+
+        // CacheTTL, when positive, lets a successful result of the same
+        // command, directory and environment stand in for a new run until
+        // it is that old. Only for commands without side effects.
+        CacheTTL time.Duration
+
+        // Stream broadcasts output as it arrives, one command_output_chunk
+        // per read from stdout or stderr, on top of the final result.
+        Stream bool
+
+        // OnTimeout is the queue item's timeout action; only its cleanup
+        // command is run here, retries are up to the agent loop.
+        OnTimeout string
 }
 
-type AgentManager struct {
-        agents      map[int]*Agent
-        queue       []QueueItem
-        queueLock   sync.RWMutex
-        agentLock   sync.RWMutex
-        clients     map[*websocket.Conn]bool
-        clientLock  sync.RWMutex
-        broadcast   chan Message
-        logDir      string
-        apiKey      string
-        stealthMode bool
-        maxAgents   int
-        running     bool
-        terminated  bool
-        db          *sql.DB
-        batchSize   int
+// OutputProcessor transforms captured output before it is stored or
+// broadcast.
+type OutputProcessor struct {
+        Name  string
+        Apply func(output string) string
 }
 
-func NewAgentManager() *AgentManager {
-        godotenv.Load("../.env")
+// parseOutputProcessor builds a processor from a spec such as "trim",
+// "json_pretty", "last_n_lines:20" or "grep:pattern".
+func parseOutputProcessor(spec string) (OutputProcessor, error) {
+        name, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
 
-        logDir := os.Getenv("AI_LOG_DIR")
-        if logDir == "" {
-                logDir = "./logs"
+        switch name {
+        case "trim":
+                return OutputProcessor{Name: spec, Apply: strings.TrimSpace}, nil
+
+        case "json_pretty":
+                return OutputProcessor{Name: spec, Apply: func(output string) string {
+                        var buf bytes.Buffer
+                        if err := json.Indent(&buf, []byte(strings.TrimSpace(output)), "", "  "); err != nil {
+                                return output
+                        }
+                        return buf.String()
+                }}, nil
+
+        case "last_n_lines":
+                n, err := strconv.Atoi(arg)
+                if err != nil || n <= 0 {
+                        return OutputProcessor{}, fmt.Errorf("last_n_lines needs a positive line count, got %q", arg)
+                }
+                return OutputProcessor{Name: spec, Apply: func(output string) string {
+                        lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+                        if len(lines) > n {
+                                lines = lines[len(lines)-n:]
+                        }
+                        return strings.Join(lines, "\n")
+                }}, nil
+
+        case "grep":
+                re, err := regexp.Compile(arg)
+                if err != nil {
+                        return OutputProcessor{}, fmt.Errorf("invalid grep pattern %q: %v", arg, err)
+                }
+                return OutputProcessor{Name: spec, Apply: func(output string) string {
+                        var matched []string
+                        for _, line := range strings.Split(output, "\n") {
+                                if re.MatchString(line) {
+                                        matched = append(matched, line)
+                                }
+                        }
+                        return strings.Join(matched, "\n")
+                }}, nil
         }
-        os.MkdirAll(logDir, 0755)
 
-        am := &AgentManager{
-                agents:    make(map[int]*Agent),
-                queue:     make([]QueueItem, 0),
-                clients:   make(map[*websocket.Conn]bool),
-                broadcast: make(chan Message, 100),
-                logDir:    logDir,
-                apiKey:    os.Getenv("OPENROUTER_API_KEY"),
-                maxAgents: 10,
-                running:   true,
-                batchSize: 5,
+        return OutputProcessor{}, fmt.Errorf("unknown output processor %q", name)
+}
+
+func parseOutputProcessors(specs []string) []OutputProcessor {
+        var processors []OutputProcessor
+        for _, spec := range specs {
+                if strings.TrimSpace(spec) == "" {
+                        continue
+                }
+                p, err := parseOutputProcessor(spec)
+                if err != nil {
+                        log.Printf("Skipping output processor: %v", err)
+                        continue
+                }
+                processors = append(processors, p)
         }
+        return processors
+}
 
-        am.initDatabase()
-        am.loadStateFromDB()
+// syncBuffer collects command output while the process is still running so
+// partial results can be read (and persisted) before it exits.
+type syncBuffer struct {
+        mu  sync.Mutex
+        buf strings.Builder
+}
 
-        return am
+func (b *syncBuffer) Write(p []byte) (int, error) {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        return b.buf.Write(p)
 }
 
-func (am *AgentManager) initDatabase() {
-        dbURL := os.Getenv("DATABASE_URL")
-        if dbURL == "" {
-                log.Println("DATABASE_URL not set, running without persistence")
-                return
-        }
+func (b *syncBuffer) String() string {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        return b.buf.String()
+}
 
-        var err error
-        am.db, err = sql.Open("postgres", dbURL)
-        if err != nil {
-                log.Printf("Error connecting to database: %v", err)
-                return
-        }
+// chunkWriter broadcasts everything written to it as command_output_chunk
+// messages for one stream of a running command.
+type chunkWriter struct {
+        am         *AgentManager
+        agentID    int
+        queueIndex int
+        stream     string
+}
 
-        if err = am.db.Ping(); err != nil {
-                log.Printf("Error pinging database: %v", err)
-                return
-        }
+func (w *chunkWriter) Write(p []byte) (int, error) {
+        w.am.broadcastMessage(Message{
+                Type: "command_output_chunk",
+                Payload: map[string]interface{}{
+                        "agent_id":    w.agentID,
+                        "queue_index": w.queueIndex,
+                        "stream":      w.stream,
+                        "data":        string(p),
+                },
+        })
+        return len(p), nil
+}
 
-        log.Println("Connected to PostgreSQL database")
+// ClientSession is the per-connection state that survives a short disconnect.
+// A client that reconnects with its token inside the grace period gets the
+// session back together with the broadcasts it missed.
+type ClientSession struct {
+        Token          string
+        DisconnectedAt time.Time
 
-        schema := `
-        CREATE TABLE IF NOT EXISTS agents (
-                id SERIAL PRIMARY KEY,
-                name VARCHAR(255) NOT NULL,
-                status VARCHAR(50) DEFAULT 'idle',
-                current_task TEXT DEFAULT '',
-                start_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-                last_execute TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-                memory_usage FLOAT DEFAULT 0,
-                cpu_usage FLOAT DEFAULT 0,
-                network_usage FLOAT DEFAULT 0,
-                tasks_done INT DEFAULT 0,
-                tasks_failed INT DEFAULT 0,
-                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-        );
+        // connCtx is cancelled when the current connection drops, even if the
+        // session itself is kept for a reconnect.
+        connCtx    context.Context
+        connCancel context.CancelFunc
 
-        CREATE TABLE IF NOT EXISTS queue (
-                id SERIAL PRIMARY KEY,
-                idx INT NOT NULL,
-                command TEXT NOT NULL,
-                status VARCHAR(50) DEFAULT 'pending',
-                output TEXT DEFAULT '',
-                agent_id INT DEFAULT 0,
-                priority INT DEFAULT 0,
-                batch_id VARCHAR(100) DEFAULT '',
-                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-                updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-        );
+        // noResume is set after a fatal write error so the session is not
+        // kept for a reconnect.
+        noResume atomic.Bool
 
-        CREATE TABLE IF NOT EXISTS logs (
-                id SERIAL PRIMARY KEY,
-                agent_id INT,
-                level VARCHAR(20) DEFAULT 'info',
-                message TEXT,
-                command TEXT,
-                output TEXT,
-                exit_code INT DEFAULT 0,
-                duration_ms BIGINT DEFAULT 0,
-                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-        );
+        // dashboard is set while the client takes dashboard_tick frames in
+        // place of resource_update.
+        dashboard atomic.Bool
 
-        CREATE TABLE IF NOT EXISTS resource_metrics (
-                id SERIAL PRIMARY KEY,
-                cpu_percent FLOAT DEFAULT 0,
-                memory_mb FLOAT DEFAULT 0,
-                memory_percent FLOAT DEFAULT 0,
-                goroutines INT DEFAULT 0,
-                num_gc INT DEFAULT 0,
-                alloc_mb FLOAT DEFAULT 0,
-                sys_mb FLOAT DEFAULT 0,
-                agent_count INT DEFAULT 0,
-                queue_count INT DEFAULT 0,
-                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-        );
+        // resultFilter, when set, limits the command_result broadcasts the
+        // client receives.
+        resultFilter atomic.Pointer[ResultFilter]
 
-        CREATE INDEX IF NOT EXISTS idx_queue_status ON queue(status);
-        CREATE INDEX IF NOT EXISTS idx_queue_priority ON queue(priority DESC);
-        CREATE INDEX IF NOT EXISTS idx_logs_agent ON logs(agent_id);
-        CREATE INDEX IF NOT EXISTS idx_logs_level ON logs(level);
-        CREATE INDEX IF NOT EXISTS idx_metrics_time ON resource_metrics(created_at);
-        `
+        // writer is the send queue of the connection the session is on, nil
+        // while detached. Guarded by the manager's clientLock.
+        writer *clientWriter
 
-        _, err = am.db.Exec(schema)
-        if err != nil {
-                log.Printf("Error creating schema: %v", err)
-        }
+        mu     sync.Mutex
+        missed []Message
 }
 
-func (am *AgentManager) loadStateFromDB() {
-        if am.db == nil {
-                return
-        }
+const maxMissedMessages = 200
 
-        rows, err := am.db.Query(`SELECT id, name, status, current_task, start_time, last_execute, 
-                memory_usage, cpu_usage, network_usage, tasks_done, tasks_failed FROM agents`)
-        if err != nil {
-                log.Printf("Error loading agents: %v", err)
-                return
-        }
-        defer rows.Close()
+// ResultFilter selects the command_result broadcasts a client subscribed
+// with subscribe_results gets. Unset fields match everything.
+type ResultFilter struct {
+        MinExitCode *int   `json:"min_exit_code,omitempty"`
+        AgentID     int    `json:"agent_id,omitempty"`
+        BatchID     string `json:"batch_id,omitempty"`
+}
 
-        for rows.Next() {
-                var agent Agent
-                err := rows.Scan(&agent.ID, &agent.Name, &agent.Status, &agent.CurrentTask,
-                        &agent.StartTime, &agent.LastExecute, &agent.MemoryUsage, &agent.CPUUsage,
-                        &agent.NetworkUsage, &agent.TasksDone, &agent.TasksFailed)
-                if err != nil {
-                        log.Printf("Error scanning agent: %v", err)
-                        continue
-                }
-                am.agents[agent.ID] = &agent
-        }
+func (f *ResultFilter) matches(result CommandResult) bool {
+        return (f.MinExitCode == nil || result.ExitCode >= *f.MinExitCode) &&
+                (f.AgentID == 0 || result.AgentID == f.AgentID) &&
+                (f.BatchID == "" || result.BatchID == f.BatchID)
+}
 
-        qRows, err := am.db.Query(`SELECT id, idx, command, status, output, agent_id, priority, batch_id, created_at 
-                FROM queue WHERE status != 'completed' ORDER BY priority DESC, id ASC`)
-        if err != nil {
-                log.Printf("Error loading queue: %v", err)
-                return
+// wants reports whether a broadcast should reach the client, given its
+// dashboard and result subscriptions.
+func (cs *ClientSession) wants(msg Message) bool {
+        if cs == nil {
+                return true
         }
-        defer qRows.Close()
+        switch msg.Type {
+        case "resource_update":
+                return !cs.dashboard.Load()
+        case "command_result":
+                filter := cs.resultFilter.Load()
+                result, ok := msg.Payload.(CommandResult)
+                return filter == nil || !ok || filter.matches(result)
+        }
+        return true
+}
 
-        for qRows.Next() {
-                var item QueueItem
-                err := qRows.Scan(&item.ID, &item.Index, &item.Command, &item.Status, &item.Output,
-                        &item.AgentID, &item.Priority, &item.BatchID, &item.CreatedAt)
-                if err != nil {
-                        log.Printf("Error scanning queue item: %v", err)
-                        continue
-                }
-                am.queue = append(am.queue, item)
+func (cs *ClientSession) bufferMissed(msg Message) {
+        cs.mu.Lock()
+        defer cs.mu.Unlock()
+
+        cs.missed = append(cs.missed, msg)
+        if len(cs.missed) > maxMissedMessages {
+                cs.missed = cs.missed[len(cs.missed)-maxMissedMessages:]
         }
+}
 
-        log.Printf("Loaded %d agents and %d queue items from database", len(am.agents), len(am.queue))
+func (cs *ClientSession) takeMissed() []Message {
+        cs.mu.Lock()
+        defer cs.mu.Unlock()
+
+        missed := cs.missed
+        cs.missed = nil
+        return missed
 }
 
-func (am *AgentManager) saveAgentToDB(agent *Agent) {
-        if am.db == nil {
-                return
+func newSessionToken() string {
+        b := make([]byte, 16)
+        if _, err := rand.Read(b); err != nil {
+                return fmt.Sprintf("%x", time.Now().UnixNano())
         }
+        return hex.EncodeToString(b)
+}
 
-        _, err := am.db.Exec(`
-                INSERT INTO agents (id, name, status, current_task, start_time, last_execute, 
-                        memory_usage, cpu_usage, network_usage, tasks_done, tasks_failed)
-                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-                ON CONFLICT (id) DO UPDATE SET
-                        name = EXCLUDED.name,
-                        status = EXCLUDED.status,
-                        current_task = EXCLUDED.current_task,
-                        last_execute = EXCLUDED.last_execute,
-                        memory_usage = EXCLUDED.memory_usage,
-                        cpu_usage = EXCLUDED.cpu_usage,
-                        network_usage = EXCLUDED.network_usage,
-                        tasks_done = EXCLUDED.tasks_done,
-                        tasks_failed = EXCLUDED.tasks_failed
-        `, agent.ID, agent.Name, agent.Status, agent.CurrentTask, agent.StartTime,
-                agent.LastExecute, agent.MemoryUsage, agent.CPUUsage, agent.NetworkUsage,
-                agent.TasksDone, agent.TasksFailed)
-        if err != nil {
-                log.Printf("Error saving agent to DB: %v", err)
-        }
+type Message struct {
+        Type    string      `json:"type"`
+        Payload interface{} `json:"payload"`
 }
 
-func (am *AgentManager) saveQueueItemToDB(item *QueueItem) int {
-        if am.db == nil {
-                return 0
-        }
+type ChatMessage struct {
+        Mode    string `json:"mode"`
+        Content string `json:"content"`
+        User    string `json:"user"`
+}
 
-        var id int
-        err := am.db.QueryRow(`
-                INSERT INTO queue (idx, command, status, output, agent_id, priority, batch_id)
-                VALUES ($1, $2, $3, $4, $5, $6, $7)
-                RETURNING id
-        `, item.Index, item.Command, item.Status, item.Output, item.AgentID, item.Priority, item.BatchID).Scan(&id)
-        if err != nil {
-                log.Printf("Error saving queue item to DB: %v", err)
-                return 0
-        }
-        return id
+type AgentManager struct {
+        agents     map[int]*Agent
+        leases     map[int]*AgentLease
+        queue      []QueueItem
+        queueLock  sync.RWMutex
+        agentLock  sync.RWMutex
+        groups     map[string]*AgentGroup
+        groupLock  sync.RWMutex
+        clients    map[*websocket.Conn]*ClientSession
+        detached   map[string]*ClientSession
+        clientLock sync.RWMutex
+
+        // broadcastLock serializes broadcasts so every client sees messages
+        // in the same order. Each client has a send queue of clientBuffer
+        // messages; broadcasts only enqueue, and a client whose queue is
+        // full is dropped.
+        broadcastLock  sync.Mutex
+        clientBuffer   int
+        broadcastStats broadcastStats
+
+        // subscribers get every broadcast in-process, for APIs served next
+        // to the WebSocket (see grpc.go).
+        subscribers     map[chan ChangeEvent]bool
+        subscribersLock sync.Mutex
+        sysMetrics      *systemMetrics
+        logDir          string
+        apiKey          string
+        chatModel       string
+        chatClient      *http.Client
+        stealthMode     bool
+        maxAgents       int
+        maxClients      int
+        // wsSlots counts WebSocket connections from before their upgrade
+        // until they close, authenticated or not, against maxClients.
+        wsSlots    atomic.Int64
+        running    atomic.Bool
+        terminated atomic.Bool
+
+        // inFlight counts executing commands so Shutdown can wait for them;
+        // shutdownLock orders new commands against shuttingDown being set.
+        inFlight      sync.WaitGroup
+        shutdownLock  sync.RWMutex
+        shuttingDown  bool
+        shutdownGrace time.Duration
+
+        // loopLock guards the set of live agent loops and the monitor so
+        // Start/Stop can be repeated without spawning duplicates. Each loop
+        // is keyed to the cancel func of its stop context, which also bounds
+        // the command it is running.
+        loopLock   sync.Mutex
+        agentLoops map[int]context.CancelFunc
+        monitoring bool
+        // hotPool and coldPool stay nil until their database is reached,
+        // which watchDatabase may do well after startup; read them through
+        // db() and logsDB(). hotUp and coldUp hold the last health check.
+        hotPool  atomic.Pointer[sql.DB]
+        coldPool atomic.Pointer[sql.DB]
+        hotUp    atomic.Bool
+        coldUp   atomic.Bool
+        dbPool   dbPoolConfig
+
+        // stateLoaded is set once loadStateFromDB has read the hot pool.
+        // Until then nothing is written to it: a pool that connects after
+        // startup holds rows whose ids the in-memory state knows nothing
+        // about, so persistence waits for a restart.
+        stateLoaded atomic.Bool
+
+        batchSize int
+        ephemeral atomic.Bool
+
+        // runtimeConfig records settings changed after startup (for example
+        // persistence over the WebSocket), keyed by their env var name.
+        runtimeConfig sync.Map
+
+        // safeMode refuses every command execution while reads keep working.
+        safeMode atomic.Bool
+
+        // banner is the operator notice shown on every dashboard, nil when
+        // there is none.
+        banner atomic.Pointer[Banner]
+
+        // memoryPressure is set while the heap is over MEMORY_PRESSURE_MB
+        // and no new queue items are dispatched.
+        memoryPressure atomic.Bool
+
+        // live holds the settings /admin/reload may swap out at runtime;
+        // read them through config(). dotenvKeys are the variables that
+        // came from .env rather than the process environment.
+        live       atomic.Pointer[liveConfig]
+        dotenvKeys map[string]bool // guarded by reloadLock
+        reloadLock sync.Mutex
+
+        // configTable holds the settings taken from the config table, and
+        // shadowedEnv (guarded by reloadLock) the environment values they
+        // replaced, put back before every reload so a deleted row stops
+        // counting.
+        configTable atomic.Pointer[map[string]string]
+        shadowedEnv map[string]envValue
+
+        outputFlushInterval time.Duration
+        reconnectGrace      time.Duration
+        leaseTTL            time.Duration
+
+        execLimiter *execLimiter
+
+        baseline        *ResourceBaseline
+        baselineLock    sync.Mutex
+        durations       *durationHistogram
+        commandHistory  *commandHistory
+        resultCache     *resultCache
+        quarantine      *quarantine
+        gitCommits      *gitCommitCache
+        tracer          *spanExporter
+        logSink         *logSink
+        isolateCommands bool
+
+        // outputCipher encrypts command output before it is written to the
+        // database or log files; nil (no OUTPUT_ENCRYPTION_KEY) stores it
+        // as plaintext.
+        outputCipher *outputCipher
+
+        processGroups     bool
+        confirmations     sync.Map
+        proposals         sync.Map
+        changes           *changeFeed
+        changeFeedPersist bool
+
+        dispatchLock sync.Mutex
+        shares       map[int]*dispatchShare
+
+        // batchStarts records when a staggered batch last had an item
+        // dispatched; guarded by queueLock.
+        batchStarts map[string]time.Time
+
+        // retryBudgets holds the max_total_retries budget of batches that
+        // were given one; guarded by queueLock.
+        retryBudgets map[string]*RetryBudget
+
+        // finishedDeps caches the final status of dependencies that are no
+        // longer in the queue, as read from the database; guarded by
+        // queueLock.
+        finishedDeps map[int]string
+
+        // runningCommands lists the commands each agent is executing, so
+        // cancel_command can stop them; cancelledItems are the queueKeys of
+        // items whose run was cancelled, for the agent loop to settle. Both are
+        // guarded by runningLock.
+        runningCommands map[int][]*runningCommand
+        cancelledItems  map[int]bool
+        runningLock     sync.Mutex
+
+        // lastIndex is the highest queue index handed out, so indexes stay
+        // unique after items leave the in-memory queue; guarded by
+        // queueLock.
+        lastIndex int
+
+        logFileLock         sync.Mutex
+        logFileMaxBytes     int64
+        logFileMaxRotations int
 }
 
-func (am *AgentManager) updateQueueItemInDB(item *QueueItem) {
-        if am.db == nil {
-                return
+// getEnvDuration reads a Go duration ("90s", "2h"); a bare number is taken
+// as seconds.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+        v := os.Getenv(key)
+        if v == "" {
+                return def
         }
-
-        _, err := am.db.Exec(`
-                UPDATE queue SET status = $1, output = $2, agent_id = $3, updated_at = CURRENT_TIMESTAMP
-                WHERE id = $4
-        `, item.Status, item.Output, item.AgentID, item.ID)
+        if n, err := strconv.Atoi(v); err == nil {
+                return time.Duration(n) * time.Second
+        }
+        d, err := time.ParseDuration(v)
         if err != nil {
-                log.Printf("Error updating queue item in DB: %v", err)
+                log.Printf("Invalid value for %s (%q), using default %s", key, v, def)
+                return def
         }
+        return d
 }
 
-func (am *AgentManager) saveLogToDB(entry *LogEntry) {
-        if am.db == nil {
-                return
+func getEnvInt(key string, def int) int {
+        v := os.Getenv(key)
+        if v == "" {
+                return def
         }
-
-        _, err := am.db.Exec(`
-                INSERT INTO logs (agent_id, level, message, command, output, exit_code, duration_ms)
-                VALUES ($1, $2, $3, $4, $5, $6, $7)
-        `, entry.AgentID, entry.Level, entry.Message, entry.Command, entry.Output, entry.ExitCode, entry.Duration)
+        n, err := strconv.Atoi(v)
         if err != nil {
-                log.Printf("Error saving log to DB: %v", err)
+                log.Printf("Invalid value for %s (%q), using default %d", key, v, def)
+                return def
         }
+        return n
 }
 
-func (am *AgentManager) saveResourceMetricToDB(metric *ResourceMetric) {
-        if am.db == nil {
-                return
+func getEnvFloat(key string, def float64) float64 {
+        v := os.Getenv(key)
+        if v == "" {
+                return def
         }
-
-        _, err := am.db.Exec(`
-                INSERT INTO resource_metrics (cpu_percent, memory_mb, memory_percent, goroutines, num_gc, alloc_mb, sys_mb, agent_count, queue_count)
-                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-        `, metric.CPUPercent, metric.MemoryMB, metric.MemoryPerc, metric.Goroutines, metric.NumGC, metric.AllocMB, metric.SysMB, metric.AgentCount, metric.QueueCount)
+        f, err := strconv.ParseFloat(v, 64)
         if err != nil {
-                log.Printf("Error saving resource metric to DB: %v", err)
+                log.Printf("Invalid value for %s (%q), using default %g", key, v, def)
+                return def
         }
+        return f
 }
 
-func (am *AgentManager) deleteAgentFromDB(id int) {
-        if am.db == nil {
-                return
+// execLimiter bounds how many commands run at once across all agents. The
+// limit can change while commands are waiting; a limit of 0 means unlimited.
+type execLimiter struct {
+        mu     sync.Mutex
+        cond   *sync.Cond
+        limit  int
+        active int
+}
+
+func newExecLimiter(limit int) *execLimiter {
+        l := &execLimiter{limit: limit}
+        l.cond = sync.NewCond(&l.mu)
+        return l
+}
+
+func (l *execLimiter) Acquire() {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        for l.limit > 0 && l.active >= l.limit {
+                l.cond.Wait()
         }
+        l.active++
+}
 
-        _, err := am.db.Exec(`DELETE FROM agents WHERE id = $1`, id)
+func (l *execLimiter) Release() {
+        l.mu.Lock()
+        l.active--
+        l.mu.Unlock()
+        l.cond.Broadcast()
+}
+
+func (l *execLimiter) SetLimit(limit int) {
+        l.mu.Lock()
+        l.limit = limit
+        l.mu.Unlock()
+        l.cond.Broadcast()
+}
+
+func (l *execLimiter) Stats() (limit int, active int) {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        return l.limit, l.active
+}
+
+// availableCPUs returns the CPUs this process may actually use, honouring a
+// cgroup v2 CPU quota when the container has one.
+func availableCPUs() float64 {
+        cpus := float64(runtime.NumCPU())
+
+        data, err := os.ReadFile("/sys/fs/cgroup/cpu.max")
         if err != nil {
-                log.Printf("Error deleting agent from DB: %v", err)
+                return cpus
         }
+        fields := strings.Fields(string(data))
+        if len(fields) != 2 || fields[0] == "max" {
+                return cpus
+        }
+        quota, err1 := strconv.ParseFloat(fields[0], 64)
+        period, err2 := strconv.ParseFloat(fields[1], 64)
+        if err1 != nil || err2 != nil || period <= 0 {
+                return cpus
+        }
+        if quotaCPUs := quota / period; quotaCPUs < cpus {
+                return quotaCPUs
+        }
+        return cpus
 }
 
-func (am *AgentManager) deleteQueueItemFromDB(id int) {
-        if am.db == nil {
+// refreshConcurrencyLimit recomputes the global limit from the CPU count when
+// CONCURRENCY_CPU_FACTOR is set, so the service follows quota changes.
+func (am *AgentManager) refreshConcurrencyLimit() {
+        if am.config().concurrencyFactor <= 0 {
                 return
         }
 
-        _, err := am.db.Exec(`DELETE FROM queue WHERE id = $1`, id)
-        if err != nil {
-                log.Printf("Error deleting queue item from DB: %v", err)
+        limit := int(availableCPUs()*am.config().concurrencyFactor + 0.5)
+        if limit < 1 {
+                limit = 1
+        }
+        if current, _ := am.execLimiter.Stats(); current != limit {
+                am.execLimiter.SetLimit(limit)
+                log.Printf("Concurrency limit set to %d (%.2f CPUs x %.2f)", limit, availableCPUs(), am.config().concurrencyFactor)
         }
 }
 
-func (am *AgentManager) GetLogs(limit int, agentID int, level string) []LogEntry {
-        if am.db == nil {
-                return nil
-        }
+// liveConfig holds the settings that are safe to change while running:
+// limits, timeouts, policies and intervals. A reload builds a new one and
+// swaps it in whole, so a reader sees either the old or the new settings.
+type liveConfig struct {
+        maxCommandLength int
+        minIdleAgents    int
+        killOnDisconnect bool
+        allowedWorkDirs  []string
+
+        // allowedOrigins are the browser origins that may open a WebSocket;
+        // nil allows localhost only and "*" any origin.
+        allowedOrigins       []string
+        keepRawOutput        bool
+        postProcessors       []OutputProcessor
+        logAgentTransitions  bool
+        preCheckTimeout      time.Duration
+        fanOutParallel       int
+        agentMetricsInterval time.Duration
+
+        // The resource monitor samples, persists and broadcasts on separate
+        // tickers, each delayed by up to monitorJitter more.
+        monitorSampleInterval    time.Duration
+        monitorPersistInterval   time.Duration
+        monitorBroadcastInterval time.Duration
+        monitorJitter            time.Duration
+        maxFailovers             int
+        maxRetries               int
+        retryBackoffBase         time.Duration
+        retryBackoffMax          time.Duration
+        dangerousPatterns        []*regexp.Regexp
+        commandPolicy            commandPolicy
+        runPrefixMode            string
+        probeBinaries            []string
+        confirmTimeout           time.Duration
+        pendingTTL               time.Duration
+        expiryWebhook            string
+
+        // quarantineThreshold failed runs of one command within
+        // quarantineWindow quarantine it (0 turns this off).
+        quarantineThreshold int
+        quarantineWindow    time.Duration
+        quarantineWebhook   string
+        weightMaxWait       time.Duration
+        commandDiffMaxBytes int
+        writeTimeout        time.Duration
+        resultCacheTTL      time.Duration
+        quietHours          *quietHours
+        concurrencyFactor   float64
+
+        // keepTerminal bounds how many finished items stay in memory
+        // (negative keeps all).
+        keepTerminal int
+
+        // commandTimeout bounds commands that set no timeout of their own.
+        commandTimeout time.Duration
+
+        // memoryLimitMB stops dispatch while the heap is above it (0 turns
+        // it off); memoryPressureGC forces a collection on crossing it.
+        memoryLimitMB    float64
+        memoryPressureGC bool
+
+        // logRetention and metricsRetention are how long rows stay in logs
+        // and in resource_metrics/agent_metrics (0 keeps them for good);
+        // the retention job runs every retentionInterval.
+        logRetention      time.Duration
+        metricsRetention  time.Duration
+        retentionInterval time.Duration
+}
 
-        query := `SELECT id, agent_id, level, message, command, output, exit_code, duration_ms, created_at 
-                FROM logs WHERE 1=1`
-        args := []interface{}{}
-        argNum := 1
+// liveConfigKeys are the env vars behind liveConfig, plus the few that are
+// read at the point of use; a reload applies changes to these and reports
+// any other change as needing a restart.
+var liveConfigKeys = map[string]bool{
+        "MAX_COMMAND_LENGTH":            true,
+        "MIN_IDLE_AGENTS":               true,
+        "KILL_ON_DISCONNECT":            true,
+        "ALLOWED_WORKDIRS":              true,
+        "ALLOWED_ORIGINS":               true,
+        "KEEP_RAW_OUTPUT":               true,
+        "OUTPUT_POSTPROCESSORS":         true,
+        "LOG_AGENT_TRANSITIONS":         true,
+        "PRECHECK_TIMEOUT_MS":           true,
+        "FANOUT_MAX_PARALLEL":           true,
+        "AGENT_METRICS_INTERVAL":        true,
+        "MONITOR_SAMPLE_INTERVAL":       true,
+        "MONITOR_PERSIST_INTERVAL":      true,
+        "MONITOR_BROADCAST_INTERVAL":    true,
+        "MONITOR_JITTER":                true,
+        "MAX_FAILOVERS":                 true,
+        "QUEUE_MAX_RETRIES":             true,
+        "RETRY_BACKOFF_BASE":            true,
+        "RETRY_BACKOFF_MAX":             true,
+        "DANGEROUS_PATTERNS":            true,
+        "COMMAND_DENYLIST":              true,
+        "COMMAND_ALLOWLIST":             true,
+        "COMMAND_POLICY_FILE":           true,
+        "REQUIRE_RUN_PREFIX":            true,
+        "PROBE_REQUIRED_BINARIES":       true,
+        "CONFIRM_TIMEOUT":               true,
+        "PENDING_TTL":                   true,
+        "PENDING_EXPIRY_WEBHOOK":        true,
+        "QUARANTINE_THRESHOLD":          true,
+        "QUARANTINE_WINDOW":             true,
+        "QUARANTINE_WEBHOOK":            true,
+        "WEIGHTED_DISPATCH_MAX_WAIT_MS": true,
+        "COMMAND_DIFF_MAX_BYTES":        true,
+        "WS_WRITE_TIMEOUT_MS":           true,
+        "QUEUE_KEEP_TERMINAL":           true,
+        "RESULT_CACHE_TTL":              true,
+        "QUIET_HOURS":                   true,
+        "QUIET_HOURS_DAYS":              true,
+        "QUIET_HOURS_TZ":                true,
+        "QUIET_HOURS_MIN_PRIORITY":      true,
+        "MAX_CONCURRENT_COMMANDS":       true,
+        "CONCURRENCY_CPU_FACTOR":        true,
+        "SAFE_MODE":                     true,
+        "ADMIN_TOKEN":                   true,
+        "BACKEND_API_KEY":               true,
+        "AUTH_DISABLED":                 true,
+        "DEFAULT_COMMAND_TIMEOUT_MS":    true,
+        "MEMORY_PRESSURE_MB":            true,
+        "MEMORY_PRESSURE_GC":            true,
+        "LOG_RETENTION_DAYS":            true,
+        "METRICS_RETENTION_DAYS":        true,
+        "LOG_RETENTION_INTERVAL":        true,
+}
 
-        if agentID > 0 {
-                query += fmt.Sprintf(" AND agent_id = $%d", argNum)
-                args = append(args, agentID)
-                argNum++
+func loadLiveConfig() *liveConfig {
+        qh, err := parseQuietHours(os.Getenv("QUIET_HOURS"), os.Getenv("QUIET_HOURS_DAYS"),
+                os.Getenv("QUIET_HOURS_TZ"), getEnvInt("QUIET_HOURS_MIN_PRIORITY", 1))
+        if err != nil {
+                log.Printf("Ignoring QUIET_HOURS: %v", err)
         }
-        if level != "" {
-                query += fmt.Sprintf(" AND level = $%d", argNum)
-                args = append(args, level)
-                argNum++
+
+        return &liveConfig{
+                maxCommandLength:     getEnvInt("MAX_COMMAND_LENGTH", 65536),
+                minIdleAgents:        getEnvInt("MIN_IDLE_AGENTS", 0),
+                killOnDisconnect:     os.Getenv("KILL_ON_DISCONNECT") == "true",
+                allowedWorkDirs:      parseAllowedWorkDirs(os.Getenv("ALLOWED_WORKDIRS")),
+                allowedOrigins:       parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS")),
+                keepRawOutput:        os.Getenv("KEEP_RAW_OUTPUT") == "true",
+                postProcessors:       parseOutputProcessors(strings.Split(os.Getenv("OUTPUT_POSTPROCESSORS"), ",")),
+                logAgentTransitions:  os.Getenv("LOG_AGENT_TRANSITIONS") == "true",
+                preCheckTimeout:      time.Duration(getEnvInt("PRECHECK_TIMEOUT_MS", 30000)) * time.Millisecond,
+                fanOutParallel:       max(getEnvInt("FANOUT_MAX_PARALLEL", 8), 1),
+                agentMetricsInterval: getEnvDuration("AGENT_METRICS_INTERVAL", 0),
+
+                monitorSampleInterval:    max(getEnvDuration("MONITOR_SAMPLE_INTERVAL", 2*time.Second), minMonitorInterval),
+                monitorPersistInterval:   max(getEnvDuration("MONITOR_PERSIST_INTERVAL", 2*time.Second), minMonitorInterval),
+                monitorBroadcastInterval: max(getEnvDuration("MONITOR_BROADCAST_INTERVAL", 2*time.Second), minMonitorInterval),
+                monitorJitter:            getEnvDuration("MONITOR_JITTER", 200*time.Millisecond),
+
+                maxFailovers:        getEnvInt("MAX_FAILOVERS", 3),
+                maxRetries:          max(getEnvInt("QUEUE_MAX_RETRIES", 0), 0),
+                retryBackoffBase:    getEnvDuration("RETRY_BACKOFF_BASE", time.Second),
+                retryBackoffMax:     getEnvDuration("RETRY_BACKOFF_MAX", 5*time.Minute),
+                dangerousPatterns:   parseDangerousPatterns(os.Getenv("DANGEROUS_PATTERNS")),
+                commandPolicy:       loadCommandPolicy(),
+                runPrefixMode:       parseRunPrefixMode(os.Getenv("REQUIRE_RUN_PREFIX")),
+                probeBinaries:       parseProbeBinaries(os.Getenv("PROBE_REQUIRED_BINARIES")),
+                confirmTimeout:      getEnvDuration("CONFIRM_TIMEOUT", 5*time.Minute),
+                pendingTTL:          getEnvDuration("PENDING_TTL", 0),
+                expiryWebhook:       os.Getenv("PENDING_EXPIRY_WEBHOOK"),
+                quarantineThreshold: max(getEnvInt("QUARANTINE_THRESHOLD", 0), 0),
+                quarantineWindow:    getEnvDuration("QUARANTINE_WINDOW", time.Hour),
+                quarantineWebhook:   os.Getenv("QUARANTINE_WEBHOOK"),
+                weightMaxWait:       time.Duration(getEnvInt("WEIGHTED_DISPATCH_MAX_WAIT_MS", 10000)) * time.Millisecond,
+                commandDiffMaxBytes: getEnvInt("COMMAND_DIFF_MAX_BYTES", 4096),
+                writeTimeout:        time.Duration(getEnvInt("WS_WRITE_TIMEOUT_MS", 5000)) * time.Millisecond,
+                resultCacheTTL:      getEnvDuration("RESULT_CACHE_TTL", time.Minute),
+                quietHours:          qh,
+                concurrencyFactor:   getEnvFloat("CONCURRENCY_CPU_FACTOR", 0),
+                keepTerminal:        getEnvInt("QUEUE_KEEP_TERMINAL", 1000),
+                commandTimeout:      time.Duration(getEnvInt("DEFAULT_COMMAND_TIMEOUT_MS", 60000)) * time.Millisecond,
+                memoryLimitMB:       getEnvFloat("MEMORY_PRESSURE_MB", 0),
+                memoryPressureGC:    os.Getenv("MEMORY_PRESSURE_GC") == "true",
+                logRetention:        time.Duration(max(getEnvInt("LOG_RETENTION_DAYS", 0), 0)) * 24 * time.Hour,
+                metricsRetention:    time.Duration(max(getEnvInt("METRICS_RETENTION_DAYS", 0), 0)) * 24 * time.Hour,
+                retentionInterval:   getEnvDuration("LOG_RETENTION_INTERVAL", time.Hour),
         }
+}
 
-        query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d", argNum)
-        args = append(args, limit)
+func (am *AgentManager) config() *liveConfig {
+        return am.live.Load()
+}
 
-        rows, err := am.db.Query(query, args...)
-        if err != nil {
-                log.Printf("Error getting logs: %v", err)
-                return nil
+// loadDotenv copies ../.env into the environment without overriding the
+// process environment. previous are the keys an earlier call set; those
+// follow the file, and are unset once it no longer has them. It returns the
+// keys it set.
+func loadDotenv(previous map[string]bool) map[string]bool {
+        values, err := godotenv.Read("../.env")
+        if err != nil && !errors.Is(err, os.ErrNotExist) {
+                log.Printf("Error reading .env: %v", err)
+                return previous
         }
-        defer rows.Close()
 
-        var logs []LogEntry
-        for rows.Next() {
-                var entry LogEntry
-                err := rows.Scan(&entry.ID, &entry.AgentID, &entry.Level, &entry.Message,
-                        &entry.Command, &entry.Output, &entry.ExitCode, &entry.Duration, &entry.Timestamp)
-                if err != nil {
+        loaded := make(map[string]bool)
+        for key := range previous {
+                if _, ok := values[key]; !ok {
+                        os.Unsetenv(key)
+                }
+        }
+        for key, value := range values {
+                if _, set := os.LookupEnv(key); set && !previous[key] {
                         continue
                 }
-                logs = append(logs, entry)
+                os.Setenv(key, value)
+                loaded[key] = true
         }
-        return logs
+        return loaded
 }
 
-func (am *AgentManager) GetResourceHistory(limit int) []ResourceMetric {
-        if am.db == nil {
-                return nil
-        }
+// envValue is an environment variable as it was before the config table
+// overrode it.
+type envValue struct {
+        value string
+        set   bool
+}
 
-        rows, err := am.db.Query(`SELECT id, cpu_percent, memory_mb, memory_percent, goroutines, 
-                num_gc, alloc_mb, sys_mb, agent_count, queue_count, created_at 
-                FROM resource_metrics ORDER BY created_at DESC LIMIT $1`, limit)
+// readConfigTable returns the rows of the config table, none without a
+// database.
+func (am *AgentManager) readConfigTable() (map[string]string, error) {
+        values := make(map[string]string)
+        if am.db() == nil {
+                return values, nil
+        }
+        rows, err := am.db().Query(`SELECT key, value FROM config`)
         if err != nil {
-                log.Printf("Error getting resource history: %v", err)
-                return nil
+                return nil, err
         }
         defer rows.Close()
-
-        var metrics []ResourceMetric
         for rows.Next() {
-                var m ResourceMetric
-                err := rows.Scan(&m.ID, &m.CPUPercent, &m.MemoryMB, &m.MemoryPerc, &m.Goroutines,
-                        &m.NumGC, &m.AllocMB, &m.SysMB, &m.AgentCount, &m.QueueCount, &m.Timestamp)
-                if err != nil {
+                var key, value string
+                if err := rows.Scan(&key, &value); err != nil {
+                        return nil, err
+                }
+                values[key] = value
+        }
+        return values, rows.Err()
+}
+
+// restoreShadowedEnv undoes applyConfigTable, putting back the environment
+// values the config table overrode.
+func (am *AgentManager) restoreShadowedEnv() {
+        for key, old := range am.shadowedEnv {
+                if old.set {
+                        os.Setenv(key, old.value)
+                } else {
+                        os.Unsetenv(key)
+                }
+        }
+        am.shadowedEnv = nil
+}
+
+// applyConfigTable sets the environment from the config table rows in
+// values, ahead of .env and the process environment. Only settings that can
+// change live are taken: the others are read once at startup, before the
+// database is connected, so a row could never take effect. Secrets are
+// never taken either; they only come from the environment. Both kinds are
+// logged and skipped.
+func (am *AgentManager) applyConfigTable(values map[string]string) {
+        applied := make(map[string]string, len(values))
+        shadowed := make(map[string]envValue, len(values))
+        for key, value := range values {
+                if !liveConfigKeys[key] || secretConfigKeys[key] {
+                        log.Printf("Ignoring config table setting %s: only settings that can change live, and no secrets, are read from the database", key)
                         continue
                 }
-                metrics = append(metrics, m)
+                old, set := os.LookupEnv(key)
+                shadowed[key] = envValue{value: old, set: set}
+                os.Setenv(key, value)
+                applied[key] = value
         }
-        return metrics
+        am.shadowedEnv = shadowed
+        am.configTable.Store(&applied)
 }
 
-func (am *AgentManager) AddAgent(name string) *Agent {
-        am.agentLock.Lock()
-        defer am.agentLock.Unlock()
+// fromConfigTable reports whether key's value came from the config table.
+func (am *AgentManager) fromConfigTable(key string) bool {
+        table := am.configTable.Load()
+        if table == nil {
+                return false
+        }
+        _, ok := (*table)[key]
+        return ok
+}
 
-        if len(am.agents) >= am.maxAgents {
-                return nil
+// ConfigReload reports what a reload changed: Applied took effect at once,
+// RequiresRestart only takes effect on the next start, and Overridden was
+// changed at runtime (safe mode, persistence), which keeps precedence.
+type ConfigReload struct {
+        Applied         []string `json:"applied"`
+        RequiresRestart []string `json:"requires_restart"`
+        Overridden      []string `json:"overridden"`
+}
+
+// ReloadConfig re-reads .env, the environment and the config table and
+// applies whatever is safe to change live; a config table row wins over
+// the environment. The COMMAND_POLICY_FILE is re-read every time, since it
+// can change without its path changing.
+func (am *AgentManager) ReloadConfig() ConfigReload {
+        am.reloadLock.Lock()
+        defer am.reloadLock.Unlock()
+
+        settings := am.EffectiveConfig()
+        before := make(map[string]string, len(settings))
+        for _, setting := range settings {
+                before[setting.Key] = os.Getenv(setting.Key)
         }
 
-        id := 1
-        for {
-                if _, exists := am.agents[id]; !exists {
-                        break
+        table, err := am.readConfigTable()
+        if err != nil {
+                log.Printf("Error reading config table, keeping its previous settings: %v", err)
+                if previous := am.configTable.Load(); previous != nil {
+                        table = *previous
                 }
-                id++
         }
+        am.restoreShadowedEnv()
+        am.dotenvKeys = loadDotenv(am.dotenvKeys)
+        am.applyConfigTable(table)
 
-        agent := &Agent{
-                ID:          id,
-                Name:        name,
-                Status:      "idle",
-                CurrentTask: "",
-                StartTime:   time.Now(),
-                LastExecute: time.Now(),
+        reload := ConfigReload{Applied: []string{}, RequiresRestart: []string{}, Overridden: []string{}}
+        for _, setting := range settings {
+                if os.Getenv(setting.Key) == before[setting.Key] {
+                        continue
+                }
+                if _, ok := am.runtimeConfig.Load(setting.Key); ok {
+                        reload.Overridden = append(reload.Overridden, setting.Key)
+                } else if liveConfigKeys[setting.Key] {
+                        reload.Applied = append(reload.Applied, setting.Key)
+                } else {
+                        reload.RequiresRestart = append(reload.RequiresRestart, setting.Key)
+                }
         }
-        am.agents[id] = agent
 
-        am.saveAgentToDB(agent)
+        live := loadLiveConfig()
+        if !live.commandPolicy.equal(am.config().commandPolicy) && !slices.Contains(reload.Applied, "COMMAND_POLICY_FILE") {
+                reload.Applied = append(reload.Applied, "COMMAND_POLICY_FILE")
+        }
+        if len(reload.Applied) == 0 && len(reload.RequiresRestart) == 0 && len(reload.Overridden) == 0 {
+                return reload
+        }
 
+        am.live.Store(live)
+        if am.config().concurrencyFactor > 0 {
+                am.refreshConcurrencyLimit()
+        } else {
+                am.execLimiter.SetLimit(getEnvInt("MAX_CONCURRENT_COMMANDS", 0))
+        }
+        if slices.Contains(reload.Applied, "SAFE_MODE") {
+                am.SetSafeMode(os.Getenv("SAFE_MODE") == "true")
+                am.runtimeConfig.Delete("SAFE_MODE")
+        }
+
+        message := fmt.Sprintf("Configuration reloaded: applied %v, requires restart %v, overridden at runtime %v",
+                reload.Applied, reload.RequiresRestart, reload.Overridden)
+        log.Println(message)
+        am.saveLogToDB(&LogEntry{Level: "info", Message: message})
         am.broadcastMessage(Message{
-                Type:    "agent_added",
-                Payload: agent,
+                Type:    "config_updated",
+                Payload: reload,
         })
+        return reload
+}
 
-        am.saveLogToDB(&LogEntry{
-                AgentID: id,
-                Level:   "info",
-                Message: fmt.Sprintf("Agent '%s' created", name),
-        })
+func NewAgentManager() *AgentManager {
+        dotenvKeys := loadDotenv(nil)
 
-        return agent
-}
+        logDir := os.Getenv("AI_LOG_DIR")
+        if logDir == "" {
+                logDir = "./logs"
+        }
+        os.MkdirAll(logDir, 0755)
 
-func (am *AgentManager) RemoveAgent(id int) bool {
-        am.agentLock.Lock()
-        defer am.agentLock.Unlock()
+        am := &AgentManager{
+                agents:     make(map[int]*Agent),
+                leases:     make(map[int]*AgentLease),
+                queue:      make([]QueueItem, 0),
+                clients:    make(map[*websocket.Conn]*ClientSession),
+                detached:   make(map[string]*ClientSession),
+                logDir:     logDir,
+                apiKey:     os.Getenv("OPENROUTER_API_KEY"),
+                chatModel:  os.Getenv("OPENROUTER_MODEL"),
+                chatClient: &http.Client{Timeout: time.Duration(getEnvInt("OPENROUTER_TIMEOUT_MS", 60000)) * time.Millisecond},
+                maxAgents:  10,
+                maxClients: getEnvInt("MAX_WS_CLIENTS", 1000),
+                agentLoops: make(map[int]context.CancelFunc),
+                dotenvKeys: dotenvKeys,
+
+                clientBuffer: max(getEnvInt("CLIENT_SEND_BUFFER", 256), 1),
+                shares:       make(map[int]*dispatchShare),
+                groups:       make(map[string]*AgentGroup),
+                batchSize:    5,
+
+                batchStarts:  make(map[string]time.Time),
+                sysMetrics:   newSystemMetrics(),
+                retryBudgets: make(map[string]*RetryBudget),
+                finishedDeps: make(map[int]string),
+
+                runningCommands: make(map[int][]*runningCommand),
+                cancelledItems:  make(map[int]bool),
+
+                outputFlushInterval: time.Duration(getEnvInt("OUTPUT_FLUSH_INTERVAL_MS", 5000)) * time.Millisecond,
+                shutdownGrace:       getEnvDuration("SHUTDOWN_GRACE_PERIOD", 30*time.Second),
+                reconnectGrace:      time.Duration(getEnvInt("WS_RECONNECT_GRACE_MS", 10000)) * time.Millisecond,
+                leaseTTL:            time.Duration(getEnvInt("AGENT_LEASE_TTL_SECONDS", 300)) * time.Second,
+                logFileMaxBytes:     int64(getEnvInt("LOG_FILE_MAX_MB", 50)) * 1024 * 1024,
+                logFileMaxRotations: getEnvInt("LOG_FILE_MAX_ROTATIONS", 5),
+                isolateCommands:     os.Getenv("ISOLATE_COMMANDS") == "true",
+                processGroups:       os.Getenv("PROCESS_GROUPS") == "true",
+                changes:             newChangeFeed(getEnvInt("CHANGE_FEED_SIZE", 1000)),
+                changeFeedPersist:   os.Getenv("CHANGE_FEED_PERSIST") == "true",
+                durations:           newDurationHistogram(time.Duration(getEnvInt("DURATION_WINDOW_SECONDS", 0)) * time.Second),
+                execLimiter:         newExecLimiter(getEnvInt("MAX_CONCURRENT_COMMANDS", 0)),
+                dbPool: dbPoolConfig{
+                        maxOpen:       getEnvInt("DB_MAX_OPEN_CONNS", 25),
+                        maxIdle:       getEnvInt("DB_MAX_IDLE_CONNS", 5),
+                        maxLifetime:   getEnvDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+                        maxIdleTime:   getEnvDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute),
+                        checkInterval: getEnvDuration("DB_RECONNECT_INTERVAL", 10*time.Second),
+                },
+        }
 
-        if agent, exists := am.agents[id]; exists {
-                am.saveLogToDB(&LogEntry{
-                        AgentID: id,
-                        Level:   "info",
-                        Message: fmt.Sprintf("Agent '%s' removed", agent.Name),
-                })
+        if size := getEnvInt("COMMAND_HISTORY_SIZE", 20); size > 0 {
+                am.commandHistory = newCommandHistory(size, os.Getenv("COMMAND_HISTORY_KEEP_OUTPUT") != "false")
+        }
 
-                delete(am.agents, id)
-                am.deleteAgentFromDB(id)
+        am.resultCache = newResultCache()
+        am.quarantine = newQuarantine()
+        am.gitCommits = &gitCommitCache{entries: make(map[string]gitCommitEntry)}
+        am.tracer = newSpanExporter()
+        am.logSink = newLogSink()
+        outputCipher, err := newOutputCipher(os.Getenv("OUTPUT_ENCRYPTION_KEY"))
+        if err != nil {
+                log.Fatalf("Invalid OUTPUT_ENCRYPTION_KEY: %v", err)
+        }
+        am.outputCipher = outputCipher
 
-                am.broadcastMessage(Message{
-                        Type:    "agent_removed",
-                        Payload: map[string]int{"id": id},
-                })
-                return true
+        am.live.Store(loadLiveConfig())
+        am.running.Store(true)
+        am.ephemeral.Store(os.Getenv("EPHEMERAL") == "true")
+        am.safeMode.Store(os.Getenv("SAFE_MODE") == "true")
+        am.refreshConcurrencyLimit()
+
+        am.initDatabase()
+        if table, err := am.readConfigTable(); err != nil {
+                log.Printf("Error reading config table: %v", err)
+        } else if len(table) > 0 {
+                am.applyConfigTable(table)
+                am.live.Store(loadLiveConfig())
+                am.safeMode.Store(os.Getenv("SAFE_MODE") == "true")
+                am.execLimiter.SetLimit(getEnvInt("MAX_CONCURRENT_COMMANDS", 0))
+                am.refreshConcurrencyLimit()
         }
-        return false
+        am.loadChangeCursor()
+        am.loadStateFromDB()
+
+        return am
 }
 
-func (am *AgentManager) GetAgents() []*Agent {
-        am.agentLock.RLock()
-        defer am.agentLock.RUnlock()
+// encryptedPrefix marks a stored value as sealed by outputCipher, so rows
+// written before a key was set (or after it was removed) still read back.
+const encryptedPrefix = "enc:v1:"
 
-        agents := make([]*Agent, 0, len(am.agents))
-        for _, agent := range am.agents {
-                agents = append(agents, agent)
-        }
-        return agents
+// outputCipher seals command output with AES-GCM for storage at rest.
+type outputCipher struct {
+        aead cipher.AEAD
 }
 
-func (am *AgentManager) validateCommand(command string) (string, bool) {
-        if !strings.HasPrefix(command, "RUN ") {
-                return "", false
+// newOutputCipher builds a cipher from a hex or base64 AES key of 16, 24 or
+// 32 bytes. An empty key returns nil, which leaves output in plaintext.
+func newOutputCipher(key string) (*outputCipher, error) {
+        if key == "" {
+                return nil, nil
         }
-        actualCmd := strings.TrimPrefix(command, "RUN ")
-        actualCmd = strings.TrimSpace(actualCmd)
-        if actualCmd == "" {
-                return "", false
+        raw, err := hex.DecodeString(key)
+        if err != nil {
+                if raw, err = base64.StdEncoding.DecodeString(key); err != nil {
+                        return nil, errors.New("key must be hex or base64")
+                }
         }
-        
-        blockedPatterns := []string{
-                "rm -rf /",
-                "dd if=",
-                ":(){:|:&};:",
-                "> /dev/sd",
-                "mkfs.",
-                "chmod -R 777 /",
-                "chown -R",
+        block, err := aes.NewCipher(raw)
+        if err != nil {
+                return nil, err
         }
-        lowerCmd := strings.ToLower(actualCmd)
-        for _, pattern := range blockedPatterns {
-                if strings.Contains(lowerCmd, pattern) {
-                        return "", false
-                }
+        aead, err := cipher.NewGCM(block)
+        if err != nil {
+                return nil, err
         }
-        
-        return actualCmd, true
+        return &outputCipher{aead: aead}, nil
 }
 
-func (am *AgentManager) AddToQueue(commands map[string]string) {
-        am.queueLock.Lock()
-        defer am.queueLock.Unlock()
-
-        batchID := fmt.Sprintf("batch_%d", time.Now().UnixNano())
-        baseIndex := len(am.queue)
-
-        for i := 1; i <= len(commands); i++ {
-                key := fmt.Sprintf("%d", i)
-                if cmd, exists := commands[key]; exists {
-                        item := QueueItem{
-                                Index:   baseIndex + i,
-                                Command: cmd,
-                                Status:  "pending",
-                                BatchID: batchID,
-                        }
-
-                        item.ID = am.saveQueueItemToDB(&item)
-                        am.queue = append(am.queue, item)
-                }
+// Seal encrypts s behind encryptedPrefix. Without a cipher, and for empty
+// output, s is returned as is. When no nonce can be generated it returns an
+// error, and callers skip the write rather than store s in the clear.
+func (c *outputCipher) Seal(s string) (string, error) {
+        if c == nil || s == "" {
+                return s, nil
         }
+        nonce := make([]byte, c.aead.NonceSize())
+        if _, err := rand.Read(nonce); err != nil {
+                return "", fmt.Errorf("generating output nonce: %w", err)
+        }
+        sealed := c.aead.Seal(nonce, nonce, []byte(s), nil)
+        return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
 
-        am.broadcastMessage(Message{
-                Type:    "queue_updated",
-                Payload: am.queue,
-        })
+// Open reverses Seal. Plaintext values pass through; sealed ones that cannot
+// be decrypted, for want of the right key, come back as a placeholder.
+func (c *outputCipher) Open(s string) string {
+        encoded, sealed := strings.CutPrefix(s, encryptedPrefix)
+        if !sealed {
+                return s
+        }
+        if c == nil {
+                return "[encrypted output: OUTPUT_ENCRYPTION_KEY is not set]"
+        }
+        data, err := base64.StdEncoding.DecodeString(encoded)
+        if err != nil || len(data) < c.aead.NonceSize() {
+                return "[encrypted output could not be decrypted]"
+        }
+        nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+        plain, err := c.aead.Open(nil, nonce, ciphertext, nil)
+        if err != nil {
+                return "[encrypted output could not be decrypted]"
+        }
+        return string(plain)
+}
 
-        am.saveLogToDB(&LogEntry{
-                Level:   "info",
-                Message: fmt.Sprintf("Added %d commands to queue (batch: %s)", len(commands), batchID),
-        })
+// dbPoolConfig sizes both database pools (DB_MAX_OPEN_CONNS,
+// DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME, DB_CONN_MAX_IDLE_TIME) and sets
+// how often watchDatabase checks on them (DB_RECONNECT_INTERVAL, 0 = never).
+type dbPoolConfig struct {
+        maxOpen       int
+        maxIdle       int
+        maxLifetime   time.Duration
+        maxIdleTime   time.Duration
+        checkInterval time.Duration
 }
 
-func (am *AgentManager) AddToQueueWithPriority(command string, priority int) {
-        am.queueLock.Lock()
-        defer am.queueLock.Unlock()
+// dbPingTimeout bounds a single connection attempt or health check.
+const dbPingTimeout = 5 * time.Second
 
-        item := QueueItem{
-                Index:    len(am.queue) + 1,
-                Command:  command,
-                Status:   "pending",
-                Priority: priority,
+func openDatabase(dbURL string, pool dbPoolConfig) (*sql.DB, error) {
+        db, err := sql.Open("postgres", dbURL)
+        if err != nil {
+                return nil, err
         }
+        db.SetMaxOpenConns(pool.maxOpen)
+        db.SetMaxIdleConns(pool.maxIdle)
+        db.SetConnMaxLifetime(pool.maxLifetime)
+        db.SetConnMaxIdleTime(pool.maxIdleTime)
+        if err = pingDatabase(db); err != nil {
+                db.Close()
+                return nil, err
+        }
+        return db, nil
+}
 
-        item.ID = am.saveQueueItemToDB(&item)
-        am.queue = append(am.queue, item)
-
-        am.broadcastMessage(Message{
-                Type:    "queue_updated",
-                Payload: am.queue,
-        })
+func pingDatabase(db *sql.DB) error {
+        ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+        defer cancel()
+        return db.PingContext(ctx)
 }
 
-func (am *AgentManager) GetQueueList() []QueueItem {
-        am.queueLock.RLock()
-        defer am.queueLock.RUnlock()
-        return am.queue
+// db is the hot pool (DATABASE_URL: agents, queue), or nil while it is not
+// connected.
+func (am *AgentManager) db() *sql.DB {
+        return am.hotPool.Load()
 }
 
-func (am *AgentManager) RemoveFromQueue(index int) bool {
-        am.queueLock.Lock()
-        defer am.queueLock.Unlock()
+// logsDB is the cold pool (LOGS_DATABASE_URL: logs, resource_metrics). It
+// is the hot pool itself when there is no separate logs database.
+func (am *AgentManager) logsDB() *sql.DB {
+        return am.coldPool.Load()
+}
 
-        for i, item := range am.queue {
-                if item.Index == index {
-                        am.deleteQueueItemFromDB(item.ID)
-                        am.queue = append(am.queue[:i], am.queue[i+1:]...)
-                        am.broadcastMessage(Message{
-                                Type:    "queue_updated",
-                                Payload: am.queue,
-                        })
-                        return true
-                }
+func (am *AgentManager) initDatabase() {
+        if os.Getenv("DATABASE_URL") == "" {
+                log.Println("DATABASE_URL not set, running without persistence")
+        }
+        hotErr, coldErr := am.connectDatabases()
+        if hotErr != nil {
+                log.Printf("Error connecting to database: %v", hotErr)
+        }
+        if coldErr != nil {
+                log.Printf("Error connecting to logs database: %v", coldErr)
         }
-        return false
 }
 
-func (am *AgentManager) GetNextQueueItem() *QueueItem {
-        am.queueLock.Lock()
-        defer am.queueLock.Unlock()
-
-        var bestItem *QueueItem
-        var bestIdx int = -1
-        bestPriority := -1
+// connectDatabases opens whichever pool is configured but not connected yet
+// and creates its schema. Without a separate logs URL the cold pool shares
+// the hot one, and it falls back to it when the logs URL cannot be reached.
+func (am *AgentManager) connectDatabases() (hotErr, coldErr error) {
+        dbURL := os.Getenv("DATABASE_URL")
+        logsURL := os.Getenv("LOGS_DATABASE_URL")
 
-        for i, item := range am.queue {
-                if item.Status == "pending" && item.Priority > bestPriority {
-                        bestItem = &am.queue[i]
-                        bestIdx = i
-                        bestPriority = item.Priority
+        if dbURL != "" && am.db() == nil {
+                if db, err := openDatabase(dbURL, am.dbPool); err != nil {
+                        hotErr = err
+                } else {
+                        if _, err := db.Exec(hotSchema); err != nil {
+                                log.Printf("Error creating schema: %v", err)
+                        }
+                        am.hotPool.Store(db)
+                        am.hotUp.Store(true)
+                        log.Println("Connected to PostgreSQL database")
                 }
         }
 
-        if bestItem != nil {
-                am.queue[bestIdx].Status = "running"
-                am.updateQueueItemInDB(&am.queue[bestIdx])
-                return bestItem
+        if am.logsDB() != nil {
+                return hotErr, nil
         }
-        return nil
+        var logs *sql.DB
+        if logsURL == "" || logsURL == dbURL {
+                logs = am.db()
+        } else if db, err := openDatabase(logsURL, am.dbPool); err != nil {
+                if logs = am.db(); logs != nil {
+                        log.Printf("Error connecting to logs database, falling back to DATABASE_URL: %v", err)
+                } else {
+                        coldErr = err
+                }
+        } else {
+                logs = db
+                log.Println("Connected to PostgreSQL logs database")
+        }
+        if logs != nil {
+                if _, err := logs.Exec(coldSchema); err != nil {
+                        log.Printf("Error creating logs schema: %v", err)
+                }
+                am.coldPool.Store(logs)
+                am.coldUp.Store(true)
+        }
+        return hotErr, coldErr
 }
 
-func (am *AgentManager) GetNextBatch(batchSize int) []QueueItem {
-        am.queueLock.Lock()
-        defer am.queueLock.Unlock()
+// watchDatabase runs for the life of the process, every
+// DB_RECONNECT_INTERVAL. It keeps trying to open a pool that never
+// connected, for example because the database was down at startup, and
+// pings the open ones so that losing and regaining the connection is
+// logged once each way. database/sql re-dials broken connections itself,
+// so an open pool recovers without being replaced.
+//
+// A hot pool that connects late gets its schema but not the state
+// loadStateFromDB would have read, so queue and agent writes stay off until
+// a restart; logs and metrics go to it straight away.
+func (am *AgentManager) watchDatabase() {
+        if am.dbPool.checkInterval <= 0 {
+                return
+        }
+        warnedUnsynced := false
+        for {
+                time.Sleep(am.dbPool.checkInterval)
+                if am.stopping() {
+                        return
+                }
 
-        var batch []QueueItem
-        for i := range am.queue {
-                if am.queue[i].Status == "pending" && len(batch) < batchSize {
-                        am.queue[i].Status = "running"
-                        am.updateQueueItemInDB(&am.queue[i])
-                        batch = append(batch, am.queue[i])
+                hotErr, coldErr := am.connectDatabases()
+                if am.db() != nil && !am.stateLoaded.Load() && !warnedUnsynced {
+                        warnedUnsynced = true
+                        log.Println("Database connected after startup; agent and queue persistence stays off until restart")
+                        am.saveLogToDB(&LogEntry{
+                                Level:   "warn",
+                                Message: "Database connected after startup; restart to persist agents and queue items",
+                        })
+                }
+                if db := am.db(); hotErr == nil && db != nil {
+                        hotErr = pingDatabase(db)
+                }
+                if os.Getenv("DATABASE_URL") != "" {
+                        noteDatabaseState("Database", &am.hotUp, hotErr)
+                }
+                if logs := am.logsDB(); logs != nil && logs != am.db() {
+                        noteDatabaseState("Logs database", &am.coldUp, pingDatabase(logs))
+                } else if logs == nil && os.Getenv("LOGS_DATABASE_URL") != "" {
+                        noteDatabaseState("Logs database", &am.coldUp, coldErr)
+                } else {
+                        am.coldUp.Store(am.hotUp.Load())
                 }
         }
-        return batch
 }
 
-func (am *AgentManager) CompleteQueueItem(index int, output string, success bool) {
-        am.queueLock.Lock()
-        defer am.queueLock.Unlock()
+// stopping reports whether Shutdown has begun, for background jobs that
+// should not touch the databases once it has.
+func (am *AgentManager) stopping() bool {
+        am.shutdownLock.Lock()
+        defer am.shutdownLock.Unlock()
+        return am.shuttingDown
+}
 
-        for i, item := range am.queue {
-                if item.Index == index {
-                        if success {
-                                am.queue[i].Status = "completed"
-                        } else {
-                                am.queue[i].Status = "failed"
-                        }
-                        am.queue[i].Output = output
-                        am.updateQueueItemInDB(&am.queue[i])
+// noteDatabaseState records the outcome of a check in up and logs when it
+// differs from the previous one.
+func noteDatabaseState(name string, up *atomic.Bool, err error) {
+        if err != nil {
+                if up.Swap(false) {
+                        log.Printf("%s connection lost: %v", name, err)
+                }
+                return
+        }
+        if !up.Swap(true) {
+                log.Printf("%s connection restored", name)
+        }
+}
+
+// dbHealth describes a pool for /health.
+func dbHealth(db *sql.DB, up bool) map[string]interface{} {
+        if db == nil {
+                return map[string]interface{}{"connected": false}
+        }
+        stats := db.Stats()
+        return map[string]interface{}{
+                "connected":            true,
+                "reachable":            up,
+                "open_connections":     stats.OpenConnections,
+                "in_use":               stats.InUse,
+                "idle":                 stats.Idle,
+                "max_open_connections": stats.MaxOpenConnections,
+                "wait_count":           stats.WaitCount,
+                "wait_duration_ms":     stats.WaitDuration.Milliseconds(),
+        }
+}
+
+const hotSchema = `
+        CREATE TABLE IF NOT EXISTS agents (
+                id SERIAL PRIMARY KEY,
+                name VARCHAR(255) NOT NULL,
+                status VARCHAR(50) DEFAULT 'idle',
+                current_task TEXT DEFAULT '',
+                start_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                last_execute TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                memory_usage FLOAT DEFAULT 0,
+                cpu_usage FLOAT DEFAULT 0,
+                network_usage FLOAT DEFAULT 0,
+                tasks_done INT DEFAULT 0,
+                tasks_failed INT DEFAULT 0,
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS config (
+                key VARCHAR(100) PRIMARY KEY,
+                value TEXT NOT NULL,
+                updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS agent_groups (
+                name VARCHAR(255) PRIMARY KEY,
+                labels TEXT DEFAULT '[]',
+                env TEXT DEFAULT '{}',
+                working_dir TEXT DEFAULT '',
+                weight INT DEFAULT 0,
+                allowed_commands TEXT DEFAULT '[]',
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS queue (
+                id SERIAL PRIMARY KEY,
+                idx INT NOT NULL,
+                command TEXT NOT NULL,
+                status VARCHAR(50) DEFAULT 'pending',
+                output TEXT DEFAULT '',
+                agent_id INT DEFAULT 0,
+                priority INT DEFAULT 0,
+                batch_id VARCHAR(100) DEFAULT '',
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        ALTER TABLE agents ADD COLUMN IF NOT EXISTS labels TEXT DEFAULT '[]';
+        ALTER TABLE agents ADD COLUMN IF NOT EXISTS working_dir TEXT DEFAULT '';
+        ALTER TABLE agents ADD COLUMN IF NOT EXISTS env TEXT DEFAULT '{}';
+        ALTER TABLE agents ADD COLUMN IF NOT EXISTS bootstrap TEXT DEFAULT '';
+        ALTER TABLE agents ADD COLUMN IF NOT EXISTS weight INT DEFAULT 1;
+        ALTER TABLE agents ADD COLUMN IF NOT EXISTS group_name VARCHAR(255) DEFAULT '';
+        ALTER TABLE agents ADD COLUMN IF NOT EXISTS allowed_commands TEXT DEFAULT '[]';
+        ALTER TABLE agents ADD COLUMN IF NOT EXISTS fifo BOOLEAN DEFAULT FALSE;
+        ALTER TABLE agents ADD COLUMN IF NOT EXISTS max_concurrent INTEGER DEFAULT 1;
+        ALTER TABLE agents ADD COLUMN IF NOT EXISTS paused BOOLEAN DEFAULT FALSE;
+
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS success_pattern TEXT DEFAULT '';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS failure_pattern TEXT DEFAULT '';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS kill_on_match BOOLEAN DEFAULT FALSE;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS pattern_timeout_ms INT DEFAULT 0;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS pre_check TEXT DEFAULT '';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS depends_on TEXT DEFAULT '[]';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS failover_count INTEGER DEFAULT 0;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS on_timeout TEXT DEFAULT '';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS timeout_ms INTEGER DEFAULT 0;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS timeout_retries INTEGER DEFAULT 0;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS pinned_agent INTEGER DEFAULT 0;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS max_retries INTEGER DEFAULT 0;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS retry_count INTEGER DEFAULT 0;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS retry_at TIMESTAMPTZ;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS fan_out TEXT DEFAULT '[]';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS fan_out_quorum INTEGER DEFAULT 0;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS stagger_ms INTEGER DEFAULT 0;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS cacheable BOOLEAN DEFAULT FALSE;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS cache_ttl_ms INTEGER DEFAULT 0;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS annotations TEXT DEFAULT '';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS annotated_by VARCHAR(255) DEFAULT '';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS annotated_at VARCHAR(64) DEFAULT '';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS expedited_at VARCHAR(64) DEFAULT '';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS env TEXT DEFAULT '{}';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS working_dir TEXT DEFAULT '';
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS run_at TIMESTAMPTZ;
+        ALTER TABLE queue ADD COLUMN IF NOT EXISTS started BOOLEAN DEFAULT FALSE;
+
+        CREATE INDEX IF NOT EXISTS idx_queue_status ON queue(status);
+        CREATE INDEX IF NOT EXISTS idx_queue_priority ON queue(priority DESC);
+        CREATE INDEX IF NOT EXISTS idx_queue_run_at ON queue(run_at) WHERE run_at IS NOT NULL;
+`
+
+// logsSearchText is the document GetLogs searches, capped so that a huge
+// output cannot overflow a tsvector. The GIN indexes in coldSchema are built
+// on these exact expressions, so they must stay in step. With
+// OUTPUT_ENCRYPTION_KEY set the output column holds ciphertext, and
+// logsSearchTextNoOutput leaves it out.
+const (
+        logsSearchText         = `to_tsvector('simple', left(COALESCE(command, '') || ' ' || COALESCE(message, '') || ' ' || COALESCE(output, ''), 262144))`
+        logsSearchTextNoOutput = `to_tsvector('simple', left(COALESCE(command, '') || ' ' || COALESCE(message, ''), 262144))`
+)
+
+const coldSchema = `
+        CREATE TABLE IF NOT EXISTS logs (
+                id SERIAL PRIMARY KEY,
+                agent_id INT,
+                level VARCHAR(20) DEFAULT 'info',
+                message TEXT,
+                command TEXT,
+                output TEXT,
+                exit_code INT DEFAULT 0,
+                duration_ms BIGINT DEFAULT 0,
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS resource_metrics (
+                id SERIAL PRIMARY KEY,
+                cpu_percent FLOAT DEFAULT 0,
+                memory_mb FLOAT DEFAULT 0,
+                memory_percent FLOAT DEFAULT 0,
+                goroutines INT DEFAULT 0,
+                num_gc INT DEFAULT 0,
+                alloc_mb FLOAT DEFAULT 0,
+                sys_mb FLOAT DEFAULT 0,
+                agent_count INT DEFAULT 0,
+                queue_count INT DEFAULT 0,
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS agent_metrics (
+                id SERIAL PRIMARY KEY,
+                metric_id INT,
+                agent_id INT NOT NULL,
+                agent_name VARCHAR(255),
+                status VARCHAR(50),
+                memory_usage FLOAT DEFAULT 0,
+                cpu_usage FLOAT DEFAULT 0,
+                network_usage FLOAT DEFAULT 0,
+                tasks_done INT DEFAULT 0,
+                tasks_failed INT DEFAULT 0,
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS command_history (
+                id SERIAL PRIMARY KEY,
+                command_hash VARCHAR(64) NOT NULL,
+                command TEXT,
+                output_hash VARCHAR(64),
+                output TEXT DEFAULT '',
+                exit_code INT DEFAULT 0,
+                changed BOOLEAN DEFAULT FALSE,
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS change_events (
+                cursor BIGINT PRIMARY KEY,
+                type VARCHAR(50) NOT NULL,
+                payload TEXT,
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        ALTER TABLE logs ADD COLUMN IF NOT EXISTS git_commit VARCHAR(64) DEFAULT '';
+        ALTER TABLE logs ADD COLUMN IF NOT EXISTS queue_id INTEGER DEFAULT 0;
+
+        CREATE INDEX IF NOT EXISTS idx_logs_agent ON logs(agent_id);
+        CREATE INDEX IF NOT EXISTS idx_logs_level ON logs(level);
+        CREATE INDEX IF NOT EXISTS idx_logs_queue ON logs(queue_id) WHERE queue_id > 0;
+        CREATE INDEX IF NOT EXISTS idx_logs_time ON logs(created_at);
+        CREATE INDEX IF NOT EXISTS idx_metrics_time ON resource_metrics(created_at);
+        CREATE INDEX IF NOT EXISTS idx_agent_metrics_agent ON agent_metrics(agent_id, created_at DESC);
+        CREATE INDEX IF NOT EXISTS idx_agent_metrics_time ON agent_metrics(created_at);
+        CREATE INDEX IF NOT EXISTS idx_command_history_hash ON command_history(command_hash, created_at DESC);
+        CREATE INDEX IF NOT EXISTS idx_logs_search ON logs USING GIN (` + logsSearchText + `);
+        CREATE INDEX IF NOT EXISTS idx_logs_search_no_output ON logs USING GIN (` + logsSearchTextNoOutput + `);
+`
+
+// validateStartup logs the effective configuration and fails when a feature
+// marked as required (REQUIRE_DB, REQUIRE_AI) is not actually available.
+func (am *AgentManager) validateStartup() error {
+        processors := make([]string, 0, len(am.config().postProcessors))
+        for _, p := range am.config().postProcessors {
+                processors = append(processors, p.Name)
+        }
+
+        log.Println("Effective configuration:")
+        log.Printf("  database:          connected=%v persistence=%v", am.db() != nil, am.persistenceEnabled())
+        log.Printf("  logs database:     connected=%v separate=%v", am.logsDB() != nil, am.logsDB() != nil && am.logsDB() != am.db())
+        log.Printf("  ai chat:           enabled=%v", am.apiKey != "")
+        log.Printf("  log dir:           %s (rotate at %d bytes, keep %d)", am.logDir, am.logFileMaxBytes, am.logFileMaxRotations)
+        log.Printf("  max agents:        %d", am.maxAgents)
+        log.Printf("  max ws clients:    %d", am.maxClients)
+        log.Printf("  reconnect grace:   %s", am.reconnectGrace)
+        log.Printf("  output flush:      %s", am.outputFlushInterval)
+        log.Printf("  post processors:   %v", processors)
+        log.Printf("  allowed workdirs:  %v", am.config().allowedWorkDirs)
+        log.Printf("  max command len:   %d", am.config().maxCommandLength)
+        log.Printf("  agent lease ttl:   %s", am.leaseTTL)
+        log.Printf("  pending ttl:       %s", am.config().pendingTTL)
+        if am.config().quietHours != nil {
+                log.Printf("  quiet hours:       %s %s (%s), min priority %d", os.Getenv("QUIET_HOURS"),
+                        os.Getenv("QUIET_HOURS_DAYS"), am.config().quietHours.loc, am.config().quietHours.minPriority)
+        }
+        concurrencyLimit, _ := am.execLimiter.Stats()
+        log.Printf("  concurrency limit: %d (cpu factor %.2f)", concurrencyLimit, am.config().concurrencyFactor)
+
+        var problems []string
+        if os.Getenv("REQUIRE_DB") == "true" && am.db() == nil {
+                if os.Getenv("DATABASE_URL") == "" {
+                        problems = append(problems, "REQUIRE_DB is set but DATABASE_URL is empty")
+                } else {
+                        problems = append(problems, "REQUIRE_DB is set but the database could not be reached")
+                }
+        }
+        if err := am.config().commandPolicy.err; err != nil {
+                problems = append(problems, err.Error())
+        }
+        if os.Getenv("REQUIRE_AI") == "true" && am.apiKey == "" {
+                problems = append(problems, "REQUIRE_AI is set but OPENROUTER_API_KEY is empty")
+        }
+
+        if len(problems) > 0 {
+                return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+        }
+        return nil
+}
+
+func (am *AgentManager) loadStateFromDB() {
+        if am.db() == nil {
+                return
+        }
+        am.stateLoaded.Store(true)
+
+        rows, err := am.db().Query(`SELECT id, name, status, current_task, start_time, last_execute, 
+                memory_usage, cpu_usage, network_usage, tasks_done, tasks_failed,
+                labels, working_dir, env, bootstrap, weight, group_name, allowed_commands, fifo, max_concurrent, paused FROM agents`)
+        if err != nil {
+                log.Printf("Error loading agents: %v", err)
+                return
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+                var agent Agent
+                var labels, env, allowed string
+                err := rows.Scan(&agent.ID, &agent.Name, &agent.Status, &agent.CurrentTask,
+                        &agent.StartTime, &agent.LastExecute, &agent.MemoryUsage, &agent.CPUUsage,
+                        &agent.NetworkUsage, &agent.TasksDone, &agent.TasksFailed,
+                        &labels, &agent.WorkingDir, &env, &agent.Bootstrap, &agent.Weight,
+                        &agent.Group, &allowed, &agent.FIFO, &agent.MaxConcurrent, &agent.Paused)
+                if err != nil {
+                        log.Printf("Error scanning agent: %v", err)
+                        continue
+                }
+                json.Unmarshal([]byte(labels), &agent.Labels)
+                json.Unmarshal([]byte(env), &agent.Env)
+                json.Unmarshal([]byte(allowed), &agent.AllowedCommands)
+                am.agents[agent.ID] = &agent
+        }
+
+        gRows, err := am.db().Query(`SELECT name, labels, env, working_dir, weight, allowed_commands FROM agent_groups`)
+        if err != nil {
+                log.Printf("Error loading agent groups: %v", err)
+        } else {
+                for gRows.Next() {
+                        var group AgentGroup
+                        var labels, env, allowed string
+                        if err := gRows.Scan(&group.Name, &labels, &env, &group.WorkingDir, &group.Weight, &allowed); err != nil {
+                                log.Printf("Error scanning agent group: %v", err)
+                                continue
+                        }
+                        json.Unmarshal([]byte(labels), &group.Labels)
+                        json.Unmarshal([]byte(env), &group.Env)
+                        json.Unmarshal([]byte(allowed), &group.AllowedCommands)
+                        am.groups[group.Name] = &group
+                }
+                gRows.Close()
+        }
+
+        qRows, err := am.db().Query(`SELECT id, idx, command, status, output, agent_id, priority, batch_id, created_at,
+                success_pattern, failure_pattern, kill_on_match, pattern_timeout_ms, pre_check, depends_on, fan_out, fan_out_quorum,
+                stagger_ms, cacheable, cache_ttl_ms, annotations, annotated_by, annotated_at, failover_count,
+                on_timeout, timeout_retries, timeout_ms, pinned_agent, max_retries, retry_count, retry_at, expedited_at,
+                env, working_dir, run_at, started
+                FROM queue WHERE status != 'completed' ORDER BY priority DESC, id ASC`)
+        if err != nil {
+                log.Printf("Error loading queue: %v", err)
+                return
+        }
+        defer qRows.Close()
+
+        for qRows.Next() {
+                var item QueueItem
+                var dependsOn, fanOut, env string
+                var retryAt, runAt sql.NullTime
+                err := qRows.Scan(&item.ID, &item.Index, &item.Command, &item.Status, &item.Output,
+                        &item.AgentID, &item.Priority, &item.BatchID, &item.CreatedAt,
+                        &item.SuccessPattern, &item.FailurePattern, &item.KillOnMatch, &item.PatternTimeoutMs, &item.PreCheck, &dependsOn, &fanOut, &item.FanOutQuorum,
+                        &item.StaggerMs, &item.Cacheable, &item.CacheTTLMs, &item.Annotations, &item.AnnotatedBy, &item.AnnotatedAt,
+                        &item.FailoverCount, &item.OnTimeout, &item.TimeoutRetries, &item.TimeoutMs, &item.PinnedAgent,
+                        &item.MaxRetries, &item.RetryCount, &retryAt, &item.ExpeditedAt,
+                        &env, &item.WorkingDir, &runAt, &item.Started)
+                if err != nil {
+                        log.Printf("Error scanning queue item: %v", err)
+                        continue
+                }
+                json.Unmarshal([]byte(dependsOn), &item.DependsOn)
+                json.Unmarshal([]byte(fanOut), &item.FanOut)
+                json.Unmarshal([]byte(env), &item.Env)
+                item.Output = am.outputCipher.Open(item.Output)
+                item.RetryAt = retryAt.Time
+                item.RunAt = runAt.Time
+                am.queue = append(am.queue, item)
+        }
+        if err := am.db().QueryRow(`SELECT COALESCE(MAX(idx), 0) FROM queue`).Scan(&am.lastIndex); err != nil {
+                log.Printf("Error reading last queue index: %v", err)
+        }
+
+        am.markInterruptedItems()
+
+        log.Printf("Loaded %d agents and %d queue items from database", len(am.agents), len(am.queue))
+}
+
+// expireStalePending marks pending items that have waited longer than
+// PENDING_TTL without ever starting as "expired", so orphaned work (for
+// example items no agent can take) does not pile up unnoticed. Scheduled
+// items wait from their RunAt.
+func (am *AgentManager) expireStalePending() {
+        if am.config().pendingTTL <= 0 {
+                return
+        }
+
+        am.queueLock.Lock()
+        var expired []QueueItem
+        now := time.Now()
+        for i := range am.queue {
+                item := &am.queue[i]
+                if item.Status != "pending" || item.CreatedAt == "" || item.Started {
+                        continue
+                }
+                created, err := time.Parse(time.RFC3339Nano, item.CreatedAt)
+                if err != nil {
+                        continue
+                }
+                if item.RunAt.After(created) {
+                        created = item.RunAt
+                }
+                if now.Sub(created) < am.config().pendingTTL {
+                        continue
+                }
+                item.Status = "expired"
+                am.updateQueueItemInDB(item)
+                expired = append(expired, *item)
+        }
+        if len(expired) > 0 {
+                am.broadcastMessage(Message{
+                        Type:    "queue_updated",
+                        Payload: am.queue,
+                })
+        }
+        am.queueLock.Unlock()
+
+        for _, item := range expired {
+                am.saveLogToDB(&LogEntry{
+                        Level:   "warn",
+                        Message: fmt.Sprintf("Queue item %d expired after pending for more than %s", item.Index, am.config().pendingTTL),
+                        Command: item.Command,
+                })
+                if am.config().expiryWebhook != "" {
+                        go am.notifyWebhook(am.config().expiryWebhook, "queue_item_expired", item)
+                }
+        }
+}
+
+// notifyWebhook POSTs {event, payload, timestamp} to url. Failures are only
+// logged; notifications are best effort.
+func (am *AgentManager) notifyWebhook(url, event string, payload interface{}) {
+        body, err := json.Marshal(map[string]interface{}{
+                "event":     event,
+                "payload":   payload,
+                "timestamp": time.Now().Format(time.RFC3339),
+        })
+        if err != nil {
+                log.Printf("Error encoding %s webhook: %v", event, err)
+                return
+        }
+
+        client := &http.Client{Timeout: 10 * time.Second}
+        resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+        if err != nil {
+                log.Printf("Error sending %s webhook: %v", event, err)
+                return
+        }
+        resp.Body.Close()
+        if resp.StatusCode >= 300 {
+                log.Printf("Webhook for %s returned %s", event, resp.Status)
+        }
+}
+
+// spanExporter sends command execution spans to an OTLP/HTTP collector as
+// JSON. A nil exporter, used when no endpoint is configured, drops spans.
+type spanExporter struct {
+        endpoint string
+        headers  map[string]string
+        service  string
+        client   *http.Client
+        spans    chan otlpSpan
+}
+
+type otlpSpan struct {
+        TraceID           string          `json:"traceId"`
+        SpanID            string          `json:"spanId"`
+        Name              string          `json:"name"`
+        Kind              int             `json:"kind"`
+        StartTimeUnixNano string          `json:"startTimeUnixNano"`
+        EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+        Attributes        []otlpAttribute `json:"attributes"`
+        Events            []otlpEvent     `json:"events,omitempty"`
+        Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+        Key   string            `json:"key"`
+        Value map[string]string `json:"value"`
+}
+
+type otlpEvent struct {
+        TimeUnixNano string `json:"timeUnixNano"`
+        Name         string `json:"name"`
+}
+
+type otlpStatus struct {
+        Code    int    `json:"code"`
+        Message string `json:"message,omitempty"`
+}
+
+const (
+        spanKindInternal = 1
+        spanStatusOK     = 1
+        spanStatusError  = 2
+)
+
+// newSpanExporter reads the standard OTEL_EXPORTER_OTLP_* variables and
+// returns nil when neither endpoint is set.
+func newSpanExporter() *spanExporter {
+        endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+        if endpoint == "" {
+                base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+                if base == "" {
+                        return nil
+                }
+                endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+        }
+
+        headers := make(map[string]string)
+        for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+                if k, v, ok := strings.Cut(pair, "="); ok {
+                        headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+                }
+        }
+        service := os.Getenv("OTEL_SERVICE_NAME")
+        if service == "" {
+                service = "axshell-backend"
+        }
+
+        e := &spanExporter{
+                endpoint: endpoint,
+                headers:  headers,
+                service:  service,
+                client:   &http.Client{Timeout: 10 * time.Second},
+                spans:    make(chan otlpSpan, 1024),
+        }
+        go e.run()
+        return e
+}
+
+func randomHex(n int) string {
+        b := make([]byte, n)
+        rand.Read(b)
+        return hex.EncodeToString(b)
+}
+
+func unixNano(t time.Time) string {
+        return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// RecordCommand queues a span covering a command from dispatch (or from the
+// call, for direct executions) to completion. Spans are dropped rather than
+// blocking execution when the exporter falls behind.
+func (e *spanExporter) RecordCommand(opts ExecOptions, started time.Time, result CommandResult) {
+        if e == nil {
+                return
+        }
+
+        traceID := strings.ToLower(opts.TraceID)
+        if _, err := hex.DecodeString(traceID); err != nil || len(traceID) != 32 {
+                traceID = randomHex(16)
+        }
+        begin := started
+        events := []otlpEvent{}
+        if !opts.DispatchedAt.IsZero() {
+                begin = opts.DispatchedAt
+                events = append(events, otlpEvent{TimeUnixNano: unixNano(opts.DispatchedAt), Name: "dispatched"})
+        }
+        end := time.Now()
+        events = append(events,
+                otlpEvent{TimeUnixNano: unixNano(started), Name: "execution_started"},
+                otlpEvent{TimeUnixNano: unixNano(end), Name: "completed"})
+
+        status := otlpStatus{Code: spanStatusOK}
+        if result.ExitCode != 0 || result.Error != "" {
+                status = otlpStatus{Code: spanStatusError, Message: result.Error}
+        }
+        span := otlpSpan{
+                TraceID:           traceID,
+                SpanID:            randomHex(8),
+                Name:              "command.execute",
+                Kind:              spanKindInternal,
+                StartTimeUnixNano: unixNano(begin),
+                EndTimeUnixNano:   unixNano(end),
+                Attributes: []otlpAttribute{
+                        {Key: "axshell.agent_id", Value: map[string]string{"intValue": strconv.Itoa(result.AgentID)}},
+                        {Key: "axshell.queue_id", Value: map[string]string{"intValue": strconv.Itoa(opts.QueueID)}},
+                        {Key: "axshell.command_hash", Value: map[string]string{"stringValue": result.CommandHash}},
+                        {Key: "process.exit_code", Value: map[string]string{"intValue": strconv.Itoa(result.ExitCode)}},
+                        {Key: "axshell.duration_ms", Value: map[string]string{"intValue": strconv.FormatInt(result.Duration, 10)}},
+                },
+                Events: events,
+                Status: status,
+        }
+        if result.ErrorCode != "" {
+                span.Attributes = append(span.Attributes, otlpAttribute{Key: "axshell.error_code", Value: map[string]string{"stringValue": result.ErrorCode}})
+        }
+
+        select {
+        case e.spans <- span:
+        default:
+        }
+}
+
+// run batches spans and exports them every few seconds or once 100 have
+// accumulated.
+func (e *spanExporter) run() {
+        ticker := time.NewTicker(5 * time.Second)
+        defer ticker.Stop()
+
+        var batch []otlpSpan
+        for {
+                select {
+                case span := <-e.spans:
+                        batch = append(batch, span)
+                        if len(batch) < 100 {
+                                continue
+                        }
+                case <-ticker.C:
+                        if len(batch) == 0 {
+                                continue
+                        }
+                }
+                e.export(batch)
+                batch = nil
+        }
+}
+
+func (e *spanExporter) export(spans []otlpSpan) {
+        body, err := json.Marshal(map[string]interface{}{
+                "resourceSpans": []interface{}{map[string]interface{}{
+                        "resource": map[string]interface{}{
+                                "attributes": []otlpAttribute{{Key: "service.name", Value: map[string]string{"stringValue": e.service}}},
+                        },
+                        "scopeSpans": []interface{}{map[string]interface{}{
+                                "scope": map[string]string{"name": "ai-backend"},
+                                "spans": spans,
+                        }},
+                }},
+        })
+        if err != nil {
+                log.Printf("Error encoding spans: %v", err)
+                return
+        }
+
+        req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+        if err != nil {
+                log.Printf("Error exporting spans: %v", err)
+                return
+        }
+        req.Header.Set("Content-Type", "application/json")
+        for k, v := range e.headers {
+                req.Header.Set(k, v)
+        }
+        resp, err := e.client.Do(req)
+        if err != nil {
+                log.Printf("Error exporting spans: %v", err)
+                return
+        }
+        resp.Body.Close()
+        if resp.StatusCode >= 300 {
+                log.Printf("Span export returned %s", resp.Status)
+        }
+}
+
+// logSink forwards log entries off-box as they are written. LOG_SINK_URL
+// picks the transport: syslog+tcp:// or syslog+udp:// send RFC 5424
+// messages, tcp:// sends one JSON object per line and http(s):// POSTs each
+// entry as JSON. Entries wait in a buffer of LOG_SINK_BUFFER and are
+// dropped, and counted, once it is full. A nil sink drops everything.
+type logSink struct {
+        url      string
+        scheme   string
+        target   string
+        hostname string
+        client   *http.Client
+        conn     net.Conn
+        entries  chan LogEntry
+
+        sent    atomic.Int64
+        failed  atomic.Int64
+        dropped atomic.Int64
+}
+
+// logSinkRetries is how often a send is retried, with doubling backoff,
+// before the entry is given up on.
+const logSinkRetries = 3
+
+func newLogSink() *logSink {
+        raw := os.Getenv("LOG_SINK_URL")
+        if raw == "" {
+                return nil
+        }
+        u, err := url.Parse(raw)
+        if err != nil {
+                log.Printf("Ignoring LOG_SINK_URL: %v", err)
+                return nil
+        }
+        target := u.Host
+        switch u.Scheme {
+        case "syslog+tcp", "syslog+udp", "tcp":
+        case "http", "https":
+                target = raw
+        default:
+                log.Printf("Ignoring LOG_SINK_URL: unsupported scheme %q", u.Scheme)
+                return nil
+        }
+
+        hostname, _ := os.Hostname()
+        if hostname == "" {
+                hostname = "-"
+        }
+        s := &logSink{
+                url:      u.Redacted(),
+                scheme:   u.Scheme,
+                target:   target,
+                hostname: hostname,
+                client:   &http.Client{Timeout: 10 * time.Second},
+                entries:  make(chan LogEntry, max(getEnvInt("LOG_SINK_BUFFER", 1000), 1)),
+        }
+        go s.run()
+        return s
+}
+
+// Forward queues a copy of entry for the sink without blocking the caller.
+func (s *logSink) Forward(entry *LogEntry) {
+        if s == nil {
+                return
+        }
+        copied := *entry
+        if copied.Timestamp == "" {
+                copied.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+        }
+        select {
+        case s.entries <- copied:
+        default:
+                s.dropped.Add(1)
+        }
+}
+
+func (s *logSink) run() {
+        for entry := range s.entries {
+                payload, err := s.encode(entry)
+                if err != nil {
+                        log.Printf("Error encoding log for sink: %v", err)
+                        s.failed.Add(1)
+                        continue
+                }
+
+                backoff := 500 * time.Millisecond
+                for attempt := 0; ; attempt++ {
+                        if err = s.send(payload); err == nil {
+                                s.sent.Add(1)
+                                break
+                        }
+                        if attempt == logSinkRetries {
+                                log.Printf("Error forwarding log to sink: %v", err)
+                                s.failed.Add(1)
+                                break
+                        }
+                        time.Sleep(backoff)
+                        backoff *= 2
+                }
+        }
+}
+
+// syslogSeverity maps log levels to RFC 5424 severities.
+var syslogSeverity = map[string]int{
+        "error": 3,
+        "warn":  4,
+        "info":  6,
+        "debug": 7,
+}
+
+// syslogEscaper escapes structured data parameter values (RFC 5424 6.3.3).
+var syslogEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func (s *logSink) encode(entry LogEntry) ([]byte, error) {
+        if !strings.HasPrefix(s.scheme, "syslog") {
+                body, err := json.Marshal(entry)
+                if s.scheme == "tcp" {
+                        body = append(body, '\n')
+                }
+                return body, err
+        }
+
+        severity, ok := syslogSeverity[entry.Level]
+        if !ok {
+                severity = 6
+        }
+        msgID := "-"
+        if entry.Command != "" {
+                msgID = "command"
+        }
+        data := fmt.Sprintf(`[axshell@32473 agent_id="%d" exit_code="%d" duration_ms="%d"`,
+                entry.AgentID, entry.ExitCode, entry.Duration)
+        if entry.Command != "" {
+                data += fmt.Sprintf(` command="%s"`, syslogEscaper.Replace(entry.Command))
+        }
+        if entry.GitCommit != "" {
+                data += fmt.Sprintf(` git_commit="%s"`, entry.GitCommit)
+        }
+        data += "]"
+        message := entry.Message
+        if entry.Output != "" {
+                message += "\n" + entry.Output
+        }
+
+        // Facility 1 (user-level messages).
+        line := fmt.Sprintf("<%d>1 %s %s ai-backend %d %s %s %s",
+                1*8+severity, entry.Timestamp, s.hostname, os.Getpid(), msgID, data, message)
+        if s.scheme == "syslog+tcp" {
+                // Octet counting (RFC 6587) so multi-line output stays one message.
+                line = fmt.Sprintf("%d %s", len(line), line)
+        }
+        return []byte(line), nil
+}
+
+func (s *logSink) send(payload []byte) error {
+        if s.scheme == "http" || s.scheme == "https" {
+                resp, err := s.client.Post(s.target, "application/json", bytes.NewReader(payload))
+                if err != nil {
+                        return err
+                }
+                resp.Body.Close()
+                if resp.StatusCode >= 300 {
+                        return fmt.Errorf("log sink returned %s", resp.Status)
+                }
+                return nil
+        }
+
+        if s.conn == nil {
+                network := "tcp"
+                if s.scheme == "syslog+udp" {
+                        network = "udp"
+                }
+                conn, err := net.DialTimeout(network, s.target, 5*time.Second)
+                if err != nil {
+                        return err
+                }
+                s.conn = conn
+        }
+        s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+        if _, err := s.conn.Write(payload); err != nil {
+                s.conn.Close()
+                s.conn = nil
+                return err
+        }
+        return nil
+}
+
+func (s *logSink) Stats() map[string]interface{} {
+        if s == nil {
+                return nil
+        }
+        return map[string]interface{}{
+                "url":      s.url,
+                "buffered": len(s.entries),
+                "sent":     s.sent.Load(),
+                "failed":   s.failed.Load(),
+                "dropped":  s.dropped.Load(),
+        }
+}
+
+// markInterruptedItems flags items that were still running when the process
+// went down. Their partial output was flushed while they ran, so they are kept
+// as "interrupted" rather than silently re-dispatched.
+func (am *AgentManager) markInterruptedItems() {
+        count := 0
+        for i := range am.queue {
+                if am.queue[i].Status != "running" {
+                        continue
+                }
+                am.queue[i].Status = "interrupted"
+                am.updateQueueItemInDB(&am.queue[i])
+                count++
+        }
+
+        if count > 0 {
+                log.Printf("Marked %d queue items as interrupted after restart", count)
+                am.saveLogToDB(&LogEntry{
+                        Level:   "warn",
+                        Message: fmt.Sprintf("%d queue items were interrupted by a restart and need to be re-run", count),
+                })
+        }
+}
+
+// persistenceEnabled reports whether writes should reach the database. Reads
+// keep using am.db() directly so an ephemeral run can still inspect history.
+func (am *AgentManager) persistenceEnabled() bool {
+        return am.db() != nil && am.stateLoaded.Load() && !am.ephemeral.Load()
+}
+
+// logsPersistenceEnabled is persistenceEnabled for the logs/metrics pool.
+// As there, readers check logsDB() instead.
+func (am *AgentManager) logsPersistenceEnabled() bool {
+        return am.logsDB() != nil && !am.ephemeral.Load()
+}
+
+// pruneBatchSize bounds each retention DELETE, so clearing a large backlog
+// never holds its row locks for long.
+const pruneBatchSize = 5000
+
+var errNoLogsDatabase = errors.New("logs database is not connected or persistence is off")
+
+// PruneResult counts the rows one retention run removed.
+type PruneResult struct {
+        Logs            int64 `json:"logs"`
+        ResourceMetrics int64 `json:"resource_metrics"`
+        AgentMetrics    int64 `json:"agent_metrics"`
+}
+
+// PruneLogs deletes logs older than logAge, and resource and agent metrics
+// older than metricsAge. A zero age leaves those tables alone.
+func (am *AgentManager) PruneLogs(logAge, metricsAge time.Duration) (PruneResult, error) {
+        var result PruneResult
+        if !am.logsPersistenceEnabled() {
+                return result, errNoLogsDatabase
+        }
+        db := am.logsDB()
+
+        var err error
+        if logAge > 0 {
+                if result.Logs, err = pruneTable(db, "logs", logAge); err != nil {
+                        return result, err
+                }
+        }
+        if metricsAge > 0 {
+                if result.ResourceMetrics, err = pruneTable(db, "resource_metrics", metricsAge); err != nil {
+                        return result, err
+                }
+                if result.AgentMetrics, err = pruneTable(db, "agent_metrics", metricsAge); err != nil {
+                        return result, err
+                }
+        }
+        log.Printf("Retention removed %d logs, %d resource metrics and %d agent metrics",
+                result.Logs, result.ResourceMetrics, result.AgentMetrics)
+        return result, nil
+}
+
+// pruneTable deletes rows of table created more than age ago, in batches of
+// pruneBatchSize, and returns how many went.
+func pruneTable(db *sql.DB, table string, age time.Duration) (int64, error) {
+        query := `DELETE FROM ` + table + ` WHERE id IN (
+                SELECT id FROM ` + table + ` WHERE created_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second' LIMIT $2)`
+
+        var total int64
+        for {
+                res, err := db.Exec(query, age.Seconds(), pruneBatchSize)
+                if err != nil {
+                        return total, fmt.Errorf("pruning %s: %w", table, err)
+                }
+                n, _ := res.RowsAffected()
+                total += n
+                if n < pruneBatchSize {
+                        return total, nil
+                }
+        }
+}
+
+// pruneLogsPeriodically runs the retention job for the life of the process:
+// once at startup, then every LOG_RETENTION_INTERVAL.
+func (am *AgentManager) pruneLogsPeriodically() {
+        for !am.stopping() {
+                cfg := am.config()
+                if (cfg.logRetention > 0 || cfg.metricsRetention > 0) && am.logsPersistenceEnabled() {
+                        if _, err := am.PruneLogs(cfg.logRetention, cfg.metricsRetention); err != nil {
+                                log.Printf("Error pruning logs: %v", err)
+                        }
+                }
+                time.Sleep(max(cfg.retentionInterval, time.Minute))
+        }
+}
+
+func (am *AgentManager) SetPersistence(enabled bool) {
+        if am.ephemeral.Swap(!enabled) == !enabled {
+                return
+        }
+        am.runtimeConfig.Store("EPHEMERAL", true)
+
+        if enabled {
+                log.Println("Persistence enabled")
+                am.advanceQueueIDs()
+        } else {
+                log.Println("Persistence disabled, running in ephemeral mode")
+        }
+
+        am.broadcastMessage(Message{
+                Type: "persistence_changed",
+                Payload: map[string]interface{}{
+                        "enabled":      enabled,
+                        "db_connected": am.db() != nil,
+                },
+        })
+}
+
+// advanceQueueIDs moves the queue id sequence past every index handed out,
+// so rows inserted from now on never get an id that an item added in
+// ephemeral mode (keyed by its index) already goes by.
+func (am *AgentManager) advanceQueueIDs() {
+        if !am.persistenceEnabled() {
+                return
+        }
+        am.queueLock.RLock()
+        last := am.lastIndex
+        am.queueLock.RUnlock()
+        _, err := am.db().Exec(`SELECT setval(pg_get_serial_sequence('queue', 'id'),
+                GREATEST($1::bigint, nextval(pg_get_serial_sequence('queue', 'id'))))`, last)
+        if err != nil {
+                log.Printf("Error advancing queue ids: %v", err)
+        }
+}
+
+// SetSafeMode turns the execution brake on or off at runtime.
+func (am *AgentManager) SetSafeMode(enabled bool) {
+        if am.safeMode.Swap(enabled) == enabled {
+                return
+        }
+        am.runtimeConfig.Store("SAFE_MODE", true)
+
+        level, message := "info", "Safe mode disabled, command execution resumed"
+        if enabled {
+                level, message = "warn", "Safe mode enabled, command execution refused"
+        }
+        log.Println(message)
+        am.saveLogToDB(&LogEntry{
+                Level:   level,
+                Message: message,
+        })
+
+        am.broadcastMessage(Message{
+                Type:    "safe_mode_changed",
+                Payload: map[string]bool{"enabled": enabled},
+        })
+}
+
+// Banner is an operator notice for every connected dashboard. An empty Text
+// clears it.
+type Banner struct {
+        Text      string `json:"text"`
+        Severity  string `json:"severity,omitempty"`
+        ExpiresAt string `json:"expires_at,omitempty"`
+        SetAt     string `json:"set_at,omitempty"`
+}
+
+var bannerSeverities = map[string]bool{"info": true, "warning": true, "critical": true}
+
+// SetBanner publishes a banner, or clears it when text is empty, and
+// broadcasts the change. A positive ttl clears it again once it expires.
+func (am *AgentManager) SetBanner(text, severity string, ttl time.Duration) (Banner, error) {
+        if text == "" {
+                if am.banner.Swap(nil) != nil {
+                        am.broadcastMessage(Message{Type: "banner", Payload: Banner{}})
+                }
+                return Banner{}, nil
+        }
+        if severity == "" {
+                severity = "info"
+        }
+        if !bannerSeverities[severity] {
+                return Banner{}, fmt.Errorf("unknown severity %q (want info, warning or critical)", severity)
+        }
+
+        banner := &Banner{
+                Text:     text,
+                Severity: severity,
+                SetAt:    time.Now().Format(time.RFC3339),
+        }
+        if ttl > 0 {
+                banner.ExpiresAt = time.Now().Add(ttl).Format(time.RFC3339)
+        }
+        am.banner.Store(banner)
+        if ttl > 0 {
+                time.AfterFunc(ttl, func() {
+                        if am.banner.CompareAndSwap(banner, nil) {
+                                am.broadcastMessage(Message{Type: "banner", Payload: Banner{}})
+                        }
+                })
+        }
+
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: fmt.Sprintf("Banner set (%s): %s", severity, text),
+        })
+        am.broadcastMessage(Message{Type: "banner", Payload: banner})
+        return *banner, nil
+}
+
+// currentBanner returns the banner for the connected handshake, an empty
+// one when there is none.
+func (am *AgentManager) currentBanner() Banner {
+        if banner := am.banner.Load(); banner != nil {
+                return *banner
+        }
+        return Banner{}
+}
+
+func (am *AgentManager) saveAgentToDB(agent *Agent) {
+        if !am.persistenceEnabled() {
+                return
+        }
+
+        labels, _ := json.Marshal(agent.Labels)
+        env, _ := json.Marshal(agent.Env)
+        allowed, _ := json.Marshal(agent.AllowedCommands)
+
+        _, err := am.db().Exec(`
+                INSERT INTO agents (id, name, status, current_task, start_time, last_execute, 
+                        memory_usage, cpu_usage, network_usage, tasks_done, tasks_failed,
+                        labels, working_dir, env, bootstrap, weight, group_name, allowed_commands, fifo, max_concurrent, paused)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+                ON CONFLICT (id) DO UPDATE SET
+                        name = EXCLUDED.name,
+                        status = EXCLUDED.status,
+                        current_task = EXCLUDED.current_task,
+                        last_execute = EXCLUDED.last_execute,
+                        memory_usage = EXCLUDED.memory_usage,
+                        cpu_usage = EXCLUDED.cpu_usage,
+                        network_usage = EXCLUDED.network_usage,
+                        tasks_done = EXCLUDED.tasks_done,
+                        tasks_failed = EXCLUDED.tasks_failed,
+                        labels = EXCLUDED.labels,
+                        working_dir = EXCLUDED.working_dir,
+                        env = EXCLUDED.env,
+                        bootstrap = EXCLUDED.bootstrap,
+                        weight = EXCLUDED.weight,
+                        group_name = EXCLUDED.group_name,
+                        allowed_commands = EXCLUDED.allowed_commands,
+                        fifo = EXCLUDED.fifo,
+                        max_concurrent = EXCLUDED.max_concurrent,
+                        paused = EXCLUDED.paused
+        `, agent.ID, agent.Name, agent.Status, agent.CurrentTask, agent.StartTime,
+                agent.LastExecute, agent.MemoryUsage, agent.CPUUsage, agent.NetworkUsage,
+                agent.TasksDone, agent.TasksFailed,
+                string(labels), agent.WorkingDir, string(env), agent.Bootstrap, agent.Weight,
+                agent.Group, string(allowed), agent.FIFO, agent.MaxConcurrent, agent.Paused)
+        if err != nil {
+                log.Printf("Error saving agent to DB: %v", err)
+        }
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx.
+type rowQuerier interface {
+        QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func insertQueueItem(q rowQuerier, item *QueueItem) (int, error) {
+        var id int
+        dependsOn, _ := json.Marshal(item.DependsOn)
+        if item.DependsOn == nil {
+                dependsOn = []byte("[]")
+        }
+        fanOut, _ := json.Marshal(item.FanOut)
+        if item.FanOut == nil {
+                fanOut = []byte("[]")
+        }
+        env, _ := json.Marshal(item.Env)
+        if item.Env == nil {
+                env = []byte("{}")
+        }
+        var runAt sql.NullTime
+        if !item.RunAt.IsZero() {
+                runAt = sql.NullTime{Time: item.RunAt, Valid: true}
+        }
+        err := q.QueryRow(`
+                INSERT INTO queue (idx, command, status, output, agent_id, priority, batch_id,
+                        success_pattern, failure_pattern, kill_on_match, pattern_timeout_ms, pre_check, depends_on, fan_out, fan_out_quorum,
+                        stagger_ms, cacheable, cache_ttl_ms, annotations, annotated_by, annotated_at, on_timeout, timeout_ms, pinned_agent,
+                        max_retries, env, working_dir, run_at)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28)
+                RETURNING id
+        `, item.Index, item.Command, item.Status, item.Output, item.AgentID, item.Priority, item.BatchID,
+                item.SuccessPattern, item.FailurePattern, item.KillOnMatch, item.PatternTimeoutMs, item.PreCheck, string(dependsOn), string(fanOut), item.FanOutQuorum,
+                item.StaggerMs, item.Cacheable, item.CacheTTLMs, item.Annotations, item.AnnotatedBy, item.AnnotatedAt, item.OnTimeout, item.TimeoutMs, item.PinnedAgent,
+                item.MaxRetries, string(env), item.WorkingDir, runAt).Scan(&id)
+        return id, err
+}
+
+// saveQueueItemToDB inserts the item and returns its row id. Without
+// persistence it returns 0 and no error; callers must not keep an item whose
+// insert failed, otherwise memory and the queue table drift apart.
+func (am *AgentManager) saveQueueItemToDB(item *QueueItem) (int, error) {
+        if !am.persistenceEnabled() {
+                return 0, nil
+        }
+
+        id, err := insertQueueItem(am.db(), item)
+        if err != nil {
+                log.Printf("Error saving queue item to DB: %v", err)
+                return 0, err
+        }
+        return id, nil
+}
+
+func (am *AgentManager) updateQueueItemInDB(item *QueueItem) {
+        if !am.persistenceEnabled() {
+                return
+        }
+
+        var retryAt sql.NullTime
+        if !item.RetryAt.IsZero() {
+                retryAt = sql.NullTime{Time: item.RetryAt, Valid: true}
+        }
+        output, err := am.outputCipher.Seal(item.Output)
+        if err != nil {
+                log.Printf("Error updating queue item in DB: %v", err)
+                return
+        }
+        _, err = am.db().Exec(`
+                UPDATE queue SET status = $1, output = $2, agent_id = $3, failover_count = $4, timeout_retries = $5,
+                        retry_count = $6, retry_at = $7, started = $8, updated_at = CURRENT_TIMESTAMP
+                WHERE id = $9
+        `, item.Status, output, item.AgentID, item.FailoverCount, item.TimeoutRetries, item.RetryCount, retryAt, item.Started, item.ID)
+        if err != nil {
+                log.Printf("Error updating queue item in DB: %v", err)
+        }
+}
+
+func (am *AgentManager) updateQueueOutputInDB(id int, output string) {
+        if !am.persistenceEnabled() || id == 0 {
+                return
+        }
+
+        sealed, err := am.outputCipher.Seal(output)
+        if err != nil {
+                log.Printf("Error flushing queue item output to DB: %v", err)
+                return
+        }
+        _, err = am.db().Exec(`
+                UPDATE queue SET output = $1, updated_at = CURRENT_TIMESTAMP
+                WHERE id = $2
+        `, sealed, id)
+        if err != nil {
+                log.Printf("Error flushing queue item output to DB: %v", err)
+        }
+}
+
+func (am *AgentManager) saveLogToDB(entry *LogEntry) {
+        am.logSink.Forward(entry)
+        if !am.logsPersistenceEnabled() {
+                return
+        }
+
+        output, err := am.outputCipher.Seal(entry.Output)
+        if err != nil {
+                log.Printf("Error saving log to DB: %v", err)
+                return
+        }
+        _, err = am.logsDB().Exec(`
+                INSERT INTO logs (agent_id, level, message, command, output, exit_code, duration_ms, git_commit, queue_id)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        `, entry.AgentID, entry.Level, entry.Message, entry.Command, output, entry.ExitCode, entry.Duration, entry.GitCommit,
+                entry.QueueID)
+        if err != nil {
+                log.Printf("Error saving log to DB: %v", err)
+        }
+}
+
+func (am *AgentManager) saveResourceMetricToDB(metric *ResourceMetric) {
+        if !am.logsPersistenceEnabled() {
+                return
+        }
+
+        err := am.logsDB().QueryRow(`
+                INSERT INTO resource_metrics (cpu_percent, memory_mb, memory_percent, goroutines, num_gc, alloc_mb, sys_mb, agent_count, queue_count)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+                RETURNING id
+        `, metric.CPUPercent, metric.MemoryMB, metric.MemoryPerc, metric.Goroutines, metric.NumGC, metric.AllocMB, metric.SysMB, metric.AgentCount, metric.QueueCount).Scan(&metric.ID)
+        if err != nil {
+                log.Printf("Error saving resource metric to DB: %v", err)
+        }
+}
+
+// saveAgentMetricsToDB stores the per-agent side of a resource snapshot in
+// one transaction.
+func (am *AgentManager) saveAgentMetricsToDB(metrics []AgentMetric) {
+        if !am.logsPersistenceEnabled() || len(metrics) == 0 {
+                return
+        }
+
+        tx, err := am.logsDB().Begin()
+        if err != nil {
+                log.Printf("Error saving agent metrics to DB: %v", err)
+                return
+        }
+        for _, m := range metrics {
+                _, err := tx.Exec(`
+                        INSERT INTO agent_metrics (metric_id, agent_id, agent_name, status, memory_usage, cpu_usage, network_usage, tasks_done, tasks_failed)
+                        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+                `, m.MetricID, m.AgentID, m.AgentName, m.Status, m.MemoryUsage, m.CPUUsage, m.NetworkUsage, m.TasksDone, m.TasksFailed)
+                if err != nil {
+                        tx.Rollback()
+                        log.Printf("Error saving agent metrics to DB: %v", err)
+                        return
+                }
+        }
+        if err := tx.Commit(); err != nil {
+                log.Printf("Error saving agent metrics to DB: %v", err)
+        }
+}
+
+func (am *AgentManager) deleteAgentFromDB(id int) {
+        if !am.persistenceEnabled() {
+                return
+        }
+
+        _, err := am.db().Exec(`DELETE FROM agents WHERE id = $1`, id)
+        if err != nil {
+                log.Printf("Error deleting agent from DB: %v", err)
+        }
+}
+
+func (am *AgentManager) deleteQueueItemFromDB(id int) {
+        if !am.persistenceEnabled() {
+                return
+        }
+
+        _, err := am.db().Exec(`DELETE FROM queue WHERE id = $1`, id)
+        if err != nil {
+                log.Printf("Error deleting queue item from DB: %v", err)
+        }
+}
+
+// outputSearchable reports whether log searches cover command output, which
+// they cannot while OUTPUT_ENCRYPTION_KEY has it stored encrypted.
+func (am *AgentManager) outputSearchable() bool {
+        return am.outputCipher == nil
+}
+
+// GetLogs returns the newest logs, optionally narrowed to an agent, a level
+// and a full-text search. search takes web search syntax ("quoted phrases",
+// or, -excluded) and matches whole words of the command, message and
+// output, case-insensitively. Output is left out while it is stored
+// encrypted; see outputSearchable.
+func (am *AgentManager) GetLogs(limit int, agentID int, level, search string) []LogEntry {
+        if am.logsDB() == nil {
+                return nil
+        }
+
+        query := `SELECT id, agent_id, level, message, command, output, exit_code, duration_ms, created_at,
+                COALESCE(git_commit, '') FROM logs WHERE 1=1`
+        args := []interface{}{}
+        argNum := 1
+
+        if agentID > 0 {
+                query += fmt.Sprintf(" AND agent_id = $%d", argNum)
+                args = append(args, agentID)
+                argNum++
+        }
+        if level != "" {
+                query += fmt.Sprintf(" AND level = $%d", argNum)
+                args = append(args, level)
+                argNum++
+        }
+        if search != "" {
+                document := logsSearchText
+                if !am.outputSearchable() {
+                        document = logsSearchTextNoOutput
+                }
+                query += fmt.Sprintf(" AND %s @@ websearch_to_tsquery('simple', $%d)", document, argNum)
+                args = append(args, search)
+                argNum++
+        }
+
+        query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d", argNum)
+        args = append(args, limit)
+
+        rows, err := am.logsDB().Query(query, args...)
+        if err != nil {
+                log.Printf("Error getting logs: %v", err)
+                return nil
+        }
+        defer rows.Close()
+
+        var logs []LogEntry
+        for rows.Next() {
+                var entry LogEntry
+                err := rows.Scan(&entry.ID, &entry.AgentID, &entry.Level, &entry.Message,
+                        &entry.Command, &entry.Output, &entry.ExitCode, &entry.Duration, &entry.Timestamp, &entry.GitCommit)
+                if err != nil {
+                        continue
+                }
+                entry.Output = am.outputCipher.Open(entry.Output)
+                logs = append(logs, entry)
+        }
+        return logs
+}
+
+func (am *AgentManager) GetResourceHistory(limit int) []ResourceMetric {
+        if am.logsDB() == nil {
+                return nil
+        }
+
+        rows, err := am.logsDB().Query(`SELECT id, cpu_percent, memory_mb, memory_percent, goroutines, 
+                num_gc, alloc_mb, sys_mb, agent_count, queue_count, created_at 
+                FROM resource_metrics ORDER BY created_at DESC LIMIT $1`, limit)
+        if err != nil {
+                log.Printf("Error getting resource history: %v", err)
+                return nil
+        }
+        defer rows.Close()
+
+        var metrics []ResourceMetric
+        for rows.Next() {
+                var m ResourceMetric
+                err := rows.Scan(&m.ID, &m.CPUPercent, &m.MemoryMB, &m.MemoryPerc, &m.Goroutines,
+                        &m.NumGC, &m.AllocMB, &m.SysMB, &m.AgentCount, &m.QueueCount, &m.Timestamp)
+                if err != nil {
+                        continue
+                }
+                metrics = append(metrics, m)
+        }
+        return metrics
+}
+
+func (am *AgentManager) GetAgentMetricsHistory(agentID, limit int) []AgentMetric {
+        if am.logsDB() == nil {
+                return nil
+        }
+
+        rows, err := am.logsDB().Query(`SELECT COALESCE(metric_id, 0), agent_id, COALESCE(agent_name, ''), COALESCE(status, ''),
+                memory_usage, cpu_usage, network_usage, tasks_done, tasks_failed, created_at
+                FROM agent_metrics WHERE agent_id = $1 ORDER BY created_at DESC LIMIT $2`, agentID, limit)
+        if err != nil {
+                log.Printf("Error getting agent metrics history: %v", err)
+                return nil
+        }
+        defer rows.Close()
+
+        metrics := []AgentMetric{}
+        for rows.Next() {
+                var m AgentMetric
+                err := rows.Scan(&m.MetricID, &m.AgentID, &m.AgentName, &m.Status,
+                        &m.MemoryUsage, &m.CPUUsage, &m.NetworkUsage, &m.TasksDone, &m.TasksFailed, &m.Timestamp)
+                if err != nil {
+                        continue
+                }
+                metrics = append(metrics, m)
+        }
+        return metrics
+}
+
+func (am *AgentManager) AddAgent(name string) *Agent {
+        return am.AddAgentWithSpec(AgentSpec{Name: name})
+}
+
+func (am *AgentManager) AddAgentWithSpec(spec AgentSpec) *Agent {
+        name := spec.Name
+
+        am.agentLock.Lock()
+        defer am.agentLock.Unlock()
+
+        if len(am.agents) >= am.maxAgents {
+                return nil
+        }
+
+        id := 1
+        for {
+                if _, exists := am.agents[id]; !exists {
+                        break
+                }
+                id++
+        }
+
+        // Looked up under agentLock, so DeleteGroup cannot remove the group
+        // before the agent is in; an agent never names a missing group.
+        var allowed []string
+        if group, ok := am.GetGroup(spec.Group); ok {
+                spec = group.applyTo(spec)
+                allowed = group.AllowedCommands
+        } else {
+                spec.Group = ""
+        }
+
+        agent := &Agent{
+                ID:          id,
+                Name:        name,
+                Status:      "idle",
+                CurrentTask: "",
+                StartTime:   time.Now(),
+                LastExecute: time.Now(),
+                Labels:      spec.Labels,
+                WorkingDir:  spec.WorkingDir,
+                Env:         spec.Env,
+                Bootstrap:   spec.Bootstrap,
+                Weight:      spec.Weight,
+                FIFO:        spec.FIFO,
+
+                MaxConcurrent: clampConcurrency(spec.MaxConcurrent),
+
+                Group:           spec.Group,
+                AllowedCommands: allowed,
+        }
+        am.agents[id] = agent
+
+        am.saveAgentToDB(agent)
+
+        am.broadcastMessage(Message{
+                Type:    "agent_added",
+                Payload: agent,
+        })
+
+        am.saveLogToDB(&LogEntry{
+                AgentID: id,
+                Level:   "info",
+                Message: fmt.Sprintf("Agent '%s' created", name),
+        })
+
+        return agent
+}
+
+// LoadAgentsConfig reconciles the agent pool with the file named by
+// AGENTS_CONFIG: declared agents that are missing are created (and their
+// bootstrap run), existing ones get the declared settings, and with
+// AGENTS_CONFIG_PRUNE=true agents not in the file are removed.
+func (am *AgentManager) LoadAgentsConfig(path string, prune bool) error {
+        data, err := os.ReadFile(path)
+        if err != nil {
+                return err
+        }
+
+        var config AgentsConfig
+        if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+                err = yaml.Unmarshal(data, &config)
+        } else {
+                err = json.Unmarshal(data, &config)
+        }
+        if err != nil {
+                return fmt.Errorf("parsing %s: %v", path, err)
+        }
+
+        if err := am.checkStartupDependencies(config.Agents); err != nil {
+                return fmt.Errorf("%s: %v", path, err)
+        }
+
+        declared := make(map[string]bool)
+        created, updated := 0, 0
+        var startups []agentStartup
+        for _, spec := range config.Agents {
+                if spec.Name == "" {
+                        log.Printf("Skipping agent without a name in %s", path)
+                        continue
+                }
+                declared[spec.Name] = true
+
+                if existing := am.findAgentByName(spec.Name); existing != nil {
+                        am.agentLock.Lock()
+                        var allowed []string
+                        if group, ok := am.GetGroup(spec.Group); ok {
+                                spec = group.applyTo(spec)
+                                allowed = group.AllowedCommands
+                        } else {
+                                spec.Group = ""
+                        }
+                        existing.Group = spec.Group
+                        existing.AllowedCommands = allowed
+                        existing.Labels = spec.Labels
+                        existing.WorkingDir = spec.WorkingDir
+                        existing.Env = spec.Env
+                        existing.Bootstrap = spec.Bootstrap
+                        existing.Weight = spec.Weight
+                        existing.FIFO = spec.FIFO
+                        existing.MaxConcurrent = clampConcurrency(spec.MaxConcurrent)
+                        am.saveAgentToDB(existing)
+                        am.agentLock.Unlock()
+                        updated++
+                        continue
+                }
+
+                agent := am.AddAgentWithSpec(spec)
+                if agent == nil {
+                        log.Printf("Could not create agent '%s' from %s: max agents reached", spec.Name, path)
+                        continue
+                }
+                created++
+                startups = append(startups, agentStartup{agent: agent, spec: spec})
+        }
+        am.startAgents(startups)
+
+        removed := 0
+        if prune {
+                for _, agent := range am.GetAgents() {
+                        if !declared[agent.Name] && am.RemoveAgent(agent.ID) {
+                                removed++
+                        }
+                }
+        }
+
+        log.Printf("Agents config %s: %d created, %d updated, %d removed", path, created, updated, removed)
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: fmt.Sprintf("Reconciled agents from %s: %d created, %d updated, %d removed", path, created, updated, removed),
+        })
+        return nil
+}
+
+// applyTo fills the spec's unset fields from the group template.
+func (g AgentGroup) applyTo(spec AgentSpec) AgentSpec {
+        if len(spec.Labels) == 0 {
+                spec.Labels = g.Labels
+        }
+        if spec.WorkingDir == "" {
+                spec.WorkingDir = g.WorkingDir
+        }
+        if spec.Weight == 0 {
+                spec.Weight = g.Weight
+        }
+        if len(g.Env) > 0 {
+                env := make(map[string]string, len(g.Env)+len(spec.Env))
+                for k, v := range g.Env {
+                        env[k] = v
+                }
+                for k, v := range spec.Env {
+                        env[k] = v
+                }
+                spec.Env = env
+        }
+        return spec
+}
+
+func (am *AgentManager) GetGroup(name string) (AgentGroup, bool) {
+        am.groupLock.RLock()
+        defer am.groupLock.RUnlock()
+        group, ok := am.groups[name]
+        if !ok {
+                return AgentGroup{}, false
+        }
+        return *group, true
+}
+
+func (am *AgentManager) GetGroups() []AgentGroup {
+        am.groupLock.RLock()
+        defer am.groupLock.RUnlock()
+
+        groups := make([]AgentGroup, 0, len(am.groups))
+        for _, group := range am.groups {
+                groups = append(groups, *group)
+        }
+        sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+        return groups
+}
+
+var (
+        errGroupExists   = errors.New("group already exists")
+        errGroupNotFound = errors.New("group not found")
+        errGroupInUse    = errors.New("group still has member agents")
+)
+
+// mergeInto moves a member agent from the old template to this one. Fields
+// the agent still shares with the old template were inherited and follow the
+// group; anything the agent set itself is left alone.
+func (g AgentGroup) mergeInto(old AgentGroup, agent *Agent) {
+        if slices.Equal(agent.Labels, old.Labels) {
+                agent.Labels = g.Labels
+        }
+        if agent.WorkingDir == old.WorkingDir {
+                agent.WorkingDir = g.WorkingDir
+        }
+        if agent.Weight == old.Weight {
+                agent.Weight = g.Weight
+        }
+        env := make(map[string]string, len(agent.Env)+len(g.Env))
+        for k, v := range agent.Env {
+                if oldValue, inherited := old.Env[k]; inherited && oldValue == v {
+                        continue
+                }
+                env[k] = v
+        }
+        for k, v := range g.Env {
+                if _, own := env[k]; !own {
+                        env[k] = v
+                }
+        }
+        if len(env) == 0 {
+                env = nil
+        }
+        agent.Env = env
+        agent.AllowedCommands = g.AllowedCommands
+}
+
+// SaveGroup creates a group, or with replace set updates an existing one and
+// merges the new template into every member agent.
+func (am *AgentManager) SaveGroup(group AgentGroup, replace bool) (int, error) {
+        am.groupLock.Lock()
+        previous, exists := am.groups[group.Name]
+        switch {
+        case exists && !replace:
+                am.groupLock.Unlock()
+                return 0, errGroupExists
+        case !exists && replace:
+                am.groupLock.Unlock()
+                return 0, errGroupNotFound
+        }
+        if err := am.saveGroupToDB(&group); err != nil {
+                am.groupLock.Unlock()
+                return 0, err
+        }
+        var old AgentGroup
+        if exists {
+                old = *previous
+        }
+        am.groups[group.Name] = &group
+        am.groupLock.Unlock()
+
+        if !exists {
+                am.saveLogToDB(&LogEntry{Level: "info", Message: fmt.Sprintf("Agent group '%s' created", group.Name)})
+                return 0, nil
+        }
+
+        am.agentLock.Lock()
+        var members []*Agent
+        for _, agent := range am.agents {
+                if agent.Group != group.Name {
+                        continue
+                }
+                group.mergeInto(old, agent)
+                am.saveAgentToDB(agent)
+                members = append(members, agent)
+        }
+        am.agentLock.Unlock()
+
+        for _, agent := range members {
+                am.broadcastMessage(Message{
+                        Type:    "agent_status",
+                        Payload: agent,
+                })
+        }
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: fmt.Sprintf("Agent group '%s' updated, applied to %d agents", group.Name, len(members)),
+        })
+        return len(members), nil
+}
+
+// DeleteGroup removes a group that no agent belongs to any more. agentLock
+// is held throughout, taken before groupLock as AddAgentWithSpec does, so no
+// agent can join the group between the check and the delete.
+func (am *AgentManager) DeleteGroup(name string) error {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+        for _, agent := range am.agents {
+                if agent.Group == name {
+                        return errGroupInUse
+                }
+        }
+
+        am.groupLock.Lock()
+        defer am.groupLock.Unlock()
+
+        if _, ok := am.groups[name]; !ok {
+                return errGroupNotFound
+        }
+        if am.persistenceEnabled() {
+                if _, err := am.db().Exec(`DELETE FROM agent_groups WHERE name = $1`, name); err != nil {
+                        return err
+                }
+        }
+        delete(am.groups, name)
+        am.saveLogToDB(&LogEntry{Level: "info", Message: fmt.Sprintf("Agent group '%s' deleted", name)})
+        return nil
+}
+
+func (am *AgentManager) saveGroupToDB(group *AgentGroup) error {
+        if !am.persistenceEnabled() {
+                return nil
+        }
+
+        labels, _ := json.Marshal(group.Labels)
+        env, _ := json.Marshal(group.Env)
+        allowed, _ := json.Marshal(group.AllowedCommands)
+        _, err := am.db().Exec(`
+                INSERT INTO agent_groups (name, labels, env, working_dir, weight, allowed_commands)
+                VALUES ($1, $2, $3, $4, $5, $6)
+                ON CONFLICT (name) DO UPDATE SET
+                        labels = EXCLUDED.labels,
+                        env = EXCLUDED.env,
+                        working_dir = EXCLUDED.working_dir,
+                        weight = EXCLUDED.weight,
+                        allowed_commands = EXCLUDED.allowed_commands
+        `, group.Name, string(labels), string(env), group.WorkingDir, group.Weight, string(allowed))
+        return err
+}
+
+// shellMetachars chain, substitute or redirect commands. A line holding any
+// of them is more than the one command its prefix names.
+const shellMetachars = ";&|$`<>\n\r"
+
+// commandAllowed reports whether command matches one of the allowed command
+// prefixes; an empty list allows everything. Since the prefix only vouches
+// for the first command, lines with shell metacharacters never match, so
+// "ls && rm -rf /" does not pass as "ls".
+func commandAllowed(command string, allowed []string) bool {
+        if len(allowed) == 0 {
+                return true
+        }
+        if strings.ContainsAny(command, shellMetachars) {
+                return false
+        }
+        for _, prefix := range allowed {
+                prefix = strings.TrimSpace(prefix)
+                if prefix == "" {
+                        continue
+                }
+                if command == prefix || strings.HasPrefix(command, prefix+" ") {
+                        return true
+                }
+        }
+        return false
+}
+
+func (am *AgentManager) findAgentByName(name string) *Agent {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+        for _, agent := range am.agents {
+                if agent.Name == name {
+                        return agent
+                }
+        }
+        return nil
+}
+
+// agentStartup is a newly created agent waiting for its turn to bootstrap.
+type agentStartup struct {
+        agent *Agent
+        spec  AgentSpec
+        done  chan struct{}
+        ok    bool
+}
+
+// checkStartupDependencies rejects depends_on entries that name neither a
+// declared nor an existing agent, and dependency cycles, before anything is
+// created.
+func (am *AgentManager) checkStartupDependencies(specs []AgentSpec) error {
+        deps := make(map[string][]string)
+        for _, spec := range specs {
+                deps[spec.Name] = spec.DependsOn
+        }
+        for _, spec := range specs {
+                for _, dep := range spec.DependsOn {
+                        if _, ok := deps[dep]; !ok && am.findAgentByName(dep) == nil {
+                                return fmt.Errorf("agent '%s' depends on unknown agent '%s'", spec.Name, dep)
+                        }
+                }
+        }
+
+        const (
+                visiting = 1
+                visited  = 2
+        )
+        state := make(map[string]int)
+        var visit func(name string) error
+        visit = func(name string) error {
+                switch state[name] {
+                case visiting:
+                        return fmt.Errorf("agent dependency cycle through '%s'", name)
+                case visited:
+                        return nil
+                }
+                state[name] = visiting
+                for _, dep := range deps[name] {
+                        if err := visit(dep); err != nil {
+                                return err
+                        }
+                }
+                state[name] = visited
+                return nil
+        }
+        for _, spec := range specs {
+                if err := visit(spec.Name); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
+// startAgents bootstraps newly created agents in StartupOrder, each once its
+// prerequisites are ready, and reports progress with agent_startup. Agents
+// that depend on an agent outside the batch only need it to exist and not
+// have failed. A failed prerequisite fails its dependents without running
+// their bootstrap.
+func (am *AgentManager) startAgents(startups []agentStartup) {
+        byName := make(map[string]*agentStartup, len(startups))
+        for i := range startups {
+                startups[i].done = make(chan struct{})
+                byName[startups[i].spec.Name] = &startups[i]
+        }
+
+        for i := range startups {
+                s := &startups[i]
+                var earlier, prereqs []*agentStartup
+                var waitingOn []string
+                for j := range startups {
+                        if startups[j].spec.StartupOrder < s.spec.StartupOrder {
+                                earlier = append(earlier, &startups[j])
+                                waitingOn = append(waitingOn, startups[j].spec.Name)
+                        }
+                }
+                external := []string{}
+                for _, dep := range s.spec.DependsOn {
+                        p, ok := byName[dep]
+                        if !ok {
+                                external = append(external, dep)
+                                continue
+                        }
+                        prereqs = append(prereqs, p)
+                        if !slices.Contains(earlier, p) {
+                                waitingOn = append(waitingOn, dep)
+                        }
+                }
+
+                go func() {
+                        defer close(s.done)
+                        if len(waitingOn) > 0 {
+                                am.reportStartup(s.agent, "waiting", fmt.Sprintf("waiting on %s", strings.Join(waitingOn, ", ")))
+                        }
+                        for _, p := range earlier {
+                                <-p.done
+                        }
+                        for _, p := range prereqs {
+                                <-p.done
+                                if !p.ok {
+                                        am.failStartup(s.agent, fmt.Sprintf("prerequisite agent '%s' did not start", p.spec.Name))
+                                        return
+                                }
+                        }
+                        for _, dep := range external {
+                                if !am.agentAvailable(dep) {
+                                        am.failStartup(s.agent, fmt.Sprintf("prerequisite agent '%s' is not available", dep))
+                                        return
+                                }
+                        }
+                        s.ok = am.bootstrapAndStart(s.agent.ID, s.spec.Bootstrap)
+                        if s.ok {
+                                am.reportStartup(s.agent, "ready", "")
+                        }
+                }()
+        }
+}
+
+// agentAvailable reports whether the named agent exists and has not failed.
+func (am *AgentManager) agentAvailable(name string) bool {
+        agent := am.findAgentByName(name)
+        if agent == nil {
+                return false
+        }
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+        return agent.Status != "failed"
+}
+
+// reportStartup announces a step of an agent's startup.
+func (am *AgentManager) reportStartup(agent *Agent, phase, detail string) {
+        message := fmt.Sprintf("Agent '%s' startup: %s", agent.Name, phase)
+        if detail != "" {
+                message += " (" + detail + ")"
+        }
+        am.saveLogToDB(&LogEntry{
+                AgentID: agent.ID,
+                Level:   "info",
+                Message: message,
+        })
+        am.broadcastMessage(Message{
+                Type: "agent_startup",
+                Payload: map[string]interface{}{
+                        "agent_id": agent.ID,
+                        "name":     agent.Name,
+                        "phase":    phase,
+                        "detail":   detail,
+                },
+        })
+}
+
+// failStartup marks an agent whose prerequisites never came up as failed,
+// the same as a failed bootstrap would.
+func (am *AgentManager) failStartup(agent *Agent, reason string) {
+        am.agentLock.Lock()
+        if current, exists := am.agents[agent.ID]; exists {
+                am.setAgentStatus(current, "failed", reason)
+                am.saveAgentToDB(current)
+        }
+        am.agentLock.Unlock()
+        am.saveLogToDB(&LogEntry{
+                AgentID: agent.ID,
+                Level:   "error",
+                Message: fmt.Sprintf("Agent startup failed: %s, agent will not take queue work", reason),
+        })
+        am.broadcastMessage(Message{
+                Type: "agent_startup",
+                Payload: map[string]interface{}{
+                        "agent_id": agent.ID,
+                        "name":     agent.Name,
+                        "phase":    "failed",
+                        "detail":   reason,
+                },
+        })
+}
+
+// bootstrapAndStart runs an agent's bootstrap command and only starts pulling
+// queue work once it has succeeded, which it reports.
+func (am *AgentManager) bootstrapAndStart(agentID int, bootstrap string) bool {
+        if bootstrap != "" {
+                if !strings.HasPrefix(bootstrap, "RUN ") {
+                        bootstrap = "RUN " + bootstrap
+                }
+                result := am.ExecuteCommand(agentID, bootstrap)
+                if result.ExitCode != 0 {
+                        am.agentLock.Lock()
+                        if agent, exists := am.agents[agentID]; exists {
+                                am.setAgentStatus(agent, "failed", "bootstrap failed")
+                                am.saveAgentToDB(agent)
+                        }
+                        am.agentLock.Unlock()
+                        am.saveLogToDB(&LogEntry{
+                                AgentID:  agentID,
+                                Level:    "error",
+                                Message:  "Agent bootstrap failed, agent will not take queue work",
+                                Command:  bootstrap,
+                                Output:   result.Output,
+                                ExitCode: result.ExitCode,
+                        })
+                        return false
+                }
+        }
+        am.StartAgentLoop(agentID)
+        return true
+}
+
+func (am *AgentManager) RemoveAgent(id int) bool {
+        // Runs after agentLock is released: the loop's in-flight item is
+        // failed over once its command has been killed.
+        defer am.stopAgentLoop(id)
+
+        am.agentLock.Lock()
+        defer am.agentLock.Unlock()
+
+        if agent, exists := am.agents[id]; exists {
+                am.saveLogToDB(&LogEntry{
+                        AgentID: id,
+                        Level:   "info",
+                        Message: fmt.Sprintf("Agent '%s' removed", agent.Name),
+                })
+
+                delete(am.agents, id)
+                am.deleteAgentFromDB(id)
+
+                am.dispatchLock.Lock()
+                delete(am.shares, id)
+                am.dispatchLock.Unlock()
+
+                am.broadcastMessage(Message{
+                        Type:    "agent_removed",
+                        Payload: map[string]int{"id": id},
+                })
+                return true
+        }
+        return false
+}
+
+// AgentCounts splits the pool into agents free to take queue work and agents
+// that are busy or reserved.
+func (am *AgentManager) AgentCounts() (idle int, busy int) {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+
+        for _, agent := range am.agents {
+                if agent.Status == "idle" && !agent.Reserved && !agent.Draining {
+                        idle++
+                } else {
+                        busy++
+                }
+        }
+        return idle, busy
+}
+
+// maintainIdleAgents keeps at least MIN_IDLE_AGENTS idle agents available,
+// creating new ones up to maxAgents so bursts do not wait for a cold start.
+func (am *AgentManager) maintainIdleAgents() {
+        if am.config().minIdleAgents <= 0 || !am.running.Load() || am.terminated.Load() {
+                return
+        }
+
+        idle, _ := am.AgentCounts()
+        for ; idle < am.config().minIdleAgents; idle++ {
+                agent := am.AddAgent(fmt.Sprintf("auto-%d", time.Now().UnixNano()%100000))
+                if agent == nil {
+                        return
+                }
+                log.Printf("Autoscaler created agent %d to keep %d idle agents", agent.ID, am.config().minIdleAgents)
+                am.StartAgentLoop(agent.ID)
+        }
+}
+
+func (am *AgentManager) GetAgents() []*Agent {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+
+        agents := make([]*Agent, 0, len(am.agents))
+        for _, agent := range am.agents {
+                agents = append(agents, agent)
+        }
+        return agents
+}
+
+func (am *AgentManager) ReserveAgent(id int, ttl time.Duration) (*AgentLease, error) {
+        if ttl <= 0 {
+                ttl = am.leaseTTL
+        }
+
+        am.agentLock.Lock()
+        agent, exists := am.agents[id]
+        if !exists {
+                am.agentLock.Unlock()
+                return nil, fmt.Errorf("agent %d not found", id)
+        }
+        if lease, held := am.leases[id]; held && time.Now().Before(lease.ExpiresAt) {
+                am.agentLock.Unlock()
+                return nil, fmt.Errorf("agent %d is already reserved until %s", id, lease.ExpiresAt.Format(time.RFC3339))
+        }
+
+        lease := &AgentLease{
+                Token:     newSessionToken(),
+                AgentID:   id,
+                ExpiresAt: time.Now().Add(ttl),
+        }
+        am.leases[id] = lease
+        agent.Reserved = true
+        am.agentLock.Unlock()
+
+        time.AfterFunc(ttl, func() {
+                am.releaseLease(id, lease.Token, "expired")
+        })
+
+        am.saveLogToDB(&LogEntry{
+                AgentID: id,
+                Level:   "info",
+                Message: fmt.Sprintf("Agent '%s' reserved until %s", agent.Name, lease.ExpiresAt.Format(time.RFC3339)),
+        })
+        am.broadcastMessage(Message{
+                Type:    "agent_status",
+                Payload: agent,
+        })
+
+        return lease, nil
+}
+
+func (am *AgentManager) ReleaseAgent(id int, token string) error {
+        if !am.releaseLease(id, token, "released") {
+                return fmt.Errorf("no matching lease for agent %d", id)
+        }
+        return nil
+}
+
+func (am *AgentManager) releaseLease(id int, token string, reason string) bool {
+        am.agentLock.Lock()
+        lease, held := am.leases[id]
+        if !held || lease.Token != token {
+                am.agentLock.Unlock()
+                return false
+        }
+        delete(am.leases, id)
+        agent, exists := am.agents[id]
+        if exists {
+                agent.Reserved = false
+        }
+        am.agentLock.Unlock()
+
+        am.saveLogToDB(&LogEntry{
+                AgentID: id,
+                Level:   "info",
+                Message: fmt.Sprintf("Agent lease %s", reason),
+        })
+        if exists {
+                am.broadcastMessage(Message{
+                        Type:    "agent_status",
+                        Payload: agent,
+                })
+        }
+        return true
+}
+
+// DrainAgent stops an agent from taking new work while it finishes its
+// current command, after which agent_drained tells that it is safe to
+// remove. Unlike a reservation nothing hands the agent back to the pool.
+func (am *AgentManager) DrainAgent(id int) (Agent, error) {
+        am.agentLock.Lock()
+        defer am.agentLock.Unlock()
+
+        agent, exists := am.agents[id]
+        if !exists {
+                return Agent{}, fmt.Errorf("agent %d not found", id)
+        }
+        if agent.Draining {
+                return *agent, nil
+        }
+        agent.Draining = true
+
+        am.saveLogToDB(&LogEntry{
+                AgentID: id,
+                Level:   "info",
+                Message: fmt.Sprintf("Agent '%s' draining", agent.Name),
+        })
+        am.broadcastMessage(Message{
+                Type:    "agent_status",
+                Payload: agent,
+        })
+        if agent.Status != "running" {
+                am.markDrainedLocked(agent)
+        }
+        return *agent, nil
+}
+
+// markDrainedLocked records that a draining agent has gone idle. The caller
+// holds agentLock.
+func (am *AgentManager) markDrainedLocked(agent *Agent) {
+        agent.Drained = true
+        am.saveLogToDB(&LogEntry{
+                AgentID: agent.ID,
+                Level:   "info",
+                Message: fmt.Sprintf("Agent '%s' drained, safe to remove", agent.Name),
+        })
+        am.broadcastMessage(Message{
+                Type:    "agent_drained",
+                Payload: agent,
+        })
+}
+
+// restingStatus is the status of an agent with nothing running.
+func restingStatus(agent *Agent) string {
+        if agent.Paused {
+                return "paused"
+        }
+        return "idle"
+}
+
+// SetAgentPaused pauses an agent, which then finishes what it is running
+// but takes no new queue items, or resumes it. Other agents keep taking the
+// items it would have run; only items pinned to it wait.
+func (am *AgentManager) SetAgentPaused(id int, paused bool) (Agent, error) {
+        am.agentLock.Lock()
+        defer am.agentLock.Unlock()
+
+        agent, exists := am.agents[id]
+        if !exists {
+                return Agent{}, errAgentNotFound
+        }
+        if agent.Paused == paused {
+                return *agent, nil
+        }
+        agent.Paused = paused
+        action := "resumed"
+        if paused {
+                action = "paused"
+        }
+        if agent.Status != "running" {
+                am.setAgentStatus(agent, restingStatus(agent), action)
+        }
+        am.saveAgentToDB(agent)
+
+        am.saveLogToDB(&LogEntry{
+                AgentID: id,
+                Level:   "info",
+                Message: fmt.Sprintf("Agent '%s' %s", agent.Name, action),
+        })
+        am.broadcastMessage(Message{
+                Type:    "agent_status",
+                Payload: agent,
+        })
+        return *agent, nil
+}
+
+func (am *AgentManager) isPaused(id int) bool {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+        agent, ok := am.agents[id]
+        return ok && agent.Paused
+}
+
+func (am *AgentManager) isDraining(id int) bool {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+        agent, ok := am.agents[id]
+        return ok && agent.Draining
+}
+
+// DrainingAgents lists the agents being drained, drained or not.
+func (am *AgentManager) DrainingAgents() []map[string]interface{} {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+
+        draining := []map[string]interface{}{}
+        for _, agent := range am.agents {
+                if agent.Draining {
+                        draining = append(draining, map[string]interface{}{
+                                "id":      agent.ID,
+                                "name":    agent.Name,
+                                "status":  agent.Status,
+                                "drained": agent.Drained,
+                        })
+                }
+        }
+        sort.Slice(draining, func(i, j int) bool { return draining[i]["id"].(int) < draining[j]["id"].(int) })
+        return draining
+}
+
+func (am *AgentManager) isReserved(id int) bool {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+        lease, held := am.leases[id]
+        return held && time.Now().Before(lease.ExpiresAt)
+}
+
+// resolveLease returns the agent a lease token belongs to.
+func (am *AgentManager) resolveLease(token string) (int, bool) {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+        for id, lease := range am.leases {
+                if lease.Token == token && time.Now().Before(lease.ExpiresAt) {
+                        return id, true
+                }
+        }
+        return 0, false
+}
+
+// checkCommandLength rejects oversized commands before they are stored or
+// run; MAX_COMMAND_LENGTH of 0 disables the check.
+func (am *AgentManager) checkCommandLength(command string) error {
+        return am.config().checkCommandLength(command)
+}
+
+func (cfg *liveConfig) checkCommandLength(command string) error {
+        if cfg.maxCommandLength > 0 && len(command) > cfg.maxCommandLength {
+                return fmt.Errorf("command is %d bytes, longer than the %d byte limit", len(command), cfg.maxCommandLength)
+        }
+        return nil
+}
+
+// CheckCommandPolicy reports whether a command would be accepted for
+// execution, without running or enqueueing it.
+func (am *AgentManager) CheckCommandPolicy(command string) map[string]interface{} {
+        if err := am.checkCommandLength(command); err != nil {
+                return map[string]interface{}{
+                        "allowed":    false,
+                        "error_code": "COMMAND_TOO_LONG",
+                        "reason":     err.Error(),
+                }
+        }
+        if _, err := am.validateCommand(command); err != nil {
+                return map[string]interface{}{
+                        "allowed":    false,
+                        "error_code": "INVALID_COMMAND",
+                        "reason":     "Invalid or blocked command: " + err.Error(),
+                }
+        }
+        return map[string]interface{}{"allowed": true}
+}
+
+var errMissingRunPrefix = errors.New("commands must use: RUN <command>")
+
+// parseRunPrefixMode reads REQUIRE_RUN_PREFIX: "false" or "off" lets raw
+// commands through, "warn" lets them through with a logged warning, and
+// anything else, "true" included, enforces the prefix.
+func parseRunPrefixMode(spec string) string {
+        switch strings.ToLower(strings.TrimSpace(spec)) {
+        case "false", "off":
+                return "off"
+        case "warn":
+                return "warn"
+        }
+        return "enforce"
+}
+
+// validateCommand returns the shell command to run for command. With
+// REQUIRE_RUN_PREFIX enforced (the default) every command must start with
+// "RUN "; otherwise the prefix is optional and stripped when present, so
+// "RUN ls" and "ls" run the same, and in warn mode a raw command is logged.
+// Either way empty and blocked commands are refused with the reason.
+func (am *AgentManager) validateCommand(command string) (string, error) {
+        actualCmd, hasPrefix := strings.CutPrefix(command, "RUN ")
+        if !hasPrefix && strings.TrimSpace(command) == "RUN" {
+                actualCmd, hasPrefix = "", true
+        }
+        if !hasPrefix {
+                switch am.config().runPrefixMode {
+                case "enforce":
+                        return "", errMissingRunPrefix
+                case "warn":
+                        log.Printf("Warning: command without RUN prefix: %q", command)
+                }
+        }
+        actualCmd = strings.TrimSpace(actualCmd)
+        if actualCmd == "" {
+                return "", errors.New("command is empty")
+        }
+
+        blockedPatterns := []string{
+                "rm -rf /",
+                "dd if=",
+                ":(){:|:&};:",
+                "> /dev/sd",
+                "mkfs.",
+                "chmod -R 777 /",
+                "chown -R",
+        }
+        lowerCmd := strings.ToLower(actualCmd)
+        for _, pattern := range blockedPatterns {
+                if strings.Contains(lowerCmd, pattern) {
+                        return "", fmt.Errorf("command contains blocked pattern %q", pattern)
+                }
+        }
+
+        return actualCmd, nil
+}
+
+// QueueAddResult reports which commands of a batch were enqueued. Failed
+// holds the 1-based keys of commands whose insert was rejected.
+type QueueAddResult struct {
+        Status  string         `json:"status"`
+        BatchID string         `json:"batch_id"`
+        Added   []QueueItem    `json:"added"`
+        Failed  []int          `json:"failed,omitempty"`
+        Errors  map[int]string `json:"errors,omitempty"`
+}
+
+func (r *QueueAddResult) fail(key int, err error) {
+        r.Failed = append(r.Failed, key)
+        if r.Errors == nil {
+                r.Errors = make(map[int]string)
+        }
+        r.Errors[key] = err.Error()
+}
+
+// queueEntry holds the per-item settings an add_queue object may carry.
+type queueEntry struct {
+        MaxRetries *int
+        Env        map[string]string
+        WorkingDir string
+        RunAt      time.Time
+        TimeoutMs  int
+        OnTimeout  string
+        // DependsOn holds queue ids the item waits for; DependsOnKeys holds
+        // keys of entries in the same add_queue, which have no id yet.
+        DependsOn     []int
+        DependsOnKeys []string
+}
+
+// parseQueueEntries splits an add_queue body into its commands and the
+// per-item settings. Each value is either a command or an object
+// {"command": ..., "max_retries": n, "env": {...}, "working_dir": ...,
+// "run_at": ... or "delay_ms": n, "timeout_ms": n, "on_timeout": ...,
+// "depends_on": [...]}. Keys number the entries "1" to "n". depends_on
+// mixes queue ids (numbers) with keys of this body (strings), so one entry
+// can wait for others added with it.
+func parseQueueEntries(payload map[string]any) (map[string]string, map[string]queueEntry, error) {
+        for k := range payload {
+                if i, err := strconv.Atoi(k); err != nil || i < 1 || i > len(payload) || strconv.Itoa(i) != k {
+                        return nil, nil, fmt.Errorf("queue entry key %q must be a number from 1 to %d", k, len(payload))
+                }
+        }
+        commands := make(map[string]string)
+        entries := make(map[string]queueEntry)
+        for k, v := range payload {
+                switch entry := v.(type) {
+                case string:
+                        commands[k] = entry
+                case map[string]any:
+                        command, ok := entry["command"].(string)
+                        if !ok {
+                                return nil, nil, fmt.Errorf("queue entry %q needs a command", k)
+                        }
+                        commands[k] = command
+                        var opts queueEntry
+                        if n, ok := entry["max_retries"].(float64); ok {
+                                if n < 0 {
+                                        return nil, nil, fmt.Errorf("queue entry %q has a negative max_retries", k)
+                                }
+                                retries := int(n)
+                                opts.MaxRetries = &retries
+                        }
+                        if raw, ok := entry["env"]; ok {
+                                env, err := parseEnv(raw)
+                                if err != nil {
+                                        return nil, nil, fmt.Errorf("queue entry %q: %v", k, err)
+                                }
+                                opts.Env = env
+                        }
+                        if raw, ok := entry["working_dir"]; ok {
+                                dir, ok := raw.(string)
+                                if !ok {
+                                        return nil, nil, fmt.Errorf("queue entry %q has a non-string working_dir", k)
+                                }
+                                opts.WorkingDir = dir
+                        }
+                        runAt, err := parseSchedule(entry)
+                        if err != nil {
+                                return nil, nil, fmt.Errorf("queue entry %q: %v", k, err)
+                        }
+                        opts.RunAt = runAt
+                        if raw, ok := entry["timeout_ms"]; ok {
+                                ms, ok := raw.(float64)
+                                if !ok || ms < 0 {
+                                        return nil, nil, fmt.Errorf("queue entry %q: timeout_ms must be a non-negative number", k)
+                                }
+                                opts.TimeoutMs = int(ms)
+                        }
+                        if raw, ok := entry["on_timeout"]; ok {
+                                spec, ok := raw.(string)
+                                if !ok {
+                                        return nil, nil, fmt.Errorf("queue entry %q has a non-string on_timeout", k)
+                                }
+                                if err := checkOnTimeout(spec); err != nil {
+                                        return nil, nil, fmt.Errorf("queue entry %q: %v", k, err)
+                                }
+                                opts.OnTimeout = spec
+                        }
+                        if raw, ok := entry["depends_on"]; ok {
+                                list, ok := raw.([]any)
+                                if !ok {
+                                        return nil, nil, fmt.Errorf("queue entry %q: depends_on must be a list of queue ids or entry keys", k)
+                                }
+                                for _, v := range list {
+                                        switch dep := v.(type) {
+                                        case float64:
+                                                if dep < 1 || dep != math.Trunc(dep) {
+                                                        return nil, nil, fmt.Errorf("queue entry %q: depends_on id %v is not a queue id", k, dep)
+                                                }
+                                                opts.DependsOn = append(opts.DependsOn, int(dep))
+                                        case string:
+                                                if _, ok := payload[dep]; !ok {
+                                                        return nil, nil, fmt.Errorf("queue entry %q depends on entry %q, which is not one of entries 1 to %d of this request", k, dep, len(payload))
+                                                }
+                                                opts.DependsOnKeys = append(opts.DependsOnKeys, dep)
+                                        default:
+                                                return nil, nil, fmt.Errorf("queue entry %q: depends_on must be a list of queue ids or entry keys", k)
+                                        }
+                                }
+                        }
+                        entries[k] = opts
+                default:
+                        return nil, nil, fmt.Errorf("queue entry %q must be a command or an object", k)
+                }
+        }
+        return commands, entries, nil
+}
+
+// parseSchedule reads when an item may first run from the run_at (RFC 3339)
+// or delay_ms field of a payload. Neither gives the zero time, so the item
+// runs as soon as possible.
+func parseSchedule(payload map[string]any) (time.Time, error) {
+        rawRunAt, hasRunAt := payload["run_at"]
+        rawDelay, hasDelay := payload["delay_ms"]
+        switch {
+        case hasRunAt && hasDelay:
+                return time.Time{}, errors.New("set run_at or delay_ms, not both")
+        case hasRunAt:
+                s, ok := rawRunAt.(string)
+                if !ok {
+                        return time.Time{}, errors.New("run_at must be an RFC 3339 time")
+                }
+                if s == "" {
+                        return time.Time{}, nil
+                }
+                runAt, err := time.Parse(time.RFC3339, s)
+                if err != nil {
+                        return time.Time{}, errors.New("run_at must be an RFC 3339 time")
+                }
+                return runAt, nil
+        case hasDelay:
+                ms, ok := rawDelay.(float64)
+                if !ok || ms < 0 {
+                        return time.Time{}, errors.New("delay_ms must be a non-negative number")
+                }
+                return time.Now().Add(time.Duration(ms) * time.Millisecond), nil
+        }
+        return time.Time{}, nil
+}
+
+// parseEnv reads an env object from a JSON payload. Values must be strings
+// and names must be usable as environment variables.
+func parseEnv(raw any) (map[string]string, error) {
+        obj, ok := raw.(map[string]any)
+        if !ok {
+                return nil, errors.New("env must be an object of strings")
+        }
+        env := make(map[string]string, len(obj))
+        for k, v := range obj {
+                value, ok := v.(string)
+                if !ok {
+                        return nil, fmt.Errorf("env %q must be a string", k)
+                }
+                env[k] = value
+        }
+        if err := checkEnv(env); err != nil {
+                return nil, err
+        }
+        return env, nil
+}
+
+// checkEnv rejects variable names the process environment cannot hold.
+func checkEnv(env map[string]string) error {
+        for k, v := range env {
+                if k == "" || strings.ContainsAny(k, "=\x00") {
+                        return fmt.Errorf("invalid env name %q", k)
+                }
+                if strings.ContainsRune(v, 0) {
+                        return fmt.Errorf("env %q contains a NUL byte", k)
+                }
+        }
+        return nil
+}
+
+// checkDirExists reports whether dir is an existing directory, with an
+// error that says which of the two it is not.
+func checkDirExists(dir string) error {
+        info, err := os.Stat(dir)
+        if os.IsNotExist(err) {
+                return fmt.Errorf("working directory %q does not exist", dir)
+        }
+        if err != nil {
+                return fmt.Errorf("working directory %q: %v", dir, err)
+        }
+        if !info.IsDir() {
+                return fmt.Errorf("working directory %q is not a directory", dir)
+        }
+        return nil
+}
+
+// checkItemWorkingDir validates a queue item's own working directory, if
+// it has one, the same way ExecuteCommandWithOptions will before running it.
+func (am *AgentManager) checkItemWorkingDir(dir string) error {
+        if dir == "" {
+                return nil
+        }
+        canonical, err := am.checkWorkingDir(dir)
+        if err != nil {
+                return err
+        }
+        return checkDirExists(canonical)
+}
+
+// AddToQueue enqueues commands keyed "1", "2", ... as one batch. Items take
+// QUEUE_MAX_RETRIES and the agent's environment and directory unless entries
+// has settings under the same key. Entries that depend on others of the
+// batch are added after them, so they can refer to their ids; an entry fails
+// if it depends on an unknown queue item, on an entry that failed, or on
+// itself through a cycle.
+func (am *AgentManager) AddToQueue(commands map[string]string, entries map[string]queueEntry) QueueAddResult {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        batchID := fmt.Sprintf("batch_%d", time.Now().UnixNano())
+        baseIndex := am.indexBaseLocked()
+        result := QueueAddResult{BatchID: batchID, Added: []QueueItem{}}
+
+        order, cycles := batchOrder(commands, entries)
+        for _, i := range cycles {
+                result.fail(i, errDependencyCycle)
+        }
+        added := make(map[string]int, len(order))
+        for _, i := range order {
+                key := fmt.Sprintf("%d", i)
+                cmd := commands[key]
+                am.lastIndex = max(am.lastIndex, baseIndex+i)
+                item := QueueItem{
+                        Index:   baseIndex + i,
+                        Command: cmd,
+                        Status:  "pending",
+                        BatchID: batchID,
+
+                        MaxRetries: am.config().maxRetries,
+
+                        CreatedAt:  time.Now().Format(time.RFC3339),
+                        EnqueuedAt: time.Now(),
+                }
+                entry, hasEntry := entries[key]
+                if hasEntry {
+                        if entry.MaxRetries != nil {
+                                item.MaxRetries = *entry.MaxRetries
+                        }
+                        item.Env = entry.Env
+                        item.WorkingDir = entry.WorkingDir
+                        item.RunAt = entry.RunAt
+                        item.TimeoutMs = entry.TimeoutMs
+                        item.OnTimeout = entry.OnTimeout
+                }
+
+                if err := am.checkCommandLength(cmd); err != nil {
+                        result.fail(i, err)
+                        continue
+                }
+                if err := am.checkItemWorkingDir(item.WorkingDir); err != nil {
+                        result.fail(i, err)
+                        continue
+                }
+                if hasEntry {
+                        deps, err := am.resolveDependenciesLocked(entry, added)
+                        if err != nil {
+                                result.fail(i, err)
+                                continue
+                        }
+                        item.DependsOn = deps
+                }
+
+                id, err := am.saveQueueItemToDB(&item)
+                if err != nil {
+                        result.fail(i, err)
+                        continue
+                }
+                item.ID = id
+                am.queue = append(am.queue, item)
+                result.Added = append(result.Added, item)
+                added[key] = queueKey(&item)
+        }
+        slices.Sort(result.Failed)
+
+        am.annotatePositionsLocked(result.Added)
+
+        switch {
+        case len(result.Failed) == 0:
+                result.Status = "added"
+        case len(result.Added) == 0:
+                result.Status = "failed"
+        default:
+                result.Status = "partial"
+        }
+
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+
+        level := "info"
+        message := fmt.Sprintf("Added %d commands to queue (batch: %s)", len(result.Added), batchID)
+        if len(result.Failed) > 0 {
+                level = "error"
+                message += fmt.Sprintf(", %d failed to save: %v", len(result.Failed), result.Failed)
+        }
+        am.saveLogToDB(&LogEntry{
+                Level:   level,
+                Message: message,
+        })
+
+        return result
+}
+
+// indexBaseLocked returns the last index handed out, after which new items
+// are numbered. Without persistence an item's index is its queueKey, so the
+// base is first raised past every row id still in the queue (items loaded
+// before switching to ephemeral mode); an index then never names another
+// item too. Callers hold queueLock.
+func (am *AgentManager) indexBaseLocked() int {
+        if !am.persistenceEnabled() {
+                for i := range am.queue {
+                        am.lastIndex = max(am.lastIndex, am.queue[i].ID)
+                }
+        }
+        return am.lastIndex
+}
+
+var errDependencyCycle = errors.New("depends_on leads into a cycle")
+
+// batchOrder returns the keys 1..n present in commands, each after the
+// entries it depends on by key and otherwise in key order, and separately
+// the keys that cannot be ordered because they are on or behind a cycle.
+func batchOrder(commands map[string]string, entries map[string]queueEntry) (order, cycles []int) {
+        placed := make(map[string]bool, len(commands))
+        var waiting []int
+        for i := 1; i <= len(commands); i++ {
+                if _, ok := commands[fmt.Sprintf("%d", i)]; ok {
+                        waiting = append(waiting, i)
+                }
+        }
+        for progress := true; progress; {
+                progress = false
+                next := waiting[:0]
+                for _, i := range waiting {
+                        key := fmt.Sprintf("%d", i)
+                        ready := true
+                        for _, dep := range entries[key].DependsOnKeys {
+                                if _, inBatch := commands[dep]; inBatch && !placed[dep] {
+                                        ready = false
+                                        break
+                                }
+                        }
+                        if !ready {
+                                next = append(next, i)
+                                continue
+                        }
+                        placed[key] = true
+                        order = append(order, i)
+                        progress = true
+                }
+                waiting = next
+        }
+        return order, waiting
+}
+
+// resolveDependenciesLocked turns an entry's depends_on into queue keys:
+// ids must name an existing queue item, and batch keys one already added
+// from the same request (added maps those keys to queue keys). Callers
+// hold queueLock.
+func (am *AgentManager) resolveDependenciesLocked(entry queueEntry, added map[string]int) ([]int, error) {
+        var deps []int
+        if len(entry.DependsOn) > 0 {
+                positions := am.queuePositionsLocked()
+                for _, dep := range entry.DependsOn {
+                        _, found, err := am.dependencyStatusLocked(dep, positions)
+                        if err != nil {
+                                return nil, fmt.Errorf("checking dependency %d: %v", dep, err)
+                        }
+                        if !found {
+                                return nil, fmt.Errorf("depends on unknown queue item %d", dep)
+                        }
+                        deps = append(deps, dep)
+                }
+        }
+        for _, key := range entry.DependsOnKeys {
+                dep, ok := added[key]
+                if !ok {
+                        return nil, fmt.Errorf("depends on entry %q, which was not added", key)
+                }
+                deps = append(deps, dep)
+        }
+        return deps, nil
+}
+
+func (am *AgentManager) AddToQueueWithPriority(command string, priority int) error {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        if err := am.checkCommandLength(command); err != nil {
+                return err
+        }
+
+        am.lastIndex = am.indexBaseLocked() + 1
+        item := QueueItem{
+                Index:    am.lastIndex,
+                Command:  command,
+                Status:   "pending",
+                Priority: priority,
+
+                MaxRetries: am.config().maxRetries,
+
+                CreatedAt:  time.Now().Format(time.RFC3339),
+                EnqueuedAt: time.Now(),
+        }
+
+        id, err := am.saveQueueItemToDB(&item)
+        if err != nil {
+                return err
+        }
+        item.ID = id
+        am.queue = append(am.queue, item)
+
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+        return nil
+}
+
+type QueueExport struct {
+        Version    int         `json:"version"`
+        ExportedAt string      `json:"exported_at"`
+        Items      []QueueItem `json:"items"`
+}
+
+func (am *AgentManager) ExportQueue(includeCompleted bool) QueueExport {
+        am.queueLock.RLock()
+        defer am.queueLock.RUnlock()
+
+        // Dependencies on completed items that are left out are already met,
+        // and are dropped so the export stands on its own.
+        exported := make(map[int]bool, len(am.queue))
+        for _, item := range am.queue {
+                if item.Status != "completed" || includeCompleted {
+                        exported[queueKey(&item)] = true
+                }
+        }
+        items := make([]QueueItem, 0, len(exported))
+        for _, item := range am.queue {
+                if !exported[queueKey(&item)] {
+                        continue
+                }
+                item.DependsOn = slices.DeleteFunc(slices.Clone(item.DependsOn), func(dep int) bool { return !exported[dep] })
+                items = append(items, item)
+        }
+
+        return QueueExport{
+                Version:    1,
+                ExportedAt: time.Now().Format(time.RFC3339),
+                Items:      items,
+        }
+}
+
+// importedStatus is the status an exported item takes on import. Waiting
+// items stay waiting and finished ones keep their outcome, so an import never
+// re-runs finished work; an item exported mid-run is marked interrupted, as
+// after a restart, since it may well have done its work already.
+func importedStatus(status string) string {
+        switch {
+        case status == "disabled" || terminalStatuses[status]:
+                return status
+        case status == "running" || status == "interrupted":
+                return "interrupted"
+        }
+        return "pending"
+}
+
+// ImportQueue enqueues exported items, each keeping its status as given by
+// importedStatus. All rows are inserted in one transaction so a failed import
+// leaves the queue untouched. The returned map translates exported IDs to the
+// newly assigned ones.
+func (am *AgentManager) ImportQueue(items []QueueItem) (map[int]int, error) {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        batchID := fmt.Sprintf("import_%d", time.Now().UnixNano())
+        baseIndex := am.indexBaseLocked()
+        idMap := make(map[int]int)
+
+        imported := make([]QueueItem, 0, len(items))
+        for i, src := range items {
+                if strings.TrimSpace(src.Command) == "" {
+                        return nil, fmt.Errorf("item %d has an empty command", i)
+                }
+                if err := am.checkCommandLength(src.Command); err != nil {
+                        return nil, fmt.Errorf("item %d: %v", i, err)
+                }
+                if err := checkOnTimeout(src.OnTimeout); err != nil {
+                        return nil, fmt.Errorf("item %d: %v", i, err)
+                }
+                if src.PinnedAgent < 0 {
+                        return nil, fmt.Errorf("item %d has a negative pinned_agent", i)
+                }
+                if src.MaxRetries < 0 {
+                        return nil, fmt.Errorf("item %d has a negative max_retries", i)
+                }
+                if err := checkEnv(src.Env); err != nil {
+                        return nil, fmt.Errorf("item %d: %v", i, err)
+                }
+                if err := am.checkItemWorkingDir(src.WorkingDir); err != nil {
+                        return nil, fmt.Errorf("item %d: %v", i, err)
+                }
+                item := QueueItem{
+                        Index:    baseIndex + i + 1,
+                        Command:  src.Command,
+                        Status:   importedStatus(src.Status),
+                        Priority: src.Priority,
+                        BatchID:  src.BatchID,
+
+                        SuccessPattern:   src.SuccessPattern,
+                        FailurePattern:   src.FailurePattern,
+                        KillOnMatch:      src.KillOnMatch,
+                        PatternTimeoutMs: src.PatternTimeoutMs,
+                        TimeoutMs:        src.TimeoutMs,
+                        PreCheck:         src.PreCheck,
+                        DependsOn:        append([]int(nil), src.DependsOn...),
+                        FanOut:           append([]string(nil), src.FanOut...),
+                        FanOutQuorum:     src.FanOutQuorum,
+                        StaggerMs:        src.StaggerMs,
+                        Cacheable:        src.Cacheable,
+                        CacheTTLMs:       src.CacheTTLMs,
+                        OnTimeout:        src.OnTimeout,
+                        PinnedAgent:      src.PinnedAgent,
+                        MaxRetries:       src.MaxRetries,
+                        Env:              maps.Clone(src.Env),
+                        WorkingDir:       src.WorkingDir,
+                        RunAt:            src.RunAt,
+
+                        CreatedAt:  time.Now().Format(time.RFC3339),
+                        EnqueuedAt: time.Now(),
+                }
+                if item.BatchID == "" {
+                        item.BatchID = batchID
+                }
+                imported = append(imported, item)
+        }
+
+        // Dependencies are given by source id and have to be rewritten once
+        // the new ids are known; without persistence the new index is the
+        // key. They can only name items of the same import, as a source id
+        // means nothing in this queue. Rows are inserted in order, so an
+        // item may only depend on items listed before it.
+        srcPos := make(map[int]int)
+        for i := range items {
+                srcPos[queueKey(&items[i])] = i
+        }
+        resolveDeps := func(i int) error {
+                for d, dep := range imported[i].DependsOn {
+                        pos, ok := srcPos[dep]
+                        if !ok {
+                                return fmt.Errorf("item %d depends on item %d, which is not part of the import", i, dep)
+                        }
+                        if pos >= i {
+                                return fmt.Errorf("item %d depends on item %d, which is not listed before it", i, dep)
+                        }
+                        imported[i].DependsOn[d] = queueKey(&imported[pos])
+                }
+                return nil
+        }
+
+        if am.persistenceEnabled() {
+                tx, err := am.db().Begin()
+                if err != nil {
+                        return nil, err
+                }
+                for i := range imported {
+                        item := &imported[i]
+                        if err := resolveDeps(i); err != nil {
+                                tx.Rollback()
+                                return nil, err
+                        }
+                        id, err := insertQueueItem(tx, item)
+                        if err != nil {
+                                tx.Rollback()
+                                return nil, err
+                        }
+                        item.ID = id
+                }
+                if err := tx.Commit(); err != nil {
+                        return nil, err
+                }
+        } else {
+                for i := range imported {
+                        if err := resolveDeps(i); err != nil {
+                                return nil, err
+                        }
+                }
+        }
+
+        for i := range imported {
+                if items[i].ID != 0 {
+                        idMap[items[i].ID] = imported[i].ID
+                }
+        }
+        am.lastIndex = baseIndex + len(imported)
+        am.queue = append(am.queue, imported...)
+
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: fmt.Sprintf("Imported %d commands into queue", len(imported)),
+        })
+
+        return idMap, nil
+}
+
+// SetBatchPriority changes the priority of every pending item in a batch in
+// one transaction and returns how many items were updated.
+func (am *AgentManager) SetBatchPriority(batchID string, priority int) (int, error) {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        var targets []int
+        for i, item := range am.queue {
+                if item.BatchID == batchID && item.Status == "pending" {
+                        targets = append(targets, i)
+                }
+        }
+        if len(targets) == 0 {
+                return 0, nil
+        }
+
+        if am.persistenceEnabled() {
+                tx, err := am.db().Begin()
+                if err != nil {
+                        return 0, err
+                }
+                _, err = tx.Exec(`
+                        UPDATE queue SET priority = $1, updated_at = CURRENT_TIMESTAMP
+                        WHERE batch_id = $2 AND status = 'pending'
+                `, priority, batchID)
+                if err != nil {
+                        tx.Rollback()
+                        return 0, err
+                }
+                if err := tx.Commit(); err != nil {
+                        return 0, err
+                }
+        }
+
+        for _, i := range targets {
+                am.queue[i].Priority = priority
+        }
+
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: fmt.Sprintf("Set priority of %d pending items in batch %s to %d", len(targets), batchID, priority),
+        })
+
+        return len(targets), nil
+}
+
+// ReprioritizeFilter selects queue items for ReprioritizeQueue. Empty fields
+// match everything; CommandLike is an SQL LIKE pattern (% and _).
+// RequiredLabels matches items that can run on an agent carrying every one
+// of the labels: the pinned agent for a pinned item, any agent otherwise.
+type ReprioritizeFilter struct {
+        Status         string   `json:"status"`
+        BatchID        string   `json:"batch_id"`
+        CommandLike    string   `json:"command_like"`
+        RequiredLabels []string `json:"required_labels"`
+}
+
+// likePattern compiles an SQL LIKE pattern into an anchored regexp.
+func likePattern(like string) *regexp.Regexp {
+        var b strings.Builder
+        b.WriteString("^")
+        for _, r := range like {
+                switch r {
+                case '%':
+                        b.WriteString(".*")
+                case '_':
+                        b.WriteString(".")
+                default:
+                        b.WriteString(regexp.QuoteMeta(string(r)))
+                }
+        }
+        b.WriteString("$")
+        return regexp.MustCompile("(?s)" + b.String())
+}
+
+var errInvalidFilter = errors.New("invalid filter")
+
+// ReprioritizeQueue sets the priority of every item matching filter that has
+// not started yet, to priority when given and otherwise to its current
+// priority plus delta, in one transaction. It returns how many items changed.
+func (am *AgentManager) ReprioritizeQueue(filter ReprioritizeFilter, priority *int, delta int) (int, error) {
+        if filter.Status != "" && filter.Status != "pending" && filter.Status != "disabled" {
+                return 0, fmt.Errorf("%w: status must be pending or disabled, items that started keep their priority", errInvalidFilter)
+        }
+        var commandLike *regexp.Regexp
+        if filter.CommandLike != "" {
+                commandLike = likePattern(filter.CommandLike)
+        }
+        // labelled holds the agents carrying every required label, and
+        // anyLabelled whether there is one for unpinned items to run on.
+        var labelled map[int]bool
+        anyLabelled := false
+        if len(filter.RequiredLabels) > 0 {
+                labelled = make(map[int]bool)
+                am.agentLock.RLock()
+                for id, agent := range am.agents {
+                        if !slices.ContainsFunc(filter.RequiredLabels, func(label string) bool { return !slices.Contains(agent.Labels, label) }) {
+                                labelled[id] = true
+                                anyLabelled = true
+                        }
+                }
+                am.agentLock.RUnlock()
+        }
+
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        targets := make(map[int]int)
+        for i, item := range am.queue {
+                if item.Status != "pending" && item.Status != "disabled" {
+                        continue
+                }
+                if filter.Status != "" && item.Status != filter.Status {
+                        continue
+                }
+                if filter.BatchID != "" && item.BatchID != filter.BatchID {
+                        continue
+                }
+                if commandLike != nil && !commandLike.MatchString(item.Command) {
+                        continue
+                }
+                if labelled != nil && !labelled[item.PinnedAgent] && (item.PinnedAgent != 0 || !anyLabelled) {
+                        continue
+                }
+                if priority != nil {
+                        targets[i] = *priority
+                } else {
+                        targets[i] = item.Priority + delta
+                }
+        }
+        if len(targets) == 0 {
+                return 0, nil
+        }
+
+        if am.persistenceEnabled() {
+                tx, err := am.db().Begin()
+                if err != nil {
+                        return 0, err
+                }
+                for i, newPriority := range targets {
+                        if am.queue[i].ID == 0 {
+                                continue
+                        }
+                        _, err := tx.Exec(`UPDATE queue SET priority = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`,
+                                newPriority, am.queue[i].ID)
+                        if err != nil {
+                                tx.Rollback()
+                                return 0, err
+                        }
+                }
+                if err := tx.Commit(); err != nil {
+                        return 0, err
+                }
+        }
+
+        for i, newPriority := range targets {
+                am.queue[i].Priority = newPriority
+        }
+
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+
+        change := fmt.Sprintf("by %+d", delta)
+        if priority != nil {
+                change = fmt.Sprintf("to %d", *priority)
+        }
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: fmt.Sprintf("Reprioritized %d queue items %s", len(targets), change),
+        })
+
+        return len(targets), nil
+}
+
+// SetBatchStagger sets the spacing between item starts for the pending items
+// of a batch and returns how many items were updated.
+func (am *AgentManager) SetBatchStagger(batchID string, staggerMs int) (int, error) {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        var targets []int
+        for i, item := range am.queue {
+                if item.BatchID == batchID && item.Status == "pending" {
+                        targets = append(targets, i)
+                }
+        }
+        if len(targets) == 0 {
+                return 0, nil
+        }
+
+        if am.persistenceEnabled() {
+                _, err := am.db().Exec(`
+                        UPDATE queue SET stagger_ms = $1, updated_at = CURRENT_TIMESTAMP
+                        WHERE batch_id = $2 AND status = 'pending'
+                `, staggerMs, batchID)
+                if err != nil {
+                        return 0, err
+                }
+        }
+
+        for _, i := range targets {
+                am.queue[i].StaggerMs = staggerMs
+        }
+
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: fmt.Sprintf("Set stagger of %d pending items in batch %s to %dms", len(targets), batchID, staggerMs),
+        })
+
+        return len(targets), nil
+}
+
+// RetryBudget caps the retries, timeout retries and failovers alike, that
+// all items of a batch may use together.
+type RetryBudget struct {
+        BatchID         string `json:"batch_id"`
+        MaxTotalRetries int    `json:"max_total_retries"`
+        Used            int    `json:"used"`
+        Remaining       int    `json:"remaining"`
+}
+
+// SetBatchRetryBudget gives a batch a shared budget of maxTotalRetries.
+// Retries the batch already used count against it. It reports
+// errQueueItemNotFound when no queued item belongs to the batch.
+func (am *AgentManager) SetBatchRetryBudget(batchID string, maxTotalRetries int) (RetryBudget, error) {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        used, found := 0, false
+        for _, item := range am.queue {
+                if item.BatchID == batchID {
+                        found = true
+                        used += item.RetryCount + item.FailoverCount + item.TimeoutRetries
+                }
+        }
+        if !found {
+                return RetryBudget{}, errQueueItemNotFound
+        }
+
+        budget := &RetryBudget{BatchID: batchID, MaxTotalRetries: maxTotalRetries, Used: used}
+        budget.Remaining = max(maxTotalRetries-used, 0)
+        am.retryBudgets[batchID] = budget
+
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: fmt.Sprintf("Set retry budget of batch %s to %d (%d used)", batchID, maxTotalRetries, used),
+        })
+        return *budget, nil
+}
+
+// BatchRetryBudget returns the retry budget of a batch, if it has one.
+func (am *AgentManager) BatchRetryBudget(batchID string) (RetryBudget, bool) {
+        am.queueLock.RLock()
+        defer am.queueLock.RUnlock()
+        budget, ok := am.retryBudgets[batchID]
+        if !ok {
+                return RetryBudget{}, false
+        }
+        return *budget, true
+}
+
+// spendRetryLocked takes one retry from the budget of item's batch and
+// reports false once the budget is used up. Items of batches without a
+// budget may always retry. Callers hold queueLock.
+func (am *AgentManager) spendRetryLocked(item *QueueItem) bool {
+        budget, ok := am.retryBudgets[item.BatchID]
+        if !ok {
+                return true
+        }
+        if budget.Used >= budget.MaxTotalRetries {
+                return false
+        }
+        budget.Used++
+        budget.Remaining = budget.MaxTotalRetries - budget.Used
+        return true
+}
+
+var errQueueItemNotFound = errors.New("queue item not found")
+
+// findQueueItem returns the position of the item with the given id, or -1.
+// The id is the item's queueKey: its row id, or its index for items added
+// without persistence, which indexBaseLocked keeps clear of every row id.
+func (am *AgentManager) findQueueItem(id int) int {
+        return slices.IndexFunc(am.queue, func(item QueueItem) bool { return queueKey(&item) == id })
+}
+
+// AnnotateQueueItem replaces the operator notes on a queue item. Notes can be
+// edited at any status and have no effect on execution.
+func (am *AgentManager) AnnotateQueueItem(id int, annotations, by string) (QueueItem, error) {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        i := am.findQueueItem(id)
+        if i < 0 {
+                return QueueItem{}, errQueueItemNotFound
+        }
+
+        item := &am.queue[i]
+        annotatedAt := ""
+        if annotations != "" {
+                annotatedAt = time.Now().Format(time.RFC3339)
+        } else {
+                by = ""
+        }
+
+        if am.persistenceEnabled() && item.ID != 0 {
+                _, err := am.db().Exec(`
+                        UPDATE queue SET annotations = $1, annotated_by = $2, annotated_at = $3, updated_at = CURRENT_TIMESTAMP
+                        WHERE id = $4
+                `, annotations, by, annotatedAt, item.ID)
+                if err != nil {
+                        return QueueItem{}, err
+                }
+        }
+
+        item.Annotations = annotations
+        item.AnnotatedBy = by
+        item.AnnotatedAt = annotatedAt
+
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+        return *item, nil
+}
+
+var errQueueItemState = errors.New("invalid queue item status")
+
+// ExpediteQueueItem moves a pending item to the front of the queue: its
+// priority is raised above the effective priority of every other pending
+// item and any schedule, retry backoff or batch stagger is dropped, so the
+// next free agent takes it. Dependencies still have to complete first.
+func (am *AgentManager) ExpediteQueueItem(id int) (QueueItem, error) {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        i := am.findQueueItem(id)
+        if i < 0 {
+                return QueueItem{}, errQueueItemNotFound
+        }
+        item := &am.queue[i]
+        if item.Status != "pending" {
+                return QueueItem{}, fmt.Errorf("%w: item is %s, not pending", errQueueItemState, item.Status)
+        }
+
+        effective := am.effectivePrioritiesLocked(am.queuePositionsLocked())
+        priority := item.Priority
+        for j, other := range am.queue {
+                if j != i && other.Status == "pending" && effective[j] >= priority {
+                        priority = effective[j]
+                        if priority < math.MaxInt {
+                                priority++
+                        }
+                }
+        }
+        expeditedAt := time.Now().Format(time.RFC3339)
+
+        if am.persistenceEnabled() && item.ID != 0 {
+                _, err := am.db().Exec(`
+                        UPDATE queue SET priority = $1, stagger_ms = 0, retry_at = NULL, run_at = NULL, expedited_at = $2, updated_at = CURRENT_TIMESTAMP
+                        WHERE id = $3
+                `, priority, expeditedAt, item.ID)
+                if err != nil {
+                        return QueueItem{}, err
+                }
+        }
+
+        previous := item.Priority
+        item.Priority = priority
+        item.StaggerMs = 0
+        item.RetryAt = time.Time{}
+        item.RunAt = time.Time{}
+        item.ExpeditedAt = expeditedAt
+
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: fmt.Sprintf("Queue item %d expedited (priority %d -> %d)", item.Index, previous, priority),
+                Command: item.Command,
+        })
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+        return *item, nil
+}
+
+// ScheduleQueueItem sets when a pending item may run; the zero time clears
+// its schedule so it runs as soon as possible.
+func (am *AgentManager) ScheduleQueueItem(id int, runAt time.Time) (QueueItem, error) {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        i := am.findQueueItem(id)
+        if i < 0 {
+                return QueueItem{}, errQueueItemNotFound
+        }
+        item := &am.queue[i]
+        if item.Status != "pending" {
+                return QueueItem{}, fmt.Errorf("%w: item is %s, not pending", errQueueItemState, item.Status)
+        }
+
+        if am.persistenceEnabled() && item.ID != 0 {
+                var stored sql.NullTime
+                if !runAt.IsZero() {
+                        stored = sql.NullTime{Time: runAt, Valid: true}
+                }
+                _, err := am.db().Exec(`UPDATE queue SET run_at = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, stored, item.ID)
+                if err != nil {
+                        return QueueItem{}, err
+                }
+        }
+        item.RunAt = runAt
+
+        message := fmt.Sprintf("Queue item %d scheduled for %s", item.Index, runAt.Format(time.RFC3339))
+        if runAt.IsZero() {
+                message = fmt.Sprintf("Queue item %d unscheduled", item.Index)
+        }
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: message,
+                Command: item.Command,
+                QueueID: item.ID,
+        })
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+        return *item, nil
+}
+
+// SetQueueItemDisabled parks a pending item as "disabled", out of dispatch but
+// kept with its output and annotations, or returns a disabled item to
+// "pending". Other statuses are left alone and report errQueueItemState.
+func (am *AgentManager) SetQueueItemDisabled(id int, disabled bool) (QueueItem, error) {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        i := am.findQueueItem(id)
+        if i < 0 {
+                return QueueItem{}, errQueueItemNotFound
+        }
+
+        item := &am.queue[i]
+        from, to := "pending", "disabled"
+        if !disabled {
+                from, to = to, from
+        }
+        if item.Status != from {
+                return QueueItem{}, fmt.Errorf("%w: item is %s, not %s", errQueueItemState, item.Status, from)
+        }
+
+        item.Status = to
+        am.updateQueueItemInDB(item)
+
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: fmt.Sprintf("Queue item %d %s -> %s", item.Index, from, to),
+                Command: item.Command,
+        })
+        return *item, nil
+}
+
+// annotatePositionsLocked fills Position and EstimatedStart on the pending
+// entries of items, a copy of (part of) the queue. Rank follows dispatch
+// order: higher priority first, then queue order. The estimate assumes every
+// unreserved agent takes one item per mean command duration and is left out
+// until a duration has been recorded. Callers hold queueLock.
+func (am *AgentManager) annotatePositionsLocked(items []QueueItem) {
+        effective := am.effectivePrioritiesLocked(am.queuePositionsLocked())
+        inherited := make(map[int]int)
+        var pending []int
+        running := 0
+        for i, item := range am.queue {
+                if effective[i] != item.Priority {
+                        inherited[item.Index] = effective[i]
+                }
+                switch item.Status {
+                case "pending":
+                        pending = append(pending, i)
+                case "running":
+                        running++
+                }
+        }
+        sort.Slice(pending, func(a, b int) bool {
+                i, j := pending[a], pending[b]
+                if effective[i] != effective[j] {
+                        return effective[i] > effective[j]
+                }
+                return enqueuedBefore(&am.queue[i], &am.queue[j])
+        })
+        rank := make(map[int]int, len(pending))
+        for pos, i := range pending {
+                rank[am.queue[i].Index] = pos + 1
+        }
+
+        mean, known := am.durations.Mean()
+        slots := 0
+        am.agentLock.RLock()
+        for _, agent := range am.agents {
+                if !agent.Reserved && !agent.Draining && !agent.Paused {
+                        slots++
+                }
+        }
+        am.agentLock.RUnlock()
+
+        now := time.Now()
+        for i := range items {
+                if p, ok := inherited[items[i].Index]; ok {
+                        items[i].EffectivePriority = p
+                }
+                pos, ok := rank[items[i].Index]
+                if !ok || items[i].Status != "pending" {
+                        continue
+                }
+                items[i].Position = pos
+                if known && slots > 0 {
+                        waves := (pos - 1 + running) / slots
+                        eta := now.Add(time.Duration(float64(waves) * mean * float64(time.Millisecond)))
+                        items[i].EstimatedStart = eta.Format(time.RFC3339)
+                }
+        }
+}
+
+// GetQueueWithPositions returns a copy of the queue with positions and
+// estimated start times filled in for pending items.
+func (am *AgentManager) GetQueueWithPositions() []QueueItem {
+        am.queueLock.RLock()
+        defer am.queueLock.RUnlock()
+
+        items := append([]QueueItem(nil), am.queue...)
+        am.annotatePositionsLocked(items)
+        return items
+}
+
+// GetQueueList returns a copy of the queue, safe to read after the lock is
+// released while agent loops keep updating items.
+func (am *AgentManager) GetQueueList() []QueueItem {
+        am.queueLock.RLock()
+        defer am.queueLock.RUnlock()
+        return slices.Clone(am.queue)
+}
+
+// RemoveQueueItem deletes the item with the given id (its index when
+// persistence is off), the identifier every queue endpoint takes.
+func (am *AgentManager) RemoveQueueItem(id int) bool {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        return am.removeQueueItemLocked(am.findQueueItem(id))
+}
+
+// RemoveFromQueue deletes the item with the given index.
+//
+// Deprecated: indexes are positional leftovers; use RemoveQueueItem.
+func (am *AgentManager) RemoveFromQueue(index int) bool {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        return am.removeQueueItemLocked(slices.IndexFunc(am.queue, func(item QueueItem) bool { return item.Index == index }))
+}
+
+func (am *AgentManager) removeQueueItemLocked(i int) bool {
+        if i < 0 {
+                return false
+        }
+        am.deleteQueueItemFromDB(am.queue[i].ID)
+        am.queue = append(am.queue[:i], am.queue[i+1:]...)
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+        return true
+}
+
+// cancelKey resolves the queue item a cancel request names, by id or by
+// its deprecated index, to its queueKey, or 0 when there is no such item.
+func (am *AgentManager) cancelKey(id, index int) int {
+        am.queueLock.RLock()
+        defer am.queueLock.RUnlock()
+        i := -1
+        if id > 0 {
+                i = am.findQueueItem(id)
+        } else if index > 0 {
+                i = slices.IndexFunc(am.queue, func(item QueueItem) bool { return item.Index == index })
+        }
+        if i < 0 {
+                return 0
+        }
+        return queueKey(&am.queue[i])
+}
+
+// terminalStatuses are queue statuses an item never leaves.
+var terminalStatuses = map[string]bool{
+        "completed": true,
+        "failed":    true,
+        "skipped":   true,
+        "expired":   true,
+        "cancelled": true,
+}
+
+// QueueItemResult is the outcome of a queue item for callers that poll
+// instead of listening for broadcasts. Done is false, and the rest mostly
+// empty, until the item reaches a terminal status. ExitCode and DurationMs
+// come from the log of its last run and are absent when it never ran or
+// logs are not stored.
+type QueueItemResult struct {
+        ID         int    `json:"id"`
+        Index      int    `json:"index"`
+        Command    string `json:"command"`
+        Status     string `json:"status"`
+        Done       bool   `json:"done"`
+        AgentID    int    `json:"agent_id,omitempty"`
+        Output     string `json:"output,omitempty"`
+        ExitCode   *int   `json:"exit_code,omitempty"`
+        DurationMs *int64 `json:"duration_ms,omitempty"`
+        FinishedAt string `json:"finished_at,omitempty"`
+}
+
+// GetQueueItemResult looks an item up in memory and then, for items already
+// compacted away, in the queue table.
+func (am *AgentManager) GetQueueItemResult(id int) (QueueItemResult, error) {
+        var result QueueItemResult
+
+        am.queueLock.RLock()
+        i := am.findQueueItem(id)
+        if i >= 0 {
+                item := am.queue[i]
+                result = QueueItemResult{ID: item.ID, Index: item.Index, Command: item.Command,
+                        Status: item.Status, AgentID: item.AgentID, Output: item.Output}
+        }
+        am.queueLock.RUnlock()
+
+        if i < 0 {
+                if !am.persistenceEnabled() {
+                        return result, errQueueItemNotFound
+                }
+                err := am.db().QueryRow(`SELECT id, idx, command, status, output, agent_id FROM queue WHERE id = $1`, id).
+                        Scan(&result.ID, &result.Index, &result.Command, &result.Status, &result.Output, &result.AgentID)
+                if errors.Is(err, sql.ErrNoRows) {
+                        return result, errQueueItemNotFound
+                }
+                if err != nil {
+                        return result, err
+                }
+                result.Output = am.outputCipher.Open(result.Output)
+        }
+
+        result.Done = terminalStatuses[result.Status]
+        if !result.Done {
+                result.Output = ""
+                return result, nil
+        }
+        if result.ID == 0 || am.logsDB() == nil {
+                return result, nil
+        }
+
+        var exitCode int
+        var duration int64
+        err := am.logsDB().QueryRow(`
+                SELECT exit_code, duration_ms, created_at FROM logs
+                WHERE queue_id = $1 ORDER BY id DESC LIMIT 1
+        `, result.ID).Scan(&exitCode, &duration, &result.FinishedAt)
+        switch {
+        case err == nil:
+                result.ExitCode, result.DurationMs = &exitCode, &duration
+        case !errors.Is(err, sql.ErrNoRows):
+                return result, err
+        }
+        return result, nil
+}
+
+// reportOutputBytes is how much of each item's output a batch report keeps.
+const reportOutputBytes = 2000
+
+// BatchReport summarizes every item of a batch for a human once a run is
+// over.
+type BatchReport struct {
+        BatchID     string            `json:"batch_id"`
+        GeneratedAt string            `json:"generated_at"`
+        Done        bool              `json:"done"`
+        Items       []BatchReportItem `json:"items"`
+        Totals      BatchTotals       `json:"totals"`
+}
+
+// BatchReportItem is one item of a BatchReport. ExitCode and DurationMs are
+// only known for items whose run was logged to the database.
+type BatchReportItem struct {
+        ID              int    `json:"id,omitempty"`
+        Index           int    `json:"index"`
+        Command         string `json:"command"`
+        Status          string `json:"status"`
+        AgentID         int    `json:"agent_id,omitempty"`
+        ExitCode        *int   `json:"exit_code,omitempty"`
+        DurationMs      *int64 `json:"duration_ms,omitempty"`
+        Output          string `json:"output"`
+        OutputTruncated bool   `json:"output_truncated,omitempty"`
+}
+
+// BatchTotals counts a batch's items by status and adds up the logged
+// durations.
+type BatchTotals struct {
+        Items           int            `json:"items"`
+        ByStatus        map[string]int `json:"by_status"`
+        TotalDurationMs int64          `json:"total_duration_ms"`
+}
+
+// GetBatchReport gathers the items of a batch from memory and the queue
+// table, takes exit codes and durations from each item's latest log row,
+// and reports errQueueItemNotFound for a batch with no items.
+func (am *AgentManager) GetBatchReport(batchID string) (BatchReport, error) {
+        report := BatchReport{
+                BatchID:     batchID,
+                GeneratedAt: time.Now().Format(time.RFC3339),
+                Items:       []BatchReportItem{},
+                Totals:      BatchTotals{ByStatus: make(map[string]int)},
+        }
+
+        seen := make(map[int]bool)
+        am.queueLock.RLock()
+        for _, item := range am.queue {
+                if item.BatchID != batchID {
+                        continue
+                }
+                if item.ID != 0 {
+                        seen[item.ID] = true
+                }
+                report.Items = append(report.Items, BatchReportItem{ID: item.ID, Index: item.Index,
+                        Command: item.Command, Status: item.Status, AgentID: item.AgentID, Output: item.Output})
+        }
+        am.queueLock.RUnlock()
+
+        if am.persistenceEnabled() {
+                rows, err := am.db().Query(`SELECT id, idx, command, status, output, agent_id FROM queue WHERE batch_id = $1`, batchID)
+                if err != nil {
+                        return report, err
+                }
+                for rows.Next() {
+                        var item BatchReportItem
+                        if err := rows.Scan(&item.ID, &item.Index, &item.Command, &item.Status, &item.Output, &item.AgentID); err != nil {
+                                rows.Close()
+                                return report, err
+                        }
+                        if !seen[item.ID] {
+                                item.Output = am.outputCipher.Open(item.Output)
+                                report.Items = append(report.Items, item)
+                        }
+                }
+                rows.Close()
+                if err := rows.Err(); err != nil {
+                        return report, err
+                }
+        }
+        if len(report.Items) == 0 {
+                return report, errQueueItemNotFound
+        }
+        sort.Slice(report.Items, func(i, j int) bool { return report.Items[i].Index < report.Items[j].Index })
+
+        if am.logsDB() != nil {
+                ids := make([]string, 0, len(report.Items))
+                for _, item := range report.Items {
+                        if item.ID != 0 {
+                                ids = append(ids, strconv.Itoa(item.ID))
+                        }
+                }
+                // The logs may live in another database, so they are looked
+                // up by queue id rather than joined on batch_id.
+                rows, err := am.logsDB().Query(`
+                        SELECT DISTINCT ON (queue_id) queue_id, exit_code, duration_ms FROM logs
+                        WHERE queue_id = ANY($1::int[]) ORDER BY queue_id, id DESC
+                `, "{"+strings.Join(ids, ",")+"}")
+                if err != nil {
+                        return report, err
+                }
+                logged := make(map[int][2]int64)
+                for rows.Next() {
+                        var queueID int
+                        var exitCode, duration int64
+                        if err := rows.Scan(&queueID, &exitCode, &duration); err != nil {
+                                rows.Close()
+                                return report, err
+                        }
+                        logged[queueID] = [2]int64{exitCode, duration}
+                }
+                rows.Close()
+                for i := range report.Items {
+                        item := &report.Items[i]
+                        if l, ok := logged[item.ID]; ok && item.ID != 0 && terminalStatuses[item.Status] {
+                                exitCode, duration := int(l[0]), l[1]
+                                item.ExitCode, item.DurationMs = &exitCode, &duration
+                        }
+                }
+        }
+
+        report.Done = true
+        for i := range report.Items {
+                item := &report.Items[i]
+                if len(item.Output) > reportOutputBytes {
+                        item.Output, item.OutputTruncated = item.Output[:reportOutputBytes], true
+                }
+                report.Totals.Items++
+                report.Totals.ByStatus[item.Status]++
+                if item.DurationMs != nil {
+                        report.Totals.TotalDurationMs += *item.DurationMs
+                }
+                if !terminalStatuses[item.Status] {
+                        report.Done = false
+                }
+        }
+        return report, nil
+}
+
+// compactQueue drops all but the newest QUEUE_KEEP_TERMINAL finished items
+// from the in-memory queue into a freshly sized slice; their rows stay in the
+// database. Finished items that an unfinished one still depends on are kept so
+// the dependency keeps resolving the same way.
+func (am *AgentManager) compactQueue() {
+        if am.config().keepTerminal < 0 {
+                return
+        }
+
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        terminal := 0
+        for _, item := range am.queue {
+                if terminalStatuses[item.Status] {
+                        terminal++
+                }
+        }
+        drop := terminal - am.config().keepTerminal
+        if drop <= 0 {
+                return
+        }
+
+        needed := make(map[int]bool)
+        for _, item := range am.queue {
+                if !terminalStatuses[item.Status] {
+                        for _, dep := range item.DependsOn {
+                                needed[dep] = true
+                        }
+                }
+        }
+
+        kept := make([]QueueItem, 0, len(am.queue)-drop)
+        dropped := 0
+        for _, item := range am.queue {
+                if dropped < drop && terminalStatuses[item.Status] && !needed[queueKey(&item)] {
+                        dropped++
+                        continue
+                }
+                kept = append(kept, item)
+        }
+        am.queue = kept
+
+        if dropped > 0 {
+                log.Printf("Compacted queue: dropped %d finished items, %d remain in memory", dropped, len(kept))
+        }
+}
+
+// quietHours is a recurring schedule during which only items at or above
+// minPriority are dispatched, so background work runs off-peak.
+type quietHours struct {
+        windows     [][2]int // minutes since midnight, [start, end)
+        days        map[time.Weekday]bool
+        loc         *time.Location
+        minPriority int
+}
+
+var weekdayNames = map[string]time.Weekday{
+        "sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+        "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClock(value string) (int, error) {
+        t, err := time.Parse("15:04", strings.TrimSpace(value))
+        if err != nil {
+                return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+        }
+        return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseQuietHours reads windows such as "09:00-12:00,13:00-17:00" (a window
+// may wrap midnight, e.g. "22:00-06:00"), an optional day list such as
+// "mon,tue,wed,thu,fri" and an IANA timezone. An empty spec disables it.
+func parseQuietHours(spec, days, tz string, minPriority int) (*quietHours, error) {
+        if strings.TrimSpace(spec) == "" {
+                return nil, nil
+        }
+
+        qh := &quietHours{loc: time.Local, minPriority: minPriority}
+        if tz != "" {
+                loc, err := time.LoadLocation(tz)
+                if err != nil {
+                        return nil, fmt.Errorf("invalid timezone %q: %v", tz, err)
+                }
+                qh.loc = loc
+        }
+
+        for _, window := range strings.Split(spec, ",") {
+                bounds := strings.SplitN(window, "-", 2)
+                if len(bounds) != 2 {
+                        return nil, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", window)
+                }
+                start, err := parseClock(bounds[0])
+                if err != nil {
+                        return nil, err
+                }
+                end, err := parseClock(bounds[1])
+                if err != nil {
+                        return nil, err
+                }
+                qh.windows = append(qh.windows, [2]int{start, end})
+        }
+
+        if strings.TrimSpace(days) != "" {
+                qh.days = make(map[time.Weekday]bool)
+                for _, day := range strings.Split(days, ",") {
+                        name := strings.ToLower(strings.TrimSpace(day))
+                        if len(name) > 3 {
+                                name = name[:3]
+                        }
+                        wd, ok := weekdayNames[name]
+                        if !ok {
+                                return nil, fmt.Errorf("invalid day %q", day)
+                        }
+                        qh.days[wd] = true
+                }
+        }
+        return qh, nil
+}
+
+func (qh *quietHours) Active(now time.Time) bool {
+        if qh == nil {
+                return false
+        }
+
+        now = now.In(qh.loc)
+        minute := now.Hour()*60 + now.Minute()
+        for _, w := range qh.windows {
+                start, end := w[0], w[1]
+                day := now.Weekday()
+                var inside bool
+                if start <= end {
+                        inside = minute >= start && minute < end
+                } else {
+                        // The window wraps midnight; the early-morning part
+                        // belongs to the day the window started on.
+                        inside = minute >= start || minute < end
+                        if minute < end {
+                                day = (day + 6) % 7
+                        }
+                }
+                if inside && (qh.days == nil || qh.days[day]) {
+                        return true
+                }
+        }
+        return false
+}
+
+// dispatchShare is an agent's standing under weighted dispatch. pass is
+// its virtual time: items taken divided by weight.
+type dispatchShare struct {
+        count int
+        pass  float64
+}
+
+func agentWeight(agent *Agent) int {
+        if agent.Weight <= 0 {
+                return 1
+        }
+        return agent.Weight
+}
+
+// shareFor returns the agent's share, starting a newcomer at the lowest pass
+// so it neither floods nor starves. Callers hold dispatchLock.
+func (am *AgentManager) shareFor(agentID int) *dispatchShare {
+        if share, ok := am.shares[agentID]; ok {
+                return share
+        }
+        share := &dispatchShare{}
+        first := true
+        for _, other := range am.shares {
+                if first || other.pass < share.pass {
+                        share.pass = other.pass
+                        first = false
+                }
+        }
+        am.shares[agentID] = share
+        return share
+}
+
+// weightedTurn reports whether agentID has the lowest pass among the agents
+// competing for work: unreserved ones with a live loop that are idle or have
+// been busy for less than WEIGHTED_DISPATCH_MAX_WAIT_MS. Agents only run one
+// command at a time, so a light agent has to hold back while a heavy one is
+// busy for the weights to matter; the bound keeps a long command from
+// stalling everyone else.
+func (am *AgentManager) weightedTurn(agentID int) bool {
+        am.loopLock.Lock()
+        looping := make(map[int]bool, len(am.agentLoops))
+        for id := range am.agentLoops {
+                looping[id] = true
+        }
+        am.loopLock.Unlock()
+
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+
+        var competing []int
+        for id, agent := range am.agents {
+                if id != agentID && (agent.Reserved || agent.Draining || agent.Paused || !looping[id]) {
+                        continue
+                }
+                if id == agentID || agent.Status == "idle" || time.Since(agent.LastExecute) < am.config().weightMaxWait {
+                        competing = append(competing, id)
+                }
+        }
+
+        am.dispatchLock.Lock()
+        defer am.dispatchLock.Unlock()
+
+        own := am.shareFor(agentID).pass
+        for _, id := range competing {
+                if am.shareFor(id).pass < own {
+                        return false
+                }
+        }
+        return true
+}
+
+func (am *AgentManager) chargeDispatch(agentID int) {
+        am.agentLock.RLock()
+        weight := 1
+        if agent, ok := am.agents[agentID]; ok {
+                weight = agentWeight(agent)
+        }
+        am.agentLock.RUnlock()
+
+        am.dispatchLock.Lock()
+        defer am.dispatchLock.Unlock()
+
+        share := am.shareFor(agentID)
+        share.count++
+        share.pass += 1 / float64(weight)
+}
+
+// DispatchShares reports each agent's configured share of the queue next to
+// the share it has actually taken since startup.
+func (am *AgentManager) DispatchShares() []map[string]interface{} {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+        am.dispatchLock.Lock()
+        defer am.dispatchLock.Unlock()
+
+        totalWeight, totalCount := 0, 0
+        for id, agent := range am.agents {
+                totalWeight += agentWeight(agent)
+                if share, ok := am.shares[id]; ok {
+                        totalCount += share.count
+                }
+        }
+
+        shares := make([]map[string]interface{}, 0, len(am.agents))
+        for id, agent := range am.agents {
+                count := 0
+                if share, ok := am.shares[id]; ok {
+                        count = share.count
+                }
+                actual := 0.0
+                if totalCount > 0 {
+                        actual = float64(count) / float64(totalCount)
+                }
+                shares = append(shares, map[string]interface{}{
+                        "agent_id":        id,
+                        "name":            agent.Name,
+                        "weight":          agentWeight(agent),
+                        "effective_share": float64(agentWeight(agent)) / float64(totalWeight),
+                        "dispatched":      count,
+                        "actual_share":    actual,
+                })
+        }
+        sort.Slice(shares, func(i, j int) bool {
+                return shares[i]["agent_id"].(int) < shares[j]["agent_id"].(int)
+        })
+        return shares
+}
+
+// dispatchFloor is the lowest priority that may be dispatched right now.
+func (am *AgentManager) dispatchFloor() (int, bool) {
+        if am.config().quietHours.Active(time.Now()) {
+                return am.config().quietHours.minPriority, true
+        }
+        return 0, false
+}
+
+// queueKey is how other items refer to this one in DependsOn.
+func queueKey(item *QueueItem) int {
+        if item.ID != 0 {
+                return item.ID
+        }
+        return item.Index
+}
+
+// queuePositionsLocked maps each item's queueKey to its position in the
+// queue. Callers hold queueLock.
+func (am *AgentManager) queuePositionsLocked() map[int]int {
+        positions := make(map[int]int, len(am.queue))
+        for i := range am.queue {
+                positions[queueKey(&am.queue[i])] = i
+        }
+        return positions
+}
+
+// dependencyStatusLocked returns the status of the item dep refers to. One
+// compacted out of the queue, or not loaded because it completed before a
+// restart, is looked up in the database; found is false when it is in
+// neither, and err is set when the database could not be asked. Callers
+// hold queueLock for writing.
+func (am *AgentManager) dependencyStatusLocked(dep int, positions map[int]int) (status string, found bool, err error) {
+        if i, ok := positions[dep]; ok {
+                return am.queue[i].Status, true, nil
+        }
+        if status, ok := am.finishedDeps[dep]; ok {
+                return status, true, nil
+        }
+        if !am.persistenceEnabled() {
+                return "", false, nil
+        }
+        err = am.db().QueryRow(`SELECT status FROM queue WHERE id = $1`, dep).Scan(&status)
+        if errors.Is(err, sql.ErrNoRows) {
+                return "", false, nil
+        }
+        if err != nil {
+                return "", false, err
+        }
+        if terminalStatuses[status] {
+                am.finishedDeps[dep] = status
+        }
+        return status, true, nil
+}
+
+// dependenciesMetLocked reports whether every dependency of item has
+// completed. One that is disabled or quarantined holds its dependents until
+// an operator enables or releases it; one that can no longer complete gets
+// them skipped by skipBlockedLocked. Callers hold queueLock for writing.
+func (am *AgentManager) dependenciesMetLocked(item *QueueItem, positions map[int]int) bool {
+        for _, dep := range item.DependsOn {
+                if status, _, _ := am.dependencyStatusLocked(dep, positions); status != "completed" {
+                        return false
+                }
+        }
+        return true
+}
+
+// skipBlockedLocked skips pending items with a dependency that ended
+// without completing (failed, skipped, expired or cancelled), was
+// interrupted by a restart, which is never dispatched again, or no longer
+// exists anywhere; in each case they would otherwise wait forever. A skip
+// blocks the item's own dependents in turn, so it cascades down the graph.
+// Callers hold queueLock for writing.
+func (am *AgentManager) skipBlockedLocked(positions map[int]int) {
+        var skipped []QueueItem
+        for changed := true; changed; {
+                changed = false
+                for i := range am.queue {
+                        item := &am.queue[i]
+                        if item.Status != "pending" {
+                                continue
+                        }
+                        for _, dep := range item.DependsOn {
+                                status, found, err := am.dependencyStatusLocked(dep, positions)
+                                if err != nil || (found && (status == "completed" || (!terminalStatuses[status] && status != "interrupted"))) {
+                                        continue
+                                }
+                                if !found {
+                                        status = "not found"
+                                }
+                                item.Status = "skipped"
+                                item.Output = fmt.Sprintf("dependency %d %s", dep, status)
+                                am.updateQueueItemInDB(item)
+                                am.saveLogToDB(&LogEntry{
+                                        Level:   "warn",
+                                        Message: fmt.Sprintf("Skipped queue item %d: %s", item.Index, item.Output),
+                                        Command: item.Command,
+                                        QueueID: item.ID,
+                                })
+                                skipped = append(skipped, *item)
+                                changed = true
+                                break
+                        }
+                }
+        }
+        if len(skipped) == 0 {
+                return
+        }
+        am.broadcastMessage(Message{
+                Type:    "queue_items_skipped",
+                Payload: skipped,
+        })
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+}
+
+// effectivePrioritiesLocked returns the dispatch priority of every queue
+// position. A pending dependency inherits the highest effective priority of
+// the pending items waiting on it, transitively, so a low-priority step does
+// not hold back an urgent chain. Inheritance is applied on top of each
+// item's own priority, so anything that raises that base carries through the
+// chain as well. Callers hold queueLock.
+func (am *AgentManager) effectivePrioritiesLocked(positions map[int]int) []int {
+        effective := make([]int, len(am.queue))
+        for i, item := range am.queue {
+                effective[i] = item.Priority
+        }
+
+        // Each pass pushes priority at least one edge further up the chain;
+        // a chain is never longer than the queue, which also bounds cycles.
+        for pass := 0; pass < len(am.queue); pass++ {
+                changed := false
+                for i, item := range am.queue {
+                        if item.Status != "pending" {
+                                continue
+                        }
+                        for _, dep := range item.DependsOn {
+                                j, ok := positions[dep]
+                                if !ok || am.queue[j].Status != "pending" {
+                                        continue
+                                }
+                                if effective[i] > effective[j] {
+                                        effective[j] = effective[i]
+                                        changed = true
+                                }
+                        }
+                }
+                if !changed {
+                        break
+                }
+        }
+        return effective
+}
+
+// staggeredLocked reports whether item has to wait because another item of
+// its batch started less than StaggerMs ago. Callers hold queueLock.
+func (am *AgentManager) staggeredLocked(item *QueueItem, now time.Time) bool {
+        if item.StaggerMs <= 0 {
+                return false
+        }
+        last, ok := am.batchStarts[item.BatchID]
+        return ok && now.Sub(last) < time.Duration(item.StaggerMs)*time.Millisecond
+}
+
+// markBatchStartLocked notes that an item of a staggered batch is starting
+// and forgets batches whose stagger window has long passed. Callers hold
+// queueLock.
+func (am *AgentManager) markBatchStartLocked(item *QueueItem, now time.Time) {
+        for batchID, last := range am.batchStarts {
+                if now.Sub(last) > time.Hour {
+                        delete(am.batchStarts, batchID)
+                }
+        }
+        if item.StaggerMs > 0 {
+                am.batchStarts[item.BatchID] = now
+        }
+}
+
+// GetNextQueueItem claims work for agentID when it is the agent's turn under
+// weighted dispatch.
+func (am *AgentManager) GetNextQueueItem(agentID int) *QueueItem {
+        // In safe mode items stay pending instead of failing one by one.
+        if am.safeMode.Load() || am.underMemoryPressure() || !am.weightedTurn(agentID) {
+                return nil
+        }
+        item := am.claimNextQueueItem(agentID)
+        if item != nil {
+                am.chargeDispatch(agentID)
+        }
+        return item
+}
+
+// underMemoryPressure compares the allocated heap against MEMORY_PRESSURE_MB
+// and announces each change with memory_pressure. Crossing the threshold
+// forces a collection first when MEMORY_PRESSURE_GC is set, so garbage alone
+// does not hold up dispatch.
+func (am *AgentManager) underMemoryPressure() bool {
+        cfg := am.config()
+        if cfg.memoryLimitMB <= 0 {
+                if am.memoryPressure.Swap(false) {
+                        am.announceMemoryPressure(false, heapAllocMB(), cfg.memoryLimitMB)
+                }
+                return false
+        }
+
+        allocMB := heapAllocMB()
+        if allocMB > cfg.memoryLimitMB && cfg.memoryPressureGC && !am.memoryPressure.Load() {
+                runtime.GC()
+                allocMB = heapAllocMB()
+        }
+        over := allocMB > cfg.memoryLimitMB
+        if am.memoryPressure.Swap(over) != over {
+                am.announceMemoryPressure(over, allocMB, cfg.memoryLimitMB)
+        }
+        return over
+}
+
+func heapAllocMB() float64 {
+        var memStats runtime.MemStats
+        runtime.ReadMemStats(&memStats)
+        return float64(memStats.Alloc) / 1024 / 1024
+}
+
+func (am *AgentManager) announceMemoryPressure(active bool, allocMB, limitMB float64) {
+        level, message := "info", fmt.Sprintf("Memory recovered (%.1f MB), dispatch resumed", allocMB)
+        if active {
+                level, message = "warn", fmt.Sprintf("Memory at %.1f MB is over the %.1f MB limit, dispatch paused", allocMB, limitMB)
+        }
+        log.Println(message)
+        am.saveLogToDB(&LogEntry{
+                Level:   level,
+                Message: message,
+        })
+        am.broadcastMessage(Message{
+                Type: "memory_pressure",
+                Payload: map[string]interface{}{
+                        "active":   active,
+                        "alloc_mb": allocMB,
+                        "limit_mb": limitMB,
+                },
+        })
+}
+
+// claimNextQueueItem claims the best pending item for agentID: the highest
+// effective priority, oldest first among equals. The status and owning agent
+// are set together under queueLock and written in one update, so listings
+// never show a running item without its agent. A copy is returned because
+// the backing slice may be reallocated once the lock is released.
+func (am *AgentManager) claimNextQueueItem(agentID int) *QueueItem {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        am.parkQuarantinedLocked()
+
+        floor, quiet := am.dispatchFloor()
+        positions := am.queuePositionsLocked()
+        am.skipBlockedLocked(positions)
+        effective := am.effectivePrioritiesLocked(positions)
+        now := time.Now()
+        ready := func(i int) bool {
+                item := &am.queue[i]
+                return item.Status == "pending" && am.dependenciesMetLocked(item, positions) && !am.staggeredLocked(item, now) &&
+                        !item.RetryAt.After(now) && !item.RunAt.After(now) && (!quiet || effective[i] >= floor)
+        }
+
+        // A FIFO agent takes its oldest pinned item first, and none of its
+        // other pinned items until that one is ready. Items it is still
+        // running count too, so one running at MaxConcurrent > 1 does not
+        // let the next overtake it.
+        fifo := am.agentFIFO(agentID)
+        if fifo {
+                head := -1
+                for i, item := range am.queue {
+                        unfinished := item.Status == "pending" || item.Status == "running" || item.Status == "awaiting_confirmation"
+                        if item.PinnedAgent == agentID && unfinished && (head < 0 || item.Index < am.queue[head].Index) {
+                                head = i
+                        }
+                }
+                if head >= 0 && ready(head) {
+                        return am.claimQueueItemLocked(head, agentID, now)
+                }
+        }
+
+        bestIdx := -1
+        bestPriority := math.MinInt
+        for i, item := range am.queue {
+                if item.PinnedAgent != 0 && (item.PinnedAgent != agentID || fifo) {
+                        continue
+                }
+                if !ready(i) {
+                        continue
+                }
+                if bestIdx < 0 || effective[i] > bestPriority ||
+                        (effective[i] == bestPriority && enqueuedBefore(&am.queue[i], &am.queue[bestIdx])) {
+                        bestIdx = i
+                        bestPriority = effective[i]
+                }
+        }
+
+        if bestIdx >= 0 {
+                return am.claimQueueItemLocked(bestIdx, agentID, now)
+        }
+        return nil
+}
+
+// enqueuedBefore breaks ties between items of equal priority: the one
+// enqueued first goes first. Row ids give that order with persistence and
+// indexes without; the slice order is not reliable, as items move around
+// on reload and retry.
+func enqueuedBefore(a, b *QueueItem) bool {
+        if a.ID != 0 && b.ID != 0 {
+                return a.ID < b.ID
+        }
+        return a.Index < b.Index
+}
+
+// observeQueueWait records how long item waited to be dispatched at now,
+// counting a scheduled item from its RunAt.
+func observeQueueWait(item *QueueItem, now time.Time) {
+        enqueued := item.EnqueuedAt
+        if enqueued.IsZero() {
+                enqueued, _ = time.Parse(time.RFC3339, item.CreatedAt)
+        }
+        if item.RunAt.After(enqueued) {
+                enqueued = item.RunAt
+        }
+        if !enqueued.IsZero() {
+                queueWaitSeconds.Observe(now.Sub(enqueued).Seconds())
+        }
+}
+
+// claimQueueItemLocked marks the item at position i as running on agentID
+// and returns a copy. Callers hold queueLock.
+func (am *AgentManager) claimQueueItemLocked(i int, agentID int, now time.Time) *QueueItem {
+        item := &am.queue[i]
+        observeQueueWait(item, now)
+        am.markBatchStartLocked(item, now)
+        item.Status = "running"
+        item.Started = true
+        item.AgentID = agentID
+        am.updateQueueItemInDB(item)
+        claimed := *item
+        return &claimed
+}
+
+// agentFIFO reports whether agentID runs its pinned items in FIFO order.
+func (am *AgentManager) agentFIFO(agentID int) bool {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+        agent, ok := am.agents[agentID]
+        return ok && agent.FIFO
+}
+
+// SetAgentFIFO switches an agent between priority and FIFO order for the
+// items pinned to it. Unpinned items are always taken by priority.
+func (am *AgentManager) SetAgentFIFO(id int, fifo bool) (Agent, error) {
+        am.agentLock.Lock()
+        defer am.agentLock.Unlock()
+
+        agent, exists := am.agents[id]
+        if !exists {
+                return Agent{}, fmt.Errorf("agent %d not found", id)
+        }
+        agent.FIFO = fifo
+        am.saveAgentToDB(agent)
+
+        mode := "priority"
+        if fifo {
+                mode = "FIFO"
+        }
+        am.saveLogToDB(&LogEntry{
+                AgentID: id,
+                Level:   "info",
+                Message: fmt.Sprintf("Agent '%s' now runs pinned items in %s order", agent.Name, mode),
+        })
+        am.broadcastMessage(Message{
+                Type:    "agent_status",
+                Payload: agent,
+        })
+        return *agent, nil
+}
+
+var errAgentNotFound = errors.New("agent not found")
+
+// maxAgentConcurrency caps how many queue items one agent may run at once.
+const maxAgentConcurrency = 64
+
+// clampConcurrency turns a requested per-agent limit into one between 1 and
+// maxAgentConcurrency.
+func clampConcurrency(limit int) int {
+        return min(max(limit, 1), maxAgentConcurrency)
+}
+
+// agentConcurrency is how many queue items agentID may run at once.
+func (am *AgentManager) agentConcurrency(agentID int) int {
+        am.agentLock.RLock()
+        defer am.agentLock.RUnlock()
+        agent, ok := am.agents[agentID]
+        if !ok {
+                return 1
+        }
+        return clampConcurrency(agent.MaxConcurrent)
+}
+
+// SetAgentMaxConcurrent changes how many queue items an agent runs at once.
+// Lowering it lets the items already running finish.
+func (am *AgentManager) SetAgentMaxConcurrent(id int, limit int) (Agent, error) {
+        if limit < 1 || limit > maxAgentConcurrency {
+                return Agent{}, fmt.Errorf("max_concurrent must be between 1 and %d", maxAgentConcurrency)
+        }
+
+        am.agentLock.Lock()
+        defer am.agentLock.Unlock()
+
+        agent, exists := am.agents[id]
+        if !exists {
+                return Agent{}, errAgentNotFound
+        }
+        agent.MaxConcurrent = limit
+        am.saveAgentToDB(agent)
+
+        am.saveLogToDB(&LogEntry{
+                AgentID: id,
+                Level:   "info",
+                Message: fmt.Sprintf("Agent '%s' now runs up to %d commands at once", agent.Name, limit),
+        })
+        am.broadcastMessage(Message{
+                Type:    "agent_status",
+                Payload: agent,
+        })
+        return *agent, nil
+}
+
+// GetNextBatch claims up to batchSize ready items in the order
+// claimNextQueueItem would hand them out: the highest effective priority
+// first, oldest first among equals.
+func (am *AgentManager) GetNextBatch(batchSize int) []QueueItem {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        am.parkQuarantinedLocked()
+
+        positions := am.queuePositionsLocked()
+        am.skipBlockedLocked(positions)
+        effective := am.effectivePrioritiesLocked(positions)
+        now := time.Now()
+        var ready []int
+        for i := range am.queue {
+                if am.queue[i].Status == "pending" && am.dependenciesMetLocked(&am.queue[i], positions) &&
+                        !am.staggeredLocked(&am.queue[i], now) && !am.queue[i].RetryAt.After(now) &&
+                        !am.queue[i].RunAt.After(now) {
+                        ready = append(ready, i)
+                }
+        }
+        sort.Slice(ready, func(a, b int) bool {
+                i, j := ready[a], ready[b]
+                if effective[i] != effective[j] {
+                        return effective[i] > effective[j]
+                }
+                return enqueuedBefore(&am.queue[i], &am.queue[j])
+        })
+
+        var batch []QueueItem
+        for _, i := range ready {
+                if len(batch) >= batchSize {
+                        break
+                }
+                // Claiming an earlier item may have started its batch's
+                // stagger window.
+                if am.staggeredLocked(&am.queue[i], now) {
+                        continue
+                }
+                observeQueueWait(&am.queue[i], now)
+                am.markBatchStartLocked(&am.queue[i], now)
+                am.queue[i].Status = "running"
+                am.queue[i].Started = true
+                am.updateQueueItemInDB(&am.queue[i])
+                batch = append(batch, am.queue[i])
+        }
+        return batch
+}
+
+// CompleteQueueItem settles the run of the item with queueKey key, retrying
+// it if it failed and has retries left.
+func (am *AgentManager) CompleteQueueItem(key int, output string, success bool) {
+        if !success {
+                // Counted once the item is settled, so a retry that was just
+                // scheduled is parked too if this failure quarantines it.
+                defer am.noteQueueFailure(key)
+        }
+        if !success && am.retryFailedQueueItem(key, output) {
+                return
+        }
+        status := "failed"
+        if success {
+                status = "completed"
+        }
+        am.finishQueueItem(key, status, output)
+}
+
+// retryBackoff is how long an item waits before its attempt'th retry:
+// RETRY_BACKOFF_BASE doubled per earlier retry, capped at RETRY_BACKOFF_MAX.
+func (am *AgentManager) retryBackoff(attempt int) time.Duration {
+        cfg := am.config()
+        delay := cfg.retryBackoffBase
+        for i := 1; i < attempt && delay < cfg.retryBackoffMax; i++ {
+                delay *= 2
+        }
+        return min(delay, cfg.retryBackoffMax)
+}
+
+// retryFailedQueueItem puts a failed item back to pending after its backoff.
+// It returns false once the item has used up its MaxRetries or its batch's
+// retry budget, and the item then fails as usual.
+func (am *AgentManager) retryFailedQueueItem(key int, output string) bool {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        i := am.findQueueItem(key)
+        if i < 0 {
+                return false
+        }
+        item := &am.queue[i]
+        if item.RetryCount >= item.MaxRetries {
+                return false
+        }
+        agentID := item.AgentID
+        if !am.spendRetryLocked(item) {
+                am.saveLogToDB(&LogEntry{
+                        AgentID: agentID,
+                        Level:   "warn",
+                        Message: fmt.Sprintf("Queue item %d failed; retry budget of batch %s exhausted", item.Index, item.BatchID),
+                        Command: item.Command,
+                })
+                return false
+        }
+        item.RetryCount++
+        delay := am.retryBackoff(item.RetryCount)
+        item.Status = "pending"
+        item.Output = output
+        item.AgentID = 0
+        item.RetryAt = time.Now().Add(delay)
+        item.EnqueuedAt = time.Now()
+        am.updateQueueItemInDB(item)
+
+        am.saveLogToDB(&LogEntry{
+                AgentID: agentID,
+                Level:   "warn",
+                Message: fmt.Sprintf("Queue item %d failed, retrying in %s (attempt %d/%d)", item.Index, delay, item.RetryCount, item.MaxRetries),
+                Command: item.Command,
+                Output:  output,
+        })
+        am.broadcastMessage(Message{
+                Type: "queue_retry",
+                Payload: map[string]interface{}{
+                        "id":          item.ID,
+                        "index":       item.Index,
+                        "agent_id":    agentID,
+                        "attempt":     item.RetryCount,
+                        "max_retries": item.MaxRetries,
+                        "retry_at":    item.RetryAt.Format(time.RFC3339),
+                },
+        })
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+        return true
+}
+
+var errQuarantineNotFound = errors.New("command is not quarantined")
+
+// quarantine tracks recent failures per normalized command. A command that
+// fails QUARANTINE_THRESHOLD times within QUARANTINE_WINDOW, counting every
+// run and retry, is quarantined: its pending queue items are parked as
+// "quarantined" instead of running until an operator releases it.
+type quarantine struct {
+        mu       sync.Mutex
+        failures map[string][]time.Time
+        commands map[string]QuarantinedCommand
+}
+
+// QuarantinedCommand is one entry of GET /quarantine. Items lists the ids
+// (indexes without persistence) of its parked queue items; QuarantinedAt
+// and Failures are unknown for items parked before a restart.
+type QuarantinedCommand struct {
+        Hash          string `json:"hash"`
+        Command       string `json:"command"`
+        Failures      int    `json:"failures,omitempty"`
+        QuarantinedAt string `json:"quarantined_at,omitempty"`
+        Items         []int  `json:"items"`
+}
+
+func newQuarantine() *quarantine {
+        return &quarantine{
+                failures: make(map[string][]time.Time),
+                commands: make(map[string]QuarantinedCommand),
+        }
+}
+
+// recordFailure notes a failed run of command at now and returns the new
+// entry when that failure put the command into quarantine.
+func (q *quarantine) recordFailure(command string, now time.Time, threshold int, window time.Duration) (QuarantinedCommand, bool) {
+        hash := commandHash(command)
+
+        q.mu.Lock()
+        defer q.mu.Unlock()
+
+        if _, ok := q.commands[hash]; ok {
+                return QuarantinedCommand{}, false
+        }
+        var recent []time.Time
+        for _, at := range q.failures[hash] {
+                if window <= 0 || now.Sub(at) < window {
+                        recent = append(recent, at)
+                }
+        }
+        recent = append(recent, now)
+        if len(recent) < threshold {
+                q.failures[hash] = recent
+                return QuarantinedCommand{}, false
+        }
+
+        delete(q.failures, hash)
+        entry := QuarantinedCommand{
+                Hash:          hash,
+                Command:       normalizeCommand(command),
+                Failures:      len(recent),
+                QuarantinedAt: now.Format(time.RFC3339),
+        }
+        q.commands[hash] = entry
+        return entry, true
+}
+
+func (q *quarantine) has(hash string) bool {
+        q.mu.Lock()
+        defer q.mu.Unlock()
+        _, ok := q.commands[hash]
+        return ok
+}
+
+func (q *quarantine) empty() bool {
+        q.mu.Lock()
+        defer q.mu.Unlock()
+        return len(q.commands) == 0
+}
+
+// release lifts the quarantine on hash and forgets its failures; it
+// reports whether the command was quarantined.
+func (q *quarantine) release(hash string) (QuarantinedCommand, bool) {
+        q.mu.Lock()
+        defer q.mu.Unlock()
+        entry, ok := q.commands[hash]
+        delete(q.commands, hash)
+        delete(q.failures, hash)
+        return entry, ok
+}
+
+func (q *quarantine) list() map[string]QuarantinedCommand {
+        q.mu.Lock()
+        defer q.mu.Unlock()
+        return maps.Clone(q.commands)
+}
+
+// noteQueueFailure counts a failed run of the item with queueKey key toward
+// its command's quarantine threshold and quarantines the command once it is
+// reached.
+func (am *AgentManager) noteQueueFailure(key int) {
+        cfg := am.config()
+        if cfg.quarantineThreshold <= 0 {
+                return
+        }
+
+        am.queueLock.RLock()
+        command := ""
+        if i := am.findQueueItem(key); i >= 0 {
+                command = am.queue[i].Command
+        }
+        am.queueLock.RUnlock()
+        if command == "" {
+                return
+        }
+
+        entry, quarantined := am.quarantine.recordFailure(command, time.Now(), cfg.quarantineThreshold, cfg.quarantineWindow)
+        if !quarantined {
+                return
+        }
+
+        am.queueLock.Lock()
+        entry.Items = am.parkQuarantinedLocked()[entry.Hash]
+        am.queueLock.Unlock()
+
+        am.saveLogToDB(&LogEntry{
+                Level:   "warn",
+                Message: fmt.Sprintf("Command quarantined after %d failures within %s; %d queued items parked", entry.Failures, cfg.quarantineWindow, len(entry.Items)),
+                Command: command,
+        })
+        am.broadcastMessage(Message{
+                Type:    "command_quarantined",
+                Payload: entry,
+        })
+        if cfg.quarantineWebhook != "" {
+                go am.notifyWebhook(cfg.quarantineWebhook, "command_quarantined", entry)
+        }
+}
+
+// parkQuarantinedLocked moves pending items of quarantined commands to
+// "quarantined" and returns the keys it parked by command hash. Callers
+// hold queueLock.
+func (am *AgentManager) parkQuarantinedLocked() map[string][]int {
+        if am.quarantine.empty() {
+                return nil
+        }
+        parked := make(map[string][]int)
+        for i := range am.queue {
+                item := &am.queue[i]
+                if item.Status != "pending" {
+                        continue
+                }
+                hash := commandHash(item.Command)
+                if !am.quarantine.has(hash) {
+                        continue
+                }
+                item.Status = "quarantined"
+                am.updateQueueItemInDB(item)
+                parked[hash] = append(parked[hash], queueKey(item))
+        }
+        if len(parked) > 0 {
+                am.broadcastMessage(Message{
+                        Type:    "queue_updated",
+                        Payload: am.queue,
+                })
+        }
+        return parked
+}
+
+// Quarantined lists the quarantined commands with their parked items.
+// Items still parked from before a restart show up under their command
+// even though its failure history is gone.
+func (am *AgentManager) Quarantined() []QuarantinedCommand {
+        commands := am.quarantine.list()
+
+        am.queueLock.RLock()
+        for i := range am.queue {
+                item := &am.queue[i]
+                if item.Status != "quarantined" {
+                        continue
+                }
+                hash := commandHash(item.Command)
+                entry, ok := commands[hash]
+                if !ok {
+                        entry = QuarantinedCommand{Hash: hash, Command: normalizeCommand(item.Command)}
+                }
+                entry.Items = append(entry.Items, queueKey(item))
+                commands[hash] = entry
+        }
+        am.queueLock.RUnlock()
+
+        list := make([]QuarantinedCommand, 0, len(commands))
+        for _, entry := range commands {
+                if entry.Items == nil {
+                        entry.Items = []int{}
+                }
+                list = append(list, entry)
+        }
+        sort.Slice(list, func(i, j int) bool {
+                return list[i].QuarantinedAt < list[j].QuarantinedAt ||
+                        (list[i].QuarantinedAt == list[j].QuarantinedAt && list[i].Hash < list[j].Hash)
+        })
+        return list
+}
+
+// ReleaseQuarantine lifts the quarantine on the command with the given hash
+// and returns its parked items to "pending" with a clean failure count.
+func (am *AgentManager) ReleaseQuarantine(hash string) (QuarantinedCommand, error) {
+        entry, ok := am.quarantine.release(hash)
+
+        am.queueLock.Lock()
+        for i := range am.queue {
+                item := &am.queue[i]
+                if item.Status != "quarantined" || commandHash(item.Command) != hash {
+                        continue
+                }
+                if !ok {
+                        entry = QuarantinedCommand{Hash: hash, Command: normalizeCommand(item.Command)}
+                        ok = true
+                }
+                item.Status = "pending"
+                item.RetryAt = time.Time{}
+                am.updateQueueItemInDB(item)
+                entry.Items = append(entry.Items, queueKey(item))
+        }
+        if len(entry.Items) > 0 {
+                am.broadcastMessage(Message{
+                        Type:    "queue_updated",
+                        Payload: am.queue,
+                })
+        }
+        am.queueLock.Unlock()
+
+        if !ok {
+                return QuarantinedCommand{}, errQuarantineNotFound
+        }
+        if entry.Items == nil {
+                entry.Items = []int{}
+        }
+
+        am.saveLogToDB(&LogEntry{
+                Level:   "info",
+                Message: fmt.Sprintf("Command released from quarantine; %d items back to pending", len(entry.Items)),
+                Command: entry.Command,
+        })
+        am.broadcastMessage(Message{
+                Type:    "quarantine_released",
+                Payload: entry,
+        })
+        return entry, nil
+}
+
+// finishQueueItem gives the item with queueKey key its final status and
+// output.
+func (am *AgentManager) finishQueueItem(key int, status string, output string) {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        if i := am.findQueueItem(key); i >= 0 {
+                am.queue[i].Status = status
+                am.queue[i].Output = output
+                am.updateQueueItemInDB(&am.queue[i])
+        }
+}
+
+// defaultDangerousPatterns cover commands that destroy data wholesale.
+const defaultDangerousPatterns = `\brm\s+-[a-zA-Z]*(r[a-zA-Z]*f|f[a-zA-Z]*r),(?i)\bdrop\s+(database|table)\b,\bmkfs\b,\bdd\s+.*\bof=/dev/`
+
+// parseDangerousPatterns compiles the comma-separated DANGEROUS_PATTERNS;
+// "none" turns confirmation off. Invalid patterns are logged and skipped.
+func parseDangerousPatterns(spec string) []*regexp.Regexp {
+        if spec == "" {
+                spec = defaultDangerousPatterns
+        }
+        if spec == "none" {
+                return nil
+        }
+        var patterns []*regexp.Regexp
+        for _, p := range strings.Split(spec, ",") {
+                if p = strings.TrimSpace(p); p == "" {
+                        continue
+                }
+                re, err := regexp.Compile(p)
+                if err != nil {
+                        log.Printf("Ignoring dangerous pattern %q: %v", p, err)
+                        continue
+                }
+                patterns = append(patterns, re)
+        }
+        return patterns
+}
+
+// policyBlockedExitCode is the exit code of commands the policy refuses,
+// the shell's "cannot execute".
+const policyBlockedExitCode = 126
+
+// commandPolicy decides which commands may run at all. A command matching a
+// denylist pattern is refused; when the allowlist is set, so is every
+// command that commandAllowed does not admit. A policy that failed to load
+// refuses everything, since running without the rules it was meant to hold
+// is worse than running nothing.
+type commandPolicy struct {
+        denylist  []*regexp.Regexp
+        allowlist []string
+        err       error
+}
+
+// loadCommandPolicy combines the comma-separated COMMAND_DENYLIST regexes
+// and COMMAND_ALLOWLIST prefixes with the "denylist" and "allowlist" arrays
+// of the JSON file named by COMMAND_POLICY_FILE. An unreadable file or an
+// invalid pattern is recorded in err.
+func loadCommandPolicy() commandPolicy {
+        var policy commandPolicy
+        var file struct {
+                Denylist  []string `json:"denylist"`
+                Allowlist []string `json:"allowlist"`
+        }
+        if path := os.Getenv("COMMAND_POLICY_FILE"); path != "" {
+                data, err := os.ReadFile(path)
+                if err == nil {
+                        err = json.Unmarshal(data, &file)
+                }
+                if err != nil {
+                        policy.err = fmt.Errorf("command policy file %s: %v", path, err)
+                }
+        }
+
+        for _, p := range append(strings.Split(os.Getenv("COMMAND_DENYLIST"), ","), file.Denylist...) {
+                if p = strings.TrimSpace(p); p == "" {
+                        continue
+                }
+                re, err := regexp.Compile(p)
+                if err != nil {
+                        if policy.err == nil {
+                                policy.err = fmt.Errorf("denylist pattern %q: %v", p, err)
+                        }
+                        continue
+                }
+                policy.denylist = append(policy.denylist, re)
+        }
+        for _, prefix := range append(strings.Split(os.Getenv("COMMAND_ALLOWLIST"), ","), file.Allowlist...) {
+                if prefix = strings.TrimSpace(prefix); prefix != "" {
+                        policy.allowlist = append(policy.allowlist, prefix)
+                }
+        }
+        if policy.err != nil {
+                log.Printf("Command policy could not be loaded, refusing every command: %v", policy.err)
+        }
+        return policy
+}
+
+// equal reports whether two loaded policies would decide every command alike.
+func (p commandPolicy) equal(q commandPolicy) bool {
+        if (p.err == nil) != (q.err == nil) || (p.err != nil && p.err.Error() != q.err.Error()) {
+                return false
+        }
+        if !slices.Equal(p.allowlist, q.allowlist) || len(p.denylist) != len(q.denylist) {
+                return false
+        }
+        for i := range p.denylist {
+                if p.denylist[i].String() != q.denylist[i].String() {
+                        return false
+                }
+        }
+        return true
+}
+
+// blocks returns why the policy refuses command, or "" when it may run.
+func (p commandPolicy) blocks(command string) string {
+        if p.err != nil {
+                return "policy could not be loaded: " + p.err.Error()
+        }
+        for _, re := range p.denylist {
+                if re.MatchString(command) {
+                        return fmt.Sprintf("matches denylist pattern %q", re.String())
+                }
+        }
+        if len(p.allowlist) > 0 && !commandAllowed(command, p.allowlist) {
+                return "not on the allowlist"
+        }
+        return ""
+}
+
+// dangerousPattern returns the first DANGEROUS_PATTERNS entry command
+// matches, or "".
+func (am *AgentManager) dangerousPattern(command string) string {
+        for _, re := range am.config().dangerousPatterns {
+                if re.MatchString(command) {
+                        return re.String()
+                }
+        }
+        return ""
+}
+
+// PendingConfirmation is a dangerous command held until someone confirms it.
+type PendingConfirmation struct {
+        Token      string `json:"token"`
+        AgentID    int    `json:"agent_id"`
+        Command    string `json:"command"`
+        Pattern    string `json:"pattern"`
+        QueueIndex int    `json:"queue_index,omitempty"`
+        ExpiresAt  string `json:"expires_at"`
+
+        decision chan bool
+}
+
+// awaitConfirmation holds a dangerous command, announcing it with
+// confirmation_required, until it is confirmed, rejected, times out after
+// CONFIRM_TIMEOUT or its context ends. A queue item waits in the
+// "awaiting_confirmation" status. It returns an error code and reason when
+// the command must not run.
+func (am *AgentManager) awaitConfirmation(agentID int, command, pattern string, opts ExecOptions) (string, string) {
+        pending := &PendingConfirmation{
+                Token:      newSessionToken(),
+                AgentID:    agentID,
+                Command:    command,
+                Pattern:    pattern,
+                QueueIndex: opts.QueueIndex,
+                ExpiresAt:  time.Now().Add(am.config().confirmTimeout).Format(time.RFC3339),
+                decision:   make(chan bool, 1),
+        }
+        am.confirmations.Store(pending.Token, pending)
+        defer am.confirmations.Delete(pending.Token)
+
+        if key := opts.queueKey(); key > 0 {
+                am.setQueueItemStatus(key, "awaiting_confirmation")
+                defer am.setQueueItemStatus(key, "running")
+        }
+        am.saveLogToDB(&LogEntry{
+                AgentID: agentID,
+                Level:   "warn",
+                Message: fmt.Sprintf("Command matches dangerous pattern %q, awaiting confirmation", pattern),
+                Command: command,
+        })
+        am.broadcastMessage(Message{
+                Type:    "confirmation_required",
+                Payload: pending,
+        })
+
+        done := context.Background().Done()
+        if opts.Context != nil {
+                done = opts.Context.Done()
+        }
+        timer := time.NewTimer(am.config().confirmTimeout)
+        defer timer.Stop()
+
+        code, reason, outcome := "", "", "confirmed"
+        select {
+        case ok := <-pending.decision:
+                if !ok {
+                        code, reason, outcome = "CONFIRMATION_REJECTED", "dangerous command was rejected", "rejected"
+                }
+        case <-timer.C:
+                code, reason, outcome = "CONFIRMATION_TIMEOUT", fmt.Sprintf("dangerous command was not confirmed within %s", am.config().confirmTimeout), "timed_out"
+        case <-done:
+                code, reason, outcome = "CONFIRMATION_CANCELLED", "command cancelled while awaiting confirmation", "cancelled"
+        }
+
+        am.broadcastMessage(Message{
+                Type:    "confirmation_resolved",
+                Payload: map[string]interface{}{"token": pending.Token, "outcome": outcome},
+        })
+        return code, reason
+}
+
+var errConfirmationNotFound = errors.New("no command is awaiting this confirmation token")
+
+// ResolveConfirmation confirms or rejects a held command.
+func (am *AgentManager) ResolveConfirmation(token string, confirm bool) error {
+        value, ok := am.confirmations.LoadAndDelete(token)
+        if !ok {
+                return errConfirmationNotFound
+        }
+        value.(*PendingConfirmation).decision <- confirm
+        return nil
+}
+
+// PendingConfirmations lists the commands currently held for confirmation.
+func (am *AgentManager) PendingConfirmations() []*PendingConfirmation {
+        pending := []*PendingConfirmation{}
+        am.confirmations.Range(func(_, value interface{}) bool {
+                pending = append(pending, value.(*PendingConfirmation))
+                return true
+        })
+        sort.Slice(pending, func(i, j int) bool { return pending[i].ExpiresAt < pending[j].ExpiresAt })
+        return pending
+}
+
+// setQueueItemStatus changes the status of the item with queueKey key and
+// announces it, leaving output and agent alone.
+func (am *AgentManager) setQueueItemStatus(key int, status string) {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        i := am.findQueueItem(key)
+        if i < 0 {
+                return
+        }
+        am.queue[i].Status = status
+        am.updateQueueItemInDB(&am.queue[i])
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+}
+
+// shellQuote quotes value for use as a single POSIX shell word.
+func shellQuote(value string) string {
+        return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// executeFanOut runs item.Command once per FanOut value on agentID, at most
+// FANOUT_MAX_PARALLEL at a time on top of the global concurrency limit, and
+// joins the outputs in value order.
+func (am *AgentManager) executeFanOut(agentID int, item *QueueItem, opts ExecOptions) (string, bool) {
+        results := make([]CommandResult, len(item.FanOut))
+        sem := make(chan struct{}, am.config().fanOutParallel)
+        var wg sync.WaitGroup
+        for i, value := range item.FanOut {
+                wg.Add(1)
+                go func(i int, value string) {
+                        defer wg.Done()
+                        sem <- struct{}{}
+                        defer func() { <-sem }()
+                        command := strings.ReplaceAll(item.Command, "{{param}}", shellQuote(value))
+                        results[i] = am.ExecuteCommandWithOptions(agentID, command, opts)
+                }(i, value)
+        }
+        wg.Wait()
+
+        quorum := item.FanOutQuorum
+        if quorum <= 0 || quorum > len(results) {
+                quorum = len(results)
+        }
+        succeeded := 0
+        var b strings.Builder
+        for i, result := range results {
+                if result.ExitCode == 0 {
+                        succeeded++
+                }
+                fmt.Fprintf(&b, "[%d/%d] %s (exit %d)\n%s", i+1, len(results), item.FanOut[i], result.ExitCode, result.Output)
+                if result.Error != "" {
+                        fmt.Fprintf(&b, "error: %s\n", result.Error)
+                }
+        }
+        fmt.Fprintf(&b, "%d of %d succeeded, quorum %d\n", succeeded, len(results), quorum)
+        return b.String(), succeeded >= quorum
+}
+
+// runTimeoutCleanup runs the cleanup command of a timed-out item whose
+// OnTimeout asks for one and appends its output to the result.
+func (am *AgentManager) runTimeoutCleanup(agentID int, result *CommandResult, opts ExecOptions) {
+        if !strings.HasPrefix(opts.OnTimeout, "cleanup:") {
+                return
+        }
+        cleanup := strings.TrimSpace(strings.TrimPrefix(opts.OnTimeout, "cleanup:"))
+        output, ok := am.runAuxCommand(agentID, opts.queueKey(), "cleanup", cleanup)
+        level, message := "info", "Ran timeout cleanup"
+        if !ok {
+                level, message = "warn", "Timeout cleanup failed"
+        }
+        result.Output += "\n--- timeout cleanup ---\n" + output
+        am.saveLogToDB(&LogEntry{
+                AgentID: agentID,
+                Level:   level,
+                Message: message,
+                Command: cleanup,
+                Output:  output,
+        })
+}
+
+// AgentProbe is the environment health report of an agent.
+type AgentProbe struct {
+        AgentID    int           `json:"agent_id"`
+        Name       string        `json:"name"`
+        Healthy    bool          `json:"healthy"`
+        OS         string        `json:"os"`
+        Arch       string        `json:"arch"`
+        Hostname   string        `json:"hostname"`
+        Path       string        `json:"path"`
+        WorkingDir ProbeCheck    `json:"working_dir"`
+        Binaries   []BinaryCheck `json:"binaries"`
+        CheckedAt  string        `json:"checked_at"`
+}
+
+// ProbeCheck is the outcome of one probe check.
+type ProbeCheck struct {
+        Path  string `json:"path,omitempty"`
+        OK    bool   `json:"ok"`
+        Error string `json:"error,omitempty"`
+}
+
+// BinaryCheck reports whether a required binary is on the agent's PATH.
+type BinaryCheck struct {
+        Name  string `json:"name"`
+        Found bool   `json:"found"`
+        Path  string `json:"path,omitempty"`
+}
+
+// ProbeAgent checks an agent's environment without running a command: the
+// shell and every PROBE_REQUIRED_BINARIES entry (plus extra) must be on its
+// PATH, and its working directory must be an allowed, readable directory.
+func (am *AgentManager) ProbeAgent(id int, extra []string) (AgentProbe, error) {
+        am.agentLock.RLock()
+        agent, ok := am.agents[id]
+        var name, dir, path string
+        if ok {
+                name, dir, path = agent.Name, agent.WorkingDir, agent.Env["PATH"]
+        }
+        am.agentLock.RUnlock()
+        if !ok {
+                return AgentProbe{}, fmt.Errorf("agent %d not found", id)
+        }
+
+        ownPath := path == ""
+        if ownPath {
+                path = os.Getenv("PATH")
+        }
+        hostname, _ := os.Hostname()
+        probe := AgentProbe{
+                AgentID:   id,
+                Name:      name,
+                Healthy:   true,
+                OS:        runtime.GOOS,
+                Arch:      runtime.GOARCH,
+                Hostname:  hostname,
+                Path:      path,
+                CheckedAt: time.Now().Format(time.RFC3339),
+        }
+
+        shell := "sh"
+        if runtime.GOOS == "windows" {
+                shell = "cmd"
+        }
+        seen := make(map[string]bool)
+        for _, binary := range append(append([]string{shell}, am.config().probeBinaries...), extra...) {
+                if binary == "" || seen[binary] {
+                        continue
+                }
+                seen[binary] = true
+                check := BinaryCheck{Name: binary}
+                var found string
+                var err error
+                if ownPath {
+                        found, err = exec.LookPath(binary)
+                } else {
+                        found, err = lookPathIn(binary, path)
+                }
+                if err == nil {
+                        check.Found, check.Path = true, found
+                } else {
+                        probe.Healthy = false
+                }
+                probe.Binaries = append(probe.Binaries, check)
+        }
+
+        if dir == "" {
+                dir, _ = os.Getwd()
+        }
+        probe.WorkingDir = ProbeCheck{Path: dir, OK: true}
+        canonical, err := am.checkWorkingDir(dir)
+        if err == nil {
+                probe.WorkingDir.Path = canonical
+                _, err = os.ReadDir(canonical)
+        }
+        if err != nil {
+                probe.WorkingDir.OK, probe.WorkingDir.Error = false, err.Error()
+                probe.Healthy = false
+        }
+        return probe, nil
+}
+
+// parseProbeBinaries splits the comma-separated PROBE_REQUIRED_BINARIES.
+func parseProbeBinaries(value string) []string {
+        var binaries []string
+        for _, binary := range strings.Split(value, ",") {
+                if binary = strings.TrimSpace(binary); binary != "" {
+                        binaries = append(binaries, binary)
+                }
+        }
+        return binaries
+}
+
+// lookPathIn is exec.LookPath against the PATH an agent sets in its env.
+func lookPathIn(name, path string) (string, error) {
+        if strings.ContainsRune(name, filepath.Separator) {
+                return exec.LookPath(name)
+        }
+        for _, dir := range filepath.SplitList(path) {
+                candidate := filepath.Join(dir, name)
+                if info, err := os.Stat(candidate); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+                        return candidate, nil
+                }
+        }
+        return "", fmt.Errorf("%s not found in PATH", name)
+}
+
+// runPreCheck runs the guard command of the queue item with queueKey key.
+func (am *AgentManager) runPreCheck(agentID int, key int, check string) (string, bool) {
+        return am.runAuxCommand(agentID, key, "pre-check", check)
+}
+
+// runAuxCommand runs a helper command such as a pre-check or timeout cleanup
+// on the agent's working directory and environment, within
+// PRECHECK_TIMEOUT_MS. It is not reported as a command of its own; only
+// whether it passed and what it printed matter. kind names it in messages.
+// It passes the same checks as a regular command, except that one matching
+// a dangerous pattern is refused, as there is nobody to confirm it. It is
+// tracked as a run of the queue item with queueKey key, so CancelCommand
+// can stop it.
+func (am *AgentManager) runAuxCommand(agentID int, key int, kind, command string) (string, bool) {
+        if am.safeMode.Load() {
+                return kind + " refused: safe mode", false
+        }
+        actual, err := am.validateCommand("RUN " + strings.TrimPrefix(strings.TrimSpace(command), "RUN "))
+        if err != nil {
+                return kind + " rejected: " + err.Error(), false
+        }
+        if reason := am.config().commandPolicy.blocks(actual); reason != "" {
+                return kind + " blocked by policy, " + reason, false
+        }
+
+        am.agentLock.RLock()
+        agent, ok := am.agents[agentID]
+        var dir string
+        var env map[string]string
+        var allowed []string
+        if ok {
+                dir, env, allowed = agent.WorkingDir, agent.Env, agent.AllowedCommands
+        }
+        am.agentLock.RUnlock()
+        if !ok {
+                return fmt.Sprintf("%s rejected: agent %d not found", kind, agentID), false
+        }
+        if !commandAllowed(actual, allowed) {
+                return kind + " rejected: command not allowed for agent group", false
+        }
+        if pattern := am.dangerousPattern(actual); pattern != "" {
+                return fmt.Sprintf("%s rejected: matches dangerous pattern %q and cannot be confirmed", kind, pattern), false
+        }
+
+        ctx, cancel := context.WithTimeout(context.Background(), am.config().preCheckTimeout)
+        defer cancel()
+        run := am.trackCommand(agentID, key, actual, cancel)
+        defer am.untrackCommand(agentID, run)
+
+        var cmd *exec.Cmd
+        if runtime.GOOS == "windows" {
+                cmd = exec.CommandContext(ctx, "cmd", "/C", actual)
+        } else {
+                cmd = exec.CommandContext(ctx, "sh", "-c", actual)
+        }
+        if am.processGroups {
+                setProcessGroup(cmd)
+        }
+        cmd.Dir = dir
+        if len(env) > 0 {
+                cmd.Env = os.Environ()
+                for k, v := range env {
+                        cmd.Env = append(cmd.Env, k+"="+v)
+                }
+        }
+        cmd.WaitDelay = 2 * time.Second
+
+        am.execLimiter.Acquire()
+        out, err := cmd.CombinedOutput()
+        am.markExited(run)
+        am.execLimiter.Release()
+        if run.cancelled.Load() {
+                return string(out) + fmt.Sprintf("\n%s cancelled", kind), false
+        }
+        if ctx.Err() == context.DeadlineExceeded {
+                return string(out) + fmt.Sprintf("\n%s timed out after %s", kind, am.config().preCheckTimeout), false
+        }
+        return string(out), err == nil
+}
+
+// queueKey identifies the queue item being run the way queueKey does for
+// the item itself; it is zero for commands run outside the queue.
+func (o ExecOptions) queueKey() int {
+        if o.QueueID != 0 {
+                return o.QueueID
+        }
+        return o.QueueIndex
+}
+
+func (am *AgentManager) ExecuteCommand(agentID int, command string) CommandResult {
+        return am.ExecuteCommandWithOptions(agentID, command, ExecOptions{})
+}
+
+// ExecuteCommandWithOptions runs command on an agent and, when tracing is
+// configured, exports a span for the run.
+func (am *AgentManager) ExecuteCommandWithOptions(agentID int, command string, opts ExecOptions) CommandResult {
+        // Queue items are tracked by the agent loop that claimed them.
+        if opts.queueKey() == 0 {
+                if !am.beginCommand() {
+                        return CommandResult{
+                                AgentID:   agentID,
+                                Command:   command,
+                                Error:     "Server is shutting down",
+                                ErrorCode: "SHUTTING_DOWN",
+                                ExitCode:  1,
+                                Timestamp: time.Now().Format(time.RFC3339),
+                        }
+                }
+                defer am.inFlight.Done()
+        }
+
+        started := time.Now()
+        result := am.executeCommand(agentID, command, opts)
+        am.tracer.RecordCommand(opts, started, result)
+        return result
+}
+
+func (am *AgentManager) executeCommand(agentID int, command string, opts ExecOptions) CommandResult {
+        // Read once, so a reload halfway through cannot change the limits
+        // this command was checked against.
+        cfg := am.config()
+        if am.terminated.Load() {
+                return CommandResult{
+                        AgentID: agentID,
+                        Command: command,
+                        Error:   "System terminated by <END!> signal",
+                }
+        }
+        if am.safeMode.Load() {
+                result := CommandResult{
+                        AgentID:   agentID,
+                        Command:   command,
+                        Error:     "Command execution is disabled in safe mode",
+                        ErrorCode: "SAFE_MODE",
+                        ExitCode:  1,
+                        Timestamp: time.Now().Format(time.RFC3339),
+                }
+                am.broadcastMessage(Message{
+                        Type:    "command_rejected",
+                        Payload: result,
+                })
+                return result
+        }
+
+        am.agentLock.Lock()
+        agent, exists := am.agents[agentID]
+        var agentDir string
+        var agentEnv map[string]string
+        var agentAllowed []string
+        if exists {
+                agentDir = agent.WorkingDir
+                agentEnv = agent.Env
+                agentAllowed = agent.AllowedCommands
+                am.startTaskLocked(agent, command)
+                agent.LastExecute = time.Now()
+                am.saveAgentToDB(agent)
+        }
+        am.agentLock.Unlock()
+
+        if !exists {
+                return am.rejectCommand(nil, CommandResult{
+                        AgentID:   agentID,
+                        Command:   command,
+                        Error:     fmt.Sprintf("agent %d not found", agentID),
+                        ErrorCode: "AGENT_NOT_FOUND",
+                        ExitCode:  1,
+                        Timestamp: time.Now().Format(time.RFC3339),
+                }, fmt.Sprintf("Rejected: agent %d not found", agentID))
+        }
+
+        am.broadcastMessage(Message{
+                Type:    "agent_status",
+                Payload: agent,
+        })
+
+        startTime := time.Now()
+        result := CommandResult{
+                AgentID:   agentID,
+                Command:   command,
+                Timestamp: time.Now().Format(time.RFC3339),
+                BatchID:   opts.BatchID,
+        }
+
+        if err := cfg.checkCommandLength(command); err != nil {
+                result.Error = err.Error()
+                result.ErrorCode = "COMMAND_TOO_LONG"
+                result.ExitCode = 1
+                result.Command = command[:min(len(command), cfg.maxCommandLength)]
+                return am.rejectCommand(agent, result, "Rejected: "+err.Error())
+        }
+
+        actualCommand, err := am.validateCommand(command)
+        if err != nil {
+                result.Error = "Invalid command: " + err.Error()
+                result.ErrorCode = "INVALID_COMMAND"
+                result.ExitCode = 1
+                return am.rejectCommand(agent, result, "Rejected: "+result.Error)
+        }
+
+        if reason := cfg.commandPolicy.blocks(actualCommand); reason != "" {
+                result.Error = "command blocked by policy"
+                result.ErrorCode = "COMMAND_BLOCKED"
+                result.ExitCode = policyBlockedExitCode
+                return am.rejectCommandAt("warn", agent, result, "Rejected: command blocked by policy, "+reason)
+        }
+
+        if !commandAllowed(actualCommand, agentAllowed) {
+                result.Error = fmt.Sprintf("command not allowed for agent group %q", agent.Group)
+                result.ErrorCode = "COMMAND_NOT_ALLOWED"
+                result.ExitCode = 1
+                return am.rejectCommand(agent, result, "Rejected: "+result.Error)
+        }
+
+        workDir := opts.WorkingDir
+        if workDir == "" {
+                workDir = agentDir
+        }
+        if workDir != "" {
+                canonical, err := am.checkWorkingDir(workDir)
+                if err != nil {
+                        result.Error = err.Error()
+                        result.ErrorCode = "FORBIDDEN_WORKDIR"
+                        result.ExitCode = 1
+                        return am.rejectCommand(agent, result, fmt.Sprintf("Rejected: working directory %q is not allowed", workDir))
+                }
+                if err := checkDirExists(canonical); err != nil {
+                        result.Error = err.Error()
+                        result.ErrorCode = "INVALID_WORKDIR"
+                        result.ExitCode = 1
+                        return am.rejectCommand(agent, result, "Rejected: "+err.Error())
+                }
+                workDir = canonical
+        }
+
+        if err := checkEnv(opts.Env); err != nil {
+                result.Error = err.Error()
+                result.ErrorCode = "INVALID_ENV"
+                result.ExitCode = 1
+                return am.rejectCommand(agent, result, "Rejected: "+err.Error())
+        }
+        if len(opts.Env) > 0 {
+                merged := maps.Clone(agentEnv)
+                if merged == nil {
+                        merged = make(map[string]string, len(opts.Env))
+                }
+                maps.Copy(merged, opts.Env)
+                agentEnv = merged
+        }
+
+        if pattern := am.dangerousPattern(actualCommand); pattern != "" {
+                if code, reason := am.awaitConfirmation(agentID, actualCommand, pattern, opts); code != "" {
+                        result.Error = reason
+                        result.ErrorCode = code
+                        result.ExitCode = 1
+                        return am.rejectCommand(agent, result, "Rejected: "+reason)
+                }
+        }
+
+        if workDir != "" {
+                result.GitCommit = am.gitCommits.Head(workDir)
+        }
+
+        cacheKey := ""
+        if opts.CacheTTL > 0 {
+                cacheKey = resultCacheKey(actualCommand, workDir, agentEnv)
+                if cached, ok := am.resultCache.Get(cacheKey); ok {
+                        return am.serveCachedResult(agent, result, cached)
+                }
+        }
+
+        isolatedDir := ""
+        if workDir == "" && (opts.Isolate || am.isolateCommands) {
+                dir, err := os.MkdirTemp("", "axshell-cmd-")
+                if err != nil {
+                        result.Error = fmt.Sprintf("failed to create isolated working directory: %v", err)
+                        result.ErrorCode = "ISOLATION_FAILED"
+                        result.ExitCode = 1
+                        return am.rejectCommand(agent, result, "Rejected: "+result.Error)
+                }
+                isolatedDir = dir
+                workDir = dir
+        }
+
+        var successRe, failureRe *regexp.Regexp
+        if opts.SuccessPattern != "" || opts.FailurePattern != "" {
+                var err error
+                if successRe, failureRe, err = compileOutputPatterns(opts.SuccessPattern, opts.FailurePattern); err != nil {
+                        result.Error = err.Error()
+                        result.ErrorCode = "INVALID_PATTERN"
+                        result.ExitCode = 1
+                        removeIsolatedDir(isolatedDir)
+                        return am.rejectCommand(agent, result, "Rejected: "+err.Error())
+                }
+        }
+
+        // A command left running after a success match must outlive this
+        // call, so the context is only cancelled here when not detached.
+        parent := opts.Context
+        if parent == nil {
+                parent = context.Background()
+        }
+        ctx, cancel := context.WithCancel(parent)
+        detached := false
+        defer func() {
+                if !detached {
+                        cancel()
+                }
+        }()
+        run := am.trackCommand(agentID, opts.queueKey(), actualCommand, cancel)
+        defer am.untrackCommand(agentID, run)
+
+        timeout := opts.Timeout
+        if timeout <= 0 {
+                timeout = cfg.commandTimeout
+        }
+        var deadline *time.Timer
+        var expired atomic.Bool
+        if timeout > 0 {
+                deadline = time.AfterFunc(timeout, func() {
+                        expired.Store(true)
+                        cancel()
+                })
+        }
+
+        var cmd *exec.Cmd
+        if runtime.GOOS == "windows" {
+                cmd = exec.CommandContext(ctx, "cmd", "/C", actualCommand)
+        } else {
+                cmd = exec.CommandContext(ctx, "sh", "-c", actualCommand)
+        }
+
+        cmd.Dir = workDir
+        if len(agentEnv) > 0 || isolatedDir != "" {
+                cmd.Env = os.Environ()
+                for k, v := range agentEnv {
+                        cmd.Env = append(cmd.Env, k+"="+v)
+                }
+        }
+        if isolatedDir != "" {
+                // Pointing TMPDIR at the private directory keeps mktemp and
+                // friends from sharing files with other commands.
+                cmd.Env = append(cmd.Env, "AXSHELL_TMPDIR="+isolatedDir, "TMPDIR="+isolatedDir)
+        }
+        // Descendants that inherit the output pipe would otherwise keep Wait
+        // blocked after the shell itself has been killed.
+        cmd.WaitDelay = 2 * time.Second
+        // A command with a deadline always gets its own group so the
+        // timeout kills what it spawned too.
+        if am.processGroups || timeout > 0 {
+                setProcessGroup(cmd)
+        }
+
+        var output syncBuffer
+        var watcher *patternWatcher
+        if successRe != nil || failureRe != nil {
+                watcher = newPatternWatcher(successRe, failureRe)
+                cmd.Stdout = io.MultiWriter(&output, watcher)
+        } else {
+                cmd.Stdout = &output
+        }
+        cmd.Stderr = cmd.Stdout
+        if opts.Stream {
+                // Separate pipes so each chunk can say which stream it came
+                // from; both still end up in the combined output.
+                combined := cmd.Stdout
+                cmd.Stdout = io.MultiWriter(combined, &chunkWriter{am: am, agentID: agentID, queueIndex: opts.QueueIndex, stream: "stdout"})
+                cmd.Stderr = io.MultiWriter(combined, &chunkWriter{am: am, agentID: agentID, queueIndex: opts.QueueIndex, stream: "stderr"})
+        }
+
+        done := make(chan struct{})
+        defer close(done)
+        if opts.QueueID > 0 && am.persistenceEnabled() && am.outputFlushInterval > 0 {
+                go am.flushOutputPeriodically(opts.QueueID, &output, done)
+        }
+
+        am.execLimiter.Acquire()
+        err = cmd.Start()
+        if err != nil {
+                am.execLimiter.Release()
+                removeIsolatedDir(isolatedDir)
+        }
+
+        matched := ""
+        if err == nil {
+                waitCh := make(chan error, 1)
+                go func() {
+                        waitErr := cmd.Wait()
+                        am.markExited(run)
+                        if cmd.ProcessState != nil {
+                                am.recordCommandUsage(agentID, cmd.ProcessState)
+                        }
+                        if am.processGroups {
+                                killProcessGroup(cmd)
+                        }
+                        // The shell itself succeeded; only a descendant it
+                        // left behind was still holding the output pipe.
+                        if errors.Is(waitErr, exec.ErrWaitDelay) {
+                                waitErr = nil
+                        }
+                        waitCh <- waitErr
+                        am.execLimiter.Release()
+                        cancel()
+                        removeIsolatedDir(isolatedDir)
+                }()
+
+                if watcher == nil {
+                        err = <-waitCh
+                } else {
+                        matched, err = am.waitForPattern(watcher, waitCh, cancel, opts)
+                        detached = matched != "" && matched != "timeout" && !opts.KillOnMatch
+                }
+        }
+        if deadline != nil {
+                deadline.Stop()
+        }
+
+        result.Output = output.String()
+        result.Duration = time.Since(startTime).Milliseconds()
+        am.durations.Record(result.Duration)
+        commandDurationSeconds.Observe(float64(result.Duration) / 1000)
+
+        processors := cfg.postProcessors
+        if opts.PostProcess != nil {
+                processors = parseOutputProcessors(opts.PostProcess)
+        }
+        if len(processors) > 0 {
+                raw := result.Output
+                for _, p := range processors {
+                        result.Output = p.Apply(result.Output)
+                }
+                if cfg.keepRawOutput && result.Output != raw {
+                        result.RawOutput = raw
+                }
+        }
+
+        if err != nil {
+                result.Error = err.Error()
+                if exitErr, ok := err.(*exec.ExitError); ok {
+                        result.ExitCode = exitErr.ExitCode()
+                } else {
+                        result.ExitCode = 1
+                }
+        }
+
+        if expired.Load() && !detached && matched != "success" && matched != "failure" {
+                result.Error = fmt.Sprintf("command timed out after %dms", timeout.Milliseconds())
+                result.ErrorCode = "COMMAND_TIMEOUT"
+                result.ExitCode = timeoutExitCode
+                am.runTimeoutCleanup(agentID, &result, opts)
+        } else if run.cancelled.Load() && matched == "" {
+                result.Error = "command cancelled"
+                result.ErrorCode = "CANCELLED"
+                result.ExitCode = cancelledExitCode
+        } else if parent.Err() != nil && matched == "" {
+                result.Error = "command killed: initiating client disconnected"
+                result.ErrorCode = "CLIENT_DISCONNECTED"
+                if result.ExitCode <= 0 {
+                        result.ExitCode = 1
+                }
+        }
+
+        switch matched {
+        case "success":
+                result.Error = ""
+                result.ExitCode = 0
+        case "failure":
+                result.Error = "output matched failure pattern"
+                if result.ExitCode == 0 {
+                        result.ExitCode = 1
+                }
+        case "timeout":
+                result.Error = fmt.Sprintf("no output matched within %dms", opts.PatternTimeout.Milliseconds())
+                result.ErrorCode = "PATTERN_TIMEOUT"
+                if result.ExitCode == 0 {
+                        result.ExitCode = 1
+                }
+                am.runTimeoutCleanup(agentID, &result, opts)
+        case "":
+                if successRe != nil && err == nil {
+                        result.Error = "command exited without matching success pattern"
+                        result.ExitCode = 1
+                }
+        }
+
+        am.recordCommandRun(actualCommand, &result)
+        if cacheKey != "" && result.ExitCode == 0 && result.Error == "" && !detached {
+                am.resultCache.Put(cacheKey, result, opts.CacheTTL)
+        }
+
+        am.agentLock.Lock()
+        if exists {
+                am.finishTaskLocked(agent, "command finished")
+                if result.ExitCode == 0 {
+                        agent.TasksDone++
+                } else {
+                        agent.TasksFailed++
+                }
+                am.saveAgentToDB(agent)
+        }
+        am.agentLock.Unlock()
+        commandsExecuted.Inc()
+        if result.ExitCode != 0 {
+                commandsFailed.Inc()
+        }
+
+        level := "info"
+        if result.ExitCode != 0 {
+                level = "error"
+        }
+        am.saveLogToDB(&LogEntry{
+                AgentID:   agentID,
+                Level:     level,
+                Message:   "Command executed",
+                Command:   actualCommand,
+                Output:    result.Output,
+                ExitCode:  result.ExitCode,
+                Duration:  result.Duration,
+                GitCommit: result.GitCommit,
+                QueueID:   opts.QueueID,
+        })
+
+        am.logResultToFile(result)
+
+        am.broadcastMessage(Message{
+                Type:    "command_result",
+                Payload: result,
+        })
+
+        am.broadcastMessage(Message{
+                Type:    "agent_status",
+                Payload: agent,
+        })
+
+        return result
+}
+
+// runningCommand is a command being executed, as listed for cancellation.
+type runningCommand struct {
+        queueKey  int
+        command   string
+        cancel    context.CancelFunc
+        cancelled atomic.Bool
+
+        // exited is set, under runningLock, once the process has exited;
+        // a cancel arriving after that is too late to have stopped it.
+        exited bool
+}
+
+func (am *AgentManager) trackCommand(agentID int, key int, command string, cancel context.CancelFunc) *runningCommand {
+        run := &runningCommand{queueKey: key, command: command, cancel: cancel}
+        am.runningLock.Lock()
+        am.runningCommands[agentID] = append(am.runningCommands[agentID], run)
+        am.runningLock.Unlock()
+        return run
+}
+
+// markExited records that run's process has exited, so CancelCommand no
+// longer counts it as cancelled.
+func (am *AgentManager) markExited(run *runningCommand) {
+        am.runningLock.Lock()
+        run.exited = true
+        am.runningLock.Unlock()
+}
+
+func (am *AgentManager) untrackCommand(agentID int, run *runningCommand) {
+        am.runningLock.Lock()
+        defer am.runningLock.Unlock()
+        runs := slices.DeleteFunc(am.runningCommands[agentID], func(r *runningCommand) bool { return r == run })
+        if len(runs) == 0 {
+                delete(am.runningCommands, agentID)
+        } else {
+                am.runningCommands[agentID] = runs
+        }
+}
+
+var errNoRunningCommand = errors.New("no matching command is running")
+
+// CancelledCommand is one command stopped by CancelCommand.
+type CancelledCommand struct {
+        AgentID int    `json:"agent_id"`
+        QueueID int    `json:"queue_id,omitempty"`
+        Command string `json:"command"`
+}
+
+// CancelCommand kills the commands running on agentID, or the run of the
+// queue item with queueKey key when agentID is zero (every part of a
+// fan-out item). Cancelled queue items end up "cancelled" rather than failed
+// or retried, and their agents go back to work once the process has exited.
+func (am *AgentManager) CancelCommand(agentID int, key int) ([]CancelledCommand, error) {
+        am.runningLock.Lock()
+        var cancelled []CancelledCommand
+        for id, runs := range am.runningCommands {
+                if agentID != 0 && id != agentID {
+                        continue
+                }
+                for _, run := range runs {
+                        if agentID == 0 && run.queueKey != key {
+                                continue
+                        }
+                        if run.exited || run.cancelled.Swap(true) {
+                                continue
+                        }
+                        run.cancel()
+                        if run.queueKey > 0 {
+                                am.cancelledItems[run.queueKey] = true
+                        }
+                        cancelled = append(cancelled, CancelledCommand{AgentID: id, QueueID: run.queueKey, Command: run.command})
+                }
+        }
+        am.runningLock.Unlock()
+
+        if len(cancelled) == 0 {
+                return nil, errNoRunningCommand
+        }
+        for _, c := range cancelled {
+                am.saveLogToDB(&LogEntry{
+                        AgentID: c.AgentID,
+                        Level:   "warn",
+                        Message: "Command cancelled",
+                        Command: c.Command,
+                })
+                am.broadcastMessage(Message{
+                        Type:    "command_cancelled",
+                        Payload: c,
+                })
+        }
+        return cancelled, nil
+}
+
+// takeCancellation reports whether the run of the queue item with queueKey
+// key was cancelled, and forgets it.
+func (am *AgentManager) takeCancellation(key int) bool {
+        am.runningLock.Lock()
+        defer am.runningLock.Unlock()
+        cancelled := am.cancelledItems[key]
+        delete(am.cancelledItems, key)
+        return cancelled
+}
+
+// startTaskLocked counts a command as running on agent. Callers hold
+// agentLock.
+func (am *AgentManager) startTaskLocked(agent *Agent, command string) {
+        agent.ActiveCommands++
+        am.setAgentStatus(agent, "running", "executing command")
+        agent.CurrentTask = command
+}
+
+// finishTaskLocked counts a command off agent, which goes back to idle once
+// none is left running. Callers hold agentLock.
+func (am *AgentManager) finishTaskLocked(agent *Agent, reason string) {
+        if agent.ActiveCommands > 0 {
+                agent.ActiveCommands--
+        }
+        if agent.ActiveCommands == 0 {
+                am.setAgentStatus(agent, restingStatus(agent), reason)
+                agent.CurrentTask = ""
+        }
+}
+
+// setAgentStatus changes an agent's status and, when LOG_AGENT_TRANSITIONS is
+// enabled, records the transition in the logs table. Callers hold agentLock.
+func (am *AgentManager) setAgentStatus(agent *Agent, status string, reason string) {
+        previous := agent.Status
+        agent.Status = status
+        if agent.Draining && !agent.Drained && previous == "running" && status != "running" {
+                am.markDrainedLocked(agent)
+        }
+        if !am.config().logAgentTransitions || previous == status {
+                return
+        }
+
+        level := "info"
+        if (previous == "idle" && status == "running") || (previous == "running" && status == "idle") {
+                level = "debug"
+        }
+        am.saveLogToDB(&LogEntry{
+                AgentID: agent.ID,
+                Level:   level,
+                Message: fmt.Sprintf("Agent '%s' status %s -> %s (%s)", agent.Name, previous, status, reason),
+        })
+}
+
+func compileOutputPatterns(success, failure string) (*regexp.Regexp, *regexp.Regexp, error) {
+        var successRe, failureRe *regexp.Regexp
+        var err error
+        if success != "" {
+                if successRe, err = regexp.Compile(success); err != nil {
+                        return nil, nil, fmt.Errorf("invalid success pattern: %v", err)
+                }
+        }
+        if failure != "" {
+                if failureRe, err = regexp.Compile(failure); err != nil {
+                        return nil, nil, fmt.Errorf("invalid failure pattern: %v", err)
+                }
+        }
+        return successRe, failureRe, nil
+}
+
+// patternWatcher scans output line by line and reports the first line that
+// matches the success or failure pattern.
+type patternWatcher struct {
+        success *regexp.Regexp
+        failure *regexp.Regexp
+        matched chan string
+
+        mu      sync.Mutex
+        partial []byte
+        done    bool
+}
+
+func newPatternWatcher(success, failure *regexp.Regexp) *patternWatcher {
+        return &patternWatcher{
+                success: success,
+                failure: failure,
+                matched: make(chan string, 1),
+        }
+}
+
+func (w *patternWatcher) Write(p []byte) (int, error) {
+        w.mu.Lock()
+        defer w.mu.Unlock()
+
+        if w.done {
+                return len(p), nil
+        }
+        w.partial = append(w.partial, p...)
+        for {
+                i := bytes.IndexByte(w.partial, '\n')
+                if i < 0 {
+                        break
+                }
+                w.check(string(w.partial[:i]))
+                w.partial = w.partial[i+1:]
+                if w.done {
+                        w.partial = nil
+                        break
+                }
+        }
+        return len(p), nil
+}
+
+// Flush checks a trailing line that was not newline terminated.
+func (w *patternWatcher) Flush() {
+        w.mu.Lock()
+        defer w.mu.Unlock()
+        if !w.done && len(w.partial) > 0 {
+                w.check(string(w.partial))
+        }
+        w.partial = nil
+}
+
+func (w *patternWatcher) check(line string) {
+        switch {
+        case w.failure != nil && w.failure.MatchString(line):
+                w.done = true
+                w.matched <- "failure"
+        case w.success != nil && w.success.MatchString(line):
+                w.done = true
+                w.matched <- "success"
+        }
+}
+
+// waitForPattern waits for the command to exit or for its output to match.
+// On a match the process is killed when KillOnMatch is set; otherwise it is
+// left running and reaped in the background.
+func (am *AgentManager) waitForPattern(watcher *patternWatcher, waitCh <-chan error, cancel context.CancelFunc, opts ExecOptions) (string, error) {
+        var timeout <-chan time.Time
+        if opts.PatternTimeout > 0 {
+                timer := time.NewTimer(opts.PatternTimeout)
+                defer timer.Stop()
+                timeout = timer.C
+        }
+
+        select {
+        case err := <-waitCh:
+                watcher.Flush()
+                select {
+                case kind := <-watcher.matched:
+                        return kind, err
+                default:
+                        return "", err
+                }
+        case kind := <-watcher.matched:
+                if opts.KillOnMatch {
+                        cancel()
+                        <-waitCh
+                }
+                return kind, nil
+        case <-timeout:
+                cancel()
+                err := <-waitCh
+                return "timeout", err
+        }
+}
+
+// rejectCommand records a command that was refused before it started and
+// returns the agent to idle.
+func (am *AgentManager) rejectCommand(agent *Agent, result CommandResult, message string) CommandResult {
+        return am.rejectCommandAt("error", agent, result, message)
+}
+
+// rejectCommandAt is rejectCommand logging at the given level.
+func (am *AgentManager) rejectCommandAt(level string, agent *Agent, result CommandResult, message string) CommandResult {
+        am.saveLogToDB(&LogEntry{
+                AgentID:  result.AgentID,
+                Level:    level,
+                Message:  message,
+                Command:  result.Command,
+                ExitCode: result.ExitCode,
+        })
+
+        am.agentLock.Lock()
+        if agent != nil {
+                am.finishTaskLocked(agent, "command rejected")
+                agent.TasksFailed++
+                am.saveAgentToDB(agent)
+        }
+        am.agentLock.Unlock()
+        commandsRejected.Inc()
+
+        am.broadcastMessage(Message{
+                Type:    "command_rejected",
+                Payload: result,
+        })
+
+        return result
+}
+
+// checkWorkingDir canonicalizes dir and, when ALLOWED_WORKDIRS is set, makes
+// sure it sits under one of the allowed roots. Symlinks are resolved so they
+// cannot be used to step outside a root.
+func (am *AgentManager) checkWorkingDir(dir string) (string, error) {
+        canonical, err := filepath.Abs(dir)
+        if err != nil {
+                return "", fmt.Errorf("invalid working directory %q: %v", dir, err)
+        }
+        if resolved, err := filepath.EvalSymlinks(canonical); err == nil {
+                canonical = resolved
+        }
+
+        if len(am.config().allowedWorkDirs) == 0 {
+                return canonical, nil
+        }
+        for _, root := range am.config().allowedWorkDirs {
+                rel, err := filepath.Rel(root, canonical)
+                if err != nil {
+                        continue
+                }
+                if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+                        return canonical, nil
+                }
+        }
+        return "", fmt.Errorf("working directory %q is outside the allowed roots", dir)
+}
+
+// parseAllowedOrigins reads the comma-separated ALLOWED_ORIGINS, each an
+// origin such as https://dash.example.com:8443, or "*".
+func parseAllowedOrigins(value string) []string {
+        var origins []string
+        for _, origin := range strings.Split(value, ",") {
+                origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+                if origin != "" {
+                        origins = append(origins, strings.ToLower(origin))
+                }
+        }
+        return origins
+}
+
+// originAllowed reports whether a page served from origin may open a
+// WebSocket. Requests without an Origin header do not come from a browser,
+// so no other site can be riding on them, and are let through.
+func (cfg *liveConfig) originAllowed(origin string) bool {
+        if origin == "" {
+                return true
+        }
+        if cfg.allowedOrigins == nil {
+                u, err := url.Parse(origin)
+                if err != nil {
+                        return false
+                }
+                switch u.Hostname() {
+                case "localhost", "127.0.0.1", "::1":
+                        return true
+                }
+                return false
+        }
+        origin = strings.ToLower(origin)
+        for _, allowed := range cfg.allowedOrigins {
+                if allowed == "*" || allowed == origin {
+                        return true
+                }
+        }
+        return false
+}
+
+func parseAllowedWorkDirs(value string) []string {
+        var roots []string
+        for _, root := range strings.Split(value, ",") {
+                root = strings.TrimSpace(root)
+                if root == "" {
+                        continue
+                }
+                abs, err := filepath.Abs(root)
+                if err != nil {
+                        log.Printf("Skipping allowed workdir %q: %v", root, err)
+                        continue
+                }
+                if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+                        abs = resolved
+                }
+                roots = append(roots, abs)
+        }
+        return roots
+}
+
+func removeIsolatedDir(dir string) {
+        if dir == "" {
+                return
+        }
+        if err := os.RemoveAll(dir); err != nil {
+                log.Printf("Error removing isolated working directory %s: %v", dir, err)
+        }
+}
+
+// flushOutputPeriodically persists the output captured so far to the queue
+// row, so a crash mid-command still leaves a record of what it produced.
+func (am *AgentManager) flushOutputPeriodically(queueID int, output *syncBuffer, done <-chan struct{}) {
+        ticker := time.NewTicker(am.outputFlushInterval)
+        defer ticker.Stop()
+
+        lastLen := 0
+        for {
+                select {
+                case <-done:
+                        return
+                case <-ticker.C:
+                        current := output.String()
+                        if len(current) == lastLen {
+                                continue
+                        }
+                        lastLen = len(current)
+                        am.updateQueueOutputInDB(queueID, current)
+                }
+        }
+}
+
+func (am *AgentManager) logResultToFile(result CommandResult) {
+        base := fmt.Sprintf("%s/agent_%d_%s", am.logDir, result.AgentID, time.Now().Format("2006-01-02"))
+        filename := base + ".log"
+
+        output, err := am.outputCipher.Seal(result.Output)
+        if err != nil {
+                log.Printf("Error writing result log: %v", err)
+                return
+        }
+        logEntry := fmt.Sprintf("[%s] Command: %s\nOutput: %s\nError: %s\nExitCode: %d\nDuration: %dms\n\n",
+                result.Timestamp, result.Command, output, result.Error, result.ExitCode, result.Duration)
+
+        am.logFileLock.Lock()
+        defer am.logFileLock.Unlock()
+
+        if am.logFileMaxBytes > 0 {
+                if info, err := os.Stat(filename); err == nil && info.Size()+int64(len(logEntry)) > am.logFileMaxBytes {
+                        am.rotateLogFile(base)
+                }
+        }
+
+        f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+        if err != nil {
+                log.Printf("Error opening log file: %v", err)
+                return
+        }
+        defer f.Close()
+
+        f.WriteString(logEntry)
+}
+
+// rotateLogFile shifts base.log to base.1.log, base.1.log to base.2.log and so
+// on, dropping whatever falls past the retention limit.
+func (am *AgentManager) rotateLogFile(base string) {
+        if am.logFileMaxRotations <= 0 {
+                os.Remove(base + ".log")
+                return
+        }
+
+        os.Remove(fmt.Sprintf("%s.%d.log", base, am.logFileMaxRotations))
+        for n := am.logFileMaxRotations - 1; n >= 1; n-- {
+                os.Rename(fmt.Sprintf("%s.%d.log", base, n), fmt.Sprintf("%s.%d.log", base, n+1))
+        }
+        if err := os.Rename(base+".log", base+".1.log"); err != nil {
+                log.Printf("Error rotating log file: %v", err)
+        }
+}
+
+func (am *AgentManager) GetResourceUsage() map[string]interface{} {
+        var memStats runtime.MemStats
+        runtime.ReadMemStats(&memStats)
+
+        am.agentLock.RLock()
+        agentCount := len(am.agents)
+        tasksDone, tasksFailed := 0, 0
+        for _, agent := range am.agents {
+                tasksDone += agent.TasksDone
+                tasksFailed += agent.TasksFailed
+        }
+        am.agentLock.RUnlock()
+
+        am.queueLock.RLock()
+        queueCount := len(am.queue)
+        am.queueLock.RUnlock()
+
+        concurrencyLimit, activeCommands := am.execLimiter.Stats()
+        idleAgents, busyAgents := am.AgentCounts()
+        last := am.sysMetrics.Last()
+
+        return map[string]interface{}{
+                "alloc_mb":          float64(memStats.Alloc) / 1024 / 1024,
+                "total_alloc_mb":    float64(memStats.TotalAlloc) / 1024 / 1024,
+                "sys_mb":            float64(memStats.Sys) / 1024 / 1024,
+                "num_gc":            memStats.NumGC,
+                "goroutines":        runtime.NumGoroutine(),
+                "agent_count":       agentCount,
+                "queue_count":       queueCount,
+                "tasks_done":        tasksDone,
+                "tasks_failed":      tasksFailed,
+                "idle_agents":       idleAgents,
+                "busy_agents":       busyAgents,
+                "min_idle_agents":   am.config().minIdleAgents,
+                "concurrency_limit": concurrencyLimit,
+                "active_commands":   activeCommands,
+                "memory_pressure":   am.memoryPressure.Load(),
+                "cpu_percent":       last.CPUPercent,
+                "rss_mb":            last.RSSMB,
+                "net_kbps":          last.NetKBps,
+        }
+}
+
+// systemSample is one reading of the process and host: CPU percent and
+// resident memory of the backend itself (commands are charged to their
+// agents instead), and host network throughput across all interfaces.
+type systemSample struct {
+        CPUPercent float64
+        RSSMB      float64
+        NetKBps    float64
+        Elapsed    time.Duration
+}
+
+// systemMetrics reads process and network counters through gopsutil. When
+// the platform does not support them it logs once and samples zeros.
+type systemMetrics struct {
+        mu       sync.Mutex
+        proc     *process.Process
+        failed   bool
+        lastAt   time.Time
+        lastNet  uint64
+        lastTick systemSample
+}
+
+func newSystemMetrics() *systemMetrics {
+        m := &systemMetrics{lastAt: time.Now()}
+        proc, err := process.NewProcess(int32(os.Getpid()))
+        if err != nil {
+                log.Printf("Process metrics unavailable, reporting zeros: %v", err)
+                m.failed = true
+                return m
+        }
+        m.proc = proc
+        m.lastNet, _ = hostNetBytes()
+        return m
+}
+
+// hostNetBytes is the bytes sent and received on all interfaces.
+func hostNetBytes() (uint64, error) {
+        counters, err := psnet.IOCounters(false)
+        if err != nil || len(counters) == 0 {
+                return 0, fmt.Errorf("network counters unavailable: %v", err)
+        }
+        return counters[0].BytesSent + counters[0].BytesRecv, nil
+}
+
+// Sample takes a reading; rates cover the time since the previous one.
+func (m *systemMetrics) Sample() systemSample {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        now := time.Now()
+        sample := systemSample{Elapsed: now.Sub(m.lastAt)}
+        m.lastAt = now
+        if m.failed {
+                m.lastTick = sample
+                return sample
+        }
+
+        var err error
+        if sample.CPUPercent, err = m.proc.Percent(0); err == nil {
+                var mem *process.MemoryInfoStat
+                if mem, err = m.proc.MemoryInfo(); err == nil {
+                        sample.RSSMB = float64(mem.RSS) / 1024 / 1024
+                }
+        }
+        if err != nil {
+                log.Printf("Process metrics failed, reporting zeros from now on: %v", err)
+                m.failed = true
+                m.lastTick = systemSample{Elapsed: sample.Elapsed}
+                return m.lastTick
+        }
+        if bytes, err := hostNetBytes(); err == nil {
+                if bytes >= m.lastNet && sample.Elapsed > 0 {
+                        sample.NetKBps = float64(bytes-m.lastNet) / 1024 / sample.Elapsed.Seconds()
+                }
+                m.lastNet = bytes
+        }
+        m.lastTick = sample
+        return sample
+}
+
+// Last returns the most recent sample without taking a new one.
+func (m *systemMetrics) Last() systemSample {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        return m.lastTick
+}
+
+// recordCommandUsage charges a finished command's CPU time to its agent and
+// records its peak memory.
+func (am *AgentManager) recordCommandUsage(agentID int, state *os.ProcessState) {
+        am.agentLock.Lock()
+        defer am.agentLock.Unlock()
+        if agent, ok := am.agents[agentID]; ok {
+                agent.cpuTime += state.UserTime() + state.SystemTime()
+                if rss := peakRSSMB(state); rss > 0 {
+                        agent.MemoryUsage = rss
+                }
+        }
+}
+
+// attributeUsageLocked sets each agent's CPUUsage to the CPU its commands
+// used since the last sample, as a percent of one core, and splits the host
+// network throughput evenly among the agents that were busy; idle agents
+// get none. Callers hold agentLock.
+func (am *AgentManager) attributeUsageLocked(sample systemSample) {
+        var busy []*Agent
+        for _, agent := range am.agents {
+                used := agent.cpuTime - agent.cpuSampled
+                agent.cpuSampled = agent.cpuTime
+                agent.CPUUsage = 0
+                if sample.Elapsed > 0 {
+                        agent.CPUUsage = float64(used) / float64(sample.Elapsed) * 100
+                }
+                agent.NetworkUsage = 0
+                if used > 0 || agent.Status == "running" {
+                        busy = append(busy, agent)
+                }
+        }
+        for _, agent := range busy {
+                agent.NetworkUsage = sample.NetKBps / float64(len(busy))
+        }
+}
+
+// latencyBuckets span quick probes to long scans, in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+var (
+        commandDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+                Name:    "axshell_command_duration_seconds",
+                Help:    "Command execution time in seconds.",
+                Buckets: latencyBuckets,
+        })
+        queueWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+                Name:    "axshell_queue_wait_seconds",
+                Help:    "Time queue items waited between enqueue and dispatch.",
+                Buckets: latencyBuckets,
+        })
+)
+
+// Command outcomes since startup, for /metrics. Executed counts cache hits
+// too; rejected commands never ran and are only counted as rejected.
+var (
+        commandsExecuted = prometheus.NewCounter(prometheus.CounterOpts{
+                Name: "axshell_commands_executed_total",
+                Help: "Commands run or served from cache since startup.",
+        })
+        commandsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+                Name: "axshell_commands_failed_total",
+                Help: "Executed commands that finished with a non-zero exit code.",
+        })
+        commandsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+                Name: "axshell_commands_rejected_total",
+                Help: "Commands refused before running, by policy, safe mode or validation.",
+        })
+)
+
+// newMetricsRegistry registers everything /metrics serves: the command and
+// queue collectors above, the manager's agent and queue state, and the Go
+// runtime and process collectors for goroutines and memory.
+func newMetricsRegistry(am *AgentManager) *prometheus.Registry {
+        registry := prometheus.NewRegistry()
+        registry.MustRegister(
+                commandDurationSeconds,
+                queueWaitSeconds,
+                commandsExecuted,
+                commandsFailed,
+                commandsRejected,
+                managerCollector{am},
+                collectors.NewGoCollector(),
+                collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+        )
+        return registry
+}
+
+var (
+        agentsDesc = prometheus.NewDesc("axshell_agents", "Agents by status.", []string{"status"}, nil)
+        queueDesc  = prometheus.NewDesc("axshell_queue_items", "Queue items by status.", []string{"status"}, nil)
+
+        durationMsDesc    = prometheus.NewDesc("axshell_command_duration_ms", "Command execution time in milliseconds.", nil, nil)
+        durationMaxMsDesc = prometheus.NewDesc("axshell_command_duration_max_ms", "Longest command in the current window.", nil, nil)
+)
+
+// managerCollector reports agent and queue counts by status and the
+// duration percentiles, read from the manager at scrape time.
+type managerCollector struct {
+        am *AgentManager
+}
+
+func (c managerCollector) Describe(ch chan<- *prometheus.Desc) {
+        ch <- agentsDesc
+        ch <- queueDesc
+        ch <- durationMsDesc
+        ch <- durationMaxMsDesc
+}
+
+func (c managerCollector) Collect(ch chan<- prometheus.Metric) {
+        agents := make(map[string]int)
+        c.am.agentLock.RLock()
+        for _, agent := range c.am.agents {
+                agents[agent.Status]++
+        }
+        c.am.agentLock.RUnlock()
+        for status, n := range agents {
+                ch <- prometheus.MustNewConstMetric(agentsDesc, prometheus.GaugeValue, float64(n), status)
+        }
+
+        queue := make(map[string]int)
+        c.am.queueLock.RLock()
+        for i := range c.am.queue {
+                queue[c.am.queue[i].Status]++
+        }
+        c.am.queueLock.RUnlock()
+        for status, n := range queue {
+                ch <- prometheus.MustNewConstMetric(queueDesc, prometheus.GaugeValue, float64(n), status)
+        }
+
+        d := c.am.durations.Snapshot()
+        ch <- prometheus.MustNewConstSummary(durationMsDesc, d["count"].(uint64), float64(d["sum_ms"].(int64)), map[float64]float64{
+                0.5:  float64(d["p50_ms"].(int64)),
+                0.9:  float64(d["p90_ms"].(int64)),
+                0.99: float64(d["p99_ms"].(int64)),
+        })
+        ch <- prometheus.MustNewConstMetric(durationMaxMsDesc, prometheus.GaugeValue, float64(d["max_ms"].(int64)))
+}
+
+// durationHistogram is a fixed-bucket latency histogram in the spirit of
+// HdrHistogram: bucket bounds grow geometrically, so percentiles stay within
+// a few percent of the true value at any scale while memory stays constant.
+type durationHistogram struct {
+        mu        sync.Mutex
+        bounds    []int64
+        counts    []uint64
+        count     uint64
+        sum       int64
+        max       int64
+        window    time.Duration
+        startedAt time.Time
+}
+
+func newDurationHistogram(window time.Duration) *durationHistogram {
+        var bounds []int64
+        for b := 1.0; b < float64(24*time.Hour/time.Millisecond); b *= 1.25 {
+                if n := int64(b + 0.5); len(bounds) == 0 || n > bounds[len(bounds)-1] {
+                        bounds = append(bounds, n)
+                }
+        }
+        return &durationHistogram{
+                bounds:    bounds,
+                counts:    make([]uint64, len(bounds)+1),
+                window:    window,
+                startedAt: time.Now(),
+        }
+}
+
+func (h *durationHistogram) Record(ms int64) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+
+        if h.window > 0 && time.Since(h.startedAt) > h.window {
+                h.resetLocked()
+        }
+
+        i := sort.Search(len(h.bounds), func(i int) bool { return h.bounds[i] >= ms })
+        h.counts[i]++
+        h.count++
+        h.sum += ms
+        if ms > h.max {
+                h.max = ms
+        }
+}
+
+func (h *durationHistogram) Reset() {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        h.resetLocked()
+}
+
+func (h *durationHistogram) resetLocked() {
+        for i := range h.counts {
+                h.counts[i] = 0
+        }
+        h.count, h.sum, h.max = 0, 0, 0
+        h.startedAt = time.Now()
+}
+
+func (h *durationHistogram) quantileLocked(q float64) int64 {
+        if h.count == 0 {
+                return 0
+        }
+        target := uint64(q*float64(h.count) + 0.5)
+        if target < 1 {
+                target = 1
+        }
+        var seen uint64
+        for i, c := range h.counts {
+                seen += c
+                if seen >= target {
+                        if i >= len(h.bounds) || h.bounds[i] > h.max {
+                                return h.max
+                        }
+                        return h.bounds[i]
+                }
+        }
+        return h.max
+}
+
+// Snapshot returns count, mean, p50/p90/p99 and max in milliseconds.
+func (h *durationHistogram) Snapshot() map[string]interface{} {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+
+        mean := 0.0
+        if h.count > 0 {
+                mean = float64(h.sum) / float64(h.count)
+        }
+        return map[string]interface{}{
+                "count":      h.count,
+                "mean_ms":    mean,
+                "sum_ms":     h.sum,
+                "p50_ms":     h.quantileLocked(0.50),
+                "p90_ms":     h.quantileLocked(0.90),
+                "p99_ms":     h.quantileLocked(0.99),
+                "max_ms":     h.max,
+                "since":      h.startedAt.Format(time.RFC3339),
+                "window_sec": int64(h.window / time.Second),
+        }
+}
+
+// Mean returns the mean duration in milliseconds, and false when nothing
+// has been recorded.
+func (h *durationHistogram) Mean() (float64, bool) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        if h.count == 0 {
+                return 0, false
+        }
+        return float64(h.sum) / float64(h.count), true
+}
+
+// CommandRun is one execution of a command as kept in its output history.
+type CommandRun struct {
+        CommandHash string `json:"command_hash"`
+        Command     string `json:"command"`
+        OutputHash  string `json:"output_hash"`
+        Output      string `json:"output,omitempty"`
+        ExitCode    int    `json:"exit_code"`
+        Changed     bool   `json:"changed"`
+        Timestamp   string `json:"timestamp"`
+}
+
+// gitCommitCache remembers the HEAD commit of working directories. An entry
+// is reused until the repository's HEAD or reflog changes, so git only runs
+// again after a commit or checkout.
+type gitCommitCache struct {
+        mu      sync.Mutex
+        entries map[string]gitCommitEntry
+}
+
+type gitCommitEntry struct {
+        mtime  time.Time
+        commit string
+}
+
+// gitStamp finds the repository holding dir and returns the latest change
+// time of its HEAD and reflog. ok is false outside a repository.
+func gitStamp(dir string) (time.Time, bool) {
+        for d := dir; ; d = filepath.Dir(d) {
+                info, err := os.Stat(filepath.Join(d, ".git"))
+                if err == nil {
+                        if !info.IsDir() {
+                                // Worktrees and submodules point elsewhere
+                                // from a .git file; its mtime is the best
+                                // cheap signal available.
+                                return info.ModTime(), true
+                        }
+                        var latest time.Time
+                        for _, name := range []string{"HEAD", filepath.Join("logs", "HEAD")} {
+                                if fi, err := os.Stat(filepath.Join(d, ".git", name)); err == nil && fi.ModTime().After(latest) {
+                                        latest = fi.ModTime()
+                                }
+                        }
+                        return latest, true
+                }
+                if parent := filepath.Dir(d); parent == d {
+                        return time.Time{}, false
+                }
+        }
+}
+
+// Head returns the commit checked out around dir, or "" when dir is not in a
+// git repository or git is not installed.
+func (c *gitCommitCache) Head(dir string) string {
+        mtime, ok := gitStamp(dir)
+        if !ok {
+                return ""
+        }
+
+        c.mu.Lock()
+        entry, cached := c.entries[dir]
+        c.mu.Unlock()
+        if cached && entry.mtime.Equal(mtime) {
+                return entry.commit
+        }
+
+        ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+        defer cancel()
+        cmd := exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+        cmd.Dir = dir
+        out, err := cmd.Output()
+        commit := ""
+        if err == nil {
+                commit = strings.TrimSpace(string(out))
+        }
+
+        c.mu.Lock()
+        c.entries[dir] = gitCommitEntry{mtime: mtime, commit: commit}
+        c.mu.Unlock()
+        return commit
+}
+
+// resultCache holds successful results of cacheable commands until their TTL
+// runs out. Expired entries are dropped whenever a new one is stored.
+type resultCache struct {
+        mu      sync.Mutex
+        entries map[string]cachedResult
+        hits    atomic.Int64
+        misses  atomic.Int64
+}
+
+type cachedResult struct {
+        result  CommandResult
+        expires time.Time
+}
+
+func newResultCache() *resultCache {
+        return &resultCache{entries: make(map[string]cachedResult)}
+}
+
+// resultCacheKey identifies a run by everything that can change its output
+// short of the system state: the normalized command, the directory it runs
+// in and the extra environment.
+func resultCacheKey(command, workDir string, env map[string]string) string {
+        keys := make([]string, 0, len(env))
+        for k := range env {
+                keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        var b strings.Builder
+        for _, k := range keys {
+                b.WriteString(k + "=" + env[k] + "\x00")
+        }
+        return hashString(normalizeCommand(command) + "\x00" + workDir + "\x00" + hashString(b.String()))
+}
+
+func (c *resultCache) Get(key string) (CommandResult, bool) {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        entry, ok := c.entries[key]
+        if !ok || time.Now().After(entry.expires) {
+                c.misses.Add(1)
+                return CommandResult{}, false
+        }
+        c.hits.Add(1)
+        return entry.result, true
+}
+
+func (c *resultCache) Put(key string, result CommandResult, ttl time.Duration) {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        now := time.Now()
+        for k, entry := range c.entries {
+                if now.After(entry.expires) {
+                        delete(c.entries, k)
+                }
+        }
+        c.entries[key] = cachedResult{result: result, expires: now.Add(ttl)}
+}
+
+func (c *resultCache) Stats() map[string]interface{} {
+        c.mu.Lock()
+        entries := len(c.entries)
+        c.mu.Unlock()
+
+        return map[string]interface{}{
+                "hits":    c.hits.Load(),
+                "misses":  c.misses.Load(),
+                "entries": entries,
+        }
+}
+
+// serveCachedResult finishes a command from the cache instead of running it.
+// The agent still counts it as a finished task and clients still get a
+// command_result, marked as cached.
+func (am *AgentManager) serveCachedResult(agent *Agent, result CommandResult, cached CommandResult) CommandResult {
+        result.Output = cached.Output
+        result.RawOutput = cached.RawOutput
+        result.ExitCode = cached.ExitCode
+        result.Duration = cached.Duration
+        result.CommandHash = cached.CommandHash
+        result.Cached = true
+
+        am.agentLock.Lock()
+        if agent != nil {
+                am.finishTaskLocked(agent, "served from cache")
+                agent.TasksDone++
+                am.saveAgentToDB(agent)
+        }
+        am.agentLock.Unlock()
+        commandsExecuted.Inc()
+
+        am.saveLogToDB(&LogEntry{
+                AgentID:  result.AgentID,
+                Level:    "info",
+                Message:  "Command served from result cache",
+                Command:  result.Command,
+                Output:   result.Output,
+                ExitCode: result.ExitCode,
+        })
+
+        am.broadcastMessage(Message{
+                Type:    "command_result",
+                Payload: result,
+        })
+
+        am.broadcastMessage(Message{
+                Type:    "agent_status",
+                Payload: agent,
+        })
+
+        return result
+}
+
+// commandHistory keeps the most recent runs of each normalized command so a
+// new run can be compared with the previous one.
+type commandHistory struct {
+        mu         sync.Mutex
+        runs       map[string][]CommandRun
+        size       int
+        keepOutput bool
+}
+
+func newCommandHistory(size int, keepOutput bool) *commandHistory {
+        return &commandHistory{
+                runs:       make(map[string][]CommandRun),
+                size:       size,
+                keepOutput: keepOutput,
+        }
+}
+
+// normalizeCommand collapses whitespace so trivially different spellings of
+// a command share one history.
+func normalizeCommand(command string) string {
+        return strings.Join(strings.Fields(command), " ")
+}
+
+func hashString(s string) string {
+        sum := sha256.Sum256([]byte(s))
+        return hex.EncodeToString(sum[:])
+}
+
+func commandHash(command string) string {
+        return hashString(normalizeCommand(command))[:16]
+}
+
+func (h *commandHistory) Record(run CommandRun) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+
+        if !h.keepOutput {
+                run.Output = ""
+        }
+        runs := append(h.runs[run.CommandHash], run)
+        if len(runs) > h.size {
+                runs = runs[len(runs)-h.size:]
+        }
+        h.runs[run.CommandHash] = runs
+}
+
+func (h *commandHistory) Last(hash string) (CommandRun, bool) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+
+        runs := h.runs[hash]
+        if len(runs) == 0 {
+                return CommandRun{}, false
+        }
+        return runs[len(runs)-1], true
+}
+
+func (h *commandHistory) Runs(hash string) []CommandRun {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        return append([]CommandRun(nil), h.runs[hash]...)
+}
+
+// unifiedDiff renders a line diff of a and b in unified format, truncated to
+// maxBytes. Inputs beyond maxDiffLines lines are not diffed line by line.
+func unifiedDiff(a, b string, maxBytes int) string {
+        const maxDiffLines = 2000
+        const context = 3
+
+        aLines := strings.Split(a, "\n")
+        bLines := strings.Split(b, "\n")
+        if len(aLines) > maxDiffLines || len(bLines) > maxDiffLines {
+                return fmt.Sprintf("output too large to diff (%d -> %d lines)\n", len(aLines), len(bLines))
+        }
+
+        // lcs[i][j] is the length of the longest common subsequence of
+        // aLines[i:] and bLines[j:].
+        lcs := make([][]int, len(aLines)+1)
+        for i := range lcs {
+                lcs[i] = make([]int, len(bLines)+1)
+        }
+        for i := len(aLines) - 1; i >= 0; i-- {
+                for j := len(bLines) - 1; j >= 0; j-- {
+                        if aLines[i] == bLines[j] {
+                                lcs[i][j] = lcs[i+1][j+1] + 1
+                        } else {
+                                lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+                        }
+                }
+        }
+
+        type diffLine struct {
+                op   byte
+                text string
+                a, b int
+        }
+        var lines []diffLine
+        i, j := 0, 0
+        for i < len(aLines) || j < len(bLines) {
+                switch {
+                case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+                        lines = append(lines, diffLine{' ', aLines[i], i, j})
+                        i++
+                        j++
+                case i < len(aLines) && (j == len(bLines) || lcs[i+1][j] >= lcs[i][j+1]):
+                        lines = append(lines, diffLine{'-', aLines[i], i, j})
+                        i++
+                default:
+                        lines = append(lines, diffLine{'+', bLines[j], i, j})
+                        j++
+                }
+        }
+
+        var sb strings.Builder
+        sb.WriteString("--- previous\n+++ current\n")
+        for start := 0; start < len(lines); {
+                if lines[start].op == ' ' {
+                        start++
+                        continue
+                }
+
+                // Grow the hunk until a run of more than 2*context unchanged
+                // lines separates it from the next change.
+                from := max(start-context, 0)
+                end := start
+                for k := start; k < len(lines); k++ {
+                        if lines[k].op != ' ' {
+                                end = k
+                        } else if k-end > 2*context {
+                                break
+                        }
+                }
+                to := min(end+context+1, len(lines))
+
+                aCount, bCount := 0, 0
+                for _, l := range lines[from:to] {
+                        if l.op != '+' {
+                                aCount++
+                        }
+                        if l.op != '-' {
+                                bCount++
+                        }
+                }
+                fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", lines[from].a+1, aCount, lines[from].b+1, bCount)
+                for _, l := range lines[from:to] {
+                        sb.WriteByte(l.op)
+                        sb.WriteString(l.text)
+                        sb.WriteByte('\n')
+                }
+                start = to
+
+                if maxBytes > 0 && sb.Len() > maxBytes {
+                        break
+                }
+        }
+
+        out := sb.String()
+        if maxBytes > 0 && len(out) > maxBytes {
+                out = out[:maxBytes] + "\n... diff truncated\n"
+        }
+        return out
+}
+
+// recordCommandRun compares the result with the previous run of the same
+// command and annotates it with changed_since_last and a bounded diff.
+func (am *AgentManager) recordCommandRun(command string, result *CommandResult) {
+        if am.commandHistory == nil {
+                return
+        }
+
+        run := CommandRun{
+                CommandHash: commandHash(command),
+                Command:     normalizeCommand(command),
+                OutputHash:  hashString(result.Output),
+                Output:      result.Output,
+                ExitCode:    result.ExitCode,
+                Timestamp:   time.Now().Format(time.RFC3339),
+        }
+
+        last, hasPrev := am.commandHistory.Last(run.CommandHash)
+        if !hasPrev {
+                last, hasPrev = am.lastCommandRunFromDB(run.CommandHash)
+        }
+
+        result.CommandHash = run.CommandHash
+        if hasPrev {
+                changed := last.OutputHash != run.OutputHash
+                run.Changed = changed
+                result.ChangedSinceLast = &changed
+                if changed && am.commandHistory.keepOutput {
+                        result.OutputDiff = unifiedDiff(last.Output, result.Output, am.config().commandDiffMaxBytes)
+                }
+        }
+
+        am.commandHistory.Record(run)
+        am.saveCommandRunToDB(&run)
+}
+
+func (am *AgentManager) saveCommandRunToDB(run *CommandRun) {
+        if !am.logsPersistenceEnabled() {
+                return
+        }
+
+        output := ""
+        if am.commandHistory.keepOutput {
+                output = run.Output
+        }
+        output, err := am.outputCipher.Seal(output)
+        if err != nil {
+                log.Printf("Error saving command history to DB: %v", err)
+                return
+        }
+        _, err = am.logsDB().Exec(`
+                INSERT INTO command_history (command_hash, command, output_hash, output, exit_code, changed)
+                VALUES ($1, $2, $3, $4, $5, $6)
+        `, run.CommandHash, run.Command, run.OutputHash, output, run.ExitCode, run.Changed)
+        if err != nil {
+                log.Printf("Error saving command history to DB: %v", err)
+        }
+}
+
+func (am *AgentManager) lastCommandRunFromDB(hash string) (CommandRun, bool) {
+        if am.logsDB() == nil {
+                return CommandRun{}, false
+        }
+        runs := am.GetCommandHistory(hash, 1)
+        if len(runs) == 0 {
+                return CommandRun{}, false
+        }
+        return runs[0], true
+}
+
+// GetCommandHistory returns the newest runs of a command first. The database
+// holds the full history; without it only the in-memory window is available.
+func (am *AgentManager) GetCommandHistory(hash string, limit int) []CommandRun {
+        if am.logsDB() == nil {
+                if am.commandHistory == nil {
+                        return nil
+                }
+                runs := am.commandHistory.Runs(hash)
+                slices.Reverse(runs)
+                if limit > 0 && len(runs) > limit {
+                        runs = runs[:limit]
+                }
+                return runs
+        }
+
+        rows, err := am.logsDB().Query(`SELECT command_hash, command, output_hash, output, exit_code, changed, created_at
+                FROM command_history WHERE command_hash = $1 ORDER BY created_at DESC, id DESC LIMIT $2`, hash, limit)
+        if err != nil {
+                log.Printf("Error getting command history: %v", err)
+                return nil
+        }
+        defer rows.Close()
+
+        var runs []CommandRun
+        for rows.Next() {
+                var run CommandRun
+                err := rows.Scan(&run.CommandHash, &run.Command, &run.OutputHash, &run.Output,
+                        &run.ExitCode, &run.Changed, &run.Timestamp)
+                if err != nil {
+                        continue
+                }
+                run.Output = am.outputCipher.Open(run.Output)
+                runs = append(runs, run)
+        }
+        return runs
+}
+
+type ResourceBaseline struct {
+        MarkedAt  time.Time              `json:"marked_at"`
+        Resources map[string]interface{} `json:"resources"`
+}
+
+func (am *AgentManager) MarkResourceBaseline() ResourceBaseline {
+        baseline := ResourceBaseline{
+                MarkedAt:  time.Now(),
+                Resources: am.GetResourceUsage(),
+        }
+
+        am.baselineLock.Lock()
+        am.baseline = &baseline
+        am.baselineLock.Unlock()
+
+        return baseline
+}
+
+// GetResourceDelta reports how much each resource counter moved since the
+// last baseline, or nil when no baseline has been marked yet.
+func (am *AgentManager) GetResourceDelta() map[string]interface{} {
+        am.baselineLock.Lock()
+        baseline := am.baseline
+        am.baselineLock.Unlock()
+        if baseline == nil {
+                return nil
+        }
+
+        current := am.GetResourceUsage()
+        before := baseline.Resources
+
+        return map[string]interface{}{
+                "baseline_at":    baseline.MarkedAt.Format(time.RFC3339),
+                "elapsed_ms":     time.Since(baseline.MarkedAt).Milliseconds(),
+                "alloc_mb":       current["alloc_mb"].(float64) - before["alloc_mb"].(float64),
+                "total_alloc_mb": current["total_alloc_mb"].(float64) - before["total_alloc_mb"].(float64),
+                "sys_mb":         current["sys_mb"].(float64) - before["sys_mb"].(float64),
+                "num_gc":         int64(current["num_gc"].(uint32)) - int64(before["num_gc"].(uint32)),
+                "goroutines":     current["goroutines"].(int) - before["goroutines"].(int),
+                "agent_count":    current["agent_count"].(int) - before["agent_count"].(int),
+                "queue_count":    current["queue_count"].(int) - before["queue_count"].(int),
+                "tasks_done":     current["tasks_done"].(int) - before["tasks_done"].(int),
+                "tasks_failed":   current["tasks_failed"].(int) - before["tasks_failed"].(int),
+                "current":        current,
+                "baseline":       before,
+        }
+}
+
+// changeEventTypes are the broadcasts that describe a state change and so
+// belong in the change feed. Streaming output and periodic resource samples
+// are left out.
+var changeEventTypes = map[string]bool{
+        "agent_added":             true,
+        "agent_removed":           true,
+        "agent_status":            true,
+        "agent_drained":           true,
+        "memory_pressure":         true,
+        "banner":                  true,
+        "queue_updated":           true,
+        "queue_retry":             true,
+        "queue_items_skipped":     true,
+        "command_cancelled":       true,
+        "command_quarantined":     true,
+        "quarantine_released":     true,
+        "persistence_changed":     true,
+        "safe_mode_changed":       true,
+        "config_updated":          true,
+        "confirmation_required":   true,
+        "confirmation_resolved":   true,
+        "queue_proposal":          true,
+        "queue_proposal_resolved": true,
+        "started":                 true,
+        "stopped":                 true,
+        "terminated":              true,
+}
+
+// ChangeEvent is one entry of the change feed. Cursor increases by one per
+// event and, with CHANGE_FEED_PERSIST, survives restarts.
+type ChangeEvent struct {
+        Cursor    int64           `json:"cursor"`
+        Type      string          `json:"type"`
+        Payload   json.RawMessage `json:"payload"`
+        Timestamp string          `json:"timestamp"`
+}
+
+// changeFeed is a ring buffer of the most recent change events. Payloads are
+// serialized on record because many of them alias live state.
+type changeFeed struct {
+        mu     sync.Mutex
+        events []ChangeEvent
+        size   int
+        cursor int64
+}
+
+func newChangeFeed(size int) *changeFeed {
+        return &changeFeed{size: size}
+}
+
+func (f *changeFeed) Record(msgType string, payload interface{}) (ChangeEvent, error) {
+        data, err := json.Marshal(payload)
+        if err != nil {
+                return ChangeEvent{}, err
+        }
+
+        f.mu.Lock()
+        defer f.mu.Unlock()
+
+        f.cursor++
+        event := ChangeEvent{
+                Cursor:    f.cursor,
+                Type:      msgType,
+                Payload:   data,
+                Timestamp: time.Now().Format(time.RFC3339Nano),
+        }
+        f.events = append(f.events, event)
+        if len(f.events) > f.size {
+                f.events = f.events[len(f.events)-f.size:]
+        }
+        return event, nil
+}
+
+// Since returns up to limit events after cursor, the latest cursor, and
+// whether the buffer still held every event after it. A cursor ahead of the
+// feed (handed out before a restart) is reported as incomplete too.
+func (f *changeFeed) Since(cursor int64, limit int) ([]ChangeEvent, int64, bool) {
+        f.mu.Lock()
+        defer f.mu.Unlock()
+
+        complete := cursor == f.cursor || (len(f.events) > 0 && cursor >= f.events[0].Cursor-1 && cursor < f.cursor)
+        i := sort.Search(len(f.events), func(i int) bool { return f.events[i].Cursor > cursor })
+        events := f.events[i:]
+        if limit > 0 && len(events) > limit {
+                events = events[:limit]
+        }
+        return append([]ChangeEvent{}, events...), f.cursor, complete
+}
+
+func (am *AgentManager) recordChange(msg Message) {
+        if am.changes == nil || !changeEventTypes[msg.Type] {
+                return
+        }
+
+        event, err := am.changes.Record(msg.Type, msg.Payload)
+        if err != nil {
+                log.Printf("Error recording change event %s: %v", msg.Type, err)
+                return
+        }
+        if am.changeFeedPersist && am.logsPersistenceEnabled() {
+                payload, err := am.outputCipher.Seal(string(event.Payload))
+                if err == nil {
+                        _, err = am.logsDB().Exec(`
+                                INSERT INTO change_events (cursor, type, payload) VALUES ($1, $2, $3)
+                        `, event.Cursor, event.Type, payload)
+                }
+                if err != nil {
+                        log.Printf("Error saving change event to DB: %v", err)
+                }
+        }
+}
+
+// loadChangeCursor continues the cursor sequence from the persisted feed so
+// cursors handed out before a restart stay valid.
+func (am *AgentManager) loadChangeCursor() {
+        if am.changes == nil || !am.changeFeedPersist || am.logsDB() == nil {
+                return
+        }
+
+        var cursor int64
+        if err := am.logsDB().QueryRow(`SELECT COALESCE(MAX(cursor), 0) FROM change_events`).Scan(&cursor); err != nil {
+                log.Printf("Error loading change feed cursor: %v", err)
+                return
+        }
+        am.changes.mu.Lock()
+        am.changes.cursor = cursor
+        am.changes.mu.Unlock()
+}
+
+// GetChanges returns events after since and the cursor to poll from next.
+// Events that fell out of the ring buffer are read back from the database
+// when the feed is persisted; otherwise truncated tells the caller to resync.
+func (am *AgentManager) GetChanges(since int64, limit int) map[string]interface{} {
+        events, cursor, complete := am.changes.Since(since, limit)
+
+        if !complete && am.changeFeedPersist && am.logsDB() != nil {
+                if stored, err := am.changeEventsFromDB(since, limit); err == nil {
+                        events, complete = stored, true
+                } else {
+                        log.Printf("Error reading change events from DB: %v", err)
+                }
+        }
+
+        next := cursor
+        if len(events) > 0 && len(events) == limit {
+                next = events[len(events)-1].Cursor
+        }
+
+        return map[string]interface{}{
+                "events":    events,
+                "cursor":    next,
+                "truncated": !complete,
+        }
+}
+
+func (am *AgentManager) changeEventsFromDB(since int64, limit int) ([]ChangeEvent, error) {
+        rows, err := am.logsDB().Query(`SELECT cursor, type, payload, created_at FROM change_events
+                WHERE cursor > $1 ORDER BY cursor ASC LIMIT $2`, since, limit)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        events := []ChangeEvent{}
+        for rows.Next() {
+                var event ChangeEvent
+                var payload string
+                if err := rows.Scan(&event.Cursor, &event.Type, &payload, &event.Timestamp); err != nil {
+                        return nil, err
+                }
+                event.Payload = json.RawMessage(am.outputCipher.Open(payload))
+                events = append(events, event)
+        }
+        return events, rows.Err()
+}
+
+// broadcastStats measures how long broadcasts take to be queued for every
+// client, and counts the clients dropped for falling behind and the output
+// chunks skipped for clients that were.
+type broadcastStats struct {
+        mu            sync.Mutex
+        count         int64
+        total         time.Duration
+        last          time.Duration
+        max           time.Duration
+        lastClients   int
+        dropped       atomic.Int64
+        droppedChunks atomic.Int64
+}
+
+func (s *broadcastStats) Record(elapsed time.Duration, clients int) {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+
+        s.count++
+        s.total += elapsed
+        s.last = elapsed
+        s.max = max(s.max, elapsed)
+        s.lastClients = clients
+}
+
+func (s *broadcastStats) Snapshot(clientBuffer int) map[string]interface{} {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+
+        avg := 0.0
+        if s.count > 0 {
+                avg = float64(s.total.Microseconds()) / float64(s.count) / 1000
+        }
+        return map[string]interface{}{
+                "client_buffer":   clientBuffer,
+                "broadcasts":      s.count,
+                "avg_ms":          avg,
+                "last_ms":         float64(s.last.Microseconds()) / 1000,
+                "max_ms":          float64(s.max.Microseconds()) / 1000,
+                "last_clients":    s.lastClients,
+                "dropped_clients": s.dropped.Load(),
+                "dropped_chunks":  s.droppedChunks.Load(),
+        }
+}
+
+func (am *AgentManager) broadcastMessage(msg Message) {
+        am.recordChange(msg)
+        am.publish(msg)
+
+        // Encode once; every client gets the same bytes.
+        data, err := json.Marshal(msg)
+        if err != nil {
+                log.Printf("Error encoding %s broadcast: %v", msg.Type, err)
+                return
+        }
+
+        am.broadcastLock.Lock()
+        defer am.broadcastLock.Unlock()
+        am.clientLock.RLock()
+        defer am.clientLock.RUnlock()
+
+        start := time.Now()
+        for client, session := range am.clients {
+                if session.wants(msg) {
+                        am.enqueueLocked(client, session, msg, data)
+                }
+        }
+        am.broadcastStats.Record(time.Since(start), len(am.clients))
+
+        for _, session := range am.detached {
+                if session.wants(msg) {
+                        session.bufferMissed(msg)
+                }
+        }
+}
+
+// Subscribe returns a channel that receives every broadcast from now on, as
+// a change event without cursor, and a function that ends the subscription.
+// A subscriber more than buffer events behind misses events rather than
+// holding up the broadcast.
+func (am *AgentManager) Subscribe(buffer int) (<-chan ChangeEvent, func()) {
+        ch := make(chan ChangeEvent, buffer)
+
+        am.subscribersLock.Lock()
+        if am.subscribers == nil {
+                am.subscribers = make(map[chan ChangeEvent]bool)
+        }
+        am.subscribers[ch] = true
+        am.subscribersLock.Unlock()
+
+        return ch, func() {
+                am.subscribersLock.Lock()
+                delete(am.subscribers, ch)
+                am.subscribersLock.Unlock()
+        }
+}
+
+func (am *AgentManager) publish(msg Message) {
+        am.subscribersLock.Lock()
+        defer am.subscribersLock.Unlock()
+
+        if len(am.subscribers) == 0 {
+                return
+        }
+        payload, err := json.Marshal(msg.Payload)
+        if err != nil {
+                return
+        }
+        event := ChangeEvent{
+                Type:      msg.Type,
+                Payload:   payload,
+                Timestamp: time.Now().Format(time.RFC3339Nano),
+        }
+        for ch := range am.subscribers {
+                select {
+                case ch <- event:
+                default:
+                }
+        }
+}
+
+// clientWriter owns every write to one connection. Broadcasts and replies
+// are queued and written in order by its own goroutine, so a slow client
+// holds up nobody but itself.
+type clientWriter struct {
+        conn    *websocket.Conn
+        session *ClientSession
+        queue   chan outboundMessage
+        done    chan struct{}
+
+        // write sends one encoded message; ctx ends with the connection and
+        // cuts short the backoff between retries.
+        write func(data []byte) error
+        ctx   context.Context
+
+        // abandoned sends what is still queued to the session's reconnect
+        // buffer instead of the connection; dropped is set once the client
+        // has been cut off for falling behind.
+        abandoned atomic.Bool
+        dropped   atomic.Bool
+}
+
+type outboundMessage struct {
+        msg  Message // kept for the reconnect buffer
+        data []byte
+}
+
+func (am *AgentManager) newClientWriter(conn *websocket.Conn, session *ClientSession) *clientWriter {
+        w := &clientWriter{
+                conn:    conn,
+                session: session,
+                queue:   make(chan outboundMessage, am.clientBuffer),
+                done:    make(chan struct{}),
+                ctx:     session.connCtx,
+        }
+        w.write = func(data []byte) error {
+                if am.config().writeTimeout > 0 {
+                        conn.SetWriteDeadline(time.Now().Add(am.config().writeTimeout))
+                }
+                return conn.WriteMessage(websocket.TextMessage, data)
+        }
+        go am.runClientWriter(w)
+        return w
+}
+
+// wsWriteRetries is how often a transient write error is retried before
+// the writer gives up on the connection. The wait between attempts starts
+// at wsWriteBackoff and doubles, plus up to as much again in jitter.
+const (
+        wsWriteRetries = 3
+        wsWriteBackoff = 50 * time.Millisecond
+)
+
+// writeWithRetry writes data, retrying transient errors with jittered
+// backoff, and returns the last error once retries run out.
+func (w *clientWriter) writeWithRetry(data []byte) error {
+        ctx := w.ctx
+        if ctx == nil {
+                ctx = context.Background()
+        }
+        backoff := wsWriteBackoff
+        for attempt := 0; ; attempt++ {
+                err := w.write(data)
+                if err == nil || !isTransientWriteError(err) || attempt == wsWriteRetries {
+                        return err
+                }
+                if !sleepJittered(ctx, backoff, backoff) {
+                        return err
+                }
+                backoff *= 2
+        }
+}
+
+// stop closes the queue; with flush the writer still sends what is queued,
+// otherwise that goes to the reconnect buffer. Callers hold clientLock for
+// writing, so nothing can be enqueued concurrently.
+func (w *clientWriter) stop(flush bool) {
+        w.abandoned.Store(!flush)
+        close(w.queue)
+}
+
+func (am *AgentManager) runClientWriter(w *clientWriter) {
+        defer close(w.done)
+
+        failed := false
+        for out := range w.queue {
+                if failed || w.abandoned.Load() {
+                        if !w.session.noResume.Load() {
+                                w.session.bufferMissed(out.msg)
+                        }
+                        continue
+                }
+                err := w.writeWithRetry(out.data)
+                if err == nil {
+                        continue
+                }
+
+                // A transient failure that outlasts its retries keeps the
+                // session (with this message and everything queued after it
+                // buffered) for the reconnect grace period; a fatal one
+                // drops it outright.
+                failed = true
+                if isTransientWriteError(err) {
+                        log.Printf("WebSocket write timed out, keeping session for reconnect: %v", err)
+                        w.session.bufferMissed(out.msg)
+                } else {
+                        log.Printf("WebSocket write error: %v", err)
+                        w.session.noResume.Store(true)
+                }
+                w.conn.Close()
+        }
+}
+
+// enqueueLocked queues an encoded message for one client without blocking.
+// A client whose queue is full is too far behind to catch up: it is
+// disconnected and, as it missed more than a reconnect could replay, not
+// kept for one. Output chunks only ever take the first half of the queue;
+// past that they are skipped, since the command_result carries the whole
+// output anyway, so a chatty command cannot get a client dropped. Callers
+// hold clientLock.
+func (am *AgentManager) enqueueLocked(client *websocket.Conn, session *ClientSession, msg Message, data []byte) {
+        if session == nil || session.writer == nil {
+                return
+        }
+        if msg.Type == "command_output_chunk" && len(session.writer.queue) >= cap(session.writer.queue)/2 {
+                am.broadcastStats.droppedChunks.Add(1)
+                return
+        }
+        select {
+        case session.writer.queue <- outboundMessage{msg: msg, data: data}:
+                return
+        default:
+        }
+        if session.writer.dropped.CompareAndSwap(false, true) {
+                log.Printf("Dropping WebSocket client: send queue of %d messages is full", am.clientBuffer)
+                am.broadcastStats.dropped.Add(1)
+                session.noResume.Store(true)
+                client.Close()
+        }
+}
+
+// sendMessage queues a reply for one client behind the broadcasts already
+// queued for it.
+func sendMessage(conn *websocket.Conn, msg Message) {
+        data, err := json.Marshal(msg)
+        if err != nil {
+                log.Printf("Error encoding %s message: %v", msg.Type, err)
+                return
+        }
+
+        manager.clientLock.RLock()
+        defer manager.clientLock.RUnlock()
+        manager.enqueueLocked(conn, manager.clients[conn], msg, data)
+}
+
+// isTransientWriteError separates network hiccups (timeouts) from errors that
+// mean the peer is gone for good.
+func isTransientWriteError(err error) bool {
+        var netErr net.Error
+        return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// attachClient registers a connection, resuming the detached session that
+// matches token if there is one.
+func (am *AgentManager) attachClient(conn *websocket.Conn, token string) (*ClientSession, bool) {
+        am.clientLock.Lock()
+        defer am.clientLock.Unlock()
+
+        if session, ok := am.detached[token]; ok && token != "" {
+                delete(am.detached, token)
+                session.DisconnectedAt = time.Time{}
+                session.noResume.Store(false)
+                session.connCtx, session.connCancel = context.WithCancel(context.Background())
+                session.writer = am.newClientWriter(conn, session)
+                am.clients[conn] = session
+                return session, true
+        }
+
+        session := &ClientSession{Token: newSessionToken()}
+        session.connCtx, session.connCancel = context.WithCancel(context.Background())
+        session.writer = am.newClientWriter(conn, session)
+        am.clients[conn] = session
+        return session, false
+}
+
+func (am *AgentManager) sessionFor(conn *websocket.Conn) *ClientSession {
+        am.clientLock.RLock()
+        defer am.clientLock.RUnlock()
+        return am.clients[conn]
+}
+
+// detachClient removes a connection but keeps its session around for the
+// reconnect grace period before dropping it for good. The session only
+// becomes resumable once its writer has moved everything still queued to the
+// reconnect buffer, so a quick reconnect replays all of it, in order.
+func (am *AgentManager) detachClient(conn *websocket.Conn) {
+        am.clientLock.Lock()
+        session, ok := am.clients[conn]
+        delete(am.clients, conn)
+        var writer *clientWriter
+        if ok && session != nil {
+                if session.connCancel != nil {
+                        session.connCancel()
+                }
+                writer = session.writer
+                session.writer = nil
+                if writer != nil {
+                        writer.stop(false)
+                }
+        }
+        am.clientLock.Unlock()
+
+        if writer != nil {
+                <-writer.done
+        }
+        if !ok || session == nil || am.reconnectGrace <= 0 || session.noResume.Load() {
+                return
+        }
+
+        am.clientLock.Lock()
+        session.DisconnectedAt = time.Now()
+        am.detached[session.Token] = session
+        am.clientLock.Unlock()
+
+        time.AfterFunc(am.reconnectGrace, func() {
+                am.clientLock.Lock()
+                defer am.clientLock.Unlock()
+                if current, ok := am.detached[session.Token]; ok && current == session {
+                        delete(am.detached, session.Token)
+                }
+        })
+}
+
+// StartAgentLoop launches the dispatch loop for an agent unless one is
+// already live.
+func (am *AgentManager) StartAgentLoop(agentID int) {
+        am.loopLock.Lock()
+        defer am.loopLock.Unlock()
+        if _, ok := am.agentLoops[agentID]; ok {
+                return
+        }
+        ctx, cancel := context.WithCancel(context.Background())
+        am.agentLoops[agentID] = cancel
+
+        go func() {
+                defer cancel()
+                // Workers run under the loop's context, so it is cancelled
+                // only after the last of them has finished.
+                var workers sync.WaitGroup
+                defer workers.Wait()
+                var active atomic.Int32
+                freed := make(chan struct{}, 1)
+
+                for am.keepAgentLoop(agentID, ctx) {
+                        if am.isReserved(agentID) || am.isDraining(agentID) || am.isPaused(agentID) {
+                                time.Sleep(1 * time.Second)
+                                continue
+                        }
+                        if int(active.Load()) >= am.agentConcurrency(agentID) {
+                                select {
+                                case <-freed:
+                                case <-ctx.Done():
+                                case <-time.After(1 * time.Second):
+                                }
+                                continue
+                        }
+
+                        if !am.beginCommand() {
+                                time.Sleep(1 * time.Second)
+                                continue
+                        }
+                        item := am.GetNextQueueItem(agentID)
+                        if item == nil {
+                                am.inFlight.Done()
+                                time.Sleep(1 * time.Second)
+                                continue
+                        }
+                        active.Add(1)
+                        workers.Add(1)
+                        go func() {
+                                defer workers.Done()
+                                pause := am.runQueueItem(agentID, item, ctx)
+                                am.inFlight.Done()
+                                time.Sleep(pause)
+                                active.Add(-1)
+                                select {
+                                case freed <- struct{}{}:
+                                default:
+                                }
+                        }()
+                }
+        }()
+}
+
+// runQueueItem runs an item claimed by agentID and returns how long its
+// worker should pause before taking another.
+func (am *AgentManager) runQueueItem(agentID int, item *QueueItem, ctx context.Context) time.Duration {
+        dispatchedAt := time.Now()
+        key := queueKey(item)
+        if item.PreCheck != "" {
+                if output, ok := am.runPreCheck(agentID, key, item.PreCheck); !ok {
+                        if am.takeCancellation(key) {
+                                am.finishQueueItem(key, "cancelled", output)
+                                return 500 * time.Millisecond
+                        }
+                        if ctx.Err() != nil && am.stopping() {
+                                return 0
+                        }
+                        am.finishQueueItem(key, "skipped", output)
+                        am.saveLogToDB(&LogEntry{
+                                AgentID: agentID,
+                                Level:   "warn",
+                                Message: fmt.Sprintf("Skipped queue item %d: pre-check failed", item.Index),
+                                Command: item.PreCheck,
+                                Output:  output,
+                        })
+                        return 0
+                }
+        }
+
+        opts := item.execOptions(am.config().resultCacheTTL)
+        opts.DispatchedAt = dispatchedAt
+        opts.Context = ctx
+        var output string
+        var ok, expired bool
+        if len(item.FanOut) > 0 {
+                output, ok = am.executeFanOut(agentID, item, opts)
+        } else {
+                result := am.ExecuteCommandWithOptions(agentID, item.Command, opts)
+                output, ok, expired = result.Output, result.ExitCode == 0, timedOut(result)
+        }
+        if am.takeCancellation(key) {
+                am.finishQueueItem(key, "cancelled", output)
+                return 500 * time.Millisecond
+        }
+        // Killed by Shutdown, which puts the item back to pending itself.
+        if ctx.Err() != nil && am.stopping() {
+                return 0
+        }
+        if ctx.Err() != nil {
+                am.failoverQueueItem(key, agentID, output)
+                return 0
+        }
+        if expired && item.OnTimeout == "retry" && am.retryTimedOutQueueItem(key, agentID, output) {
+                return 0
+        }
+        am.CompleteQueueItem(key, output, ok)
+        return 500 * time.Millisecond
+}
+
+// keepAgentLoop reports whether an agent loop should continue. A loop that
+// stops deregisters itself under loopLock, so a concurrent Start either sees
+// it still live (and lets it carry on) or starts a fresh one. A loop whose
+// stop context was cancelled has already been deregistered by stopAgentLoop.
+func (am *AgentManager) keepAgentLoop(agentID int, ctx context.Context) bool {
+        am.loopLock.Lock()
+        defer am.loopLock.Unlock()
+        if ctx.Err() != nil {
+                return false
+        }
+        if am.running.Load() && !am.terminated.Load() {
+                return true
+        }
+        delete(am.agentLoops, agentID)
+        return false
+}
+
+// stopAgentLoop cancels an agent's loop together with whatever command it
+// is running, for when the agent itself goes away.
+func (am *AgentManager) stopAgentLoop(agentID int) {
+        am.loopLock.Lock()
+        defer am.loopLock.Unlock()
+        if cancel, ok := am.agentLoops[agentID]; ok {
+                cancel()
+                delete(am.agentLoops, agentID)
+        }
+}
+
+// failoverQueueItem hands an item whose agent went away mid-run back to the
+// queue for another agent, up to MAX_FAILOVERS times or until its batch's
+// retry budget runs out; after that it fails with whatever output it had
+// produced.
+func (am *AgentManager) failoverQueueItem(key int, agentID int, output string) {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        i := am.findQueueItem(key)
+        if i < 0 {
+                return
+        }
+        item := &am.queue[i]
+        if item.FailoverCount >= am.config().maxFailovers {
+                item.Status = "failed"
+                item.Output = output + fmt.Sprintf("\nagent %d went away; failover limit of %d reached", agentID, am.config().maxFailovers)
+        } else if !am.spendRetryLocked(item) {
+                item.Status = "failed"
+                item.Output = output + fmt.Sprintf("\nagent %d went away; retry budget of batch %s exhausted", agentID, item.BatchID)
+        } else {
+                item.Status = "pending"
+                item.AgentID = 0
+                item.FailoverCount++
+        }
+        am.updateQueueItemInDB(item)
+
+        am.saveLogToDB(&LogEntry{
+                AgentID: agentID,
+                Level:   "warn",
+                Message: fmt.Sprintf("Agent %d stopped while running queue item %d (failover %d/%d, now %s)",
+                        agentID, item.Index, item.FailoverCount, am.config().maxFailovers, item.Status),
+                Command: item.Command,
+        })
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+}
+
+// retryTimedOutQueueItem puts a timed-out item with OnTimeout "retry" back
+// to pending. It returns false once the item has used up its retries or its
+// batch's retry budget, and the timeout then fails it as usual.
+func (am *AgentManager) retryTimedOutQueueItem(key int, agentID int, output string) bool {
+        am.queueLock.Lock()
+        defer am.queueLock.Unlock()
+
+        i := am.findQueueItem(key)
+        if i < 0 {
+                return false
+        }
+        item := &am.queue[i]
+        if item.TimeoutRetries >= maxTimeoutRetries {
+                return false
+        }
+        if !am.spendRetryLocked(item) {
+                am.saveLogToDB(&LogEntry{
+                        AgentID: agentID,
+                        Level:   "warn",
+                        Message: fmt.Sprintf("Queue item %d timed out; retry budget of batch %s exhausted", item.Index, item.BatchID),
+                        Command: item.Command,
+                })
+                return false
+        }
+        item.Status = "pending"
+        item.Output = output
+        item.AgentID = 0
+        item.TimeoutRetries++
+        item.EnqueuedAt = time.Now()
+        am.updateQueueItemInDB(item)
+
+        am.saveLogToDB(&LogEntry{
+                AgentID: agentID,
+                Level:   "warn",
+                Message: fmt.Sprintf("Queue item %d timed out, retrying (%d/%d)", item.Index, item.TimeoutRetries, maxTimeoutRetries),
+                Command: item.Command,
+        })
+        am.broadcastMessage(Message{
+                Type:    "queue_updated",
+                Payload: am.queue,
+        })
+        return true
+}
+
+func (am *AgentManager) keepMonitoring() bool {
+        am.loopLock.Lock()
+        defer am.loopLock.Unlock()
+        if am.running.Load() {
+                return true
+        }
+        am.monitoring = false
+        return false
+}
+
+// Stop halts every agent loop and the resource monitor once their current
+// iteration finishes. Commands already executing are left to complete.
+func (am *AgentManager) Stop() {
+        if am.running.Swap(false) {
+                log.Println("Manager stopped")
+                am.saveLogToDB(&LogEntry{Level: "warn", Message: "Manager stopped"})
+        }
+        am.broadcastMessage(Message{
+                Type:    "stopped",
+                Payload: nil,
+        })
+}
+
+// Start resumes a stopped manager, relaunching loops for every existing
+// agent. A system terminated by <END!> stays terminated.
+func (am *AgentManager) Start() error {
+        if am.terminated.Load() {
+                return fmt.Errorf("system was terminated and cannot be restarted")
+        }
+
+        if !am.running.Swap(true) {
+                log.Println("Manager started")
+                am.saveLogToDB(&LogEntry{Level: "info", Message: "Manager started"})
+        }
+
+        am.agentLock.RLock()
+        ids := make([]int, 0, len(am.agents))
+        for id := range am.agents {
+                ids = append(ids, id)
+        }
+        am.agentLock.RUnlock()
+
+        for _, id := range ids {
+                am.StartAgentLoop(id)
+        }
+        am.MonitorResources()
+
+        am.broadcastMessage(Message{
+                Type:    "started",
+                Payload: map[string]interface{}{"agents": len(ids)},
+        })
+        return nil
+}
+
+func (am *AgentManager) MonitorResources() {
+        am.loopLock.Lock()
+        defer am.loopLock.Unlock()
+        if am.monitoring {
+                return
+        }
+        am.monitoring = true
+
+        // Sampling owns the monitor's lifetime; persisting and broadcasting
+        // run on their own tickers so a slow DB write cannot hold up the
+        // broadcasts, and stop when sampling does.
+        ctx, cancel := context.WithCancel(context.Background())
+        go func() {
+                defer cancel()
+                for am.keepMonitoring() {
+                        am.sampleResources()
+                        sleepJittered(ctx, am.config().monitorSampleInterval, am.config().monitorJitter)
+                }
+        }()
+        go func() {
+                var lastAgentMetrics time.Time
+                for sleepJittered(ctx, am.config().monitorPersistInterval, am.config().monitorJitter) {
+                        lastAgentMetrics = am.persistResources(lastAgentMetrics)
+                }
+        }()
+        go func() {
+                for sleepJittered(ctx, am.config().monitorBroadcastInterval, am.config().monitorJitter) {
+                        resources := am.GetResourceUsage()
+                        am.broadcastMessage(Message{
+                                Type:    "resource_update",
+                                Payload: resources,
+                        })
+                        am.sendDashboardTick(resources)
+                }
+        }()
+}
+
+// minMonitorInterval keeps a misconfigured monitor ticker from spinning.
+const minMonitorInterval = 100 * time.Millisecond
+
+// sleepJittered waits d plus up to jitter at random, so that instances
+// started together do not tick together. It reports false if ctx ends
+// first.
+func sleepJittered(ctx context.Context, d, jitter time.Duration) bool {
+        if jitter > 0 {
+                d += mrand.N(jitter)
+        }
+        timer := time.NewTimer(d)
+        defer timer.Stop()
+        select {
+        case <-ctx.Done():
+                return false
+        case <-timer.C:
+                return true
+        }
+}
+
+// sampleResources does the monitor's housekeeping and takes a process
+// sample, attributing its CPU and network use to the agents.
+func (am *AgentManager) sampleResources() {
+        am.refreshConcurrencyLimit()
+        am.maintainIdleAgents()
+        am.expireStalePending()
+        am.compactQueue()
+
+        sample := am.sysMetrics.Sample()
+        am.agentLock.Lock()
+        am.attributeUsageLocked(sample)
+        am.agentLock.Unlock()
+}
+
+// persistResources writes the latest sample to resource_metrics and, once
+// AGENT_METRICS_INTERVAL has passed since lastAgentMetrics, the agents'
+// figures to agent_metrics. It returns when agent metrics were last written.
+func (am *AgentManager) persistResources(lastAgentMetrics time.Time) time.Time {
+        recordAgents := am.config().agentMetricsInterval > 0 && time.Since(lastAgentMetrics) >= am.config().agentMetricsInterval
+        var agentMetrics []AgentMetric
+        if recordAgents {
+                am.agentLock.RLock()
+                for _, agent := range am.agents {
+                        agentMetrics = append(agentMetrics, AgentMetric{
+                                AgentID:      agent.ID,
+                                AgentName:    agent.Name,
+                                Status:       agent.Status,
+                                MemoryUsage:  agent.MemoryUsage,
+                                CPUUsage:     agent.CPUUsage,
+                                NetworkUsage: agent.NetworkUsage,
+                                TasksDone:    agent.TasksDone,
+                                TasksFailed:  agent.TasksFailed,
+                        })
+                }
+                am.agentLock.RUnlock()
+        }
+
+        resources := am.GetResourceUsage()
+        metric := &ResourceMetric{
+                CPUPercent: resources["cpu_percent"].(float64),
+                MemoryMB:   resources["rss_mb"].(float64),
+                AllocMB:    resources["alloc_mb"].(float64),
+                SysMB:      resources["sys_mb"].(float64),
+                Goroutines: resources["goroutines"].(int),
+                NumGC:      resources["num_gc"].(uint32),
+                AgentCount: resources["agent_count"].(int),
+                QueueCount: resources["queue_count"].(int),
+        }
+        am.saveResourceMetricToDB(metric)
+        if !recordAgents {
+                return lastAgentMetrics
+        }
+        for i := range agentMetrics {
+                agentMetrics[i].MetricID = metric.ID
+        }
+        am.saveAgentMetricsToDB(agentMetrics)
+        return time.Now()
+}
+
+// DashboardAgent is the summary of one agent in a dashboard_tick.
+type DashboardAgent struct {
+        ID          int     `json:"id"`
+        Name        string  `json:"name"`
+        Status      string  `json:"status"`
+        CurrentTask string  `json:"current_task,omitempty"`
+        TasksDone   int     `json:"tasks_done"`
+        TasksFailed int     `json:"tasks_failed"`
+        MemoryUsage float64 `json:"memory_usage"`
+        CPUUsage    float64 `json:"cpu_usage"`
+}
+
+// SetDashboardSubscription switches a client between the granular
+// resource_update and the consolidated dashboard_tick. It reports false for
+// an unknown connection.
+func (am *AgentManager) SetDashboardSubscription(conn *websocket.Conn, enabled bool) bool {
+        am.clientLock.RLock()
+        defer am.clientLock.RUnlock()
+        session, ok := am.clients[conn]
+        if !ok || session == nil {
+                return false
+        }
+        session.dashboard.Store(enabled)
+        return true
+}
+
+// SetResultFilter limits the command_result broadcasts a client receives;
+// nil lifts the limit. It reports false for an unknown connection.
+func (am *AgentManager) SetResultFilter(conn *websocket.Conn, filter *ResultFilter) bool {
+        am.clientLock.RLock()
+        defer am.clientLock.RUnlock()
+        session, ok := am.clients[conn]
+        if !ok || session == nil {
+                return false
+        }
+        session.resultFilter.Store(filter)
+        return true
+}
+
+// sendDashboardTick sends subscribed clients one frame holding resources,
+// a summary of every agent and the queue counts by status.
+func (am *AgentManager) sendDashboardTick(resources map[string]interface{}) {
+        am.clientLock.RLock()
+        subscribed := false
+        for _, session := range am.clients {
+                if session != nil && session.dashboard.Load() {
+                        subscribed = true
+                        break
+                }
+        }
+        am.clientLock.RUnlock()
+        if !subscribed {
+                return
+        }
+
+        am.agentLock.RLock()
+        agents := make([]DashboardAgent, 0, len(am.agents))
+        for _, agent := range am.agents {
+                agents = append(agents, DashboardAgent{
+                        ID:          agent.ID,
+                        Name:        agent.Name,
+                        Status:      agent.Status,
+                        CurrentTask: agent.CurrentTask,
+                        TasksDone:   agent.TasksDone,
+                        TasksFailed: agent.TasksFailed,
+                        MemoryUsage: agent.MemoryUsage,
+                        CPUUsage:    agent.CPUUsage,
+                })
+        }
+        am.agentLock.RUnlock()
+        sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+
+        am.queueLock.RLock()
+        counts := make(map[string]int)
+        for _, item := range am.queue {
+                counts[item.Status]++
+        }
+        am.queueLock.RUnlock()
+
+        msg := Message{
+                Type: "dashboard_tick",
+                Payload: map[string]interface{}{
+                        "resources": resources,
+                        "agents":    agents,
+                        "queue":     counts,
+                        "timestamp": time.Now().Format(time.RFC3339),
+                },
+        }
+        data, err := json.Marshal(msg)
+        if err != nil {
+                log.Printf("Error encoding dashboard_tick: %v", err)
+                return
+        }
+
+        am.broadcastLock.Lock()
+        defer am.broadcastLock.Unlock()
+        am.clientLock.RLock()
+        defer am.clientLock.RUnlock()
+        for client, session := range am.clients {
+                if session != nil && session.dashboard.Load() {
+                        am.enqueueLocked(client, session, msg, data)
+                }
+        }
+}
+
+func (am *AgentManager) GracefulTerminate(signal string) {
+        if signal == "<END!>" {
+                am.terminated.Store(true)
+                am.running.Store(false)
+
+                am.saveLogToDB(&LogEntry{
+                        Level:   "warn",
+                        Message: "System terminated by <END!> signal",
+                })
+
+                am.broadcastMessage(Message{
+                        Type:    "terminated",
+                        Payload: map[string]string{"reason": "Graceful termination via <END!> signal"},
+                })
+
+                log.Println("System gracefully terminated via <END!> signal")
+        }
+}
+
+// beginCommand registers a command with inFlight, or reports false once
+// shutdown has begun.
+func (am *AgentManager) beginCommand() bool {
+        am.shutdownLock.RLock()
+        defer am.shutdownLock.RUnlock()
+        if am.shuttingDown {
+                return false
+        }
+        am.inFlight.Add(1)
+        return true
+}
+
+// shutdownKillWait is how long Shutdown waits for commands it has killed
+// to exit before requeueing their items regardless.
+const shutdownKillWait = 5 * time.Second
+
+// stopRunningCommands cancels every agent loop and every running command,
+// killing their process groups, without marking any item cancelled.
+func (am *AgentManager) stopRunningCommands() {
+        am.loopLock.Lock()
+        for id, cancel := range am.agentLoops {
+                cancel()
+                delete(am.agentLoops, id)
+        }
+        am.loopLock.Unlock()
+
+        am.runningLock.Lock()
+        for _, runs := range am.runningCommands {
+                for _, run := range runs {
+                        run.cancel()
+                }
+        }
+        am.runningLock.Unlock()
+}
+
+// Shutdown stops the agent loops, gives executing commands up to
+// SHUTDOWN_GRACE_PERIOD to finish, kills those that did not, puts their
+// items back to pending for the next start, then says goodbye to every
+// WebSocket client and closes the databases.
+func (am *AgentManager) Shutdown() {
+        am.shutdownLock.Lock()
+        am.shuttingDown = true
+        am.shutdownLock.Unlock()
+        am.running.Store(false)
+
+        log.Printf("Shutting down, waiting up to %s for running commands", am.shutdownGrace)
+        drained := make(chan struct{})
+        go func() {
+                am.inFlight.Wait()
+                close(drained)
+        }()
+        select {
+        case <-drained:
+                log.Println("All running commands finished")
+        case <-time.After(am.shutdownGrace):
+                log.Println("Shutdown grace period over, killing running commands")
+                am.stopRunningCommands()
+                select {
+                case <-drained:
+                case <-time.After(shutdownKillWait):
+                        log.Printf("Commands still running %s after being killed, requeueing anyway", shutdownKillWait)
+                }
+        }
+
+        am.queueLock.Lock()
+        requeued := 0
+        for i := range am.queue {
+                item := &am.queue[i]
+                if item.Status == "running" || item.Status == "awaiting_confirmation" {
+                        item.Status = "pending"
+                        item.AgentID = 0
+                        am.updateQueueItemInDB(item)
+                        requeued++
+                }
+        }
+        am.queueLock.Unlock()
+
+        am.saveLogToDB(&LogEntry{
+                Level:   "warn",
+                Message: fmt.Sprintf("Server shutting down (%d running items requeued)", requeued),
+        })
+        am.broadcastMessage(Message{
+                Type:    "shutdown",
+                Payload: map[string]interface{}{"requeued": requeued},
+        })
+
+        // Give every client a moment to receive what is still queued for
+        // it, the shutdown notice included.
+        am.clientLock.Lock()
+        flushDeadline := time.After(2 * time.Second)
+        for _, session := range am.clients {
+                if session.writer == nil {
+                        continue
+                }
+                session.writer.stop(true)
+                select {
+                case <-session.writer.done:
+                case <-flushDeadline:
+                }
+                session.writer = nil
+        }
+        for conn := range am.clients {
+                conn.WriteControl(websocket.CloseMessage,
+                        websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+                        time.Now().Add(time.Second))
+                conn.Close()
+                delete(am.clients, conn)
+        }
+        am.clientLock.Unlock()
+
+        if logs := am.logsDB(); logs != nil && logs != am.db() {
+                logs.Close()
+        }
+        if db := am.db(); db != nil {
+                db.Close()
+        }
+}
+
+var manager *AgentManager
+
+func (am *AgentManager) ClientCount() int {
+        am.clientLock.RLock()
+        defer am.clientLock.RUnlock()
+        return len(am.clients)
+}
+
+// reserveClientSlot claims a MAX_WS_CLIENTS slot for a new connection,
+// reporting false when none is free. Slots are taken before the upgrade, so
+// connections still waiting to authenticate count against the limit too.
+func (am *AgentManager) reserveClientSlot() bool {
+        if am.wsSlots.Add(1) > int64(am.maxClients) && am.maxClients > 0 {
+                am.wsSlots.Add(-1)
+                return false
+        }
+        return true
+}
+
+func (am *AgentManager) releaseClientSlot() {
+        am.wsSlots.Add(-1)
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+        if !manager.reserveClientSlot() {
+                log.Printf("Rejecting WebSocket connection from %s: too many connections", r.RemoteAddr)
+                writeError(w, r, http.StatusServiceUnavailable, "too many connections")
+                return
+        }
+        defer manager.releaseClientSlot()
+
+        // The key comes as ?token= (browsers cannot set headers on the
+        // upgrade), an Authorization header, or failing both as the first
+        // message once connected.
+        key := apiKey()
+        given := r.URL.Query().Get("token")
+        if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && given == "" {
+                given = bearer
+        }
+        if key != "" && given != "" && !validAPIKey(given, key) {
+                writeError(w, r, http.StatusUnauthorized, "Missing or invalid API key")
+                return
+        }
+        // Checked here as well as by the upgrader to answer with the usual
+        // JSON error instead of its plain-text one.
+        if origin := r.Header.Get("Origin"); !manager.config().originAllowed(origin) {
+                log.Printf("Rejecting WebSocket connection from %s: origin %q not allowed", r.RemoteAddr, origin)
+                writeError(w, r, http.StatusForbidden, "Origin not allowed")
+                return
+        }
+
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+                log.Printf("WebSocket upgrade error: %v", err)
+                return
+        }
+        defer conn.Close()
+
+        if key != "" && given == "" && !authenticateWebSocket(conn, key) {
+                log.Printf("Closing WebSocket connection from %s: not authenticated", r.RemoteAddr)
+                return
+        }
+
+        session, resumed := manager.attachClient(conn, r.URL.Query().Get("reconnect_token"))
+
+        sendMessage(conn, Message{
+                Type: "connected",
+                Payload: map[string]interface{}{
+                        "agents":          manager.GetAgents(),
+                        "queue":           manager.GetQueueList(),
+                        "terminated":      manager.terminated.Load(),
+                        "running":         manager.running.Load(),
+                        "safe_mode":       manager.safeMode.Load(),
+                        "banner":          manager.currentBanner(),
+                        "reconnect_token": session.Token,
+                        "resumed":         resumed,
+                },
+        })
+
+        if resumed {
+                for _, missed := range session.takeMissed() {
+                        sendMessage(conn, missed)
+                }
+        }
+
+        for {
+                _, data, err := conn.ReadMessage()
+                if err != nil {
+                        log.Printf("WebSocket read error: %v", err)
+                        manager.detachClient(conn)
                         break
                 }
+                // A malformed message is the client's mistake, not a reason
+                // to drop the connection.
+                var msg Message
+                if err := json.Unmarshal(data, &msg); err != nil {
+                        sendError(conn, "invalid message: "+err.Error())
+                        continue
+                }
+
+                handleMessageSafely(conn, msg)
+        }
+}
+
+// wsAuthTimeout is how long a WebSocket client that connected without a
+// token has to send its auth message.
+const wsAuthTimeout = 10 * time.Second
+
+// authenticateWebSocket expects {"type": "auth", "payload": {"token": ...}}
+// as the first message and closes the connection with 4401 otherwise.
+func authenticateWebSocket(conn *websocket.Conn, key string) bool {
+        conn.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+        var msg Message
+        err := conn.ReadJSON(&msg)
+        conn.SetReadDeadline(time.Time{})
+        if err == nil && msg.Type == "auth" {
+                payload, _ := msg.Payload.(map[string]interface{})
+                if token, ok := payload["token"].(string); ok && validAPIKey(token, key) {
+                        return true
+                }
+        }
+        conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4401, "unauthorized"), time.Now().Add(time.Second))
+        return false
+}
+
+// handleMessageSafely keeps a bad message from taking down the connection:
+// a panic in its handler is logged and reported to the client.
+func handleMessageSafely(conn *websocket.Conn, msg Message) {
+        defer func() {
+                if r := recover(); r != nil {
+                        log.Printf("Panic handling %s message: %v", msg.Type, r)
+                        sendError(conn, fmt.Sprintf("could not handle %s message", msg.Type))
+                }
+        }()
+        handleMessage(conn, msg)
+}
+
+func handleMessage(conn *websocket.Conn, msg Message) {
+        switch msg.Type {
+        case "add_agent":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                name, ok := payload["name"].(string)
+                if !ok || name == "" {
+                        sendError(conn, "add_agent needs a name")
+                        return
+                }
+                spec := AgentSpec{Name: name}
+                if weight, ok := payload["weight"].(float64); ok {
+                        spec.Weight = int(weight)
+                }
+                spec.FIFO, _ = payload["fifo"].(bool)
+                if limit, ok := payload["max_concurrent"].(float64); ok {
+                        spec.MaxConcurrent = int(limit)
+                }
+                if group, ok := payload["group"].(string); ok {
+                        if _, exists := manager.GetGroup(group); !exists {
+                                sendError(conn, fmt.Sprintf("unknown agent group %q", group))
+                                return
+                        }
+                        spec.Group = group
+                }
+                agent := manager.AddAgentWithSpec(spec)
+                if agent != nil {
+                        manager.StartAgentLoop(agent.ID)
+                }
+
+        case "remove_agent":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                id, ok := payload["id"].(float64)
+                if !ok {
+                        sendError(conn, "remove_agent needs a numeric id")
+                        return
+                }
+                manager.RemoveAgent(int(id))
+
+        case "pause_agent", "resume_agent":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                id, ok := payload["id"].(float64)
+                if !ok {
+                        sendError(conn, msg.Type+" needs a numeric id")
+                        return
+                }
+                if _, err := manager.SetAgentPaused(int(id), msg.Type == "pause_agent"); err != nil {
+                        sendError(conn, err.Error())
+                }
+
+        case "add_queue":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                commands, entries, err := parseQueueEntries(payload)
+                if err != nil {
+                        sendError(conn, err.Error())
+                        return
+                }
+                sendMessage(conn, Message{
+                        Type:    "queue_add_result",
+                        Payload: manager.AddToQueue(commands, entries),
+                })
+
+        case "cancel_command":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                agentID, _ := payload["agent_id"].(float64)
+                queueID, _ := payload["queue_id"].(float64)
+                queueIndex, _ := payload["queue_index"].(float64)
+                key := 0
+                if queueID > 0 || queueIndex > 0 {
+                        if key = manager.cancelKey(int(queueID), int(queueIndex)); key == 0 {
+                                sendError(conn, errQueueItemNotFound.Error())
+                                return
+                        }
+                }
+                if (agentID > 0) == (key > 0) {
+                        sendError(conn, "cancel_command needs either an agent_id or a queue_id")
+                        return
+                }
+                if _, err := manager.CancelCommand(int(agentID), key); err != nil {
+                        sendError(conn, err.Error())
+                }
+
+        case "queue_list":
+                sendMessage(conn, Message{
+                        Type:    "queue_list",
+                        Payload: manager.GetQueueWithPositions(),
+                })
+
+        case "queue_rm":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                if id, ok := payload["id"].(float64); ok {
+                        manager.RemoveQueueItem(int(id))
+                        return
+                }
+                // Deprecated: removal by index, kept for older clients.
+                index, ok := payload["index"].(float64)
+                if !ok {
+                        sendError(conn, "queue_rm needs a numeric id")
+                        return
+                }
+                manager.RemoveFromQueue(int(index))
+
+        case "queue_disable", "queue_enable":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                id, ok := payload["id"].(float64)
+                if !ok {
+                        sendError(conn, msg.Type+" needs a numeric id")
+                        return
+                }
+                if _, err := manager.SetQueueItemDisabled(int(id), msg.Type == "queue_disable"); err != nil {
+                        sendError(conn, err.Error())
+                }
+
+        case "queue_schedule":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                id, ok := payload["id"].(float64)
+                if !ok {
+                        sendError(conn, "queue_schedule needs a numeric id")
+                        return
+                }
+                runAt, err := parseSchedule(payload)
+                if err != nil {
+                        sendError(conn, err.Error())
+                        return
+                }
+                if _, err := manager.ScheduleQueueItem(int(id), runAt); err != nil {
+                        sendError(conn, err.Error())
+                }
+
+        case "chat":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                mode, modeOK := payload["mode"].(string)
+                content, contentOK := payload["content"].(string)
+                if !modeOK || !contentOK {
+                        sendError(conn, "chat needs a mode and content")
+                        return
+                }
+                chatMsg := ChatMessage{
+                        Mode:    mode,
+                        Content: content,
+                        User:    "user",
+                }
+                handleChat(chatMsg)
+
+        case "get_agents":
+                sendMessage(conn, Message{
+                        Type:    "agents",
+                        Payload: manager.GetAgents(),
+                })
+
+        case "get_resources":
+                sendMessage(conn, Message{
+                        Type:    "resources",
+                        Payload: manager.GetResourceUsage(),
+                })
+
+        case "get_logs":
+                // The filters are optional, so a missing payload is fine.
+                payload, _ := msg.Payload.(map[string]interface{})
+                limit := 50
+                agentID := 0
+                level := ""
+                if l, ok := payload["limit"].(float64); ok {
+                        limit = int(l)
+                }
+                if a, ok := payload["agent_id"].(float64); ok {
+                        agentID = int(a)
+                }
+                if lv, ok := payload["level"].(string); ok {
+                        level = lv
+                }
+                search, _ := payload["search"].(string)
+                sendMessage(conn, Message{
+                        Type:    "logs",
+                        Payload: manager.GetLogs(limit, agentID, level, search),
+                })
+
+        case "get_resource_history":
+                limit := 100
+                if payload, ok := msg.Payload.(map[string]interface{}); ok {
+                        if l, ok := payload["limit"].(float64); ok {
+                                limit = int(l)
+                        }
+                }
+                sendMessage(conn, Message{
+                        Type:    "resource_history",
+                        Payload: manager.GetResourceHistory(limit),
+                })
+
+        case "execute":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                id, idOK := payload["agent_id"].(float64)
+                command, commandOK := payload["command"].(string)
+                if !idOK || !commandOK {
+                        sendError(conn, "execute needs a numeric agent_id and a command")
+                        return
+                }
+                agentID := int(id)
+                if token, ok := payload["lease_token"].(string); ok && token != "" {
+                        leased, ok := manager.resolveLease(token)
+                        if !ok {
+                                sendError(conn, "invalid or expired lease token")
+                                return
+                        }
+                        agentID = leased
+                } else if manager.isReserved(agentID) {
+                        sendError(conn, fmt.Sprintf("agent %d is reserved", agentID))
+                        return
+                }
+                if manager.isDraining(agentID) {
+                        sendError(conn, fmt.Sprintf("agent %d is draining", agentID))
+                        return
+                }
+                var opts ExecOptions
+                if dir, ok := payload["working_dir"].(string); ok {
+                        opts.WorkingDir = dir
+                }
+                if raw, ok := payload["env"]; ok {
+                        env, err := parseEnv(raw)
+                        if err != nil {
+                                sendError(conn, err.Error())
+                                return
+                        }
+                        opts.Env = env
+                }
+                if isolate, ok := payload["isolate"].(bool); ok {
+                        opts.Isolate = isolate
+                }
+                if pattern, ok := payload["success_pattern"].(string); ok {
+                        opts.SuccessPattern = pattern
+                }
+                if pattern, ok := payload["failure_pattern"].(string); ok {
+                        opts.FailurePattern = pattern
+                }
+                if kill, ok := payload["kill_on_match"].(bool); ok {
+                        opts.KillOnMatch = kill
+                }
+                if ms, ok := payload["pattern_timeout_ms"].(float64); ok {
+                        opts.PatternTimeout = time.Duration(ms) * time.Millisecond
+                }
+                if ms, ok := payload["timeout_ms"].(float64); ok {
+                        opts.Timeout = time.Duration(ms) * time.Millisecond
+                }
+                if stream, ok := payload["stream"].(bool); ok {
+                        opts.Stream = stream
+                }
+                if traceID, ok := payload["trace_id"].(string); ok {
+                        opts.TraceID = traceID
+                }
+                if cacheable, ok := payload["cacheable"].(bool); ok && cacheable {
+                        opts.CacheTTL = manager.config().resultCacheTTL
+                        if ms, ok := payload["cache_ttl_ms"].(float64); ok && ms > 0 {
+                                opts.CacheTTL = time.Duration(ms) * time.Millisecond
+                        }
+                }
+                killOnDisconnect := manager.config().killOnDisconnect
+                if kill, ok := payload["kill_on_disconnect"].(bool); ok {
+                        killOnDisconnect = kill
+                }
+                if session := manager.sessionFor(conn); killOnDisconnect && session != nil {
+                        opts.Context = session.connCtx
+                }
+                if steps, ok := payload["post_process"].([]interface{}); ok {
+                        opts.PostProcess = make([]string, 0, len(steps))
+                        for _, step := range steps {
+                                if spec, ok := step.(string); ok {
+                                        opts.PostProcess = append(opts.PostProcess, spec)
+                                }
+                        }
+                }
+                go manager.ExecuteCommandWithOptions(agentID, command, opts)
+
+        case "terminate":
+                manager.GracefulTerminate("<END!>")
+
+        case "set_persistence":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                enabled, ok := payload["enabled"].(bool)
+                if !ok {
+                        sendError(conn, "set_persistence needs a boolean enabled")
+                        return
+                }
+                manager.SetPersistence(enabled)
+
+        case "set_safe_mode":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                // Like POST /admin/safe-mode, this takes the admin token and
+                // not just the API key.
+                if given, _ := payload["admin_token"].(string); !validAdminToken(given) {
+                        sendError(conn, "set_safe_mode requires a valid admin_token")
+                        return
+                }
+                enabled, ok := payload["enabled"].(bool)
+                if !ok {
+                        sendError(conn, "set_safe_mode needs a boolean enabled")
+                        return
+                }
+                manager.SetSafeMode(enabled)
+
+        case "confirm", "reject":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                token, _ := payload["token"].(string)
+                if err := manager.ResolveConfirmation(token, msg.Type == "confirm"); err != nil {
+                        sendError(conn, err.Error())
+                }
+
+        case "accept_proposal", "reject_proposal":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                token, _ := payload["token"].(string)
+                if _, err := manager.ResolveProposal(token, msg.Type == "accept_proposal"); err != nil {
+                        sendError(conn, err.Error())
+                }
+
+        case "subscribe_dashboard":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                enabled, ok := payload["enabled"].(bool)
+                if !ok {
+                        sendError(conn, "subscribe_dashboard needs a boolean enabled")
+                        return
+                }
+                manager.SetDashboardSubscription(conn, enabled)
+
+        case "subscribe_results":
+                payload, ok := payloadObject(conn, msg)
+                if !ok {
+                        return
+                }
+                var filter ResultFilter
+                minExitCode, codeOK := optionalField[float64](payload, "min_exit_code")
+                agentID, agentOK := optionalField[float64](payload, "agent_id")
+                batchID, batchOK := optionalField[string](payload, "batch_id")
+                if !codeOK || !agentOK || !batchOK {
+                        sendError(conn, "subscribe_results needs numeric min_exit_code and agent_id and a string batch_id")
+                        return
+                }
+                if _, ok := payload["min_exit_code"]; ok {
+                        code := int(minExitCode)
+                        filter.MinExitCode = &code
+                }
+                filter.AgentID = int(agentID)
+                filter.BatchID = batchID
+                if filter == (ResultFilter{}) {
+                        manager.SetResultFilter(conn, nil)
+                } else {
+                        manager.SetResultFilter(conn, &filter)
+                }
+
+        case "stop":
+                manager.Stop()
+
+        case "start", "resume":
+                if err := manager.Start(); err != nil {
+                        sendError(conn, err.Error())
+                }
+        }
+}
+
+// sendError reports a problem with a client's message back to that client.
+func sendError(conn *websocket.Conn, text string) {
+        sendMessage(conn, Message{Type: "error", Payload: map[string]string{"error": text}})
+}
+
+// payloadObject returns msg's payload as a JSON object, telling the client
+// when it is not one.
+func payloadObject(conn *websocket.Conn, msg Message) (map[string]interface{}, bool) {
+        payload, ok := msg.Payload.(map[string]interface{})
+        if !ok {
+                sendError(conn, fmt.Sprintf("%s needs an object payload", msg.Type))
+        }
+        return payload, ok
+}
+
+// optionalField returns payload[key] as a T, and false when it is present
+// but of another type.
+func optionalField[T any](payload map[string]interface{}, key string) (T, bool) {
+        raw, present := payload[key]
+        value, ok := raw.(T)
+        return value, ok || !present
+}
+
+func handleChat(chat ChatMessage) {
+        if strings.Contains(chat.Content, "<END!>") {
+                manager.GracefulTerminate("<END!>")
+                return
+        }
+
+        switch chat.Mode {
+        case "/queue":
+                parts := strings.Fields(chat.Content)
+                if len(parts) >= 1 {
+                        switch parts[0] {
+                        case "list":
+                                manager.broadcastMessage(Message{
+                                        Type:    "queue_list",
+                                        Payload: manager.GetQueueWithPositions(),
+                                })
+                        case "rm":
+                                if len(parts) >= 2 {
+                                        var id int
+                                        fmt.Sscanf(parts[1], "%d", &id)
+                                        manager.RemoveQueueItem(id)
+                                }
+                        case "add":
+                                if len(parts) < 2 {
+                                        broadcastChatError("queue add needs a JSON list of commands")
+                                        break
+                                }
+                                commands, err := parseQueueCommands(strings.Join(parts[1:], " "))
+                                if err != nil {
+                                        broadcastChatError(err.Error())
+                                        break
+                                }
+                                if result := manager.AddToQueue(commands, nil); len(result.Failed) > 0 {
+                                        broadcastChatError(fmt.Sprintf("%d of %d commands could not be queued: %v",
+                                                len(result.Failed), len(commands), result.Failed))
+                                }
+                        case "clear":
+                                manager.queueLock.Lock()
+                                for _, item := range manager.queue {
+                                        manager.deleteQueueItemFromDB(item.ID)
+                                }
+                                manager.queue = make([]QueueItem, 0)
+                                manager.queueLock.Unlock()
+                                manager.broadcastMessage(Message{
+                                        Type:    "queue_updated",
+                                        Payload: manager.queue,
+                                })
+                        }
+                }
+        case "/chat":
+                manager.broadcastMessage(Message{
+                        Type: "chat_message",
+                        Payload: map[string]string{
+                                "user":    chat.User,
+                                "content": chat.Content,
+                        },
+                })
+                if manager.apiKey == "" {
+                        broadcastChatError("AI chat is disabled, set OPENROUTER_API_KEY")
+                        return
+                }
+                // The reply can take a while; the connection keeps reading.
+                go manager.replyToChat(chat.Content)
+        case "/ai":
+                manager.broadcastMessage(Message{
+                        Type: "chat_message",
+                        Payload: map[string]string{
+                                "user":    chat.User,
+                                "content": chat.Content,
+                        },
+                })
+                if manager.apiKey == "" {
+                        broadcastChatError("AI chat is disabled, set OPENROUTER_API_KEY")
+                        return
+                }
+                go manager.proposeQueue(chat.Content)
+        }
+}
+
+const (
+        openRouterURL    = "https://openrouter.ai/api/v1/chat/completions"
+        defaultChatModel = "openai/gpt-3.5-turbo"
+)
+
+// chatCompletion sends messages to OPENROUTER_MODEL and returns the text of
+// its first choice. The request gives up after OPENROUTER_TIMEOUT_MS.
+func (am *AgentManager) chatCompletion(messages []map[string]string) (string, error) {
+        model := am.chatModel
+        if model == "" {
+                model = defaultChatModel
+        }
+        body, err := json.Marshal(map[string]interface{}{
+                "model":    model,
+                "messages": messages,
+        })
+        if err != nil {
+                return "", err
+        }
+
+        req, err := http.NewRequest("POST", openRouterURL, bytes.NewReader(body))
+        if err != nil {
+                return "", err
+        }
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set("Authorization", "Bearer "+am.apiKey)
+        req.Header.Set("X-Title", "AxShell")
+
+        resp, err := am.chatClient.Do(req)
+        if err != nil {
+                log.Printf("Error calling OpenRouter: %v", err)
+                return "", err
+        }
+        defer resp.Body.Close()
+
+        var reply struct {
+                Choices []struct {
+                        Message struct {
+                                Content string `json:"content"`
+                        } `json:"message"`
+                } `json:"choices"`
+                Error *struct {
+                        Message string `json:"message"`
+                } `json:"error"`
+        }
+        decodeErr := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&reply)
+        switch {
+        case reply.Error != nil:
+                return "", fmt.Errorf("%s: %s", resp.Status, reply.Error.Message)
+        case resp.StatusCode >= 300:
+                return "", fmt.Errorf("%s", resp.Status)
+        case decodeErr != nil:
+                return "", fmt.Errorf("unreadable response: %v", decodeErr)
+        case len(reply.Choices) == 0:
+                return "", fmt.Errorf("response contained no reply")
+        }
+        return reply.Choices[0].Message.Content, nil
+}
+
+// replyToChat asks OPENROUTER_MODEL to answer content and broadcasts the
+// reply as an assistant chat_message, or an error chat message when the
+// request fails or exceeds OPENROUTER_TIMEOUT_MS.
+func (am *AgentManager) replyToChat(content string) {
+        reply, err := am.chatCompletion([]map[string]string{
+                {"role": "user", "content": content},
+        })
+        if err != nil {
+                broadcastChatError(fmt.Sprintf("AI request failed: %v", err))
+                return
+        }
+
+        am.broadcastMessage(Message{
+                Type: "chat_message",
+                Payload: map[string]string{
+                        "user":    "assistant",
+                        "content": reply,
+                        "model":   cmp.Or(am.chatModel, defaultChatModel),
+                },
+        })
+}
+
+// queueProposalPrompt tells the model to answer /ai requests with nothing
+// but a queue map.
+const queueProposalPrompt = `You turn task descriptions into shell commands for a command queue.
+Reply with a single JSON object and nothing else. Its keys are "1", "2", ... in execution order
+and its values are commands, each prefixed with "RUN ", for example:
+{"1":"RUN find /var/log -mtime +7 -delete","2":"RUN systemctl restart nginx"}`
+
+// QueueProposal is a set of commands the model suggested for an /ai
+// request, held until someone accepts or rejects it.
+type QueueProposal struct {
+        Token     string            `json:"token"`
+        Prompt    string            `json:"prompt"`
+        Commands  map[string]string `json:"commands"`
+        ExpiresAt string            `json:"expires_at"`
+}
+
+// proposeQueue asks the model for the commands that carry out task and
+// broadcasts them as a queue_proposal. Nothing is queued until the proposal
+// is accepted; one left alone lapses after CONFIRM_TIMEOUT.
+func (am *AgentManager) proposeQueue(task string) {
+        reply, err := am.chatCompletion([]map[string]string{
+                {"role": "system", "content": queueProposalPrompt},
+                {"role": "user", "content": task},
+        })
+        if err != nil {
+                broadcastChatError(fmt.Sprintf("AI request failed: %v", err))
+                return
+        }
+
+        commands, err := parseProposedCommands(reply)
+        if err != nil {
+                broadcastChatError(fmt.Sprintf("AI did not propose usable commands: %v", err))
+                return
+        }
+
+        ttl := am.config().confirmTimeout
+        proposal := &QueueProposal{
+                Token:     newSessionToken(),
+                Prompt:    task,
+                Commands:  commands,
+                ExpiresAt: time.Now().Add(ttl).Format(time.RFC3339),
+        }
+        am.proposals.Store(proposal.Token, proposal)
+        time.AfterFunc(ttl, func() {
+                if _, ok := am.proposals.LoadAndDelete(proposal.Token); ok {
+                        am.broadcastMessage(Message{
+                                Type:    "queue_proposal_resolved",
+                                Payload: map[string]interface{}{"token": proposal.Token, "outcome": "expired"},
+                        })
+                }
+        })
+
+        am.broadcastMessage(Message{
+                Type:    "queue_proposal",
+                Payload: proposal,
+        })
+}
+
+// parseProposedCommands accepts a model reply only if it is a JSON object of
+// strings numbered like a /queue add map. A surrounding Markdown code fence
+// is tolerated.
+func parseProposedCommands(reply string) (map[string]string, error) {
+        reply = strings.TrimSpace(reply)
+        if strings.HasPrefix(reply, "```") {
+                reply = strings.TrimPrefix(reply, "```json")
+                reply = strings.TrimPrefix(reply, "```")
+                reply = strings.TrimSuffix(strings.TrimSpace(reply), "```")
+        }
+
+        var commands map[string]string
+        if err := json.Unmarshal([]byte(reply), &commands); err != nil {
+                return nil, fmt.Errorf("reply is not a JSON map of commands: %v", err)
+        }
+        return parseQueueCommands(reply)
+}
+
+var errProposalNotFound = errors.New("no queue proposal has this token")
+
+// ResolveProposal queues the commands of an accepted proposal or drops a
+// rejected one.
+func (am *AgentManager) ResolveProposal(token string, accept bool) (QueueAddResult, error) {
+        value, ok := am.proposals.LoadAndDelete(token)
+        if !ok {
+                return QueueAddResult{}, errProposalNotFound
+        }
+        proposal := value.(*QueueProposal)
+
+        outcome := map[string]interface{}{"token": token, "outcome": "rejected"}
+        var result QueueAddResult
+        if accept {
+                result = am.AddToQueue(proposal.Commands, nil)
+                outcome["outcome"] = "accepted"
+                outcome["batch_id"] = result.BatchID
+                outcome["failed"] = result.Failed
+        }
+        am.broadcastMessage(Message{
+                Type:    "queue_proposal_resolved",
+                Payload: outcome,
+        })
+        return result, nil
+}
+
+const queueAddUsage = `expected a JSON object or array, e.g. {"1":"RUN ls","2":"RUN pwd"} or ["RUN ls","RUN pwd"]`
+
+// parseQueueCommands accepts either the numbered-key object used by
+// AddToQueue or a plain array, which is converted to numbered keys.
+func parseQueueCommands(jsonStr string) (map[string]string, error) {
+        var commands map[string]string
+        if err := json.Unmarshal([]byte(jsonStr), &commands); err == nil {
+                if len(commands) == 0 {
+                        return nil, fmt.Errorf("no commands given: %s", queueAddUsage)
+                }
+                for i := 1; i <= len(commands); i++ {
+                        if _, ok := commands[strconv.Itoa(i)]; !ok {
+                                return nil, fmt.Errorf("keys must be numbered 1..%d without gaps: %s", len(commands), queueAddUsage)
+                        }
+                }
+                return commands, nil
+        }
+
+        var list []string
+        if err := json.Unmarshal([]byte(jsonStr), &list); err != nil {
+                return nil, fmt.Errorf("invalid JSON (%v): %s", err, queueAddUsage)
+        }
+        if len(list) == 0 {
+                return nil, fmt.Errorf("no commands given: %s", queueAddUsage)
+        }
+
+        commands = make(map[string]string, len(list))
+        for i, cmd := range list {
+                commands[strconv.Itoa(i+1)] = cmd
+        }
+        return commands, nil
+}
+
+func broadcastChatError(text string) {
+        manager.broadcastMessage(Message{
+                Type: "chat_message",
+                Payload: map[string]string{
+                        "user":    "system",
+                        "content": "Error: " + text,
+                        "level":   "error",
+                },
+        })
+}
+
+// ConfigSetting is one setting as reported by GET /config/effective. Source
+// is "runtime" when changed since startup, "db" when taken from the config
+// table, "env" when taken from the environment (or .env) and "default"
+// otherwise, in that order of precedence.
+type ConfigSetting struct {
+        Key    string      `json:"key"`
+        Value  interface{} `json:"value"`
+        Source string      `json:"source"`
+}
+
+// secretConfigKeys are reported as set or unset, never by value.
+var secretConfigKeys = map[string]bool{
+        "OPENROUTER_API_KEY":         true,
+        "ADMIN_TOKEN":                true,
+        "BACKEND_API_KEY":            true,
+        "DATABASE_URL":               true,
+        "LOGS_DATABASE_URL":          true,
+        "OTEL_EXPORTER_OTLP_HEADERS": true,
+}
+
+// EffectiveConfig lists the settings in effect, with values as the manager
+// actually uses them (after parsing and fallbacks) rather than as written.
+func (am *AgentManager) EffectiveConfig() []ConfigSetting {
+        var settings []ConfigSetting
+        add := func(key string, value interface{}) {
+                source := "default"
+                if _, ok := am.runtimeConfig.Load(key); ok {
+                        source = "runtime"
+                } else if am.fromConfigTable(key) {
+                        source = "db"
+                } else if os.Getenv(key) != "" {
+                        source = "env"
+                }
+                if secretConfigKeys[key] {
+                        value = os.Getenv(key) != ""
+                }
+                settings = append(settings, ConfigSetting{Key: key, Value: value, Source: source})
+        }
+
+        concurrencyLimit, _ := am.execLimiter.Stats()
+        historySize := 0
+        if am.commandHistory != nil {
+                historySize = am.commandHistory.size
+        }
+        port := os.Getenv("BACKEND_PORT")
+        if port == "" {
+                port = "8080"
+        }
+
+        add("BACKEND_PORT", port)
+        add("GRPC_PORT", os.Getenv("GRPC_PORT"))
+        add("AI_LOG_DIR", am.logDir)
+        add("OPENROUTER_API_KEY", nil)
+        add("OPENROUTER_MODEL", cmp.Or(am.chatModel, defaultChatModel))
+        add("OPENROUTER_TIMEOUT_MS", am.chatClient.Timeout.Milliseconds())
+        add("ADMIN_TOKEN", nil)
+        add("BACKEND_API_KEY", nil)
+        add("AUTH_DISABLED", os.Getenv("AUTH_DISABLED") == "true")
+        add("DATABASE_URL", nil)
+        add("LOGS_DATABASE_URL", nil)
+        add("DB_MAX_OPEN_CONNS", am.dbPool.maxOpen)
+        add("DB_MAX_IDLE_CONNS", am.dbPool.maxIdle)
+        add("DB_CONN_MAX_LIFETIME", am.dbPool.maxLifetime.String())
+        add("DB_CONN_MAX_IDLE_TIME", am.dbPool.maxIdleTime.String())
+        add("DB_RECONNECT_INTERVAL", am.dbPool.checkInterval.String())
+        add("OUTPUT_ENCRYPTION_KEY", nil)
+        add("REQUIRE_DB", os.Getenv("REQUIRE_DB") == "true")
+        add("REQUIRE_AI", os.Getenv("REQUIRE_AI") == "true")
+        add("EPHEMERAL", am.ephemeral.Load())
+        add("SAFE_MODE", am.safeMode.Load())
+        add("AGENTS_CONFIG", os.Getenv("AGENTS_CONFIG"))
+        add("AGENTS_CONFIG_PRUNE", os.Getenv("AGENTS_CONFIG_PRUNE") == "true")
+        add("MAX_WS_CLIENTS", am.maxClients)
+        add("CLIENT_SEND_BUFFER", am.clientBuffer)
+        add("WS_RECONNECT_GRACE_MS", am.reconnectGrace.Milliseconds())
+        add("WS_WRITE_TIMEOUT_MS", am.config().writeTimeout.Milliseconds())
+        add("OUTPUT_FLUSH_INTERVAL_MS", am.outputFlushInterval.Milliseconds())
+        add("SHUTDOWN_GRACE_PERIOD", am.shutdownGrace.String())
+        add("OUTPUT_POSTPROCESSORS", os.Getenv("OUTPUT_POSTPROCESSORS"))
+        add("KEEP_RAW_OUTPUT", am.config().keepRawOutput)
+        add("AGENT_LEASE_TTL_SECONDS", int(am.leaseTTL.Seconds()))
+        add("LOG_FILE_MAX_MB", am.logFileMaxBytes/1024/1024)
+        add("LOG_FILE_MAX_ROTATIONS", am.logFileMaxRotations)
+        add("LOG_AGENT_TRANSITIONS", am.config().logAgentTransitions)
+        add("MAX_COMMAND_LENGTH", am.config().maxCommandLength)
+        add("MIN_IDLE_AGENTS", am.config().minIdleAgents)
+        add("KILL_ON_DISCONNECT", am.config().killOnDisconnect)
+        add("ALLOWED_ORIGINS", am.config().allowedOrigins)
+        add("ALLOWED_WORKDIRS", am.config().allowedWorkDirs)
+        add("ISOLATE_COMMANDS", am.isolateCommands)
+        add("PROCESS_GROUPS", am.processGroups)
+        add("DEFAULT_COMMAND_TIMEOUT_MS", am.config().commandTimeout.Milliseconds())
+        add("PRECHECK_TIMEOUT_MS", am.config().preCheckTimeout.Milliseconds())
+        add("FANOUT_MAX_PARALLEL", am.config().fanOutParallel)
+        add("MAX_CONCURRENT_COMMANDS", concurrencyLimit)
+        add("CONCURRENCY_CPU_FACTOR", am.config().concurrencyFactor)
+        add("DURATION_WINDOW_SECONDS", getEnvInt("DURATION_WINDOW_SECONDS", 0))
+        add("COMMAND_HISTORY_SIZE", historySize)
+        add("COMMAND_HISTORY_KEEP_OUTPUT", am.commandHistory != nil && am.commandHistory.keepOutput)
+        add("COMMAND_DIFF_MAX_BYTES", am.config().commandDiffMaxBytes)
+        add("RESULT_CACHE_TTL", am.config().resultCacheTTL.String())
+        add("QUIET_HOURS", os.Getenv("QUIET_HOURS"))
+        add("QUIET_HOURS_DAYS", os.Getenv("QUIET_HOURS_DAYS"))
+        add("QUIET_HOURS_TZ", os.Getenv("QUIET_HOURS_TZ"))
+        add("QUIET_HOURS_MIN_PRIORITY", getEnvInt("QUIET_HOURS_MIN_PRIORITY", 1))
+        add("CHANGE_FEED_SIZE", getEnvInt("CHANGE_FEED_SIZE", 1000))
+        add("CHANGE_FEED_PERSIST", am.changeFeedPersist)
+        add("WEIGHTED_DISPATCH_MAX_WAIT_MS", am.config().weightMaxWait.Milliseconds())
+        add("PENDING_TTL", am.config().pendingTTL.String())
+        add("PENDING_EXPIRY_WEBHOOK", am.config().expiryWebhook)
+        add("QUARANTINE_THRESHOLD", am.config().quarantineThreshold)
+        add("QUARANTINE_WINDOW", am.config().quarantineWindow.String())
+        add("LOG_RETENTION_DAYS", int(am.config().logRetention.Hours()/24))
+        add("METRICS_RETENTION_DAYS", int(am.config().metricsRetention.Hours()/24))
+        add("LOG_RETENTION_INTERVAL", am.config().retentionInterval.String())
+        add("QUARANTINE_WEBHOOK", am.config().quarantineWebhook)
+        add("QUEUE_KEEP_TERMINAL", am.config().keepTerminal)
+        add("MAX_FAILOVERS", am.config().maxFailovers)
+        add("QUEUE_MAX_RETRIES", am.config().maxRetries)
+        add("RETRY_BACKOFF_BASE", am.config().retryBackoffBase.String())
+        add("RETRY_BACKOFF_MAX", am.config().retryBackoffMax.String())
+        add("DANGEROUS_PATTERNS", os.Getenv("DANGEROUS_PATTERNS"))
+        add("COMMAND_DENYLIST", os.Getenv("COMMAND_DENYLIST"))
+        add("COMMAND_ALLOWLIST", os.Getenv("COMMAND_ALLOWLIST"))
+        add("COMMAND_POLICY_FILE", os.Getenv("COMMAND_POLICY_FILE"))
+        add("REQUIRE_RUN_PREFIX", am.config().runPrefixMode)
+        add("PROBE_REQUIRED_BINARIES", strings.Join(am.config().probeBinaries, ","))
+        add("CONFIRM_TIMEOUT", am.config().confirmTimeout.String())
+        add("AGENT_METRICS_INTERVAL", am.config().agentMetricsInterval.String())
+        add("MONITOR_SAMPLE_INTERVAL", am.config().monitorSampleInterval.String())
+        add("MONITOR_PERSIST_INTERVAL", am.config().monitorPersistInterval.String())
+        add("MONITOR_BROADCAST_INTERVAL", am.config().monitorBroadcastInterval.String())
+        add("MONITOR_JITTER", am.config().monitorJitter.String())
+        add("OTEL_EXPORTER_OTLP_ENDPOINT", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+        add("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"))
+        add("OTEL_EXPORTER_OTLP_HEADERS", nil)
+        add("OTEL_SERVICE_NAME", os.Getenv("OTEL_SERVICE_NAME"))
+        add("MEMORY_PRESSURE_MB", am.config().memoryLimitMB)
+        add("MEMORY_PRESSURE_GC", am.config().memoryPressureGC)
+        add("LOG_SINK_URL", os.Getenv("LOG_SINK_URL"))
+        add("LOG_SINK_BUFFER", getEnvInt("LOG_SINK_BUFFER", 1000))
+        return settings
+}
+
+func handleConfigEffective(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "GET" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+        json.NewEncoder(w).Encode(manager.EffectiveConfig())
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "status":            "ok",
+                "agents":            len(manager.agents),
+                "queue":             len(manager.queue),
+                "resources":         manager.GetResourceUsage(),
+                "terminated":        manager.terminated.Load(),
+                "running":           manager.running.Load(),
+                "safe_mode":         manager.safeMode.Load(),
+                "db_connected":      manager.db() != nil,
+                "logs_db_connected": manager.logsDB() != nil,
+                "database":          dbHealth(manager.db(), manager.hotUp.Load()),
+                "logs_database":     dbHealth(manager.logsDB(), manager.coldUp.Load()),
+                "quiet_hours":       manager.config().quietHours.Active(time.Now()),
+                "persistence":       manager.persistenceEnabled(),
+                "clients":           manager.ClientCount(),
+                "max_clients":       manager.maxClients,
+        })
+}
+
+func handleAgents(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        switch r.Method {
+        case "GET":
+                json.NewEncoder(w).Encode(manager.GetAgents())
+        case "POST":
+                var data struct {
+                        Name   string `json:"name"`
+                        Weight int    `json:"weight"`
+                        Group  string `json:"group"`
+                }
+                if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+                        writeError(w, r, http.StatusBadRequest, "Invalid request body")
+                        return
+                }
+                if _, ok := manager.GetGroup(data.Group); data.Group != "" && !ok {
+                        writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown agent group %q", data.Group))
+                        return
+                }
+                agent := manager.AddAgentWithSpec(AgentSpec{Name: data.Name, Weight: data.Weight, Group: data.Group})
+                if agent != nil {
+                        manager.StartAgentLoop(agent.ID)
+                        json.NewEncoder(w).Encode(agent)
+                } else {
+                        writeError(w, r, http.StatusBadRequest, "Max agents reached")
+                }
+        default:
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+        }
+}
+
+func handleGroups(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        switch r.Method {
+        case "GET":
+                json.NewEncoder(w).Encode(manager.GetGroups())
+        case "POST":
+                var group AgentGroup
+                if err := json.NewDecoder(r.Body).Decode(&group); err != nil || group.Name == "" {
+                        writeError(w, r, http.StatusBadRequest, "Body must be a group with a name")
+                        return
+                }
+                if _, err := manager.SaveGroup(group, false); err != nil {
+                        writeGroupError(w, r, err)
+                        return
+                }
+                w.WriteHeader(http.StatusCreated)
+                json.NewEncoder(w).Encode(group)
+        default:
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+        }
+}
+
+func handleGroup(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        name := r.PathValue("name")
+        switch r.Method {
+        case "GET":
+                group, ok := manager.GetGroup(name)
+                if !ok {
+                        writeGroupError(w, r, errGroupNotFound)
+                        return
+                }
+                json.NewEncoder(w).Encode(group)
+        case "PUT":
+                var group AgentGroup
+                if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+                        writeError(w, r, http.StatusBadRequest, "Invalid request body")
+                        return
+                }
+                group.Name = name
+                updated, err := manager.SaveGroup(group, true)
+                if err != nil {
+                        writeGroupError(w, r, err)
+                        return
+                }
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                        "group":          group,
+                        "agents_updated": updated,
+                })
+        case "DELETE":
+                if err := manager.DeleteGroup(name); err != nil {
+                        writeGroupError(w, r, err)
+                        return
+                }
+                json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+        default:
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+        }
+}
+
+func writeGroupError(w http.ResponseWriter, r *http.Request, err error) {
+        switch {
+        case errors.Is(err, errGroupNotFound):
+                writeError(w, r, http.StatusNotFound, err.Error())
+        case errors.Is(err, errGroupExists), errors.Is(err, errGroupInUse):
+                writeError(w, r, http.StatusConflict, err.Error())
+        default:
+                writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to save group: %v", err))
+        }
+}
+
+func handleAgentReserve(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        id, err := strconv.Atoi(r.PathValue("id"))
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid agent id")
+                return
+        }
+
+        var data struct {
+                TTLSeconds int `json:"ttl_seconds"`
+        }
+        json.NewDecoder(r.Body).Decode(&data)
+
+        lease, err := manager.ReserveAgent(id, time.Duration(data.TTLSeconds)*time.Second)
+        if err != nil {
+                writeError(w, r, http.StatusConflict, err.Error())
+                return
+        }
+        json.NewEncoder(w).Encode(lease)
+}
+
+func handleAgentPause(paused bool) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Content-Type", "application/json")
+
+                if r.Method != "POST" {
+                        writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                        return
+                }
+
+                id, err := strconv.Atoi(r.PathValue("id"))
+                if err != nil {
+                        writeError(w, r, http.StatusBadRequest, "Invalid agent id")
+                        return
+                }
+
+                agent, err := manager.SetAgentPaused(id, paused)
+                if err != nil {
+                        writeError(w, r, http.StatusNotFound, err.Error())
+                        return
+                }
+                json.NewEncoder(w).Encode(agent)
+        }
+}
+
+func handleAgentDrain(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        id, err := strconv.Atoi(r.PathValue("id"))
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid agent id")
+                return
+        }
+
+        agent, err := manager.DrainAgent(id)
+        if err != nil {
+                writeError(w, r, http.StatusNotFound, err.Error())
+                return
+        }
+        json.NewEncoder(w).Encode(agent)
+}
+
+func handleAgentProbe(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        id, err := strconv.Atoi(r.PathValue("id"))
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid agent id")
+                return
+        }
+
+        var data struct {
+                Binaries []string `json:"binaries"`
+        }
+        json.NewDecoder(r.Body).Decode(&data)
+
+        probe, err := manager.ProbeAgent(id, data.Binaries)
+        if err != nil {
+                writeError(w, r, http.StatusNotFound, err.Error())
+                return
+        }
+        json.NewEncoder(w).Encode(probe)
+}
+
+func handleAgentConcurrency(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        id, err := strconv.Atoi(r.PathValue("id"))
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid agent id")
+                return
+        }
+
+        var data struct {
+                MaxConcurrent *int `json:"max_concurrent"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.MaxConcurrent == nil {
+                writeError(w, r, http.StatusBadRequest, "Body must contain max_concurrent")
+                return
+        }
+
+        agent, err := manager.SetAgentMaxConcurrent(id, *data.MaxConcurrent)
+        if errors.Is(err, errAgentNotFound) {
+                writeError(w, r, http.StatusNotFound, err.Error())
+                return
+        }
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, err.Error())
+                return
+        }
+        json.NewEncoder(w).Encode(agent)
+}
+
+func handleAgentFIFO(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        id, err := strconv.Atoi(r.PathValue("id"))
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid agent id")
+                return
+        }
+
+        var data struct {
+                FIFO *bool `json:"fifo"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.FIFO == nil {
+                writeError(w, r, http.StatusBadRequest, "Body must contain fifo")
+                return
+        }
+
+        agent, err := manager.SetAgentFIFO(id, *data.FIFO)
+        if err != nil {
+                writeError(w, r, http.StatusNotFound, err.Error())
+                return
+        }
+        json.NewEncoder(w).Encode(agent)
+}
+
+func handleAgentRelease(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        id, err := strconv.Atoi(r.PathValue("id"))
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid agent id")
+                return
+        }
+
+        var data struct {
+                Token string `json:"token"`
+        }
+        json.NewDecoder(r.Body).Decode(&data)
+
+        if err := manager.ReleaseAgent(id, data.Token); err != nil {
+                writeError(w, r, http.StatusNotFound, err.Error())
+                return
+        }
+        json.NewEncoder(w).Encode(map[string]string{"status": "released"})
+}
+
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        switch r.Method {
+        case "GET":
+                json.NewEncoder(w).Encode(manager.GetQueueWithPositions())
+        case "POST":
+                var payload map[string]any
+                if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+                        writeError(w, r, http.StatusBadRequest, "Invalid request body")
+                        return
+                }
+                commands, entries, err := parseQueueEntries(payload)
+                if err != nil {
+                        writeError(w, r, http.StatusBadRequest, err.Error())
+                        return
+                }
+                result := manager.AddToQueue(commands, entries)
+                if result.Status == "failed" && len(result.Failed) > 0 {
+                        w.WriteHeader(http.StatusInternalServerError)
+                }
+                json.NewEncoder(w).Encode(result)
+        case "DELETE":
+                var data map[string]int
+                if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+                        writeError(w, r, http.StatusBadRequest, "Invalid request body")
+                        return
+                }
+                var removed bool
+                if id, ok := data["id"]; ok {
+                        removed = manager.RemoveQueueItem(id)
+                } else {
+                        // Deprecated: removal by index, kept for older clients.
+                        removed = manager.RemoveFromQueue(data["index"])
+                }
+                if !removed {
+                        writeError(w, r, http.StatusNotFound, "Queue item not found")
+                        return
+                }
+                json.NewEncoder(w).Encode(map[string]string{"status": "removed"})
+        default:
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+        }
+}
+
+func handleQueueItem(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "PATCH" && r.Method != "DELETE" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        id, err := strconv.Atoi(r.PathValue("id"))
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid queue item id")
+                return
+        }
+
+        if r.Method == "DELETE" {
+                if !manager.RemoveQueueItem(id) {
+                        writeError(w, r, http.StatusNotFound, "Queue item not found")
+                        return
+                }
+                json.NewEncoder(w).Encode(map[string]string{"status": "removed"})
+                return
+        }
+
+        var data struct {
+                Annotations *string `json:"annotations"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Annotations == nil {
+                writeError(w, r, http.StatusBadRequest, "Body must contain annotations")
+                return
+        }
+
+        // Every client shares BACKEND_API_KEY, which so names nobody; the
+        // edit is attributed to the X-Client-Name the client sends, or else
+        // to its address.
+        by := strings.TrimSpace(r.Header.Get("X-Client-Name"))
+        if by == "" {
+                by, _, _ = net.SplitHostPort(r.RemoteAddr)
+        }
+        item, err := manager.AnnotateQueueItem(id, *data.Annotations, by)
+        if err != nil {
+                if errors.Is(err, errQueueItemNotFound) {
+                        writeError(w, r, http.StatusNotFound, err.Error())
+                } else {
+                        writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to update queue item: %v", err))
+                }
+                return
+        }
+
+        json.NewEncoder(w).Encode(item)
+}
+
+// handleQueueItemResult serves GET /queue/{id}/result: 200 once the item is
+// done, 202 with its current status while it is not.
+func handleQueueItemResult(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "GET" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        id, err := strconv.Atoi(r.PathValue("id"))
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid queue item id")
+                return
+        }
+
+        result, err := manager.GetQueueItemResult(id)
+        switch {
+        case errors.Is(err, errQueueItemNotFound):
+                writeError(w, r, http.StatusNotFound, err.Error())
+                return
+        case err != nil:
+                writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to load queue item result: %v", err))
+                return
+        }
+        if !result.Done {
+                w.WriteHeader(http.StatusAccepted)
+        }
+        json.NewEncoder(w).Encode(result)
+}
+
+// handleCommandCancel kills the command running on agent_id, or the run of
+// the queue item given by queue_id (or its queue_index).
+func handleCommandCancel(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        var data struct {
+                AgentID    int `json:"agent_id"`
+                QueueID    int `json:"queue_id"`
+                QueueIndex int `json:"queue_index"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid request body")
+                return
+        }
+        key := 0
+        if data.QueueID > 0 || data.QueueIndex > 0 {
+                if key = manager.cancelKey(data.QueueID, data.QueueIndex); key == 0 {
+                        writeError(w, r, http.StatusNotFound, errQueueItemNotFound.Error())
+                        return
+                }
+        }
+        if (data.AgentID > 0) == (key > 0) {
+                writeError(w, r, http.StatusBadRequest, "Body must contain either agent_id or queue_id")
+                return
+        }
+
+        cancelled, err := manager.CancelCommand(data.AgentID, key)
+        if err != nil {
+                writeError(w, r, http.StatusNotFound, err.Error())
+                return
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"cancelled": cancelled})
+}
+
+// handleQueueItemExpedite serves POST /queue/{id}/expedite, moving a pending
+// item to the front of the queue.
+func handleQueueItemExpedite(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        id, err := strconv.Atoi(r.PathValue("id"))
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid queue item id")
+                return
+        }
+
+        item, err := manager.ExpediteQueueItem(id)
+        switch {
+        case errors.Is(err, errQueueItemNotFound):
+                writeError(w, r, http.StatusNotFound, err.Error())
+        case errors.Is(err, errQueueItemState):
+                writeError(w, r, http.StatusConflict, err.Error())
+        case err != nil:
+                writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to expedite queue item: %v", err))
+        default:
+                json.NewEncoder(w).Encode(item)
+        }
+}
+
+// handleQueueItemSchedule sets or clears when a pending item runs, from a
+// body with run_at (RFC 3339) or delay_ms; an empty body clears it.
+func handleQueueItemSchedule(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        id, err := strconv.Atoi(r.PathValue("id"))
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid queue item id")
+                return
+        }
+        var payload map[string]any
+        if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && err != io.EOF {
+                writeError(w, r, http.StatusBadRequest, "Invalid request body")
+                return
+        }
+        runAt, err := parseSchedule(payload)
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, err.Error())
+                return
+        }
+
+        item, err := manager.ScheduleQueueItem(id, runAt)
+        switch {
+        case errors.Is(err, errQueueItemNotFound):
+                writeError(w, r, http.StatusNotFound, err.Error())
+        case errors.Is(err, errQueueItemState):
+                writeError(w, r, http.StatusConflict, err.Error())
+        case err != nil:
+                writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to schedule queue item: %v", err))
+        default:
+                json.NewEncoder(w).Encode(item)
+        }
+}
+
+// handleQueueItemDisable serves POST /queue/{id}/disable and
+// /queue/{id}/enable.
+func handleQueueItemDisable(disabled bool) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Content-Type", "application/json")
+
+                if r.Method != "POST" {
+                        writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                        return
+                }
+
+                id, err := strconv.Atoi(r.PathValue("id"))
+                if err != nil {
+                        writeError(w, r, http.StatusBadRequest, "Invalid queue item id")
+                        return
+                }
+
+                item, err := manager.SetQueueItemDisabled(id, disabled)
+                switch {
+                case errors.Is(err, errQueueItemNotFound):
+                        writeError(w, r, http.StatusNotFound, err.Error())
+                case errors.Is(err, errQueueItemState):
+                        writeError(w, r, http.StatusConflict, err.Error())
+                case err != nil:
+                        writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to update queue item: %v", err))
+                default:
+                        json.NewEncoder(w).Encode(item)
+                }
+        }
+}
+
+func handleQuarantine(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "GET" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+        json.NewEncoder(w).Encode(manager.Quarantined())
+}
+
+func handleQuarantineRelease(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        entry, err := manager.ReleaseQuarantine(r.PathValue("hash"))
+        if errors.Is(err, errQuarantineNotFound) {
+                writeError(w, r, http.StatusNotFound, err.Error())
+                return
+        }
+        json.NewEncoder(w).Encode(entry)
+}
+
+func handleConfirmations(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "GET" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
         }
+        json.NewEncoder(w).Encode(manager.PendingConfirmations())
 }
 
-func (am *AgentManager) ExecuteCommand(agentID int, command string) CommandResult {
-        if am.terminated {
-                return CommandResult{
-                        AgentID: agentID,
-                        Command: command,
-                        Error:   "System terminated by <END!> signal",
-                }
+func handleConfirmation(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
         }
 
-        am.agentLock.Lock()
-        agent, exists := am.agents[agentID]
-        if exists {
-                agent.Status = "running"
-                agent.CurrentTask = command
-                agent.LastExecute = time.Now()
-                am.saveAgentToDB(agent)
+        var data struct {
+                Confirm *bool `json:"confirm"`
         }
-        am.agentLock.Unlock()
+        if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Confirm == nil {
+                writeError(w, r, http.StatusBadRequest, "Body must contain confirm")
+                return
+        }
+        if err := manager.ResolveConfirmation(r.PathValue("token"), *data.Confirm); err != nil {
+                writeError(w, r, http.StatusNotFound, err.Error())
+                return
+        }
+        json.NewEncoder(w).Encode(map[string]bool{"confirmed": *data.Confirm})
+}
 
-        am.broadcastMessage(Message{
-                Type:    "agent_status",
-                Payload: agent,
-        })
+func handleCommandHistory(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-        startTime := time.Now()
-        result := CommandResult{
-                AgentID:   agentID,
-                Command:   command,
-                Timestamp: time.Now().Format(time.RFC3339),
+        if r.Method != "GET" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
         }
 
-        actualCommand, valid := am.validateCommand(command)
-        if !valid {
-                result.Error = "Invalid command format. Commands must use: RUN <command>"
-                result.ExitCode = 1
+        limit := 50
+        if l := r.URL.Query().Get("limit"); l != "" {
+                fmt.Sscanf(l, "%d", &limit)
+        }
 
-                am.saveLogToDB(&LogEntry{
-                        AgentID:  agentID,
-                        Level:    "error",
-                        Message:  "Rejected: Invalid or blocked command format",
-                        Command:  command,
-                        ExitCode: 1,
-                })
+        runs := manager.GetCommandHistory(r.PathValue("hash"), limit)
+        if runs == nil {
+                runs = []CommandRun{}
+        }
+        json.NewEncoder(w).Encode(runs)
+}
 
-                am.agentLock.Lock()
-                if exists {
-                        agent.Status = "idle"
-                        agent.TasksFailed++
-                        am.saveAgentToDB(agent)
+func handleChanges(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "GET" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        var since int64
+        if v := r.URL.Query().Get("since"); v != "" {
+                parsed, err := strconv.ParseInt(v, 10, 64)
+                if err != nil || parsed < 0 {
+                        writeError(w, r, http.StatusBadRequest, "since must be a non-negative cursor")
+                        return
                 }
-                am.agentLock.Unlock()
+                since = parsed
+        }
 
-                am.broadcastMessage(Message{
-                        Type:    "command_rejected",
-                        Payload: result,
-                })
+        limit := 500
+        if l := r.URL.Query().Get("limit"); l != "" {
+                fmt.Sscanf(l, "%d", &limit)
+        }
+        if limit <= 0 || limit > 5000 {
+                limit = 5000
+        }
 
-                return result
+        json.NewEncoder(w).Encode(manager.GetChanges(since, limit))
+}
+
+func handleQueueExport(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "GET" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
         }
 
-        var cmd *exec.Cmd
-        if runtime.GOOS == "windows" {
-                cmd = exec.Command("cmd", "/C", actualCommand)
-        } else {
-                cmd = exec.Command("sh", "-c", actualCommand)
+        includeCompleted := r.URL.Query().Get("include_completed") == "true"
+        json.NewEncoder(w).Encode(manager.ExportQueue(includeCompleted))
+}
+
+func handleQueueImport(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
         }
 
-        output, err := cmd.CombinedOutput()
-        result.Output = string(output)
-        result.Duration = time.Since(startTime).Milliseconds()
+        var data QueueExport
+        if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid export payload")
+                return
+        }
 
+        idMap, err := manager.ImportQueue(data.Items)
         if err != nil {
-                result.Error = err.Error()
-                if exitErr, ok := err.(*exec.ExitError); ok {
-                        result.ExitCode = exitErr.ExitCode()
-                } else {
-                        result.ExitCode = 1
-                }
+                writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Import failed: %v", err))
+                return
         }
 
-        am.agentLock.Lock()
-        if exists {
-                agent.Status = "idle"
-                agent.CurrentTask = ""
-                if result.ExitCode == 0 {
-                        agent.TasksDone++
-                } else {
-                        agent.TasksFailed++
-                }
-                am.saveAgentToDB(agent)
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "status":   "imported",
+                "imported": len(data.Items),
+                "id_map":   idMap,
+        })
+}
+
+func handleBatchPriority(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
         }
-        am.agentLock.Unlock()
 
-        level := "info"
-        if result.ExitCode != 0 {
-                level = "error"
+        var data struct {
+                Priority *int `json:"priority"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Priority == nil {
+                writeError(w, r, http.StatusBadRequest, "Body must contain a priority")
+                return
         }
-        am.saveLogToDB(&LogEntry{
-                AgentID:  agentID,
-                Level:    level,
-                Message:  "Command executed",
-                Command:  actualCommand,
-                Output:   result.Output,
-                ExitCode: result.ExitCode,
-                Duration: result.Duration,
-        })
 
-        am.logResultToFile(result)
+        batchID := r.PathValue("id")
+        updated, err := manager.SetBatchPriority(batchID, *data.Priority)
+        if err != nil {
+                writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to update batch: %v", err))
+                return
+        }
+        if updated == 0 {
+                writeError(w, r, http.StatusNotFound, "No pending items in batch")
+                return
+        }
 
-        am.broadcastMessage(Message{
-                Type:    "command_result",
-                Payload: result,
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "status":   "updated",
+                "batch_id": batchID,
+                "priority": *data.Priority,
+                "updated":  updated,
         })
+}
 
-        am.broadcastMessage(Message{
-                Type:    "agent_status",
-                Payload: agent,
-        })
+func handleQueueReprioritize(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-        return result
-}
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
 
-func (am *AgentManager) logResultToFile(result CommandResult) {
-        filename := fmt.Sprintf("%s/agent_%d_%s.log", am.logDir, result.AgentID, time.Now().Format("2006-01-02"))
-        f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+        var data struct {
+                Filter   ReprioritizeFilter `json:"filter"`
+                Priority *int               `json:"priority"`
+                Delta    *int               `json:"delta"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&data); err != nil || (data.Priority == nil) == (data.Delta == nil) {
+                writeError(w, r, http.StatusBadRequest, "Body must contain a filter and either priority or delta")
+                return
+        }
+
+        delta := 0
+        if data.Delta != nil {
+                delta = *data.Delta
+        }
+        updated, err := manager.ReprioritizeQueue(data.Filter, data.Priority, delta)
+        if errors.Is(err, errInvalidFilter) {
+                writeError(w, r, http.StatusBadRequest, err.Error())
+                return
+        }
         if err != nil {
-                log.Printf("Error opening log file: %v", err)
+                writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to reprioritize: %v", err))
                 return
         }
-        defer f.Close()
 
-        logEntry := fmt.Sprintf("[%s] Command: %s\nOutput: %s\nError: %s\nExitCode: %d\nDuration: %dms\n\n",
-                result.Timestamp, result.Command, result.Output, result.Error, result.ExitCode, result.Duration)
-        f.WriteString(logEntry)
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "status":  "updated",
+                "updated": updated,
+        })
 }
 
-func (am *AgentManager) GetResourceUsage() map[string]interface{} {
-        var memStats runtime.MemStats
-        runtime.ReadMemStats(&memStats)
+func handleBatchStagger(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-        am.agentLock.RLock()
-        agentCount := len(am.agents)
-        am.agentLock.RUnlock()
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
 
-        am.queueLock.RLock()
-        queueCount := len(am.queue)
-        am.queueLock.RUnlock()
+        var data struct {
+                StaggerMs *int `json:"stagger_ms"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.StaggerMs == nil || *data.StaggerMs < 0 {
+                writeError(w, r, http.StatusBadRequest, "Body must contain a non-negative stagger_ms")
+                return
+        }
 
-        return map[string]interface{}{
-                "alloc_mb":       float64(memStats.Alloc) / 1024 / 1024,
-                "total_alloc_mb": float64(memStats.TotalAlloc) / 1024 / 1024,
-                "sys_mb":         float64(memStats.Sys) / 1024 / 1024,
-                "num_gc":         memStats.NumGC,
-                "goroutines":     runtime.NumGoroutine(),
-                "agent_count":    agentCount,
-                "queue_count":    queueCount,
+        batchID := r.PathValue("id")
+        updated, err := manager.SetBatchStagger(batchID, *data.StaggerMs)
+        if err != nil {
+                writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to update batch: %v", err))
+                return
+        }
+        if updated == 0 {
+                writeError(w, r, http.StatusNotFound, "No pending items in batch")
+                return
         }
+
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "status":     "updated",
+                "batch_id":   batchID,
+                "stagger_ms": *data.StaggerMs,
+                "updated":    updated,
+        })
 }
 
-func (am *AgentManager) broadcastMessage(msg Message) {
-        am.clientLock.RLock()
-        defer am.clientLock.RUnlock()
+// handleBatchReport serves GET /batches/{id}/report; ?download=true makes
+// browsers save it as a file.
+func handleBatchReport(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-        for client := range am.clients {
-                err := client.WriteJSON(msg)
-                if err != nil {
-                        log.Printf("WebSocket write error: %v", err)
-                        client.Close()
-                        delete(am.clients, client)
-                }
+        if r.Method != "GET" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
         }
-}
 
-func (am *AgentManager) StartAgentLoop(agentID int) {
-        go func() {
-                for am.running && !am.terminated {
-                        item := am.GetNextQueueItem()
-                        if item != nil {
-                                am.queueLock.Lock()
-                                item.AgentID = agentID
-                                am.updateQueueItemInDB(item)
-                                am.queueLock.Unlock()
+        batchID := r.PathValue("id")
+        report, err := manager.GetBatchReport(batchID)
+        if errors.Is(err, errQueueItemNotFound) {
+                writeError(w, r, http.StatusNotFound, "No items in batch")
+                return
+        }
+        if err != nil {
+                writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to build report: %v", err))
+                return
+        }
 
-                                result := am.ExecuteCommand(agentID, item.Command)
-                                am.CompleteQueueItem(item.Index, result.Output, result.ExitCode == 0)
+        if download, _ := strconv.ParseBool(r.URL.Query().Get("download")); download {
+                w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "batch-"+batchID+"-report.json"))
+                enc := json.NewEncoder(w)
+                enc.SetIndent("", "  ")
+                enc.Encode(report)
+                return
+        }
+        json.NewEncoder(w).Encode(report)
+}
 
-                                time.Sleep(500 * time.Millisecond)
-                        } else {
-                                time.Sleep(1 * time.Second)
-                        }
+func handleBatchRetryBudget(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        batchID := r.PathValue("id")
+        switch r.Method {
+        case "GET":
+                budget, ok := manager.BatchRetryBudget(batchID)
+                if !ok {
+                        writeError(w, r, http.StatusNotFound, "Batch has no retry budget")
+                        return
                 }
-        }()
+                json.NewEncoder(w).Encode(budget)
+        case "POST":
+                var data struct {
+                        MaxTotalRetries *int `json:"max_total_retries"`
+                }
+                if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.MaxTotalRetries == nil || *data.MaxTotalRetries < 0 {
+                        writeError(w, r, http.StatusBadRequest, "Body must contain a non-negative max_total_retries")
+                        return
+                }
+                budget, err := manager.SetBatchRetryBudget(batchID, *data.MaxTotalRetries)
+                if errors.Is(err, errQueueItemNotFound) {
+                        writeError(w, r, http.StatusNotFound, "No items in batch")
+                        return
+                }
+                json.NewEncoder(w).Encode(budget)
+        default:
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+        }
 }
 
-func (am *AgentManager) MonitorResources() {
-        go func() {
-                for am.running {
-                        am.agentLock.Lock()
-                        for _, agent := range am.agents {
-                                var memStats runtime.MemStats
-                                runtime.ReadMemStats(&memStats)
-                                agent.MemoryUsage = float64(memStats.Alloc) / 1024 / 1024 / float64(len(am.agents)+1)
-                        }
-                        am.agentLock.Unlock()
-
-                        resources := am.GetResourceUsage()
+func handleLogs(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-                        metric := &ResourceMetric{
-                                AllocMB:    resources["alloc_mb"].(float64),
-                                SysMB:      resources["sys_mb"].(float64),
-                                Goroutines: resources["goroutines"].(int),
-                                NumGC:      resources["num_gc"].(uint32),
-                                AgentCount: resources["agent_count"].(int),
-                                QueueCount: resources["queue_count"].(int),
-                        }
-                        am.saveResourceMetricToDB(metric)
+        limit := 50
+        agentID := 0
+        level := ""
 
-                        am.broadcastMessage(Message{
-                                Type:    "resource_update",
-                                Payload: resources,
-                        })
+        q := r.URL.Query()
+        if l := q.Get("limit"); l != "" {
+                fmt.Sscanf(l, "%d", &limit)
+        }
+        if a := q.Get("agent_id"); a != "" {
+                fmt.Sscanf(a, "%d", &agentID)
+        }
+        level = q.Get("level")
 
-                        time.Sleep(2 * time.Second)
-                }
-        }()
+        search := q.Get("search")
+        if search != "" && !manager.outputSearchable() {
+                w.Header().Set("X-Search-Excludes", "output")
+        }
+        json.NewEncoder(w).Encode(manager.GetLogs(limit, agentID, level, search))
 }
 
-func (am *AgentManager) GracefulTerminate(signal string) {
-        if signal == "<END!>" {
-                am.terminated = true
-                am.running = false
+// handleLogsPrune runs the retention job now. The log_days and metrics_days
+// query parameters override LOG_RETENTION_DAYS and METRICS_RETENTION_DAYS
+// for this run.
+func handleLogsPrune(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-                am.saveLogToDB(&LogEntry{
-                        Level:   "warn",
-                        Message: "System terminated by <END!> signal",
-                })
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        cfg := manager.config()
+        logAge, metricsAge := cfg.logRetention, cfg.metricsRetention
+        q := r.URL.Query()
+        for key, age := range map[string]*time.Duration{"log_days": &logAge, "metrics_days": &metricsAge} {
+                v := q.Get(key)
+                if v == "" {
+                        continue
+                }
+                days, err := strconv.Atoi(v)
+                if err != nil || days < 0 {
+                        writeError(w, r, http.StatusBadRequest, key+" must be a non-negative number of days")
+                        return
+                }
+                *age = time.Duration(days) * 24 * time.Hour
+        }
+        if logAge == 0 && metricsAge == 0 {
+                writeError(w, r, http.StatusBadRequest, "No retention set; configure LOG_RETENTION_DAYS or METRICS_RETENTION_DAYS, or pass log_days or metrics_days")
+                return
+        }
+
+        result, err := manager.PruneLogs(logAge, metricsAge)
+        if errors.Is(err, errNoLogsDatabase) {
+                writeError(w, r, http.StatusServiceUnavailable, err.Error())
+                return
+        }
+        if err != nil {
+                writeError(w, r, http.StatusInternalServerError, err.Error())
+                return
+        }
+        json.NewEncoder(w).Encode(result)
+}
 
-                am.broadcastMessage(Message{
-                        Type:    "terminated",
-                        Payload: map[string]string{"reason": "Graceful termination via <END!> signal"},
-                })
+func handleResourceHistory(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-                log.Println("System gracefully terminated via <END!> signal")
+        limit := 100
+        q := r.URL.Query()
+        if l := q.Get("limit"); l != "" {
+                fmt.Sscanf(l, "%d", &limit)
         }
+
+        json.NewEncoder(w).Encode(manager.GetResourceHistory(limit))
 }
 
-var manager *AgentManager
+func handleAgentMetricsHistory(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-        conn, err := upgrader.Upgrade(w, r, nil)
+        if r.Method != "GET" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+
+        id, err := strconv.Atoi(r.PathValue("id"))
         if err != nil {
-                log.Printf("WebSocket upgrade error: %v", err)
+                writeError(w, r, http.StatusBadRequest, "Invalid agent id")
                 return
         }
-        defer conn.Close()
+        limit := 100
+        if l := r.URL.Query().Get("limit"); l != "" {
+                fmt.Sscanf(l, "%d", &limit)
+        }
 
-        manager.clientLock.Lock()
-        manager.clients[conn] = true
-        manager.clientLock.Unlock()
+        json.NewEncoder(w).Encode(manager.GetAgentMetricsHistory(id, limit))
+}
 
-        conn.WriteJSON(Message{
-                Type: "connected",
-                Payload: map[string]interface{}{
-                        "agents":     manager.GetAgents(),
-                        "queue":      manager.GetQueueList(),
-                        "terminated": manager.terminated,
-                },
-        })
+func handlePolicyCheck(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-        for {
-                var msg Message
-                err := conn.ReadJSON(&msg)
-                if err != nil {
-                        log.Printf("WebSocket read error: %v", err)
-                        manager.clientLock.Lock()
-                        delete(manager.clients, conn)
-                        manager.clientLock.Unlock()
-                        break
-                }
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
 
-                handleMessage(conn, msg)
+        var data struct {
+                Command string `json:"command"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+                writeError(w, r, http.StatusBadRequest, "Invalid request body")
+                return
         }
+        json.NewEncoder(w).Encode(manager.CheckCommandPolicy(data.Command))
 }
 
-func handleMessage(conn *websocket.Conn, msg Message) {
-        switch msg.Type {
-        case "add_agent":
-                payload := msg.Payload.(map[string]interface{})
-                name := payload["name"].(string)
-                agent := manager.AddAgent(name)
-                if agent != nil {
-                        manager.StartAgentLoop(agent.ID)
-                }
-
-        case "remove_agent":
-                payload := msg.Payload.(map[string]interface{})
-                id := int(payload["id"].(float64))
-                manager.RemoveAgent(id)
+// GetStats gathers the in-memory statistics served on /stats. Nothing here
+// touches the database, so it works with persistence off.
+func (am *AgentManager) GetStats() map[string]interface{} {
+        return map[string]interface{}{
+                "resources":         am.GetResourceUsage(),
+                "command_durations": am.durations.Snapshot(),
+                "agent_shares":      am.DispatchShares(),
+                "result_cache":      am.resultCache.Stats(),
+                "broadcast":         am.broadcastStats.Snapshot(am.clientBuffer),
+                "log_sink":          am.logSink.Stats(),
+                "draining_agents":   am.DrainingAgents(),
+        }
+}
 
-        case "add_queue":
-                payload := msg.Payload.(map[string]interface{})
-                commands := make(map[string]string)
-                for k, v := range payload {
-                        commands[k] = v.(string)
-                }
-                manager.AddToQueue(commands)
+func handleStats(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(manager.GetStats())
+}
 
-        case "queue_list":
-                conn.WriteJSON(Message{
-                        Type:    "queue_list",
-                        Payload: manager.GetQueueList(),
-                })
+func handleStatsDurationsReset(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-        case "queue_rm":
-                payload := msg.Payload.(map[string]interface{})
-                index := int(payload["index"].(float64))
-                manager.RemoveFromQueue(index)
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+        manager.durations.Reset()
+        json.NewEncoder(w).Encode(map[string]string{"status": "reset"})
+}
 
-        case "chat":
-                payload := msg.Payload.(map[string]interface{})
-                chatMsg := ChatMessage{
-                        Mode:    payload["mode"].(string),
-                        Content: payload["content"].(string),
-                        User:    "user",
-                }
-                handleChat(chatMsg)
+func handleStatsBaseline(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-        case "get_agents":
-                conn.WriteJSON(Message{
-                        Type:    "agents",
-                        Payload: manager.GetAgents(),
-                })
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+        json.NewEncoder(w).Encode(manager.MarkResourceBaseline())
+}
 
-        case "get_resources":
-                conn.WriteJSON(Message{
-                        Type:    "resources",
-                        Payload: manager.GetResourceUsage(),
-                })
+func handleStatsDelta(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-        case "get_logs":
-                payload := msg.Payload.(map[string]interface{})
-                limit := 50
-                agentID := 0
-                level := ""
-                if l, ok := payload["limit"].(float64); ok {
-                        limit = int(l)
-                }
-                if a, ok := payload["agent_id"].(float64); ok {
-                        agentID = int(a)
-                }
-                if lv, ok := payload["level"].(string); ok {
-                        level = lv
-                }
-                conn.WriteJSON(Message{
-                        Type:    "logs",
-                        Payload: manager.GetLogs(limit, agentID, level),
-                })
+        delta := manager.GetResourceDelta()
+        if delta == nil {
+                writeError(w, r, http.StatusNotFound, "No baseline marked, POST /stats/baseline first")
+                return
+        }
+        json.NewEncoder(w).Encode(delta)
+}
 
-        case "get_resource_history":
-                limit := 100
-                if payload, ok := msg.Payload.(map[string]interface{}); ok {
-                        if l, ok := payload["limit"].(float64); ok {
-                                limit = int(l)
-                        }
-                }
-                conn.WriteJSON(Message{
-                        Type:    "resource_history",
-                        Payload: manager.GetResourceHistory(limit),
-                })
+func handleTerminate(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
 
-        case "execute":
-                payload := msg.Payload.(map[string]interface{})
-                agentID := int(payload["agent_id"].(float64))
-                command := payload["command"].(string)
-                go manager.ExecuteCommand(agentID, command)
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
+        }
+        manager.GracefulTerminate("<END!>")
+        json.NewEncoder(w).Encode(map[string]string{"status": "terminated"})
+}
 
-        case "terminate":
-                manager.GracefulTerminate("<END!>")
+// APIError is the body of every failed REST response.
+type APIError struct {
+        Error string `json:"error"`
+        Code  string `json:"code"`
+}
 
-        case "stop":
-                manager.running = false
-                manager.broadcastMessage(Message{
-                        Type:    "stopped",
-                        Payload: nil,
-                })
-        }
+var errorCodes = map[int]string{
+        http.StatusBadRequest:          "BAD_REQUEST",
+        http.StatusUnauthorized:        "UNAUTHORIZED",
+        http.StatusForbidden:           "FORBIDDEN",
+        http.StatusNotFound:            "NOT_FOUND",
+        http.StatusMethodNotAllowed:    "METHOD_NOT_ALLOWED",
+        http.StatusNotAcceptable:       "NOT_ACCEPTABLE",
+        http.StatusConflict:            "CONFLICT",
+        http.StatusInternalServerError: "INTERNAL_ERROR",
+        http.StatusServiceUnavailable:  "SERVICE_UNAVAILABLE",
 }
 
-func handleChat(chat ChatMessage) {
-        if strings.Contains(chat.Content, "<END!>") {
-                manager.GracefulTerminate("<END!>")
-                return
+// acceptsMedia reports whether the Accept header admits the given media
+// type. A missing header accepts anything.
+func acceptsMedia(r *http.Request, mediaType string) bool {
+        accept := r.Header.Get("Accept")
+        if accept == "" {
+                return true
         }
 
-        switch chat.Mode {
-        case "/queue":
-                parts := strings.Fields(chat.Content)
-                if len(parts) >= 1 {
-                        switch parts[0] {
-                        case "list":
-                                manager.broadcastMessage(Message{
-                                        Type:    "queue_list",
-                                        Payload: manager.GetQueueList(),
-                                })
-                        case "rm":
-                                if len(parts) >= 2 {
-                                        var index int
-                                        fmt.Sscanf(parts[1], "%d", &index)
-                                        manager.RemoveFromQueue(index)
-                                }
-                        case "add":
-                                if len(parts) >= 2 {
-                                        jsonStr := strings.Join(parts[1:], " ")
-                                        var commands map[string]string
-                                        if err := json.Unmarshal([]byte(jsonStr), &commands); err == nil {
-                                                manager.AddToQueue(commands)
-                                        }
-                                }
-                        case "clear":
-                                manager.queueLock.Lock()
-                                for _, item := range manager.queue {
-                                        manager.deleteQueueItemFromDB(item.ID)
+        major, _, _ := strings.Cut(mediaType, "/")
+        for _, part := range strings.Split(accept, ",") {
+                fields := strings.Split(part, ";")
+                media := strings.ToLower(strings.TrimSpace(fields[0]))
+                rejected := false
+                for _, param := range fields[1:] {
+                        if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+                                if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+                                        rejected = true
                                 }
-                                manager.queue = make([]QueueItem, 0)
-                                manager.queueLock.Unlock()
-                                manager.broadcastMessage(Message{
-                                        Type:    "queue_updated",
-                                        Payload: manager.queue,
-                                })
                         }
                 }
-        case "/chat":
-                manager.broadcastMessage(Message{
-                        Type: "chat_message",
-                        Payload: map[string]string{
-                                "user":    chat.User,
-                                "content": chat.Content,
-                        },
-                })
+                if !rejected && (media == mediaType || media == major+"/*" || media == "*/*") {
+                        return true
+                }
         }
+        return false
 }
 
-func handleHealth(w http.ResponseWriter, r *http.Request) {
+// writeError sends {error, code} as JSON, or plain text to a client that
+// asked for text and not JSON.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+        code, ok := errorCodes[status]
+        if !ok {
+                code = strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+        }
+
+        w.Header().Set("X-Content-Type-Options", "nosniff")
+        if !acceptsMedia(r, "application/json") && acceptsMedia(r, "text/plain") {
+                w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+                w.WriteHeader(status)
+                fmt.Fprintln(w, message)
+                return
+        }
+
         w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(map[string]interface{}{
-                "status":     "ok",
-                "agents":     len(manager.agents),
-                "queue":      len(manager.queue),
-                "resources":  manager.GetResourceUsage(),
-                "terminated": manager.terminated,
-                "db_connected": manager.db != nil,
-        })
+        w.WriteHeader(status)
+        json.NewEncoder(w).Encode(APIError{Error: message, Code: code})
 }
 
-func handleAgents(w http.ResponseWriter, r *http.Request) {
+// extraServers start listeners that files built with extra tags (see
+// grpc.go) add from init. Each returns a function that stops it.
+var extraServers []func() (stop func())
+
+// adminRoutes holds optional /admin endpoints; files built with extra tags
+// (see loadtest.go) add to it from init.
+var adminRoutes = map[string]http.HandlerFunc{
+        "/admin/safe-mode": handleSafeMode,
+        "/admin/reload":    handleReload,
+        "/admin/banner":    handleBanner,
+}
+
+// handleBanner shows (GET), sets (POST) or clears (DELETE, or POST with an
+// empty text) the dashboard banner.
+func handleBanner(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Content-Type", "application/json")
 
         switch r.Method {
         case "GET":
-                json.NewEncoder(w).Encode(manager.GetAgents())
+                json.NewEncoder(w).Encode(manager.currentBanner())
         case "POST":
-                var data map[string]string
-                json.NewDecoder(r.Body).Decode(&data)
-                agent := manager.AddAgent(data["name"])
-                if agent != nil {
-                        manager.StartAgentLoop(agent.ID)
-                        json.NewEncoder(w).Encode(agent)
-                } else {
-                        http.Error(w, "Max agents reached", http.StatusBadRequest)
+                var data struct {
+                        Text       string `json:"text"`
+                        Severity   string `json:"severity"`
+                        TTLSeconds int    `json:"ttl_seconds"`
+                }
+                if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+                        writeError(w, r, http.StatusBadRequest, "Invalid request body")
+                        return
                 }
+                banner, err := manager.SetBanner(data.Text, data.Severity, time.Duration(data.TTLSeconds)*time.Second)
+                if err != nil {
+                        writeError(w, r, http.StatusBadRequest, err.Error())
+                        return
+                }
+                json.NewEncoder(w).Encode(banner)
+        case "DELETE":
+                banner, _ := manager.SetBanner("", "", 0)
+                json.NewEncoder(w).Encode(banner)
+        default:
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
         }
 }
 
-func handleQueue(w http.ResponseWriter, r *http.Request) {
+func handleReload(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Content-Type", "application/json")
 
-        switch r.Method {
-        case "GET":
-                json.NewEncoder(w).Encode(manager.GetQueueList())
-        case "POST":
-                var commands map[string]string
-                json.NewDecoder(r.Body).Decode(&commands)
-                manager.AddToQueue(commands)
-                json.NewEncoder(w).Encode(map[string]string{"status": "added"})
-        case "DELETE":
-                var data map[string]int
-                json.NewDecoder(r.Body).Decode(&data)
-                manager.RemoveFromQueue(data["index"])
-                json.NewEncoder(w).Encode(map[string]string{"status": "removed"})
+        if r.Method != "POST" {
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
         }
+        json.NewEncoder(w).Encode(manager.ReloadConfig())
 }
 
-func handleLogs(w http.ResponseWriter, r *http.Request) {
+func handleSafeMode(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Content-Type", "application/json")
 
-        limit := 50
-        agentID := 0
-        level := ""
-
-        q := r.URL.Query()
-        if l := q.Get("limit"); l != "" {
-                fmt.Sscanf(l, "%d", &limit)
-        }
-        if a := q.Get("agent_id"); a != "" {
-                fmt.Sscanf(a, "%d", &agentID)
+        switch r.Method {
+        case "GET":
+        case "POST":
+                var data struct {
+                        Enabled *bool `json:"enabled"`
+                }
+                if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Enabled == nil {
+                        writeError(w, r, http.StatusBadRequest, "Body must contain enabled")
+                        return
+                }
+                manager.SetSafeMode(*data.Enabled)
+        default:
+                writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+                return
         }
-        level = q.Get("level")
+        json.NewEncoder(w).Encode(map[string]bool{"safe_mode": manager.safeMode.Load()})
+}
 
-        json.NewEncoder(w).Encode(manager.GetLogs(limit, agentID, level))
+// requireAdmin guards /admin endpoints with the ADMIN_TOKEN bearer token.
+// Without a token configured they are disabled entirely.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                token := os.Getenv("ADMIN_TOKEN")
+                if token == "" {
+                        writeError(w, r, http.StatusForbidden, "Admin endpoints are disabled, set ADMIN_TOKEN")
+                        return
+                }
+                given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+                if !ok || !validAdminToken(given) {
+                        writeError(w, r, http.StatusUnauthorized, "Invalid admin token")
+                        return
+                }
+                handler(w, r)
+        }
 }
 
-func handleResourceHistory(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Content-Type", "application/json")
+// validAdminToken reports whether given is the ADMIN_TOKEN; nothing is
+// valid while it is unset.
+func validAdminToken(given string) bool {
+        token := os.Getenv("ADMIN_TOKEN")
+        return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
 
-        limit := 100
-        q := r.URL.Query()
-        if l := q.Get("limit"); l != "" {
-                fmt.Sscanf(l, "%d", &limit)
+// apiKey is the key REST and WebSocket clients must present, or "" when
+// authentication is off: BACKEND_API_KEY is unset, or AUTH_DISABLED=true
+// for local development.
+func apiKey() string {
+        if os.Getenv("AUTH_DISABLED") == "true" {
+                return ""
         }
-
-        json.NewEncoder(w).Encode(manager.GetResourceHistory(limit))
+        return os.Getenv("BACKEND_API_KEY")
 }
 
-func handleTerminate(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Content-Type", "application/json")
+func validAPIKey(given, key string) bool {
+        return subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1
+}
 
-        if r.Method == "POST" {
-                manager.GracefulTerminate("<END!>")
-                json.NewEncoder(w).Encode(map[string]string{"status": "terminated"})
+// requireAPIKey guards an endpoint with the BACKEND_API_KEY bearer token.
+// Admin endpoints authenticate with ADMIN_TOKEN instead and skip this.
+func requireAPIKey(handler http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                key := apiKey()
+                if key == "" {
+                        handler(w, r)
+                        return
+                }
+                given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+                if !ok || !validAPIKey(given, key) {
+                        w.Header().Set("WWW-Authenticate", `Bearer realm="axshell"`)
+                        writeError(w, r, http.StatusUnauthorized, "Missing or invalid API key")
+                        return
+                }
+                handler(w, r)
         }
 }
 
 func enableCORS(handler http.HandlerFunc) http.HandlerFunc {
         return func(w http.ResponseWriter, r *http.Request) {
                 w.Header().Set("Access-Control-Allow-Origin", "*")
-                w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-                w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+                w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+                w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept, Authorization, X-Client-Name")
 
                 if r.Method == "OPTIONS" {
                         w.WriteHeader(http.StatusOK)
                         return
                 }
 
+                // Every wrapped endpoint speaks JSON; refuse clients that
+                // rule it out rather than sending them a body they reject.
+                if !acceptsMedia(r, "application/json") {
+                        writeError(w, r, http.StatusNotAcceptable, "This endpoint only serves application/json")
+                        return
+                }
+
                 handler(w, r)
         }
 }
 
 func main() {
         manager = NewAgentManager()
+        if err := manager.validateStartup(); err != nil {
+                log.Fatalf("Startup validation failed: %v", err)
+        }
+        if path := os.Getenv("AGENTS_CONFIG"); path != "" {
+                if err := manager.LoadAgentsConfig(path, os.Getenv("AGENTS_CONFIG_PRUNE") == "true"); err != nil {
+                        log.Fatalf("Loading agents config failed: %v", err)
+                }
+        }
         manager.MonitorResources()
+        go manager.watchDatabase()
+        go manager.pruneLogsPeriodically()
 
         http.HandleFunc("/ws", handleWebSocket)
+        // /health stays open so load balancers can probe without the key.
         http.HandleFunc("/health", enableCORS(handleHealth))
-        http.HandleFunc("/agents", enableCORS(handleAgents))
-        http.HandleFunc("/queue", enableCORS(handleQueue))
-        http.HandleFunc("/logs", enableCORS(handleLogs))
-        http.HandleFunc("/resources/history", enableCORS(handleResourceHistory))
-        http.HandleFunc("/terminate", enableCORS(handleTerminate))
+        http.HandleFunc("/agents", enableCORS(requireAPIKey(handleAgents)))
+        http.HandleFunc("/agents/{id}/reserve", enableCORS(requireAPIKey(handleAgentReserve)))
+        http.HandleFunc("/groups", enableCORS(requireAPIKey(handleGroups)))
+        http.HandleFunc("/groups/{name}", enableCORS(requireAPIKey(handleGroup)))
+        http.HandleFunc("/agents/{id}/release", enableCORS(requireAPIKey(handleAgentRelease)))
+        http.HandleFunc("/agents/{id}/drain", enableCORS(requireAPIKey(handleAgentDrain)))
+        http.HandleFunc("/agents/{id}/pause", enableCORS(requireAPIKey(handleAgentPause(true))))
+        http.HandleFunc("/agents/{id}/resume", enableCORS(requireAPIKey(handleAgentPause(false))))
+        http.HandleFunc("/agents/{id}/fifo", enableCORS(requireAPIKey(handleAgentFIFO)))
+        http.HandleFunc("/agents/{id}/concurrency", enableCORS(requireAPIKey(handleAgentConcurrency)))
+        http.HandleFunc("/agents/{id}/probe", enableCORS(requireAPIKey(handleAgentProbe)))
+        http.HandleFunc("/queue", enableCORS(requireAPIKey(handleQueue)))
+        http.HandleFunc("/queue/{id}", enableCORS(requireAPIKey(handleQueueItem)))
+        http.HandleFunc("/queue/{id}/result", enableCORS(requireAPIKey(handleQueueItemResult)))
+        http.HandleFunc("/queue/{id}/disable", enableCORS(requireAPIKey(handleQueueItemDisable(true))))
+        http.HandleFunc("/queue/{id}/enable", enableCORS(requireAPIKey(handleQueueItemDisable(false))))
+        http.HandleFunc("/queue/{id}/expedite", enableCORS(requireAPIKey(handleQueueItemExpedite)))
+        http.HandleFunc("/queue/{id}/schedule", enableCORS(requireAPIKey(handleQueueItemSchedule)))
+        http.HandleFunc("/queue/export", enableCORS(requireAPIKey(handleQueueExport)))
+        http.HandleFunc("/queue/import", enableCORS(requireAPIKey(handleQueueImport)))
+        http.HandleFunc("/queue/reprioritize", enableCORS(requireAPIKey(handleQueueReprioritize)))
+        http.HandleFunc("/batches/{id}/priority", enableCORS(requireAPIKey(handleBatchPriority)))
+        http.HandleFunc("/batches/{id}/stagger", enableCORS(requireAPIKey(handleBatchStagger)))
+        http.HandleFunc("/batches/{id}/retry-budget", enableCORS(requireAPIKey(handleBatchRetryBudget)))
+        http.HandleFunc("/batches/{id}/report", enableCORS(requireAPIKey(handleBatchReport)))
+        http.HandleFunc("/commands/{hash}/history", enableCORS(requireAPIKey(handleCommandHistory)))
+        http.HandleFunc("/commands/cancel", enableCORS(requireAPIKey(handleCommandCancel)))
+        http.HandleFunc("/quarantine", enableCORS(requireAPIKey(handleQuarantine)))
+        http.HandleFunc("/quarantine/{hash}/release", enableCORS(requireAPIKey(handleQuarantineRelease)))
+        http.HandleFunc("/confirmations", enableCORS(requireAPIKey(handleConfirmations)))
+        http.HandleFunc("/confirmations/{token}", enableCORS(requireAPIKey(handleConfirmation)))
+        http.HandleFunc("/changes", enableCORS(requireAPIKey(handleChanges)))
+        http.HandleFunc("/logs", enableCORS(requireAPIKey(handleLogs)))
+        http.HandleFunc("/logs/prune", enableCORS(requireAPIKey(handleLogsPrune)))
+        http.HandleFunc("/resources/history", enableCORS(requireAPIKey(handleResourceHistory)))
+        http.HandleFunc("/agents/{id}/metrics/history", enableCORS(requireAPIKey(handleAgentMetricsHistory)))
+        http.HandleFunc("/policy/check", enableCORS(requireAPIKey(handlePolicyCheck)))
+        http.HandleFunc("/config/effective", enableCORS(requireAPIKey(handleConfigEffective)))
+        http.HandleFunc("/stats", enableCORS(requireAPIKey(handleStats)))
+        http.HandleFunc("/stats/durations/reset", enableCORS(requireAPIKey(handleStatsDurationsReset)))
+        http.HandleFunc("/metrics", requireAPIKey(promhttp.HandlerFor(newMetricsRegistry(manager), promhttp.HandlerOpts{}).ServeHTTP))
+        http.HandleFunc("/stats/baseline", enableCORS(requireAPIKey(handleStatsBaseline)))
+        http.HandleFunc("/stats/delta", enableCORS(requireAPIKey(handleStatsDelta)))
+        http.HandleFunc("/terminate", enableCORS(requireAPIKey(handleTerminate)))
+        for pattern, handler := range adminRoutes {
+                http.HandleFunc(pattern, enableCORS(requireAdmin(handler)))
+        }
 
         port := os.Getenv("BACKEND_PORT")
         if port == "" {
@@ -1264,9 +12472,43 @@ func main() {
         log.Printf("AI Agent Backend starting on port %s", port)
         log.Printf("WebSocket endpoint: ws://localhost:%s/ws", port)
         log.Printf("Health check: http://localhost:%s/health", port)
-        log.Printf("Database persistence: %v", manager.db != nil)
+        log.Printf("Database persistence: %v", manager.persistenceEnabled())
+        var stopExtra []func()
+        for _, start := range extraServers {
+                stopExtra = append(stopExtra, start())
+        }
+        switch {
+        case os.Getenv("BACKEND_API_KEY") == "":
+                log.Printf("WARNING: BACKEND_API_KEY is not set, REST and WebSocket endpoints are unauthenticated")
+        case os.Getenv("AUTH_DISABLED") == "true":
+                log.Printf("WARNING: AUTH_DISABLED is set, BACKEND_API_KEY is not enforced")
+        }
+        if os.Getenv("BROADCAST_WORKERS") != "" {
+                log.Printf("WARNING: BROADCAST_WORKERS is no longer used; each client has its own writer, queueing up to CLIENT_SEND_BUFFER messages")
+        }
+
+        server := &http.Server{Addr: ":" + port}
+        stopped := make(chan struct{})
+        go func() {
+                signals := make(chan os.Signal, 1)
+                signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+                sig := <-signals
+                log.Printf("Received %s", sig)
+                signal.Stop(signals)
+
+                manager.Shutdown()
+                for _, stop := range stopExtra {
+                        stop()
+                }
+                ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+                defer cancel()
+                server.Shutdown(ctx)
+                close(stopped)
+        }()
 
-        if err := http.ListenAndServe(":"+port, nil); err != nil {
+        if err := server.ListenAndServe(); err != http.ErrServerClosed {
                 log.Fatal(err)
         }
+        <-stopped
+        log.Println("Server stopped")
 }
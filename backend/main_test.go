@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+// newTestManager returns an AgentManager without a database, logging to a
+// temporary directory. env holds key, value pairs set before it is built.
+func newTestManager(t *testing.T, env ...string) *AgentManager {
+        t.Helper()
+        t.Setenv("AI_LOG_DIR", t.TempDir())
+        t.Setenv("DATABASE_URL", "")
+        t.Setenv("LOGS_DATABASE_URL", "")
+        for i := 0; i+1 < len(env); i += 2 {
+                t.Setenv(env[i], env[i+1])
+        }
+        return NewAgentManager()
+}
+
+// newTestAgent adds an agent to am and returns its id.
+func newTestAgent(t *testing.T, am *AgentManager, spec AgentSpec) int {
+        t.Helper()
+        if spec.Name == "" {
+                spec.Name = "test"
+        }
+        agent := am.AddAgentWithSpec(spec)
+        if agent == nil {
+                t.Fatal("AddAgentWithSpec returned nil")
+        }
+        return agent.ID
+}
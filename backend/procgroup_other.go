@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// Process groups are a Unix concept; elsewhere commands keep the default
+// behaviour of only the direct child being killed and waited for.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+        "os/exec"
+        "syscall"
+)
+
+// setProcessGroup starts the command in its own process group and makes
+// cancellation kill the whole group, so descendants the shell backgrounded
+// die with it instead of being orphaned.
+func setProcessGroup(cmd *exec.Cmd) {
+        cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+        cmd.Cancel = func() error {
+                return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+        }
+}
+
+// killProcessGroup reaps whatever is left of the command's group once the
+// shell itself has been waited for.
+func killProcessGroup(cmd *exec.Cmd) {
+        if cmd.Process == nil {
+                return
+        }
+        syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
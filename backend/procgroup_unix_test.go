@@ -0,0 +1,88 @@
+//go:build unix
+
+package main
+
+import (
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "syscall"
+        "testing"
+        "time"
+)
+
+// processGone reports whether pid has exited, counting a zombie nobody has
+// reaped yet as gone.
+func processGone(pid int) bool {
+        if syscall.Kill(pid, 0) != nil {
+                return true
+        }
+        stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+        if err != nil {
+                return false
+        }
+        fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+        return len(fields) > 0 && fields[0] == "Z"
+}
+
+// waitForPid waits for the command to write its background child's pid to
+// file and returns it.
+func waitForPid(t *testing.T, file string) int {
+        t.Helper()
+        deadline := time.Now().Add(5 * time.Second)
+        for time.Now().Before(deadline) {
+                data, _ := os.ReadFile(file)
+                if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid > 0 {
+                        return pid
+                }
+                time.Sleep(20 * time.Millisecond)
+        }
+        t.Fatal("command never wrote its child's pid")
+        return 0
+}
+
+func waitGone(t *testing.T, pid int) {
+        t.Helper()
+        deadline := time.Now().Add(5 * time.Second)
+        for !processGone(pid) {
+                if time.Now().After(deadline) {
+                        syscall.Kill(pid, syscall.SIGKILL)
+                        t.Fatalf("background child %d outlived its command", pid)
+                }
+                time.Sleep(20 * time.Millisecond)
+        }
+}
+
+func TestProcessGroupKilledWhenCommandFinishes(t *testing.T) {
+        am := newTestManager(t, "PROCESS_GROUPS", "true")
+        id := newTestAgent(t, am, AgentSpec{})
+        pidFile := filepath.Join(t.TempDir(), "pid")
+
+        result := am.ExecuteCommand(id, "RUN sleep 30 >/dev/null 2>&1 & echo $! > "+pidFile)
+        if result.ExitCode != 0 {
+                t.Fatalf("command failed: %+v", result)
+        }
+        waitGone(t, waitForPid(t, pidFile))
+}
+
+func TestProcessGroupKilledWhenCommandCancelled(t *testing.T) {
+        am := newTestManager(t, "PROCESS_GROUPS", "true")
+        id := newTestAgent(t, am, AgentSpec{})
+        pidFile := filepath.Join(t.TempDir(), "pid")
+
+        done := make(chan CommandResult, 1)
+        go func() {
+                done <- am.ExecuteCommand(id, "RUN sleep 30 >/dev/null 2>&1 & echo $! > "+pidFile+"; sleep 30")
+        }()
+        pid := waitForPid(t, pidFile)
+        if _, err := am.CancelCommand(id, 0); err != nil {
+                t.Fatal(err)
+        }
+        select {
+        case <-done:
+        case <-time.After(10 * time.Second):
+                t.Fatal("cancelled command did not return")
+        }
+        waitGone(t, pid)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+        "errors"
+        "net/http"
+        "net/http/httptest"
+        "slices"
+        "strings"
+        "testing"
+        "time"
+)
+
+func TestParseQueueEntries(t *testing.T) {
+        commands, entries, err := parseQueueEntries(map[string]any{
+                "1": "RUN echo plain",
+                "2": map[string]any{
+                        "command":    "RUN make",
+                        "timeout_ms": float64(1500),
+                        "on_timeout": "cleanup:make clean",
+                        "depends_on": []any{float64(4), "1"},
+                },
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+        if commands["1"] != "RUN echo plain" || commands["2"] != "RUN make" {
+                t.Errorf("commands = %v", commands)
+        }
+        entry := entries["2"]
+        if entry.TimeoutMs != 1500 || entry.OnTimeout != "cleanup:make clean" ||
+                !slices.Equal(entry.DependsOn, []int{4}) || !slices.Equal(entry.DependsOnKeys, []string{"1"}) {
+                t.Errorf("entry = %+v", entry)
+        }
+
+        for name, bad := range map[string]map[string]any{
+                "negative timeout":   {"command": "RUN a", "timeout_ms": float64(-1)},
+                "unknown on_timeout": {"command": "RUN a", "on_timeout": "explode"},
+                "depends_on string":  {"command": "RUN a", "depends_on": "4"},
+                "depends_on zero":    {"command": "RUN a", "depends_on": []any{float64(0)}},
+                "depends_on float":   {"command": "RUN a", "depends_on": []any{float64(1.5)}},
+                "depends_on bad key": {"command": "RUN a", "depends_on": []any{"9"}},
+        } {
+                if _, _, err := parseQueueEntries(map[string]any{"1": bad}); err == nil {
+                        t.Errorf("%s: accepted %v", name, bad)
+                }
+        }
+
+        for name, bad := range map[string]map[string]any{
+                "named key":       {"1": map[string]any{"command": "RUN a", "depends_on": []any{"build"}}, "build": "RUN b"},
+                "key past n":      {"1": "RUN a", "3": "RUN b"},
+                "zero key":        {"0": "RUN a"},
+                "padded key":      {"01": "RUN a"},
+                "depends past n":  {"1": map[string]any{"command": "RUN a", "depends_on": []any{"2"}}},
+                "depends on name": {"1": map[string]any{"command": "RUN a", "depends_on": []any{"build"}}},
+        } {
+                _, _, err := parseQueueEntries(bad)
+                if err == nil || !strings.Contains(err.Error(), "1 to") {
+                        t.Errorf("%s: err = %v, want it to name the 1 to n range", name, err)
+                }
+        }
+}
+
+func TestAddToQueueAppliesEntrySettings(t *testing.T) {
+        am := newDispatchManager(t)
+        result := am.AddToQueue(map[string]string{"1": "RUN make"}, map[string]queueEntry{
+                "1": {TimeoutMs: 2000, OnTimeout: "retry"},
+        })
+        if len(result.Added) != 1 {
+                t.Fatalf("result = %+v", result)
+        }
+        item := result.Added[0]
+        if item.TimeoutMs != 2000 || item.OnTimeout != "retry" {
+                t.Errorf("item = %+v", item)
+        }
+}
+
+func TestAddToQueueBatchDependencies(t *testing.T) {
+        am := newDispatchManager(t)
+        am.lastIndex = 10
+        result := am.AddToQueue(map[string]string{"1": "RUN deploy", "2": "RUN build", "3": "RUN test"}, map[string]queueEntry{
+                "1": {DependsOnKeys: []string{"2", "3"}},
+                "3": {DependsOnKeys: []string{"2"}},
+        })
+        if result.Status != "added" {
+                t.Fatalf("result = %+v", result)
+        }
+        var indexes []int
+        for _, item := range result.Added {
+                indexes = append(indexes, item.Index)
+        }
+        if !slices.Equal(indexes, []int{12, 13, 11}) {
+                t.Errorf("added in order %v, want each entry after its dependencies", indexes)
+        }
+        if deps := result.Added[2].DependsOn; !slices.Equal(deps, []int{12, 13}) {
+                t.Errorf("entry 1 depends on %v, want [12 13]", deps)
+        }
+        if am.lastIndex != 13 {
+                t.Errorf("lastIndex = %d, want 13", am.lastIndex)
+        }
+}
+
+func TestAddToQueueRejectsBadDependencies(t *testing.T) {
+        am := newDispatchManager(t)
+        am.queue = []QueueItem{{Index: 1, Command: "RUN echo", Status: "pending"}}
+        am.lastIndex = 1
+
+        result := am.AddToQueue(map[string]string{
+                "1": "RUN a", "2": "RUN b", "3": "RUN c", "4": "RUN d", "5": "RUN e", "6": "RUN f",
+        }, map[string]queueEntry{
+                "1": {DependsOn: []int{1}},
+                "2": {DependsOn: []int{99}},
+                "3": {DependsOnKeys: []string{"2"}},
+                "4": {DependsOnKeys: []string{"5"}},
+                "5": {DependsOnKeys: []string{"4"}},
+                "6": {DependsOnKeys: []string{"6"}},
+        })
+        if !slices.Equal(result.Failed, []int{2, 3, 4, 5, 6}) {
+                t.Fatalf("failed = %v (%v), want 2 to 6", result.Failed, result.Errors)
+        }
+        for key, want := range map[int]string{
+                2: "unknown queue item 99",
+                3: "not added",
+                4: "cycle",
+                6: "cycle",
+        } {
+                if !strings.Contains(result.Errors[key], want) {
+                        t.Errorf("error for %d = %q, want it to mention %q", key, result.Errors[key], want)
+                }
+        }
+        if len(am.queue) != 2 || !slices.Equal(am.queue[1].DependsOn, []int{1}) {
+                t.Errorf("queue = %+v, want only entry 1 added", am.queue)
+        }
+}
+
+func TestAnnotateAttributesClient(t *testing.T) {
+        am := newDispatchManager(t)
+        previous := manager
+        manager = am
+        t.Cleanup(func() { manager = previous })
+        am.queue = []QueueItem{{Index: 1, Command: "RUN echo", Status: "pending"}}
+
+        mux := http.NewServeMux()
+        mux.HandleFunc("/queue/{id}", handleQueueItem)
+        for _, tc := range []struct {
+                client string
+                want   string
+        }{
+                {"deploy-bot", "deploy-bot"},
+                {"", "192.0.2.1"},
+        } {
+                req := httptest.NewRequest("PATCH", "/queue/1", strings.NewReader(`{"annotations": "flaky"}`))
+                if tc.client != "" {
+                        req.Header.Set("X-Client-Name", tc.client)
+                }
+                rec := httptest.NewRecorder()
+                mux.ServeHTTP(rec, req)
+                if rec.Code != http.StatusOK {
+                        t.Fatalf("status %d: %s", rec.Code, rec.Body)
+                }
+                if got := am.queue[0].AnnotatedBy; got != tc.want {
+                        t.Errorf("annotated_by = %q, want %q", got, tc.want)
+                }
+        }
+}
+
+func TestPendingTTLSkipsRequeuedItems(t *testing.T) {
+        am := newDispatchManager(t, "PENDING_TTL", "1h")
+        id := newTestAgent(t, am, AgentSpec{MaxConcurrent: 4})
+        old := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+        am.queue = []QueueItem{
+                {Index: 1, Command: "RUN failover", Status: "pending", CreatedAt: old},
+                {Index: 2, Command: "RUN timeout", Status: "pending", CreatedAt: old, OnTimeout: "retry"},
+                {Index: 3, Command: "RUN shutdown", Status: "pending", CreatedAt: old},
+                {Index: 4, Command: "RUN retry", Status: "pending", CreatedAt: old, MaxRetries: 1},
+        }
+        for range 3 {
+                if am.claimNextQueueItem(id) == nil {
+                        t.Fatal("could not claim an item")
+                }
+        }
+        if batch := am.GetNextBatch(1); len(batch) != 1 {
+                t.Fatalf("batch = %+v", batch)
+        }
+        am.queue = append(am.queue, QueueItem{Index: 5, Command: "RUN never", Status: "pending", CreatedAt: old})
+
+        am.failoverQueueItem(1, id, "")
+        if !am.retryTimedOutQueueItem(2, id, "") {
+                t.Fatal("timed-out item not retried")
+        }
+        am.CompleteQueueItem(4, "", false)
+        am.Shutdown()
+
+        am.expireStalePending()
+        want := []string{"pending", "pending", "pending", "pending", "expired"}
+        if got := queueStatuses(am); !slices.Equal(got, want) {
+                t.Errorf("statuses = %v, want %v", got, want)
+        }
+}
+
+func TestQueueKeyAfterRemoveThenAddEphemeral(t *testing.T) {
+        am := newDispatchManager(t)
+        // Saved before persistence was switched off: its id is what a new
+        // item's index would otherwise have been.
+        am.queue = []QueueItem{{ID: 2, Index: 1, Command: "RUN saved", Status: "pending"}}
+        am.lastIndex = 1
+
+        first := am.AddToQueue(map[string]string{"1": "RUN first"}, nil).Added[0]
+        if first.Index == 2 {
+                t.Fatalf("new item got index %d, the id of a queued item", first.Index)
+        }
+        if !am.RemoveQueueItem(2) {
+                t.Fatal("could not remove the saved item")
+        }
+        second := am.AddToQueue(map[string]string{"1": "RUN second"}, nil).Added[0]
+
+        am.finishQueueItem(queueKey(&first), "completed", "")
+        am.setQueueItemStatus(queueKey(&second), "running")
+        if got := queueStatuses(am); !slices.Equal(got, []string{"completed", "running"}) {
+                t.Errorf("statuses = %v, want [completed running]", got)
+        }
+}
+
+func TestQueueKeyAfterRemoveThenAddPersistent(t *testing.T) {
+        am := newDispatchManager(t)
+        useFakeDB(t, am)
+
+        added := am.AddToQueue(map[string]string{"1": "RUN a", "2": "RUN b"}, nil).Added
+        if !am.RemoveQueueItem(added[0].ID) {
+                t.Fatal("could not remove the first item")
+        }
+        last := am.AddToQueue(map[string]string{"1": "RUN c"}, nil).Added[0]
+        if am.findQueueItem(added[0].ID) >= 0 {
+                t.Fatalf("removed item %d still found", added[0].ID)
+        }
+
+        run := am.trackCommand(1, queueKey(&last), last.Command, func() {})
+        key := am.cancelKey(last.ID, 0)
+        if key != queueKey(&last) {
+                t.Fatalf("cancelKey(%d) = %d, want %d", last.ID, key, queueKey(&last))
+        }
+        if _, err := am.CancelCommand(0, key); err != nil || !run.cancelled.Load() {
+                t.Fatalf("CancelCommand = %v, want the run of item %d cancelled", err, last.ID)
+        }
+        if !am.takeCancellation(key) {
+                t.Error("cancellation not recorded under the item's key")
+        }
+
+        am.CompleteQueueItem(queueKey(&added[1]), "", true)
+        if got := queueStatuses(am); !slices.Equal(got, []string{"completed", "pending"}) {
+                t.Errorf("statuses = %v, want [completed pending]", got)
+        }
+}
+
+func TestFailedQueueInsertIsNotKept(t *testing.T) {
+        am := newDispatchManager(t)
+        fake := useFakeDB(t, am)
+        fake.insertErr = errors.New("disk full")
+
+        result := am.AddToQueue(map[string]string{"1": "RUN a", "2": "RUN b"}, nil)
+        if result.Status != "failed" || !slices.Equal(result.Failed, []int{1, 2}) {
+                t.Fatalf("result = %+v, want both entries failed", result)
+        }
+        if !strings.Contains(result.Errors[1], "disk full") {
+                t.Errorf("error for 1 = %q, want the insert error", result.Errors[1])
+        }
+        if err := am.AddToQueueWithPriority("RUN c", 5); err == nil || !strings.Contains(err.Error(), "disk full") {
+                t.Errorf("AddToQueueWithPriority = %v, want the insert error", err)
+        }
+        if len(am.queue) != 0 {
+                t.Errorf("queue = %+v, want nothing kept after failed inserts", am.queue)
+        }
+
+        fake.insertErr = nil
+        if err := am.AddToQueueWithPriority("RUN d", 0); err != nil || len(am.queue) != 1 || am.queue[0].ID == 0 {
+                t.Errorf("add after recovery = %v, queue %+v", err, am.queue)
+        }
+}
+
+func TestReprioritizeByRequiredLabels(t *testing.T) {
+        am := newDispatchManager(t)
+        gpu := newTestAgent(t, am, AgentSpec{Labels: []string{"gpu", "linux"}})
+        cpu := newTestAgent(t, am, AgentSpec{Labels: []string{"linux"}})
+        am.queue = []QueueItem{
+                {Index: 1, Command: "RUN train", Status: "pending", PinnedAgent: gpu},
+                {Index: 2, Command: "RUN build", Status: "pending", PinnedAgent: cpu},
+                {Index: 3, Command: "RUN anywhere", Status: "pending"},
+        }
+
+        updated, err := am.ReprioritizeQueue(ReprioritizeFilter{RequiredLabels: []string{"gpu", "linux"}}, nil, -5)
+        if err != nil || updated != 2 {
+                t.Fatalf("updated %d, %v; want the gpu-pinned and unpinned items", updated, err)
+        }
+        var priorities []int
+        for _, item := range am.queue {
+                priorities = append(priorities, item.Priority)
+        }
+        if want := []int{-5, 0, -5}; !slices.Equal(priorities, want) {
+                t.Errorf("priorities = %v, want %v", priorities, want)
+        }
+
+        if updated, err := am.ReprioritizeQueue(ReprioritizeFilter{RequiredLabels: []string{"arm"}}, nil, 1); err != nil || updated != 0 {
+                t.Errorf("no agent labelled arm: updated %d, %v; want nothing", updated, err)
+        }
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// peakRSSMB is not available without getrusage.
+func peakRSSMB(state *os.ProcessState) float64 {
+        return 0
+}
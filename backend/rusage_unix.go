@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+        "os"
+        "runtime"
+        "syscall"
+)
+
+// peakRSSMB returns the peak resident memory of a finished command in MB.
+func peakRSSMB(state *os.ProcessState) float64 {
+        usage, ok := state.SysUsage().(*syscall.Rusage)
+        if !ok {
+                return 0
+        }
+        // Linux reports kilobytes, Darwin bytes.
+        if runtime.GOOS == "darwin" {
+                return float64(usage.Maxrss) / 1024 / 1024
+        }
+        return float64(usage.Maxrss) / 1024
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "syscall"
+        "testing"
+        "time"
+)
+
+func TestShutdownKillsAndRequeuesRunningItems(t *testing.T) {
+        pidFile := filepath.Join(t.TempDir(), "pid")
+        am := newTestManager(t, "SHUTDOWN_GRACE_PERIOD", "200ms", "PROCESS_GROUPS", "true")
+        id := newTestAgent(t, am, AgentSpec{})
+        am.AddToQueue(map[string]string{"1": "RUN sleep 30 & echo $! > " + pidFile + "; wait"}, nil)
+        am.StartAgentLoop(id)
+
+        var pid int
+        for deadline := time.Now().Add(5 * time.Second); pid == 0; time.Sleep(20 * time.Millisecond) {
+                if time.Now().After(deadline) {
+                        t.Fatal("queue item never started")
+                }
+                data, _ := os.ReadFile(pidFile)
+                pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+        }
+
+        started := time.Now()
+        am.Shutdown()
+        if elapsed := time.Since(started); elapsed > shutdownKillWait {
+                t.Errorf("Shutdown took %s", elapsed)
+        }
+
+        items := am.GetQueueList()
+        if len(items) != 1 || items[0].Status != "pending" || items[0].AgentID != 0 {
+                t.Fatalf("queue after shutdown = %+v, want the item back to pending", items)
+        }
+        if items[0].FailoverCount != 0 {
+                t.Errorf("shutdown counted as failover %d", items[0].FailoverCount)
+        }
+
+        process, _ := os.FindProcess(pid)
+        for deadline := time.Now().Add(2 * time.Second); process.Signal(syscall.Signal(0)) == nil; time.Sleep(20 * time.Millisecond) {
+                if time.Now().After(deadline) {
+                        t.Fatalf("child process %d survived shutdown", pid)
+                }
+        }
+}
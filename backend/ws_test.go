@@ -0,0 +1,211 @@
+package main
+
+import (
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "sync"
+        "testing"
+        "time"
+
+        "github.com/gorilla/websocket"
+)
+
+// serveTestWebSocket serves handleWebSocket for am, which becomes the
+// package manager for the test, and returns the ws:// URL. The manager is
+// restored only once every handler has returned, which needs the test's
+// connections closed first.
+func serveTestWebSocket(t *testing.T, am *AgentManager) string {
+        t.Helper()
+        previous := manager
+        manager = am
+        t.Cleanup(func() { manager = previous })
+
+        var handlers sync.WaitGroup
+        t.Cleanup(handlers.Wait)
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                handlers.Add(1)
+                defer handlers.Done()
+                handleWebSocket(w, r)
+        }))
+        t.Cleanup(server.Close)
+        return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// dialTestClient serves handleWebSocket for am and returns a connected
+// client past its "connected" message.
+func dialTestClient(t *testing.T, am *AgentManager) *websocket.Conn {
+        t.Helper()
+        conn, _, err := websocket.DefaultDialer.Dial(serveTestWebSocket(t, am), nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        t.Cleanup(func() { conn.Close() })
+        readMessageOfType(t, conn, "connected")
+        return conn
+}
+
+// readMessageOfType reads from conn until a message of type msgType
+// arrives, failing the test after a few seconds without one.
+func readMessageOfType(t *testing.T, conn *websocket.Conn, msgType string) Message {
+        t.Helper()
+        conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+        defer conn.SetReadDeadline(time.Time{})
+        for {
+                var msg Message
+                if err := conn.ReadJSON(&msg); err != nil {
+                        t.Fatalf("waiting for %s: %v", msgType, err)
+                }
+                if msg.Type == msgType {
+                        return msg
+                }
+        }
+}
+
+func TestSetSafeModeRequiresAdminToken(t *testing.T) {
+        am := newTestManager(t, "ADMIN_TOKEN", "secret", "BACKEND_API_KEY", "", "SAFE_MODE", "")
+        conn := dialTestClient(t, am)
+
+        for _, payload := range []map[string]interface{}{
+                {"enabled": true},
+                {"enabled": true, "admin_token": "wrong"},
+        } {
+                conn.WriteJSON(Message{Type: "set_safe_mode", Payload: payload})
+                readMessageOfType(t, conn, "error")
+                if am.safeMode.Load() {
+                        t.Fatalf("safe mode turned on with %v", payload)
+                }
+        }
+
+        conn.WriteJSON(Message{Type: "set_safe_mode", Payload: map[string]interface{}{"enabled": true, "admin_token": "secret"}})
+        readMessageOfType(t, conn, "safe_mode_changed")
+        if !am.safeMode.Load() {
+                t.Error("safe mode not turned on with the admin token")
+        }
+}
+
+func TestClientLimitCountsUnauthenticatedConnections(t *testing.T) {
+        am := newTestManager(t, "MAX_WS_CLIENTS", "1", "BACKEND_API_KEY", "secret", "AUTH_DISABLED", "")
+        url := serveTestWebSocket(t, am)
+
+        parked, _, err := websocket.DefaultDialer.Dial(url, nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        _, resp, err := websocket.DefaultDialer.Dial(url, nil)
+        if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+                t.Fatalf("second connection while the first is authenticating: err %v, response %+v", err, resp)
+        }
+
+        parked.Close()
+        for deadline := time.Now().Add(3 * time.Second); am.wsSlots.Load() != 0; time.Sleep(10 * time.Millisecond) {
+                if time.Now().After(deadline) {
+                        t.Fatal("slot not released after the connection closed")
+                }
+        }
+        conn, _, err := websocket.DefaultDialer.Dial(url+"?token=secret", nil)
+        if err != nil {
+                t.Fatalf("connection after the slot was freed: %v", err)
+        }
+        defer conn.Close()
+        readMessageOfType(t, conn, "connected")
+}
+
+func TestMalformedMessagesGetAnErrorReply(t *testing.T) {
+        am := newTestManager(t, "BACKEND_API_KEY", "", "ADMIN_TOKEN", "secret")
+        conn := dialTestClient(t, am)
+
+        for _, raw := range []string{
+                `{"type": "add_agent", "payload": {"name": "a`,
+                `{"type": "execute"`,
+                `not json`,
+                `{"type": "add_agent", "payload": null}`,
+                `{"type": "add_agent", "payload": "name"}`,
+                `{"type": "add_agent", "payload": {"name": 7}}`,
+                `{"type": "remove_agent", "payload": {"id": "1"}}`,
+                `{"type": "pause_agent", "payload": {}}`,
+                `{"type": "resume_agent", "payload": [1]}`,
+                `{"type": "add_queue", "payload": {"1": 5}}`,
+                `{"type": "add_queue", "payload": 3}`,
+                `{"type": "cancel_command", "payload": {"agent_id": "1"}}`,
+                `{"type": "queue_rm", "payload": {"id": "1"}}`,
+                `{"type": "queue_disable", "payload": {"id": true}}`,
+                `{"type": "queue_enable", "payload": null}`,
+                `{"type": "queue_schedule", "payload": {"id": "1"}}`,
+                `{"type": "chat", "payload": {"mode": "cmd"}}`,
+                `{"type": "execute", "payload": {"agent_id": "1", "command": "RUN ls"}}`,
+                `{"type": "execute", "payload": {"agent_id": 1}}`,
+                `{"type": "set_persistence", "payload": {"enabled": "yes"}}`,
+                `{"type": "set_safe_mode", "payload": {"admin_token": "secret", "enabled": 1}}`,
+                `{"type": "confirm", "payload": {"token": 5}}`,
+                `{"type": "reject", "payload": "token"}`,
+                `{"type": "accept_proposal", "payload": {}}`,
+                `{"type": "reject_proposal", "payload": null}`,
+                `{"type": "subscribe_dashboard", "payload": {"enabled": "true"}}`,
+                `{"type": "subscribe_results", "payload": {"agent_id": "2"}}`,
+        } {
+                if err := conn.WriteMessage(websocket.TextMessage, []byte(raw)); err != nil {
+                        t.Fatal(err)
+                }
+                // get_agents marks the end of the replies to raw, and shows
+                // the connection survived it.
+                conn.WriteJSON(Message{Type: "get_agents"})
+                var errs []string
+                conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+                for {
+                        var msg Message
+                        if err := conn.ReadJSON(&msg); err != nil {
+                                t.Fatalf("%s: %v", raw, err)
+                        }
+                        if msg.Type == "agents" {
+                                break
+                        }
+                        if msg.Type == "error" {
+                                errs = append(errs, msg.Payload.(map[string]interface{})["error"].(string))
+                        }
+                }
+                if len(errs) != 1 || strings.HasPrefix(errs[0], "could not handle") {
+                        t.Errorf("%s: errors %q, want one error reply and no panic", raw, errs)
+                }
+        }
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+        for _, tc := range []struct {
+                name, allowed, origin string
+                ok                    bool
+        }{
+                {"no origin header", "", "", true},
+                {"localhost by default", "", "http://localhost:5173", true},
+                {"loopback by default", "", "http://127.0.0.1:3000", true},
+                {"other site by default", "", "https://evil.example", false},
+                {"listed origin", "https://dash.example.com, https://ops.example.com/", "https://ops.example.com", true},
+                {"listed origin any case", "https://dash.example.com", "HTTPS://Dash.Example.com", true},
+                {"unlisted origin", "https://dash.example.com", "https://dash.example.com:8443", false},
+                {"localhost once a list is set", "https://dash.example.com", "http://localhost:5173", false},
+                {"wildcard", "*", "https://anything.example", true},
+        } {
+                t.Run(tc.name, func(t *testing.T) {
+                        am := newTestManager(t, "ALLOWED_ORIGINS", tc.allowed, "BACKEND_API_KEY", "", "AUTH_DISABLED", "true")
+                        header := http.Header{}
+                        if tc.origin != "" {
+                                header.Set("Origin", tc.origin)
+                        }
+                        conn, resp, err := websocket.DefaultDialer.Dial(serveTestWebSocket(t, am), header)
+                        if tc.ok {
+                                if err != nil {
+                                        t.Fatalf("origin %q refused: %v", tc.origin, err)
+                                }
+                                conn.Close()
+                                return
+                        }
+                        if err == nil {
+                                conn.Close()
+                                t.Fatalf("origin %q upgraded", tc.origin)
+                        }
+                        if resp == nil || resp.StatusCode != http.StatusForbidden {
+                                t.Errorf("origin %q got %v, want 403", tc.origin, resp)
+                        }
+                })
+        }
+}